@@ -27,6 +27,7 @@ func NewLevelFlightReporter(r *report.Report, f *fdb.Flight, tis []fdb.TrackInte
 	longestLevelRunKM := -1.0
 	iStart,iEnd := 0,0
 	tName := ""
+	analysed := map[string]*fdb.Track{} // The (maybe smoothed) tracks the runs were found in
 	noteLevelRun := func(trackName string, t *fdb.Track, i,j int) {
 		if i==j { return }
 		levelRunKM := (*t)[j].DistanceTravelledKM - (*t)[i].DistanceTravelledKM
@@ -41,7 +42,13 @@ func NewLevelFlightReporter(r *report.Report, f *fdb.Flight, tis []fdb.TrackInte
 
 	for _,ti := range tis {
 		t := f.Tracks[ti.TrackName]
-		t.PostProcess()
+		if r.SmoothTracks {
+			smoothed := t.Smoothed().AsTrack() // Same indices, so ti still applies
+			t = &smoothed // A copy; the flight's own track is left alone
+		} else {
+			t.PostProcess()
+		}
+		analysed[ti.TrackName] = t
 
 		iStart := -1
 		for i:=ti.I; i<=ti.J; i++ {
@@ -94,7 +101,7 @@ func NewLevelFlightReporter(r *report.Report, f *fdb.Flight, tis []fdb.TrackInte
 		"<code>" + f.IdentString() + "</code>",
 		"<b>(LengthKM,Alt,I,J)</b>",
 		fmt.Sprintf("%.2f", longestLevelRunKM),
-		fmt.Sprintf("%.0f", t[iStart].Altitude),
+		fmt.Sprintf("%.0f", (*analysed[tName])[iStart].Altitude),
 		fmt.Sprintf("%d", iStart),
 		fmt.Sprintf("%d", iEnd),
 	}
@@ -115,7 +122,12 @@ func LevelFlightReporter(r *report.Report, f *fdb.Flight, tis []fdb.TrackInterse
 	// See if any trackpoints inside the intersection lie outside the tolerance
 	for _,ti := range tis {
 		t := f.Tracks[ti.TrackName]
-		t.PostProcess()
+		if r.SmoothTracks {
+			smoothed := t.Smoothed().AsTrack() // Same indices, so ti still applies
+			t = &smoothed // A copy; the flight's own track is left alone
+		} else {
+			t.PostProcess()
+		}
 
 		for i:=ti.I; i<=ti.J; i++ {
 			if math.Abs((*t)[i].AngleOfInclination) > r.AltitudeTolerance {
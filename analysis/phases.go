@@ -0,0 +1,72 @@
+package analysis
+
+import (
+	"fmt"
+	"strings"
+
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/report"
+)
+
+func init() {
+	report.HandleReport("phase", PhaseReporter, "Flights in phase of flight {phases} within {region}")
+}
+
+func PhaseReporter(r *report.Report, f *fdb.Flight, tis []fdb.TrackIntersection) (report.FlightReportOutcome, error){
+	if len(r.Phases) == 0 {
+		return report.RejectedByReport, fmt.Errorf("report option {phases} not defined")
+	}
+	ti,err := r.GetFirstAreaIntersection(tis)
+	if err != nil {
+		return report.RejectedByReport, err
+	}
+
+	r.I["[C] Flights passing through region"]++
+
+	// Redo the phases, in case tracks have been added (or fused) since the flight was analysed
+	tName := f.AnalysePhases()
+
+	wanted := map[fdb.FlightPhase]bool{}
+	for _,p := range r.Phases { wanted[p] = true }
+
+	seen := map[fdb.FlightPhase]bool{}
+	matches := []fdb.PhaseSegment{}
+	for _,seg := range f.PhasesBetween(ti.Start.TimestampUTC, ti.End.TimestampUTC) {
+		if !seen[seg.Phase] {
+			r.I[fmt.Sprintf("[E] Flights in phase '%s' within region", seg.Phase)]++
+			seen[seg.Phase] = true
+		}
+		if wanted[seg.Phase] { matches = append(matches, seg) }
+	}
+
+	if len(matches) == 0 {
+		r.I[fmt.Sprintf("[D] Flights not in phase %v within region", r.Phases)]++
+		return report.RejectedByReport, nil
+	}
+	r.I[fmt.Sprintf("[D] <b>Flights in phase %v within region</b>", r.Phases)]++
+
+	t := *f.Tracks[tName]
+	strs := []string{}
+	for _,seg := range matches {
+		minAlt, maxAlt := -1.0, -1.0
+		for i,tp := range t {
+			if tp.TimestampUTC.Before(seg.Start) || tp.TimestampUTC.After(seg.End) { continue }
+			if minAlt < 0 || tp.Altitude < minAlt { minAlt = tp.Altitude }
+			if tp.Altitude > maxAlt { maxAlt = tp.Altitude }
+			t[i].AnalysisDisplay = fdb.AnalysisDisplayHighlight
+			t[i].AnalysisAnnotation += fmt.Sprintf("* <b>Phase: %s</b>\n", seg.Phase)
+		}
+		strs = append(strs, fmt.Sprintf("%s for %s, %.0f-%.0fft", seg.Phase, seg.Duration(),
+			minAlt, maxAlt))
+	}
+
+	row := []string{
+		r.Links(f),
+		"<code>" + f.IdentString() + "</code>",
+		strings.Join(strs, "<br/>"),
+	}
+
+	r.AddRow(&row, &row)
+
+	return report.Accepted, nil
+}
@@ -0,0 +1,81 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/skypies/util/date"
+
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/report"
+)
+
+func init() {
+	report.HandleReport("runwayusage", RunwayUsageReporter,
+		"Runway usage by hour (use tags to pick an airport, e.g. :SFO or SFO:)")
+	report.SummarizeReport("runwayusage", RunwayUsageSummarizer)
+}
+
+// Per runway (e.g. "SFO:28L arrivals"), the number of flights in each hour of the day (PDT)
+type RunwayUsageBlob map[string]*[24]int
+
+func RunwayUsageReporter(r *report.Report, f *fdb.Flight, tis []fdb.TrackIntersection) (report.FlightReportOutcome, error){
+	blob := RunwayUsageBlob{}
+	if r.Blobs["runwayusage"] != nil { blob = r.Blobs["runwayusage"].(RunwayUsageBlob) }
+
+	if len(fdb.DefaultRunways) == 0 {
+		r.I["[A] No runway database was loaded, so no runways can be found"]++
+		return report.RejectedByReport, nil
+	}
+
+	// Redo the phases, in case the flight was analysed before it had all its tracks
+	f.AnalysePhases()
+	uses := f.IdentifyRunways(fdb.DefaultRunways)
+	if len(uses) == 0 {
+		r.I["[C] Flights without an identifiable runway"]++
+		return report.RejectedByReport, nil
+	}
+	r.I["[C] <b>Flights with an identifiable runway</b>"]++
+
+	for _,u := range uses {
+		key := u.Runway.String() + " arrivals"
+		if u.Departure { key = u.Runway.String() + " departures" }
+		r.I["[D] "+key]++
+
+		if blob[key] == nil { blob[key] = &[24]int{} }
+		blob[key][date.InPdt(u.Time).Hour()]++
+
+		row := []string{
+			r.Links(f),
+			"<code>" + f.IdentString() + "</code>",
+			u.String(),
+			date.InPdt(u.Time).Format("15:04:05 MST"),
+		}
+		r.AddRow(&row, &row)
+	}
+
+	r.Blobs["runwayusage"] = blob
+	return report.Accepted, nil
+}
+
+func RunwayUsageSummarizer(r *report.Report) {
+	genericBlob,exists := r.Blobs["runwayusage"]
+	if !exists { return }
+	blob := genericBlob.(RunwayUsageBlob)
+
+	keys := []string{}
+	for k,_ := range blob { keys = append(keys, k) }
+	sort.Strings(keys)
+
+	str := "<pre>Hour "
+	for _,k := range keys { str += fmt.Sprintf(" %18s", k) }
+	str += "\n"
+	for h:=0; h<24; h++ {
+		str += fmt.Sprintf("%02d:00", h)
+		for _,k := range keys { str += fmt.Sprintf(" %18d", blob[k][h]) }
+		str += "\n"
+	}
+	str += "</pre>"
+
+	r.S["[E] <b>Runway usage by hour (PDT)</b>"] = str
+}
@@ -24,12 +24,13 @@ import (
 
 var(
 	// Should really put these vars somewhere more sensible
-	LocationID  = "us-central1" // This is "us-central" in appengine-land, needs a 1 for cloud tasks
+	LocationID  = fgae.BatchLocationID
 	ProjectID   = "serfr0-fdb"
-	QueueName   = "batch"
+	QueueName   = fgae.BatchQueueName
 
-	batchDayUrl      = "/batch/flights/day"
-	batchInstanceUrl = "/batch/flights/flight"
+	batchDayUrl       = "/batch/flights/day"
+	batchInstanceUrl  = "/batch/flights/flight"
+	condensedPatchUrl = fgae.CondensedPatchURL
 )
 
 // {{{ formValueFlightByKey
@@ -127,6 +128,11 @@ func batchFlightDateRangeHandler(db fgae.FlightDB, w http.ResponseWriter, r *htt
 //   &day=2016/01/21
 //   &job=foo
 //   &tags=FOO,BAR
+//   &cursor=... (continuations only)
+
+// How many per-flight tasks a single day task will enqueue; if the day has more flights
+// than this, it enqueues a continuation of itself to carry on from where it stopped.
+const kBatchDayPageSize = 1000
 
 // Dequeue a single day, and enqueue a job for each flight on that day
 func batchFlightDayHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
@@ -143,8 +149,8 @@ func batchFlightDayHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Requ
 	start,end := date.WindowForTime(day)
 	end = end.Add(-1 * time.Second)
 	
-	q := fgae.QueryForTimeRange(tags,start,end)
-	keyers,err := db.LookupAllKeys(q)
+	q := fgae.QueryForTimeRange(tags,start,end).StartAt(r.FormValue("cursor"))
+	keyers,nextCursor,err := db.LookupKeysPage(q, kBatchDayPageSize)
 	if err != nil {
 		errStr := fmt.Sprintf("elapsed=%s; err=%v", time.Since(tStart), err)
 		http.Error(w, errStr, http.StatusInternalServerError)
@@ -187,6 +193,21 @@ func batchFlightDayHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Requ
 		n++
 	}
 
+	if nextCursor != "" {
+		params := url.Values{}
+		params.Set("day", r.FormValue("day"))
+		params.Set("job", job)
+		params.Set("tags", r.FormValue("tags"))
+		params.Set("cursor", nextCursor)
+
+		if _,err := tasks.SubmitAETask(ctx, taskClient, ProjectID, LocationID, QueueName, 0, batchDayUrl, params); err != nil {
+			db.Errorf(" batchFlightDayHandler: enqueue continuation: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		str += "* more to come; enqueued a continuation\n"
+	}
+
 	db.Infof("enqueued %d batch items for '%s'", n, job)
 
 	w.Header().Set("Content-Type", "text/plain")
@@ -212,6 +233,10 @@ func batchFlightHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request
 	switch job {
 	case "retag":         str,err = jobRetagHandler(db,f)
 	case "breakup":       str,err = jobMaybeBreakupFlight(db,f)
+	case "reencode":      str,err = jobReencodeFlight(db,f)
+	case "downsample":    str,err = jobDownsampleFlight(db,f)
+	case "dedup":         str,err = jobDedupFlight(db,f)
+	case "splitlegs":     str,err = jobSplitLegsFlight(db,f)
 	}
 
 	if err != nil {
@@ -231,7 +256,8 @@ func batchFlightHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request
 
 // {{{ jobRetagHandler
 
-// Note; this never removes any tags. It only adds new ones.
+// Reruns the analysis, which also backfills phases of flight. Note; the tags it derives (AL/GA,
+// PHASE:*) are redone, so they may be removed. It never removes any other tags.
 func jobRetagHandler(db fgae.FlightDB, f *fdb.Flight) (string, error) {
 	str := fmt.Sprintf("OK\nbatch, for [%s]\n", f)
 	
@@ -260,6 +286,29 @@ func jobRetagHandler(db fgae.FlightDB, f *fdb.Flight) (string, error) {
 	return str, nil
 }
 
+// }}}
+// {{{ jobReencodeFlight
+
+// Rewrites the flight using the columnar blob encoding. The tracks get quantized along
+// the way (see flightdb/columnar.go); rerunning it over columnar flights is harmless.
+//  /batch/flights/dates?job=reencode&date=range&range_from=2016/01/21&range_to=2016/01/26
+func jobReencodeFlight(db fgae.FlightDB, f *fdb.Flight) (string, error) {
+	before,err := f.ToBlob()
+	if err != nil { return "", err }
+	after,err := f.ToBlobWithEncoding(fdb.AsColumnar)
+	if err != nil { return "", err }
+
+	str := fmt.Sprintf("* %s: %d bytes as %s, %d bytes as %s\n", f.IdentityString(),
+		len(before.Blob), before.BlobEncoding, len(after.Blob), after.BlobEncoding)
+
+	if err := db.ReencodeFlight(f, fdb.AsColumnar); err != nil {
+		str += fmt.Sprintf("* Failed, with: %v\n", err)
+		return str, err
+	}
+
+	return str, nil
+}
+
 // }}}
 // {{{ jobMaybeBreakupFlight
 
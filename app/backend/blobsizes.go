@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/skypies/util/date"
+	"github.com/skypies/util/widget"
+
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/fgae"
+)
+
+// {{{ blobSizesHandler
+
+// /batch/flights/blobsizes?day=2016/01/21&tags=:SFO
+
+// Compares the size of each blob encoding, over a day's flights. The flights are not modified.
+func blobSizesHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
+	ctx := db.Ctx()
+
+	tStart := time.Now()
+	tags := widget.FormValueCommaSepStrings(r, "tags")
+	day := date.ArbitraryDatestring2MidnightPdt(r.FormValue("day"), "2006/01/02")
+	start,end := date.WindowForTime(day)
+	end = end.Add(-1 * time.Second)
+
+	nFlights,nPoints := 0,0
+	totals := map[fdb.BlobEncoding]int{}
+
+	it := db.NewIterator(fgae.QueryForTimeRange(tags,start,end))
+	for it.Iterate(ctx) {
+		f := it.Flight()
+		if f == nil { break } // it.Err() will say why
+
+		// Flights straddling midnight show up in two days; only count them in the first.
+		if slots := f.Timeslots(); len(slots)>0 && slots[0].Before(start) {
+			continue
+		}
+
+		for _,enc := range fdb.AllBlobEncodings {
+			blob,err := f.ToBlobWithEncoding(enc)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("%s, %s: %v", f, enc, err), http.StatusInternalServerError)
+				return
+			}
+			totals[enc] += len(blob.Blob)
+		}
+		for _,t := range f.Tracks {
+			nPoints += len(*t)
+		}
+		nFlights++
+	}
+	if it.Err() != nil {
+		http.Error(w, it.Err().Error(), http.StatusInternalServerError)
+		return
+	}
+
+	str := fmt.Sprintf("* start: %s\n* end  : %s\n* tags : %q\n", start, end, tags)
+	str += fmt.Sprintf("* %d flights, %d trackpoints, elapsed %s\n\n", nFlights, nPoints,
+		time.Since(tStart))
+	str += fmt.Sprintf("%-12s %12s %10s %10s %8s\n", "encoding", "bytes", "B/flight", "B/point",
+		"ratio")
+
+	base := totals[fdb.DefaultBlobEncoding]
+	for _,enc := range fdb.AllBlobEncodings {
+		perFlight,perPoint,ratio := 0.0, 0.0, 0.0
+		if nFlights > 0 { perFlight = float64(totals[enc]) / float64(nFlights) }
+		if nPoints > 0  { perPoint = float64(totals[enc]) / float64(nPoints) }
+		if base > 0     { ratio = float64(totals[enc]) / float64(base) }
+		str += fmt.Sprintf("%-12s %12d %10.0f %10.2f %8.3f\n", enc, totals[enc], perFlight,
+			perPoint, ratio)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(fmt.Sprintf("OK\n%s", str)))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
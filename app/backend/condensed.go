@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/skypies/flightdb/fgae"
+)
+
+// {{{ condensedPatchHandler
+
+// /batch/condensed/patch?key=...&shard=2017-04-01/07&shard=...
+
+// Enqueued by fgae.TaskCondensedDayPatcher, after a flight is persisted. Failing makes the
+// task get retried.
+func condensedPatchHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
+	key := r.FormValue("key")
+	shards := r.Form["shard"]
+
+	if err := db.PatchCondensedDays(key, shards); err != nil {
+		db.Errorf("condensedPatchHandler: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(fmt.Sprintf("OK\n* %s\n* %v\n", key, shards)))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/skypies/util/date"
+	"github.com/skypies/util/widget"
+
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/fgae"
+)
+
+// {{{ jobDedupFlight
+
+// Merges any duplicates of this flight into one, and deletes the rest. Every flight in a set of
+// duplicates gets its own task, but only the task for the survivor does anything. (Chains of
+// overlapping flights may need a second run to fully collapse.)
+//  /batch/flights/dates?job=dedup&date=range&range_from=2016/01/21&range_to=2016/01/26
+func jobDedupFlight(db fgae.FlightDB, f *fdb.Flight) (string, error) {
+	dm,err := db.PlanDuplicateMerge(f)
+	if err != nil {
+		return "", err
+	} else if dm == nil {
+		return "* no duplicates\n", nil
+	} else if dm.Survivor.GetDatastoreKey() != f.GetDatastoreKey() {
+		return fmt.Sprintf("* has duplicates, but will be merged into %s\n",
+			dm.Survivor.GetDatastoreKey()), nil
+	}
+
+	str := describeDuplicateMerge(dm)
+	if err := db.ApplyDuplicateMerge(dm); err != nil {
+		str += fmt.Sprintf("* Failed, with: %v\n", err)
+		return str, err
+	}
+
+	return str, nil
+}
+
+func describeDuplicateMerge(dm *fgae.DuplicateMerge) string {
+	str := fmt.Sprintf("* keep   %s [%s]\n", dm.Survivor.IdentityString(), dm.Survivor.GetDatastoreKey())
+	for _,f := range dm.Redundant {
+		str += fmt.Sprintf("* delete %s [%s]\n", f.IdentityString(), f.GetDatastoreKey())
+	}
+	for _,diff := range dm.Diffs {
+		str += fmt.Sprintf("  - %s\n", diff)
+	}
+	return str
+}
+
+// }}}
+// {{{ dedupDryRunHandler
+
+// /batch/flights/dedup/dryrun?day=2016/01/21&tags=:SFO
+
+// Lists the sets of duplicate flights on a day, and what the dedup job would do about them.
+// Nothing is modified.
+func dedupDryRunHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
+	ctx := db.Ctx()
+
+	tStart := time.Now()
+	tags := widget.FormValueCommaSepStrings(r, "tags")
+	day := date.ArbitraryDatestring2MidnightPdt(r.FormValue("day"), "2006/01/02")
+	start,end := date.WindowForTime(day)
+	end = end.Add(-1 * time.Second)
+
+	nFlights,nSets,nRedundant := 0,0,0
+	str := ""
+
+	it := db.NewIterator(fgae.QueryForTimeRange(tags,start,end))
+	for it.Iterate(ctx) {
+		f := it.Flight()
+		if f == nil { break } // it.Err() will say why
+		nFlights++
+
+		dm,err := db.PlanDuplicateMerge(f)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", f, err), http.StatusInternalServerError)
+			return
+		} else if dm == nil || dm.Survivor.GetDatastoreKey() != f.GetDatastoreKey() {
+			continue // Only report each set once, from its survivor
+		}
+
+		nSets++
+		nRedundant += len(dm.Redundant)
+		str += describeDuplicateMerge(dm) + "\n"
+	}
+	if it.Err() != nil {
+		http.Error(w, it.Err().Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hdr := fmt.Sprintf("* start: %s\n* end  : %s\n* tags : %q\n", start, end, tags)
+	hdr += fmt.Sprintf("* %d flights; %d sets of duplicates, %d flights would be deleted; "+
+		"elapsed %s\n\n", nFlights, nSets, nRedundant, time.Since(tStart))
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(fmt.Sprintf("OK (dry run)\n%s%s", hdr, str)))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
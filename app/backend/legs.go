@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/fgae"
+)
+
+// {{{ jobSplitLegsFlight
+
+// Splits flights that contain more than one leg (turnarounds, touch-and-goes, circuits) into
+// separate flights; see flightdb/legs.go.
+//  /batch/flights/dates?job=splitlegs&date=range&range_from=2016/01/21&range_to=2016/01/26
+func jobSplitLegsFlight(db fgae.FlightDB, f *fdb.Flight) (string, error) {
+	boundaries := f.FindLegBoundaries(fdb.DefaultLegSplitOptions)
+	if len(boundaries) == 0 {
+		return fmt.Sprintf("* %s: one leg\n", f.IdentityString()), nil
+	}
+
+	str := fmt.Sprintf("* %s: %d boundaries\n", f.IdentityString(), len(boundaries))
+	for _,b := range boundaries {
+		str += fmt.Sprintf("  - %s\n", b)
+	}
+
+	legs,err := db.SplitFlight(f, fdb.DefaultLegSplitOptions)
+	if err != nil {
+		str += fmt.Sprintf("* Failed, with: %v\n", err)
+		return str, err
+	}
+	for i,leg := range legs {
+		s,e := leg.Times()
+		str += fmt.Sprintf("* leg %d: %s, %s - %s, %v\n", i+1, leg.IdentityString(),
+			s.Format("15:04:05"), e.Format("15:04:05"), leg.WaypointList())
+	}
+
+	return str, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -12,27 +12,75 @@ import(
 	"github.com/skypies/util/gcp/ds"
 	hw "github.com/skypies/util/handlerware"
 
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/blobstore"
 	"github.com/skypies/flightdb/config"
+	"github.com/skypies/flightdb/fgae"
+	"github.com/skypies/flightdb/localds"
 	"github.com/skypies/flightdb/ui"
 )
 
 var(
 	GoogleCloudProjectId = "serfr0-fdb"
+
+	// If $FDB_LOCALDB names a file, we use a local datastore instead of the cloud one. Either
+	// way, all requests share the one provider (and its connections).
+	provider ds.DatastoreProvider
 )
 
 func init() {
 	hw.RequireTls = false
 	hw.InitTemplates("app/web/templates") // relative to go module root, which is git repo root
 
+	if filename := os.Getenv("FDB_LOCALDB"); filename != "" {
+		p,err := localds.Open(filename)
+		if err != nil {
+			panic(fmt.Errorf("NewDB: could not open local datastore %s: %v\n", filename, err))
+		}
+		log.Printf("[init] using local datastore %s\n", filename)
+		provider = p
+	} else {
+		p,err := fgae.NewTxCloudDSProvider(context.Background(), GoogleCloudProjectId)
+		if err != nil {
+			panic(fmt.Errorf("NewDB: could not get a clouddsprovider (projectId=%s): %v\n", GoogleCloudProjectId, err))
+		}
+		provider = p
+
+		// Materialized condensed days get patched by a task, not by whoever wrote the flight
+		fgae.DefaultCondensedDayPatcher = fgae.TaskCondensedDayPatcher{
+			ProjectID:ProjectID, LocationID:LocationID, QueueName:QueueName, URL:condensedPatchUrl,
+		}
+	}
+
+	// Flights too big for datastore go into a blobstore, if one is configured
+	if dir := os.Getenv("FDB_BLOBDIR"); dir != "" {
+		fdb.DefaultBlobStore = blobstore.NewDirBlobStore(dir)
+	} else if bucket := config.Get("blobstore.bucket"); bucket != "" {
+		fdb.DefaultBlobStore = blobstore.NewGCSBlobStore(bucket)
+	}
+
+	// Runway thresholds, so that Analyse can tag flights with the runways they used. Without
+	// them, we carry on, but don't tag runways (and the runway usage report finds nothing).
+	if db,err := fdb.LoadRunwayDB(fdb.DefaultRunwaysFile); err != nil {
+		log.Printf("[init] runways: %v; runway tagging is off\n", err)
+		fdb.DefaultRunways = nil
+	} else {
+		fdb.DefaultRunways = db
+	}
+
+	if str := os.Getenv("FDB_RETENTION"); str != "" {
+		p,err := fdb.ParseRetentionPolicy(str)
+		if err != nil {
+			panic(fmt.Errorf("FDB_RETENTION: %v", err))
+		}
+		retentionPolicy = p
+	}
+
 	// This is the routine that creates new contexts, and injects a provider into them,
 	// as required by the FdbHandlers
 	hw.CtxMakerCallback = func(r *http.Request) context.Context {
 		ctx,_ := context.WithTimeout(r.Context(), 595 * time.Second)
-		p,err := ds.NewCloudDSProvider(ctx, GoogleCloudProjectId)
-		if err != nil {
-			panic(fmt.Errorf("NewDB: could not get a clouddsprovider (projectId=%s): %v\n", GoogleCloudProjectId, err))
-		}
-		return ds.SetProvider(ctx, p)
+		return ds.SetProvider(ctx, provider)
 	}
 
 	// This stuff needs to be in sync with thew frontend app, which handles login
@@ -49,6 +97,18 @@ func init() {
 	http.HandleFunc(batchDayUrl,                  ui.WithFdb(batchFlightDayHandler))
 	http.HandleFunc(batchInstanceUrl,             ui.WithFdb(batchFlightHandler))
 
+	// backend/condensed.go
+	http.HandleFunc(condensedPatchUrl,            ui.WithFdb(condensedPatchHandler))
+
+	// backend/blobsizes.go
+	http.HandleFunc("/batch/flights/blobsizes",   ui.WithFdb(blobSizesHandler))
+
+	// backend/retention.go
+	http.HandleFunc("/batch/flights/downsample/dryrun", ui.WithFdb(retentionDryRunHandler))
+
+	// backend/dedup.go
+	http.HandleFunc("/batch/flights/dedup/dryrun", ui.WithFdb(dedupDryRunHandler))
+
 	// backend/bigquery.go (ran out of dispatch.yaml entries, so put this in 'batch')
 	http.HandleFunc("/batch/publish-all-flights", ui.WithFdb(publishAllFlightsHandler))
 	http.HandleFunc("/batch/publish-flights",     ui.WithFdb(publishFlightsHandler))
@@ -83,6 +143,9 @@ func init() {
 	http.HandleFunc(stem+"/list",           ui.WithFdbSession(ui.RListHandler))
 	http.HandleFunc(stem+"/grs/new",        ui.WithFdbSession(ui.RGrsNewHandler))
 	http.HandleFunc(stem+"/grs/delete",     ui.WithFdbSession(ui.RGrsDeleteHandler))
+	http.HandleFunc(stem+"/grs/copy",       ui.WithFdbSession(ui.RGrsCopyHandler))
+	http.HandleFunc(stem+"/grs/export",     ui.WithFdbSession(ui.RGrsExportHandler))
+	http.HandleFunc(stem+"/grs/import",     ui.WithFdbSession(ui.RGrsImportHandler))
 	http.HandleFunc(stem+"/grs/edit",       ui.WithFdbSession(ui.RGrsEditHandler))
 	http.HandleFunc(stem+"/grs/view",       ui.WithFdbSession(ui.RGrsViewHandler))
 	http.HandleFunc(stem+"/gr/new",         ui.WithFdbSession(ui.RGrNewHandler))
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/skypies/util/date"
+	"github.com/skypies/util/widget"
+
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/fgae"
+)
+
+// The policy applied by the "downsample" batch job; see flightdb/retention.go. It can be
+// overridden via $FDB_RETENTION (e.g. "90d:5s,730d:30s").
+var retentionPolicy = fdb.DefaultRetentionPolicy
+
+// {{{ jobDownsampleFlight
+
+// Thins out the flight's tracks, according to the retention policy. The flight is rewritten
+// with the default blob encoding.
+//  /batch/flights/dates?job=downsample&date=range&range_from=2016/01/21&range_to=2016/01/26
+func jobDownsampleFlight(db fgae.FlightDB, f *fdb.Flight) (string, error) {
+	before,err := f.ToBlob()
+	if err != nil { return "", err }
+
+	if !f.ApplyRetentionPolicy(retentionPolicy, time.Now()) {
+		return fmt.Sprintf("* %s: no change (%s)\n", f.IdentityString(), f.Downsampled), nil
+	}
+
+	after,err := f.ToBlob()
+	if err != nil { return "", err }
+
+	str := fmt.Sprintf("* %s: %s; %d bytes -> %d bytes\n", f.IdentityString(), f.Downsampled,
+		len(before.Blob), len(after.Blob))
+
+	if err := db.ReencodeFlight(f, fdb.DefaultBlobEncoding); err != nil {
+		str += fmt.Sprintf("* Failed, with: %v\n", err)
+		return str, err
+	}
+
+	return str, nil
+}
+
+// }}}
+// {{{ retentionDryRunHandler
+
+// /batch/flights/downsample/dryrun?day=2016/01/21&tags=:SFO
+
+// Estimates what the downsample job would save over a day's flights. Nothing is modified.
+func retentionDryRunHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
+	ctx := db.Ctx()
+
+	tStart := time.Now()
+	tags := widget.FormValueCommaSepStrings(r, "tags")
+	day := date.ArbitraryDatestring2MidnightPdt(r.FormValue("day"), "2006/01/02")
+	start,end := date.WindowForTime(day)
+	end = end.Add(-1 * time.Second)
+
+	nFlights,nChanged := 0,0
+	pointsBefore,pointsAfter := 0,0
+	bytesBefore,bytesAfter := 0,0
+
+	it := db.NewIterator(fgae.QueryForTimeRange(tags,start,end))
+	for it.Iterate(ctx) {
+		f := it.Flight()
+		if f == nil { break } // it.Err() will say why
+
+		// Flights straddling midnight show up in two days; only count them in the first.
+		if slots := f.Timeslots(); len(slots)>0 && slots[0].Before(start) {
+			continue
+		}
+		nFlights++
+
+		before,err := f.ToBlob()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", f, err), http.StatusInternalServerError)
+			return
+		}
+		if !f.ApplyRetentionPolicy(retentionPolicy, time.Now()) {
+			continue
+		}
+		after,err := f.ToBlob()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", f, err), http.StatusInternalServerError)
+			return
+		}
+
+		nChanged++
+		pointsBefore += f.Downsampled.PointsBefore
+		pointsAfter += f.Downsampled.PointsAfter
+		bytesBefore += len(before.Blob)
+		bytesAfter += len(after.Blob)
+	}
+	if it.Err() != nil {
+		http.Error(w, it.Err().Error(), http.StatusInternalServerError)
+		return
+	}
+
+	str := fmt.Sprintf("* start : %s\n* end   : %s\n* tags  : %q\n* policy: %s\n", start, end,
+		tags, retentionPolicy)
+	str += fmt.Sprintf("* %d flights, %d would be downsampled, elapsed %s\n\n", nFlights, nChanged,
+		time.Since(tStart))
+	str += fmt.Sprintf("* trackpoints: %d -> %d\n", pointsBefore, pointsAfter)
+	str += fmt.Sprintf("* bytes      : %d -> %d (saving %d)\n", bytesBefore, bytesAfter,
+		bytesBefore-bytesAfter)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(fmt.Sprintf("OK (dry run)\n%s", str)))
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -14,26 +14,67 @@ import(
 	"github.com/skypies/util/login"
 
 	_ "github.com/skypies/flightdb/analysis" // populate the reports registry
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/blobstore"
 	"github.com/skypies/flightdb/config"
+	"github.com/skypies/flightdb/fgae"
+	"github.com/skypies/flightdb/localds"
 	"github.com/skypies/flightdb/ui"
 )
 
 var(
 	GoogleCloudProjectId = "serfr0-fdb"
+
+	// If $FDB_LOCALDB names a file, we use a local datastore instead of the cloud one. Either
+	// way, all requests share the one provider (and its connections).
+	provider ds.DatastoreProvider
 )
 
 func init() {
 	hw.RequireTls = false
 	hw.InitTemplates("app/web/templates") // location relative to go module root, which is git repo root
 
-	// The FdbHandlers expect to find a DSProvider in the context
-	hw.CtxMakerCallback = func(r *http.Request) context.Context {
-		ctx,_ := context.WithTimeout(r.Context(), 55 * time.Second)
-		p,err := ds.NewCloudDSProvider(ctx, GoogleCloudProjectId)
+	if filename := os.Getenv("FDB_LOCALDB"); filename != "" {
+		p,err := localds.Open(filename)
+		if err != nil {
+			panic(fmt.Errorf("NewDB: could not open local datastore %s: %v\n", filename, err))
+		}
+		log.Printf("[init] using local datastore %s\n", filename)
+		provider = p
+	} else {
+		p,err := fgae.NewTxCloudDSProvider(context.Background(), GoogleCloudProjectId)
 		if err != nil {
 			panic(fmt.Errorf("NewDB: could not get a clouddsprovider (projectId=%s): %v\n", GoogleCloudProjectId, err))
 		}
-		return ds.SetProvider(ctx, p)
+		provider = p
+
+		// Materialized condensed days get patched by a task on the backend (see app/backend)
+		fgae.DefaultCondensedDayPatcher = fgae.TaskCondensedDayPatcher{
+			ProjectID:GoogleCloudProjectId, LocationID:fgae.BatchLocationID,
+			QueueName:fgae.BatchQueueName, URL:fgae.CondensedPatchURL,
+		}
+	}
+
+	// Flights too big for datastore go into a blobstore, if one is configured
+	if dir := os.Getenv("FDB_BLOBDIR"); dir != "" {
+		fdb.DefaultBlobStore = blobstore.NewDirBlobStore(dir)
+	} else if bucket := config.Get("blobstore.bucket"); bucket != "" {
+		fdb.DefaultBlobStore = blobstore.NewGCSBlobStore(bucket)
+	}
+
+	// Runway thresholds, so that Analyse can tag flights with the runways they used. Without
+	// them, we carry on, but don't tag runways (and the runway usage report finds nothing).
+	if db,err := fdb.LoadRunwayDB(fdb.DefaultRunwaysFile); err != nil {
+		log.Printf("[init] runways: %v; runway tagging is off\n", err)
+		fdb.DefaultRunways = nil
+	} else {
+		fdb.DefaultRunways = db
+	}
+
+	// The FdbHandlers expect to find a DSProvider in the context
+	hw.CtxMakerCallback = func(r *http.Request) context.Context {
+		ctx,_ := context.WithTimeout(r.Context(), 55 * time.Second)
+		return ds.SetProvider(ctx, provider)
 	}
 
 
@@ -86,6 +127,9 @@ func init() {
 	http.HandleFunc(stem+"/list",           ui.WithFdbSession(ui.RListHandler))
 	http.HandleFunc(stem+"/grs/new",        ui.WithFdbSession(ui.RGrsNewHandler))
 	http.HandleFunc(stem+"/grs/delete",     ui.WithFdbSession(ui.RGrsDeleteHandler))
+	http.HandleFunc(stem+"/grs/copy",       ui.WithFdbSession(ui.RGrsCopyHandler))
+	http.HandleFunc(stem+"/grs/export",     ui.WithFdbSession(ui.RGrsExportHandler))
+	http.HandleFunc(stem+"/grs/import",     ui.WithFdbSession(ui.RGrsImportHandler))
 	http.HandleFunc(stem+"/grs/edit",       ui.WithFdbSession(ui.RGrsEditHandler))
 	http.HandleFunc(stem+"/grs/view",       ui.WithFdbSession(ui.RGrsViewHandler))
 	http.HandleFunc(stem+"/gr/new",         ui.WithFdbSession(ui.RGrNewHandler))
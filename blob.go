@@ -4,10 +4,16 @@ import(
 	"bytes"
 	"compress/gzip"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"sort"
+	"strings"
 	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/skypies/util/date"
 )
 
 const KWaypointTagPrefix = "^"
@@ -16,25 +22,76 @@ type BlobEncoding int64
 const(
 	AsGob BlobEncoding = iota
 	AsGzippedGob
+	AsColumnar  // Tracks are quantized & delta-encoded; see columnar.go
 )
 
+func (enc BlobEncoding)String() string {
+	switch enc {
+	case AsGob:        return "gob"
+	case AsGzippedGob: return "gzipped-gob"
+	case AsColumnar:   return "columnar"
+	default:           return fmt.Sprintf("BlobEncoding(%d)", int64(enc))
+	}
+}
+
+var AllBlobEncodings = []BlobEncoding{AsGob, AsGzippedGob, AsColumnar}
+
 var DefaultBlobEncoding = AsGzippedGob // Try and save some datastore GB-months.
 
+// Returned by conditional writes, when someone else wrote the flight since we read it.
+var ErrVersionConflict = errors.New("flight was modified by another writer")
+
 // An indexed flight blob is the thing we persist into datastore (or other blobstores)
 type IndexedFlightBlob struct {
 	Blob             []byte      `datastore:",noindex"`
 	BlobEncoding       BlobEncoding
+	BlobRef            string    `datastore:",noindex"` // If set, Blob is in the DefaultBlobStore
+	Version            int64     `datastore:",noindex"` // Bumped on every write
 
 	Icao24             string
 	Ident              string  // Right now, this is the ADS-B callsign (SKW2848, or N1J421)
 	LastUpdate         time.Time  // Used to identify most-recent instance of Icao24 for ADS-B
 	Timeslots        []time.Time
 	Tags             []string
+	Cells            []string  // Coarse spatial index; see cells.go
+	CellTimes        []string  // When the cells were passed through; see CellTimeToken
+	WaypointTimes    []string  // When the waypoints were passed; see WaypointTimeToken
+
+	// Some identity & airframe attributes, so we can search on them (uppercased; empty if unknown)
+	EquipmentType      string
+	AirlineICAO        string
+	AirlineIATA        string
+	Origin             string
+	Destination        string
+	Registration       string
 
 	// DO NOT POPULATE
 	Waypoints        []string //`datastore:",noindex"`
 }
 
+// IndexSummary is the identity & main index fields of a stored flight, so we can tell what
+// changed when it gets written back.
+type IndexSummary struct {
+	Icao24      string
+	Ident       string
+	Timeslots []time.Time
+	Tags      []string
+}
+
+func (blob IndexedFlightBlob)IndexSummary() *IndexSummary {
+	return &IndexSummary{
+		Icao24: blob.Icao24,
+		Ident: blob.Ident,
+		Timeslots: blob.Timeslots,
+		Tags: blob.Tags,
+	}
+}
+
+func (s *IndexSummary)GetTimeslots() []time.Time {
+	if s == nil { return nil }
+	return s.Timeslots
+}
+
 // Real tags, and things we want to search on
 func (f *Flight)IndexTagList() []string {
 	tags := f.TagList()
@@ -45,9 +102,36 @@ func (f *Flight)IndexTagList() []string {
 	return tags
 }
 
+// WaypointTimeToken identifies a waypoint, and the WaypointTimeslot in which it was passed;
+// e.g. "EPICK@1491055200".
+func WaypointTimeToken(wp string, t time.Time) string {
+	slot := date.Timeslots(t, t, WaypointTimeslotDuration)[0]
+	return fmt.Sprintf("%s@%d", wp, slot.Unix())
+}
+
+// WaypointTimeTokens returns the tokens for all the slots that overlap [s,e].
+func WaypointTimeTokens(wp string, s,e time.Time) []string {
+	tokens := []string{}
+	for _,slot := range date.Timeslots(s, e, WaypointTimeslotDuration) {
+		tokens = append(tokens, WaypointTimeToken(wp, slot))
+	}
+	return tokens
+}
+
+func (f *Flight)WaypointTimeTokens() []string {
+	tokens := []string{}
+	for _,wp := range f.WaypointList() {
+		tokens = append(tokens, WaypointTimeToken(wp, f.Waypoints[wp]))
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
 func (f *Flight)ToBlob() (*IndexedFlightBlob, error) {
-	encoding := DefaultBlobEncoding
+	return f.ToBlobWithEncoding(DefaultBlobEncoding)
+}
 
+func (f *Flight)ToBlobWithEncoding(encoding BlobEncoding) (*IndexedFlightBlob, error) {
 	var buf bytes.Buffer
 	var writer io.Writer
 	var closeFunc func() error = func()error{return nil}
@@ -59,12 +143,21 @@ func (f *Flight)ToBlob() (*IndexedFlightBlob, error) {
 		gzipWriter := gzip.NewWriter(&buf)
 		closeFunc = gzipWriter.Close
 		writer = gzipWriter
+	case AsColumnar:
+		if b,err := encodeColumnarFlight(f.withoutDerivedTracks()); err != nil {
+			return nil, err
+		} else {
+			buf.Write(b)
+			writer = nil
+		}
 	default:
 		return nil, fmt.Errorf("Unrecognized blobencoding '%v'", encoding)
 	}
 
-	if err := gob.NewEncoder(writer).Encode(f); err != nil {
-		return nil,err
+	if writer != nil {
+		if err := gob.NewEncoder(writer).Encode(f.withoutDerivedTracks()); err != nil {
+			return nil,err
+		}
 	}
 	if err := closeFunc(); err != nil {
 		return nil,err
@@ -77,12 +170,53 @@ func (f *Flight)ToBlob() (*IndexedFlightBlob, error) {
 		Ident: f.Callsign,
 		Timeslots: f.Timeslots(),
 		Tags: f.IndexTagList(),
+		Cells: f.Cells(),
+		CellTimes: f.CellTimeTokens(),
+		WaypointTimes: f.WaypointTimeTokens(),
+		EquipmentType: strings.ToUpper(f.Airframe.EquipmentType),
+		AirlineICAO: strings.ToUpper(f.Identity.Schedule.ICAO),
+		AirlineIATA: strings.ToUpper(f.Identity.Schedule.IATA),
+		Origin: strings.ToUpper(f.Identity.Origin),
+		Destination: strings.ToUpper(f.Identity.Destination),
+		Registration: strings.ToUpper(f.Airframe.Registration),
 		// Waypoints: f.WaypointList(),
 		LastUpdate: time.Now(),
 	}, nil
 }
 
+// Externalize moves the payload out into the blobstore, under the given name; the indexed
+// fields stay put, so the blob can still be found by queries.
+func (blob *IndexedFlightBlob)Externalize(ctx context.Context, store BlobStore, name string) error {
+	if err := store.WriteBlob(ctx, name, blob.Blob); err != nil {
+		return fmt.Errorf("Externalize %s: %v", name, err)
+	}
+	blob.BlobRef = name
+	blob.Blob = nil
+	return nil
+}
+
+// Internalize pulls the payload back from the blobstore, if it was externalized.
+func (blob *IndexedFlightBlob)Internalize(ctx context.Context, store BlobStore) error {
+	if blob.BlobRef == "" || len(blob.Blob) > 0 {
+		return nil
+	} else if store == nil {
+		return fmt.Errorf("Internalize %s: no blobstore available", blob.BlobRef)
+	}
+
+	data,err := store.ReadBlob(ctx, blob.BlobRef)
+	if err != nil {
+		return fmt.Errorf("Internalize %s: %v", blob.BlobRef, err)
+	}
+	blob.Blob = data
+	return nil
+}
+
 func (blob *IndexedFlightBlob)ToFlight(key string) (*Flight, error) {
+	// The request context isn't available down here; callers who care should Internalize first.
+	if err := blob.Internalize(context.Background(), DefaultBlobStore); err != nil {
+		return nil, err
+	}
+
 	buf := bytes.NewBuffer(blob.Blob)
 	f := BlankFlight()
 
@@ -91,6 +225,12 @@ func (blob *IndexedFlightBlob)ToFlight(key string) (*Flight, error) {
 
 	encoding := blob.BlobEncoding
 	switch encoding {
+	case AsColumnar:
+		if cf,err := decodeColumnarFlight(blob.Blob); err != nil {
+			return nil, err
+		} else {
+			f = *cf
+		}
 	case AsGob: reader = buf
 	case AsGzippedGob:
 		if gzipReader,err := gzip.NewReader(buf); err != nil {
@@ -103,8 +243,10 @@ func (blob *IndexedFlightBlob)ToFlight(key string) (*Flight, error) {
 		return nil, fmt.Errorf("Unrecognized blobencoding '%v'", encoding)
 	}
 
-	if err := gob.NewDecoder(reader).Decode(&f); err != nil {
-		return nil, err
+	if reader != nil {
+		if err := gob.NewDecoder(reader).Decode(&f); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := closeFunc(); err != nil {
@@ -114,6 +256,9 @@ func (blob *IndexedFlightBlob)ToFlight(key string) (*Flight, error) {
 	// Various kinds of post-load fixups
 	f.SetDatastoreKey(key)
 	f.SetLastUpdate(blob.LastUpdate)
+	f.SetVersion(blob.Version)
+	f.SetStoredIndex(blob.IndexSummary())
+	f.SetBlobRef(blob.BlobRef)
 	// TODO(abw) - retain details about encoding ?
 
 	return &f, nil
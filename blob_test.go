@@ -0,0 +1,138 @@
+package flightdb
+
+import(
+	"reflect"
+	"testing"
+	"time"
+)
+
+func columnarTestFlight() Flight {
+	f := BlankFlight()
+	f.IcaoId = "A12345"
+	f.Callsign = "UAL123"
+	f.SetTag("SFO")
+
+	t1 := loadTrack(tN)
+	for i := range t1 {
+		t1[i].DataSource = "ADSB"
+		t1[i].ReceiverName = "ScottsValley"
+		if i%3 == 0 { t1[i].ReceiverName = "Saratoga" }
+		t1[i].Squawk = "1234"
+		t1[i].VerticalRate = 1234.5678
+		t1[i].IndicatedAltitude = 123 // derived; should not be stored
+	}
+	t2 := loadTrack(t1a)
+	for i := range t2 {
+		t2[i].DataSource = "FA:TA"
+	}
+	f.Tracks["ADSB"] = &t1
+	f.Tracks["FA"] = &t2
+	return f
+}
+
+func TestColumnarRoundtrip(t *testing.T) {
+	f := columnarTestFlight()
+	f.Downsampled = DownsampleRecord{Every: 5*time.Second, PointsBefore: 10, PointsAfter: 2}
+
+	blob,err := f.ToBlobWithEncoding(AsColumnar)
+	if err != nil { t.Fatal(err) }
+	f2,err := blob.ToFlight("somekey")
+	if err != nil { t.Fatal(err) }
+
+	if f2.IdentityString() != f.IdentityString() || !reflect.DeepEqual(f2.Tags, f.Tags) {
+		t.Errorf("flight mismatch:\n%s\n%s", f.IdentityString(), f2.IdentityString())
+	}
+	if f2.Downsampled != f.Downsampled {
+		t.Errorf("downsample record mismatch: %s vs %s", f.Downsampled, f2.Downsampled)
+	}
+	if len(f2.Tracks) != len(f.Tracks) {
+		t.Fatalf("expected %d tracks, got %d", len(f.Tracks), len(f2.Tracks))
+	}
+	for name,tr := range f.Tracks {
+		expected := tr.Quantized()
+		actual := f2.Tracks[name]
+		if actual == nil {
+			t.Errorf("track %s missing", name)
+		} else if !reflect.DeepEqual(expected, *actual) {
+			t.Errorf("track %s mismatch;\nexp: %v\nact: %v", name, expected[0], (*actual)[0])
+		}
+	}
+
+	// Quantizing twice should be a no-op
+	if blob2,err := f2.ToBlobWithEncoding(AsColumnar); err != nil {
+		t.Error(err)
+	} else if f3,err := blob2.ToFlight("somekey"); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(f3.Tracks, f2.Tracks) {
+		t.Errorf("requantizing changed the tracks")
+	}
+
+	gobBlob,err := f.ToBlobWithEncoding(AsGzippedGob)
+	if err != nil { t.Fatal(err) }
+	if len(blob.Blob) >= len(gobBlob.Blob) {
+		t.Errorf("columnar (%d bytes) not smaller than gzipped gob (%d)", len(blob.Blob),
+			len(gobBlob.Blob))
+	}
+}
+
+// Sets everything it can reach to something non-zero
+func fillForTest(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(7)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(7)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(7.5)
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillForTest(v.Index(0))
+	case reflect.Map:
+		k,e := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		fillForTest(k)
+		fillForTest(e)
+		v.Set(reflect.MakeMap(v.Type()))
+		v.SetMapIndex(k, e)
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			v.Set(reflect.ValueOf(time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)))
+			return
+		}
+		for i:=0; i<v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" { fillForTest(v.Field(i)) }
+		}
+	}
+}
+
+// Every exported field (bar the tracks, which are checked above) should survive the trip
+func TestColumnarRoundtripAllFields(t *testing.T) {
+	f := BlankFlight()
+	fillForTest(reflect.ValueOf(&f).Elem())
+	f.Tracks = map[string]*Track{}
+
+	blob,err := f.ToBlobWithEncoding(AsColumnar)
+	if err != nil { t.Fatal(err) }
+	f2,err := blob.ToFlight("somekey")
+	if err != nil { t.Fatal(err) }
+
+	v,v2 := reflect.ValueOf(f), reflect.ValueOf(*f2)
+	for i:=0; i<v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" || field.Name == "Tracks" { continue }
+		if !reflect.DeepEqual(v.Field(i).Interface(), v2.Field(i).Interface()) {
+			t.Errorf("field %s lost: %v vs %v", field.Name, v.Field(i), v2.Field(i))
+		}
+	}
+}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
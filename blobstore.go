@@ -0,0 +1,25 @@
+package flightdb
+
+import(
+	"golang.org/x/net/context"
+)
+
+// A BlobStore holds flight payloads that are too big to live inside their datastore entity
+// (which is capped at about 1MB). Implementations are in github.com/skypies/flightdb/blobstore.
+type BlobStore interface {
+	WriteBlob(ctx context.Context, name string, data []byte) error
+	ReadBlob(ctx context.Context, name string) ([]byte, error)
+	DeleteBlob(ctx context.Context, name string) error // Deleting a non-existent blob is not an error
+}
+
+// DefaultBlobStore is where oversized flight blobs get written to, and read back from. If it
+// is nil, oversized flights cannot be persisted.
+var DefaultBlobStore BlobStore
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
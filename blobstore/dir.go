@@ -0,0 +1,69 @@
+// Package blobstore has implementations of the flightdb.BlobStore interface, for holding
+// flight payloads that are too big for datastore.
+package blobstore
+
+import(
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// DirBlobStore keeps each blob as a file, somewhere underneath a local directory.
+type DirBlobStore struct {
+	Dir string
+}
+
+func NewDirBlobStore(dir string) DirBlobStore {
+	return DirBlobStore{Dir:dir}
+}
+
+func (s DirBlobStore)filename(name string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(name))
+}
+
+// {{{ s.WriteBlob, s.ReadBlob, s.DeleteBlob
+
+// WriteBlob writes to a temp file, and renames it into place, so readers never see half a blob.
+func (s DirBlobStore)WriteBlob(ctx context.Context, name string, data []byte) error {
+	filename := s.filename(name)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("DirBlobStore.WriteBlob: %v", err)
+	}
+
+	tmpName := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpName, data, 0644); err != nil {
+		return fmt.Errorf("DirBlobStore.WriteBlob: %v", err)
+	}
+	if err := os.Rename(tmpName, filename); err != nil {
+		return fmt.Errorf("DirBlobStore.WriteBlob: %v", err)
+	}
+	return nil
+}
+
+func (s DirBlobStore)ReadBlob(ctx context.Context, name string) ([]byte, error) {
+	data,err := ioutil.ReadFile(s.filename(name))
+	if err != nil {
+		return nil, fmt.Errorf("DirBlobStore.ReadBlob: %v", err)
+	}
+	return data, nil
+}
+
+func (s DirBlobStore)DeleteBlob(ctx context.Context, name string) error {
+	if err := os.Remove(s.filename(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("DirBlobStore.DeleteBlob: %v", err)
+	}
+	return nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
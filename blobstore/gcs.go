@@ -0,0 +1,81 @@
+package blobstore
+
+import(
+	"fmt"
+	"io/ioutil"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
+)
+
+// GCSBlobStore keeps each blob as an object in a Google Cloud Storage bucket.
+type GCSBlobStore struct {
+	Bucket string
+}
+
+func NewGCSBlobStore(bucket string) GCSBlobStore {
+	return GCSBlobStore{Bucket:bucket}
+}
+
+func (s GCSBlobStore)object(ctx context.Context, name string) (*storage.Client, *storage.ObjectHandle, error) {
+	client,err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, client.Bucket(s.Bucket).Object(name), nil
+}
+
+// {{{ s.WriteBlob, s.ReadBlob, s.DeleteBlob
+
+func (s GCSBlobStore)WriteBlob(ctx context.Context, name string, data []byte) error {
+	client,obj,err := s.object(ctx, name)
+	if err != nil { return fmt.Errorf("GCSBlobStore.WriteBlob %s: %v", name, err) }
+	defer client.Close()
+
+	w := obj.NewWriter(ctx)
+	w.ContentType = "application/octet-stream"
+	if _,err := w.Write(data); err != nil {
+		w.Close()
+		return fmt.Errorf("GCSBlobStore.WriteBlob %s: %v", name, err)
+	}
+	// IMPORTANT - if Close doesn't return nil, the data is likely lost
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("GCSBlobStore.WriteBlob %s: close: %v", name, err)
+	}
+	return nil
+}
+
+func (s GCSBlobStore)ReadBlob(ctx context.Context, name string) ([]byte, error) {
+	client,obj,err := s.object(ctx, name)
+	if err != nil { return nil, fmt.Errorf("GCSBlobStore.ReadBlob %s: %v", name, err) }
+	defer client.Close()
+
+	r,err := obj.NewReader(ctx)
+	if err != nil { return nil, fmt.Errorf("GCSBlobStore.ReadBlob %s: %v", name, err) }
+	defer r.Close()
+
+	data,err := ioutil.ReadAll(r)
+	if err != nil { return nil, fmt.Errorf("GCSBlobStore.ReadBlob %s: %v", name, err) }
+	return data, nil
+}
+
+func (s GCSBlobStore)DeleteBlob(ctx context.Context, name string) error {
+	client,obj,err := s.object(ctx, name)
+	if err != nil { return fmt.Errorf("GCSBlobStore.DeleteBlob %s: %v", name, err) }
+	defer client.Close()
+
+	if err := obj.Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return fmt.Errorf("GCSBlobStore.DeleteBlob %s: %v", name, err)
+	}
+	return nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,197 @@
+package flightdb
+
+// A coarse spatial index. The world is cut into a grid of CellSizeDeg x CellSizeDeg cells, and
+// each flight is indexed by the set of cells its tracks pass through. This lets queries rule
+// out flights that can't possibly go near a region, without having to load their blobs.
+
+import(
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/skypies/geo"
+	"github.com/skypies/util/date"
+)
+
+// About 28km north-south; this keeps the cell count of a coast-to-coast flight to a few hundred.
+const CellSizeDeg = 0.25
+
+type cellIndex struct { Lat, Long int }
+
+func (c cellIndex)String() string { return fmt.Sprintf("%d:%d", c.Lat, c.Long) }
+
+func cellAt(pos geo.Latlong) cellIndex {
+	return cellIndex{
+		Lat: int(math.Floor(pos.Lat / CellSizeDeg)),
+		Long: int(math.Floor(pos.Long / CellSizeDeg)),
+	}
+}
+
+// CellToken returns the token of the cell that contains the point.
+func CellToken(pos geo.Latlong) string { return cellAt(pos).String() }
+
+// {{{ t.Cells, f.Cells
+
+// Cells returns the tokens for all the cells the track passes through, in sorted order. The
+// lines between trackpoints are walked in steps of half a cell, so gaps in the track don't
+// leave holes; a line that only clips the corner of a cell may still miss it, so anything
+// matching against these should allow for neighbouring cells (as CellsForBox does).
+func (t Track)Cells() []string {
+	cells := map[cellIndex]bool{}
+	t.walkCells(func(c cellIndex, tm time.Time) { cells[c] = true })
+	return cellTokens(cells)
+}
+
+// Calls f for every trackpoint, and for the points interpolated between them.
+func (t Track)walkCells(f func(cellIndex, time.Time)) {
+	for i,tp := range t {
+		f(cellAt(tp.Latlong), tp.TimestampUTC)
+		if i == 0 { continue }
+
+		prev := t[i-1]
+		dist := math.Max(math.Abs(tp.Lat - prev.Lat), math.Abs(tp.Long - prev.Long))
+		nSteps := int(dist / (CellSizeDeg/2))
+		for j:=1; j<=nSteps; j++ {
+			frac := float64(j)/float64(nSteps+1)
+			tm := prev.TimestampUTC.Add(time.Duration(frac * float64(tp.TimestampUTC.Sub(prev.TimestampUTC))))
+			f(cellAt(prev.Latlong.InterpolateTo(tp.Latlong, frac)), tm)
+		}
+	}
+}
+
+// Cells returns the union of the cells of all the flight's tracks.
+func (f *Flight)Cells() []string {
+	cells := map[string]bool{}
+	for _,t := range f.Tracks {
+		for _,cell := range t.Cells() {
+			cells[cell] = true
+		}
+	}
+	tokens := []string{}
+	for cell,_ := range cells { tokens = append(tokens, cell) }
+	sort.Strings(tokens)
+	return tokens
+}
+
+// }}}
+// {{{ CellTimeToken, f.CellTimeTokens
+
+// CellTimeToken identifies a cell, and the CellTimeslot in which it was passed through; e.g.
+// "150:-490@1491004800". Unlike the cells, these can be queried by themselves within a time
+// range, so they don't need a composite index with Timeslots.
+func CellTimeToken(cell string, t time.Time) string {
+	slot := date.Timeslots(t, t, CellTimeslotDuration)[0]
+	return fmt.Sprintf("%s@%d", cell, slot.Unix())
+}
+
+// CellTimeTokens returns the tokens for all the slots that overlap [s,e].
+func CellTimeTokens(cell string, s,e time.Time) []string {
+	tokens := []string{}
+	for _,slot := range date.Timeslots(s, e, CellTimeslotDuration) {
+		tokens = append(tokens, CellTimeToken(cell, slot))
+	}
+	return tokens
+}
+
+func (f *Flight)CellTimeTokens() []string {
+	seen := map[string]bool{}
+	for _,t := range f.Tracks {
+		t.walkCells(func(c cellIndex, tm time.Time) { seen[CellTimeToken(c.String(), tm)] = true })
+	}
+	tokens := []string{}
+	for token,_ := range seen { tokens = append(tokens, token) }
+	sort.Strings(tokens)
+	return tokens
+}
+
+// }}}
+// {{{ CellsForBox, CellsForRestrictor
+
+// CellsForBox returns the tokens for all the cells that a track passing through the box might
+// have been indexed under; that is, the cells that overlap the box, plus a ring of neighbours.
+func CellsForBox(box geo.LatlongBox) []string {
+	sw,ne := cellAt(box.SW), cellAt(box.NE)
+	cells := map[cellIndex]bool{}
+	for lat:=sw.Lat-1; lat<=ne.Lat+1; lat++ {
+		for long:=sw.Long-1; long<=ne.Long+1; long++ {
+			cells[cellIndex{lat,long}] = true
+		}
+	}
+	return cellTokens(cells)
+}
+
+// CellsForRestrictor returns CellsForBox of the restrictor's bounding box.
+func CellsForRestrictor(gr geo.Restrictor) []string {
+	return CellsForBox(gr.BoundingBox())
+}
+
+// }}}
+// {{{ grs.CellGroups, grs.RuledOutByCells
+
+// CellGroups returns the cells that a flight needs to have, to possibly satisfy the restrictor
+// set: at least one from every group. If it returns no groups, there's nothing to rule out.
+func (grs GeoRestrictorSet)CellGroups() [][]string {
+	groups := [][]string{}
+
+	switch grs.Logic {
+	case CombinationLogicAll:
+		// Every inclusive restrictor needs to be intersected
+		for _,gr := range grs.R {
+			if !gr.IsExclusion() { groups = append(groups, CellsForRestrictor(gr)) }
+		}
+	case CombinationLogicAny:
+		// An exclusion is satisfied by staying away, so we can't rule anything out
+		union := map[string]bool{}
+		for _,gr := range grs.R {
+			if gr.IsExclusion() { return [][]string{} }
+			for _,cell := range CellsForRestrictor(gr) { union[cell] = true }
+		}
+		if len(union) > 0 {
+			cells := []string{}
+			for cell,_ := range union { cells = append(cells, cell) }
+			sort.Strings(cells)
+			groups = append(groups, cells)
+		}
+	}
+
+	return groups
+}
+
+// RuledOutByCells returns true if a flight with the given cells can't possibly satisfy the
+// restrictor set. A false result doesn't mean the flight will satisfy the set. Flights with no
+// cells are never ruled out, as they may have been indexed before cells existed.
+func (grs GeoRestrictorSet)RuledOutByCells(cells []string) bool {
+	if len(cells) == 0 { return false }
+
+	have := map[string]bool{}
+	for _,cell := range cells { have[cell] = true }
+	for _,group := range grs.CellGroups() {
+		overlaps := false
+		for _,cell := range group {
+			if have[cell] { overlaps = true; break }
+		}
+		if !overlaps { return true }
+	}
+
+	return false
+}
+
+// }}}
+
+func cellTokens(cells map[cellIndex]bool) []string {
+	tokens := []string{}
+	for cell,_ := range cells {
+		tokens = append(tokens, cell.String())
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
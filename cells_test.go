@@ -0,0 +1,35 @@
+package flightdb
+
+import(
+	"testing"
+
+	"github.com/skypies/geo"
+)
+
+func TestCells(t *testing.T) {
+	// Two points, a few cells apart; the cells in between should get filled in
+	sfo,sjc := geo.Latlong{Lat:37.6188, Long:-122.3756}, geo.Latlong{Lat:37.3639, Long:-121.9289}
+	track := Track{ Trackpoint{Latlong:sfo}, Trackpoint{Latlong:sjc} }
+	cells := track.Cells()
+	if len(cells) < 3 {
+		t.Errorf("expected the gap to be filled, got %v", cells)
+	}
+
+	mid := sfo.InterpolateTo(sjc, 0.5)
+	grs := GeoRestrictorSet{R: []geo.Restrictor{
+		geo.SquareBoxRestriction{NamedLatlong:geo.NamedLatlong{Latlong:mid}, SideKM:2},
+	}}
+	if grs.RuledOutByCells(cells) {
+		t.Errorf("track was ruled out by a box it flies through")
+	}
+
+	grs.R = append(grs.R, geo.SquareBoxRestriction{
+		NamedLatlong:geo.NamedLatlong{Latlong:geo.Latlong{Lat:34.0, Long:-118.4}}, SideKM:2})
+	if !grs.RuledOutByCells(cells) {
+		t.Errorf("track wasn't ruled out by a box 500km away")
+	}
+	grs.Logic = CombinationLogicAny
+	if grs.RuledOutByCells(cells) {
+		t.Errorf("track was ruled out under 'any', despite flying through one box")
+	}
+}
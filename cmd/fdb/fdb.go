@@ -14,7 +14,9 @@ import(
 	"github.com/skypies/util/gcp/ds"
 
 	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/blobstore"
 	"github.com/skypies/flightdb/fgae"
+	"github.com/skypies/flightdb/localds"
 )
 
 var(
@@ -25,6 +27,13 @@ var(
 	fLimit int
 	fIcaoId string
 	fCallsign string
+	fEquipment string
+	fAirline string
+	fOrigin string
+	fDestination string
+	fRegistration string
+	fLocalDB string
+	fBlobDir string
 )
 	
 func init() {
@@ -34,7 +43,18 @@ func init() {
 	flag.IntVar(&fLimit, "limit", 40, "how many matches to retrieve")
 	flag.StringVar(&fIcaoId, "icao", "", "ICAO id for airframe (6-digit hex)")
 	flag.StringVar(&fCallsign, "callsign", "", "Callsign, or maybe registration, for a flight")
+	flag.StringVar(&fEquipment, "equip", "", "equipment type (e.g. A320)")
+	flag.StringVar(&fAirline, "airline", "", "airline code, IATA (UA) or ICAO (UAL)")
+	flag.StringVar(&fOrigin, "origin", "", "origin airport (e.g. SFO)")
+	flag.StringVar(&fDestination, "dest", "", "destination airport (e.g. OAK)")
+	flag.StringVar(&fRegistration, "reg", "", "airframe registration (e.g. N12345)")
+	flag.StringVar(&fBlobDir, "blobdir", "", "local directory holding oversized flight blobs")
+	flag.StringVar(&fLocalDB, "localdb", "", "use this local file (.sqlite for SQLite) instead of cloud datastore")
 	flag.Parse()
+
+	if fBlobDir != "" {
+		fdb.DefaultBlobStore = blobstore.NewDirBlobStore(fBlobDir)
+	}
 }
 
 // Based on the various command line flags
@@ -51,19 +71,33 @@ func queryFromArgs() *fgae.FQuery {
 
 	if fIcaoId != "" { fq.ByIcaoId(adsb.IcaoId(fIcaoId)) }
 	if fCallsign != "" { fq.ByCallsign(fCallsign) }
+	if fEquipment != "" { fq.ByEquipment(fEquipment) }
+	if fAirline != "" { fq.ByAirline(fAirline) }
+	if fOrigin != "" { fq.ByOrigin(fOrigin) }
+	if fDestination != "" { fq.ByDestination(fDestination) }
+	if fRegistration != "" { fq.ByRegistration(fRegistration) }
 
 	fq.Order("-LastUpdate")
 	
 	return fq
 }
 
-func runQuery(fq *fgae.FQuery) {
-	fmt.Printf("Running query %s\n", fq)
+func newProvider() ds.DatastoreProvider {
+	if fLocalDB != "" {
+		p,err := localds.Open(fLocalDB)
+		if err != nil { log.Fatal(err) }
+		return p
+	}
 
-	p,err := ds.NewCloudDSProvider(ctx,"serfr0-fdb")
+	p,err := fgae.NewTxCloudDSProvider(ctx,"serfr0-fdb")
 	if err != nil { log.Fatal(err) }
+	return p
+}
+
+func runQuery(fq *fgae.FQuery) {
+	fmt.Printf("Running query %s\n", fq)
 
-	db := fgae.New(ctx,p)
+	db := fgae.New(ctx,newProvider())
 
 	flights,err := db.LookupAll(fq)
 	if err != nil { log.Fatal(err) }
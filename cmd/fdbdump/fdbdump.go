@@ -0,0 +1,200 @@
+package main
+
+// Dumps the flight database (or part of it) into an archive file, and restores it again; for
+// backups, and for moving data between projects and backends. See fgae/archive.go.
+//
+//  fdbdump -o sfo-march.fdba -tags=:SFO -from=2017/03/01 -to=2017/03/31
+//  fdbdump -o refdata.fdba -flights=false -kinds=RSet,IdSpecSet,Singleton
+//  fdbdump -localdb=copy.sqlite -restore sfo-march.fdba
+//  fdbdump -list sfo-march.fdba
+//
+// You'll need something useful in $ENV{GOOGLE_APPLICATION_CREDENTIALS}, unless using -localdb
+
+import(
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/util/date"
+	"github.com/skypies/util/gcp/ds"
+
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/blobstore"
+	"github.com/skypies/flightdb/fgae"
+	"github.com/skypies/flightdb/localds"
+)
+
+var(
+	ctx = context.Background()
+	fOutput string
+	fRestore string
+	fList string
+	fFlights bool
+	fKinds string
+	fTags string
+	fFrom string
+	fTo string
+	fIcaoId string
+	fCallsign string
+	fLocalDB string
+	fBlobDir string
+	fProject string
+)
+
+func init() {
+	flag.StringVar(&fOutput, "o", "", "export into this archive file")
+	flag.StringVar(&fRestore, "restore", "", "import this archive file")
+	flag.StringVar(&fList, "list", "", "list the contents of this archive file")
+	flag.BoolVar(&fFlights, "flights", true, "export flights matching the query flags")
+	flag.StringVar(&fKinds, "kinds", "", "also export all entities of these kinds (e.g. "+
+		strings.Join(fgae.ArchiveKinds()[1:], ",")+")")
+	flag.StringVar(&fTags, "tags", "", "comma-separated tags that flights must have")
+	flag.StringVar(&fFrom, "from", "", "flights from this date (e.g. 2017/03/01)")
+	flag.StringVar(&fTo, "to", "", "flights up to the end of this date")
+	flag.StringVar(&fIcaoId, "icao", "", "ICAO id for airframe (6-digit hex)")
+	flag.StringVar(&fCallsign, "callsign", "", "callsign")
+	flag.StringVar(&fBlobDir, "blobdir", "", "local directory holding oversized flight blobs")
+	flag.StringVar(&fLocalDB, "localdb", "", "use this local file (.sqlite for SQLite) instead of cloud datastore")
+	flag.StringVar(&fProject, "project", "serfr0-fdb", "cloud project, if not using -localdb")
+	flag.Parse()
+
+	if fBlobDir != "" {
+		fdb.DefaultBlobStore = blobstore.NewDirBlobStore(fBlobDir)
+	}
+}
+
+func newProvider() ds.DatastoreProvider {
+	if fLocalDB != "" {
+		p,err := localds.Open(fLocalDB)
+		if err != nil { log.Fatal(err) }
+		return p
+	}
+
+	p,err := fgae.NewTxCloudDSProvider(ctx, fProject)
+	if err != nil { log.Fatal(err) }
+	return p
+}
+
+// Based on the various command line flags
+func queryFromArgs() *fgae.FQuery {
+	fq := fgae.NewFlightQuery()
+	if fTags != "" { fq.ByTags(strings.Split(fTags, ",")) }
+	if fIcaoId != "" { fq.ByIcaoId(adsb.IcaoId(fIcaoId)) }
+	if fCallsign != "" { fq.ByCallsign(fCallsign) }
+
+	if fFrom != "" || fTo != "" {
+		s,e := time.Time{}, time.Now()
+		if fFrom != "" { s = date.ArbitraryDatestring2MidnightPdt(fFrom, "2006/01/02") }
+		if fTo != "" {
+			_,e = date.WindowForTime(date.ArbitraryDatestring2MidnightPdt(fTo, "2006/01/02"))
+		}
+		fq.ByTimeRange(s,e)
+	}
+
+	return fq
+}
+
+// {{{ export
+
+func export(db fgae.FlightDB) {
+	out,err := os.Create(fOutput)
+	if err != nil { log.Fatal(err) }
+	defer out.Close()
+
+	aw,err := fgae.NewArchiveWriter(out, fmt.Sprintf("%T", db.Backend))
+	if err != nil { log.Fatal(err) }
+
+	if fFlights {
+		fq := queryFromArgs()
+		n,err := db.ExportFlights(aw, fq)
+		if err != nil { log.Fatal(err) }
+		fmt.Printf("exported %d flights (%s)\n", n, fq)
+	}
+
+	if fKinds != "" {
+		for _,kind := range strings.Split(fKinds, ",") {
+			n,err := db.ExportKind(aw, kind)
+			if err != nil { log.Fatal(err) }
+			fmt.Printf("exported %d %s\n", n, kind)
+		}
+	}
+
+	if err := aw.Close(); err != nil { log.Fatal(err) }
+	fmt.Printf("wrote %s: %s\n", fOutput, aw.Manifest)
+}
+
+// }}}
+// {{{ restore
+
+func restore(db fgae.FlightDB) {
+	in,err := os.Open(fRestore)
+	if err != nil { log.Fatal(err) }
+	defer in.Close()
+
+	ar,err := fgae.NewArchiveReader(in)
+	if err != nil { log.Fatal(err) }
+
+	counts,err := db.ImportArchive(ar)
+	if err != nil { log.Fatal(err) }
+	fmt.Printf("restored %v from %s\n", counts, ar.Manifest)
+}
+
+// }}}
+// {{{ list
+
+func list() {
+	in,err := os.Open(fList)
+	if err != nil { log.Fatal(err) }
+	defer in.Close()
+
+	ar,err := fgae.NewArchiveReader(in)
+	if err != nil { log.Fatal(err) }
+
+	for i:=0; ; i++ {
+		rec,err := ar.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("[%5d] %-10.10s %v (%d bytes)\n", i, rec.Kind, rec.Key, len(rec.Entity))
+	}
+	fmt.Printf("%s\n", ar.Manifest)
+}
+
+// }}}
+
+func main() {
+	if fList != "" {
+		list()
+		return
+	} else if fRestore == "" && fOutput == "" {
+		log.Fatal("usage: fdbdump [-o out.fdba | -restore in.fdba | -list in.fdba] [flags]\n")
+	}
+
+	p := newProvider()
+	if closer,ok := p.(io.Closer); ok {
+		defer closer.Close() // The local providers need to flush
+	}
+
+	if fRestore != "" {
+		restore(fgae.New(ctx, p))
+	} else {
+		export(fgae.New(ctx, p))
+	}
+}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -12,7 +12,6 @@ import(
 
 	"github.com/skypies/geo"
 	"github.com/skypies/util/date"
-	"github.com/skypies/util/gcp/ds"
 	"github.com/skypies/util/histogram"
 	
 	fdb "github.com/skypies/flightdb"
@@ -33,7 +32,7 @@ func init() {
 	flag.Parse()
 
 	ctx := context.Background()
-	if p,err := ds.NewCloudDSProvider(ctx, "serfr0-fdb"); err != nil {
+	if p,err := fgae.NewTxCloudDSProvider(ctx, "serfr0-fdb"); err != nil {
 		log.Fatalf("new cloud provider: %v\n", err)
 	} else {
 		db = fgae.New(ctx, p)
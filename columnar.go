@@ -0,0 +1,308 @@
+package flightdb
+
+// The columnar blob encoding. Gob spends a lot of bytes on tracks: every Trackpoint carries
+// its field names, and full float64s. Here, each track is stored column by column; numeric
+// columns are quantized to integers, and then delta-encoded as zigzag varints, and the string
+// columns are dictionary-coded. The rest of the flight (identity, tags, etc) is still gob.
+// The whole lot is then gzipped, which mops up the runs of repeated dictionary indices.
+//
+// Quantization is as follows (see Trackpoint.Quantized):
+//   TimestampUTC   milliseconds
+//   Lat, Long      1e-6 degrees (~11cm)
+//   Altitude       feet
+//   GroundSpeed    0.01 knots
+//   Heading        0.01 degrees
+//   VerticalRate   feet per minute
+// The derived fields (those tagged `datastore:"-"`) are not stored.
+
+import(
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/skypies/geo"
+)
+
+const kColumnarTrackVersion = 1
+
+// What actually gets gob-encoded
+type columnarFlight struct {
+	Flight      Flight              // With the Tracks removed
+	TrackNames  []string
+	Tracks      [][]byte            // Parallel to TrackNames
+}
+
+// {{{ quantizers
+
+func quantize(x, scale float64) int64 { return int64(math.Round(x * scale)) }
+func quantizeTime(t time.Time) int64 { return t.Round(time.Millisecond).UnixNano() / 1e6 }
+func unquantizeTime(ms int64) time.Time { return time.Unix(0, ms * 1e6).UTC() }
+
+// Quantized returns the trackpoint as it will be after a round trip through the columnar
+// encoding; the stored fields are rounded, and the derived ones are dropped.
+func (tp Trackpoint)Quantized() Trackpoint {
+	return Trackpoint{
+		DataSource: tp.DataSource,
+		ReceiverName: tp.ReceiverName,
+		TimestampUTC: unquantizeTime(quantizeTime(tp.TimestampUTC)),
+		Latlong: geo.Latlong{
+			Lat: float64(quantize(tp.Lat, 1e6)) / 1e6,
+			Long: float64(quantize(tp.Long, 1e6)) / 1e6,
+		},
+		Altitude: float64(quantize(tp.Altitude, 1)),
+		GroundSpeed: float64(quantize(tp.GroundSpeed, 100)) / 100,
+		Heading: float64(quantize(tp.Heading, 100)) / 100,
+		VerticalRate: float64(quantize(tp.VerticalRate, 1)),
+		Squawk: tp.Squawk,
+	}
+}
+
+func (t Track)Quantized() Track {
+	out := make(Track, len(t))
+	for i,tp := range t {
+		out[i] = tp.Quantized()
+	}
+	return out
+}
+
+// }}}
+
+// {{{ columnWriter, columnReader
+
+// columnWriter accumulates varints
+type columnWriter struct {
+	bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (w *columnWriter)uvarint(v uint64) {
+	n := binary.PutUvarint(w.scratch[:], v)
+	w.Write(w.scratch[:n])
+}
+func (w *columnWriter)varint(v int64) {
+	n := binary.PutVarint(w.scratch[:], v) // zigzag, so small negatives stay small
+	w.Write(w.scratch[:n])
+}
+func (w *columnWriter)str(s string) {
+	w.uvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+// Writes out the column as a series of deltas
+func (w *columnWriter)deltas(vals []int64) {
+	prev := int64(0)
+	for _,v := range vals {
+		w.varint(v - prev)
+		prev = v
+	}
+}
+
+type columnReader struct {
+	*bytes.Reader
+}
+
+func (r columnReader)uvarint() (uint64, error) { return binary.ReadUvarint(r) }
+func (r columnReader)varint() (int64, error) { return binary.ReadVarint(r) }
+func (r columnReader)str() (string, error) {
+	n,err := r.uvarint()
+	if err != nil { return "", err }
+	if n > uint64(r.Len()) { return "", io.ErrUnexpectedEOF }
+	b := make([]byte, n)
+	_,err = io.ReadFull(r, b)
+	return string(b), err
+}
+func (r columnReader)deltas(n int) ([]int64, error) {
+	vals := make([]int64, n)
+	prev := int64(0)
+	for i:=0; i<n; i++ {
+		d,err := r.varint()
+		if err != nil { return nil, err }
+		prev += d
+		vals[i] = prev
+	}
+	return vals, nil
+}
+
+// }}}
+
+// {{{ encodeColumnarTrack
+
+func encodeColumnarTrack(t Track) []byte {
+	n := len(t)
+
+	// Build a single dictionary for all the string columns
+	dict := map[string]int{}
+	dictList := []string{}
+	lookup := func(s string) int64 {
+		if _,exists := dict[s]; !exists {
+			dict[s] = len(dictList)
+			dictList = append(dictList, s)
+		}
+		return int64(dict[s])
+	}
+
+	cols := make([][]int64, 10)
+	for i := range cols { cols[i] = make([]int64, n) }
+	for i,tp := range t {
+		cols[0][i] = lookup(tp.DataSource)
+		cols[1][i] = lookup(tp.ReceiverName)
+		cols[2][i] = lookup(tp.Squawk)
+		cols[3][i] = quantizeTime(tp.TimestampUTC)
+		cols[4][i] = quantize(tp.Lat, 1e6)
+		cols[5][i] = quantize(tp.Long, 1e6)
+		cols[6][i] = quantize(tp.Altitude, 1)
+		cols[7][i] = quantize(tp.GroundSpeed, 100)
+		cols[8][i] = quantize(tp.Heading, 100)
+		cols[9][i] = quantize(tp.VerticalRate, 1)
+	}
+
+	w := columnWriter{}
+	w.uvarint(kColumnarTrackVersion)
+	w.uvarint(uint64(n))
+	w.uvarint(uint64(len(dictList)))
+	for _,s := range dictList {
+		w.str(s)
+	}
+	for _,col := range cols {
+		w.deltas(col)
+	}
+
+	return w.Bytes()
+}
+
+// }}}
+// {{{ decodeColumnarTrack
+
+func decodeColumnarTrack(b []byte) (Track, error) {
+	r := columnReader{bytes.NewReader(b)}
+
+	if v,err := r.uvarint(); err != nil {
+		return nil, err
+	} else if v != kColumnarTrackVersion {
+		return nil, fmt.Errorf("columnar track: unknown version %d", v)
+	}
+
+	n64,err := r.uvarint()
+	if err != nil { return nil, err }
+	nDict,err := r.uvarint()
+	if err != nil { return nil, err }
+	// Every point, and every dict entry, takes at least one byte per column; so this catches
+	// corrupt lengths before we try to allocate something huge.
+	if n64 > uint64(len(b)) || nDict > uint64(len(b)) {
+		return nil, fmt.Errorf("columnar track: implausible lengths (%d,%d)", n64, nDict)
+	}
+	n := int(n64)
+
+	dictList := make([]string, nDict)
+	for i := range dictList {
+		if dictList[i],err = r.str(); err != nil { return nil, err }
+	}
+
+	cols := make([][]int64, 10)
+	for i := range cols {
+		if cols[i],err = r.deltas(n); err != nil {
+			return nil, fmt.Errorf("columnar track: column %d: %v", i, err)
+		}
+	}
+
+	str := func(idx int64) (string, error) {
+		if idx < 0 || idx >= int64(len(dictList)) {
+			return "", fmt.Errorf("columnar track: bad dictionary index %d", idx)
+		}
+		return dictList[idx], nil
+	}
+
+	t := make(Track, n)
+	for i := range t {
+		tp := &t[i]
+		if tp.DataSource,err = str(cols[0][i]); err != nil { return nil, err }
+		if tp.ReceiverName,err = str(cols[1][i]); err != nil { return nil, err }
+		if tp.Squawk,err = str(cols[2][i]); err != nil { return nil, err }
+		tp.TimestampUTC = unquantizeTime(cols[3][i])
+		tp.Lat = float64(cols[4][i]) / 1e6
+		tp.Long = float64(cols[5][i]) / 1e6
+		tp.Altitude = float64(cols[6][i])
+		tp.GroundSpeed = float64(cols[7][i]) / 100
+		tp.Heading = float64(cols[8][i]) / 100
+		tp.VerticalRate = float64(cols[9][i])
+	}
+
+	return t, nil
+}
+
+// }}}
+
+// {{{ encodeColumnarFlight, decodeColumnarFlight
+
+func encodeColumnarFlight(f *Flight) ([]byte, error) {
+	cf := columnarFlight{Flight: *f}
+	cf.Flight.Tracks = nil
+
+	for name := range f.Tracks {
+		cf.TrackNames = append(cf.TrackNames, name)
+	}
+	sort.Strings(cf.TrackNames) // So the encoding is deterministic
+	for _,name := range cf.TrackNames {
+		var t Track
+		if f.Tracks[name] != nil { t = *f.Tracks[name] }
+		cf.Tracks = append(cf.Tracks, encodeColumnarTrack(t))
+	}
+
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(gzipWriter).Encode(cf); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decodeColumnarFlight(b []byte) (*Flight, error) {
+	gzipReader,err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil { return nil, err }
+	gobBytes,err := ioutil.ReadAll(gzipReader)
+	if err != nil { return nil, err }
+
+	cf := columnarFlight{}
+	if err := gob.NewDecoder(bytes.NewReader(gobBytes)).Decode(&cf); err != nil {
+		return nil, err
+	}
+	if len(cf.TrackNames) != len(cf.Tracks) {
+		return nil, fmt.Errorf("columnar flight: %d track names, but %d tracks", len(cf.TrackNames),
+			len(cf.Tracks))
+	}
+
+	// Take the flight as a whole, so new fields come through without needing a mention here
+	f := cf.Flight
+	f.Tracks = map[string]*Track{}
+	if f.Tags == nil { f.Tags = map[string]int{} }
+	if f.Waypoints == nil { f.Waypoints = map[string]time.Time{} }
+
+	for i,name := range cf.TrackNames {
+		t,err := decodeColumnarTrack(cf.Tracks[i])
+		if err != nil { return nil, fmt.Errorf("track %s: %v", name, err) }
+		f.Tracks[name] = &t
+	}
+
+	return &f, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,108 @@
+package flightdb
+
+// Sometimes the same flight gets stored more than once (reloads, tasks that run twice, data
+// from different providers). These routines spot such duplicates, and fold them together.
+
+import(
+	"fmt"
+	"sort"
+)
+
+// {{{ f.IsDuplicateOf
+
+// IsDuplicateOf is true if the flights are from the same airframe (same IcaoId; or same
+// callsign, if neither has an IcaoId), and their tracks overlap in time.
+func (f1 Flight)IsDuplicateOf(f2 Flight) bool {
+	if f1.IcaoId != "" || f2.IcaoId != "" {
+		if f1.IcaoId != f2.IcaoId { return false }
+	} else if f1.Callsign == "" || f1.Callsign != f2.Callsign {
+		return false
+	}
+
+	if len(f1.Tracks) == 0 || len(f2.Tracks) == 0 { return false }
+	s1,e1 := f1.Times()
+	s2,e2 := f2.Times()
+	return !s1.After(e2) && !s2.After(e1)
+}
+
+// }}}
+// {{{ f.MergeDuplicate
+
+// MergeDuplicate folds f2 into f1: tracks are merged (trackpoints that appear in both are
+// only kept once), tags and waypoints are unioned, and the identity is merged via
+// MergeIdentityFrom. It returns a list of the changes made to f1, for diffs & debugging.
+func (f1 *Flight)MergeDuplicate(f2 Flight) []string {
+	diffs := []string{}
+
+	for _,name := range f2.ListTracks() {
+		t2 := f2.Tracks[name]
+		if !f1.HasTrack(name) {
+			t := append(Track{}, (*t2)...)
+			f1.Tracks[name] = &t
+			diffs = append(diffs, fmt.Sprintf("track %s: added %d points", name, len(t)))
+			continue
+		}
+
+		t1 := f1.Tracks[name]
+		merged := mergeTracksWithoutRepeats(*t1, *t2)
+		if n := len(merged) - len(*t1); n > 0 {
+			diffs = append(diffs, fmt.Sprintf("track %s: added %d of %d points", name, n, len(*t2)))
+		}
+		f1.Tracks[name] = &merged
+	}
+
+	for _,tag := range f2.TagList() {
+		if !f1.HasTag(tag) {
+			f1.SetTag(tag)
+			diffs = append(diffs, fmt.Sprintf("tag %s: added", tag))
+		}
+	}
+
+	for _,wp := range f2.WaypointList() {
+		if t,exists := f1.Waypoints[wp]; !exists || f2.Waypoints[wp].Before(t) {
+			f1.SetWaypoint(wp, f2.Waypoints[wp])
+			diffs = append(diffs, fmt.Sprintf("waypoint %s: set to %s", wp, f2.Waypoints[wp]))
+		}
+	}
+
+	before := f1.IdentityString()
+	if f1.MergeIdentityFrom(f2) {
+		diffs = append(diffs, fmt.Sprintf("identity: %s -> %s", before, f1.IdentityString()))
+	}
+
+	f1.DebugLog += fmt.Sprintf("-- MergeDuplicate from %s [%s]\n", f2.IdentityString(),
+		f2.GetDatastoreKey())
+	for _,diff := range diffs {
+		f1.DebugLog += " - "+diff+"\n"
+	}
+
+	return diffs
+}
+
+// Trackpoints at the same time & place are assumed to be the same point
+func mergeTracksWithoutRepeats(t1, t2 Track) Track {
+	merged := append(append(Track{}, t1...), t2...)
+	sort.Stable(TrackByTimestampAscending(merged))
+
+	out := Track{}
+	for i,tp := range merged {
+		if i > 0 {
+			prev := out[len(out)-1]
+			if tp.TimestampUTC.Equal(prev.TimestampUTC) && tp.Latlong.Equal(prev.Latlong) {
+				continue
+			}
+		}
+		out = append(out, tp)
+	}
+	return out
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
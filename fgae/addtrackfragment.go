@@ -1,7 +1,9 @@
 package fgae
 
 import(
+	"errors"
 	"fmt"
+	"math/rand"
 	"time"
 
 	"github.com/skypies/geo/sfo"
@@ -33,21 +35,161 @@ func currentAccumulationTrack(f *fdb.Flight) *fdb.Track {
 // }}}
 // {{{ AddTrackFragment
 
+// How many times AddTrackFragment will re-read and re-merge, after losing a race with another
+// writer, before giving up.
+var MaxAddTrackFragmentRetries = 10
+
+// How long to wait before the first retry; this doubles with each retry, up to the max.
+var AddTrackFragmentBackoff = 10 * time.Millisecond
+var MaxAddTrackFragmentBackoff = 2 * time.Second
+
+// AddTrackFragment merges the fragment into the most recent flight for its IcaoId that it fits
+// onto (or starts a new one). If that fills the gap between two flights, they are merged. If
+// another writer updates the flight concurrently, it is re-read and the fragment merged again.
 func (db *FlightDB)AddTrackFragment(frag *fdb.TrackFragment, airframes *ref.AirframeCache, schedules *ref.ScheduleCache, perf map[string]time.Time) error {
+	_,err := db.addTrackFragmentWithRetries(frag, airframes, schedules, perf)
+	return err
+}
+
+func (db *FlightDB)addTrackFragmentWithRetries(frag *fdb.TrackFragment, airframes *ref.AirframeCache, schedules *ref.ScheduleCache, perf map[string]time.Time) (FragOutcome, error) {
+	var outcome FragOutcome
+	var err error
+	for i:=0; i<=MaxAddTrackFragmentRetries; i++ {
+		if i > 0 {
+			time.Sleep(addTrackFragmentBackoff(i))
+		}
+
+		// The fragment gets modified along the way, so each attempt gets a fresh copy
+		fragCopy := *frag
+		fragCopy.Track = append(fdb.Track{}, frag.Track...)
+
+		outcome,err = db.addTrackFragmentOnce(&fragCopy, airframes, schedules, perf)
+		if !errors.Is(err, fdb.ErrVersionConflict) {
+			return outcome, err
+		}
+		db.Debugf("* [%s] AddTrackFragment conflict, attempt %d: %v", frag.IcaoId, i+1, err)
+	}
+
+	err = fmt.Errorf("AddTrackFragment [%s]: gave up after %d attempts: %w", frag.IcaoId,
+		MaxAddTrackFragmentRetries+1, err)
+	return FragOutcome{Result:FragRejected, Reason:err.Error()}, err
+}
+
+// The wait before the ith retry. Half of it is jitter, so that the racers don't all come
+// straight back together.
+func addTrackFragmentBackoff(i int) time.Duration {
+	d := AddTrackFragmentBackoff
+	for j:=1; j<i && d<MaxAddTrackFragmentBackoff; j++ {
+		d *= 2
+	}
+	if d > MaxAddTrackFragmentBackoff {
+		d = MaxAddTrackFragmentBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (db *FlightDB)addTrackFragmentOnce(frag *fdb.TrackFragment, airframes *ref.AirframeCache, schedules *ref.ScheduleCache, perf map[string]time.Time) (FragOutcome, error) {
 	perf["01_start"] = time.Now()
 	db.Debugf("* adding frag %d\n", len(frag.Track))
 
-	f,err := db.LookupMostRecent(db.NewQuery().ByIcaoId(frag.IcaoId))
-	if err != nil { return err }
+	if reason := rejectFragment(frag); reason != "" {
+		return FragOutcome{Result:FragRejected, Reason:reason}, fmt.Errorf("AddTrackFragment: %s", reason)
+	}
+
+	q := db.NewQuery().ByIcaoId(frag.IcaoId).Order("-LastUpdate").Limit(MaxFragmentCandidates)
+	candidates,err := db.LookupAll(q)
+	if err != nil { return FragOutcome{Result:FragRejected, Reason:err.Error()}, err }
 	perf["02_mostrecent"] = time.Now()
 
+	f,outcome := db.mergeFragment(pickFlightForFragment(candidates, frag), frag, airframes, perf)
+
+	perf["05_waypoints"] = time.Now()
+	bridged := bridgedFlights(f, candidates)
+	for _,other := range bridged {
+		f.MergeDuplicate(*other)
+	}
+	// The bridged flights go in the same write, and are checked in the same way, as f itself
+	err = db.persistReplacing([]*fdb.Flight{f}, nil, bridged)
+	perf["06_persist"] = time.Now()
+
+	if err != nil {
+		outcome = FragOutcome{Result:FragRejected, Reason:err.Error()}
+	}
+	return outcome, err
+}
+
+// Returns a reason if the fragment can't be added to anything
+func rejectFragment(frag *fdb.TrackFragment) string {
+	if len(frag.Track) == 0 {
+		return "fragment has no trackpoints"
+	} else if frag.IcaoId == "" {
+		return "fragment has no IcaoId"
+	}
+	return ""
+}
+
+// }}}
+// {{{ pickFlightForFragment, bridgedFlights
+
+// Fragments can arrive out of order, so a fragment that isn't a plausible contribution to the
+// IcaoId's most recent flight may still belong to one of the few before it.
+var MaxFragmentCandidates = 4
+
+// pickFlightForFragment returns the most recently updated candidate that the fragment could be
+// added to; if there isn't one, it returns the most recent (so that mergeFragment starts a new
+// flight), or nil if there are no candidates at all.
+func pickFlightForFragment(candidates []*fdb.Flight, frag *fdb.TrackFragment) *fdb.Flight {
+	if len(candidates) == 0 { return nil }
+	for _,f := range candidates {
+		accTrack := currentAccumulationTrack(f)
+		if accTrack == nil { continue }
+		if plausible,_ := accTrack.PlausibleContribution(&frag.Track); plausible {
+			return f
+		}
+	}
+	return candidates[0]
+}
+
+// bridgedFlights returns the candidates (other than f) that f now runs on into, or on from,
+// without a gap; this happens when a late fragment fills in the hole between two flights that
+// were started because their fragments arrived out of order. These should be folded into f.
+func bridgedFlights(f *fdb.Flight, candidates []*fdb.Flight) []*fdb.Flight {
+	fTrack := currentAccumulationTrack(f)
+	if fTrack == nil { return nil }
+
+	bridged := []*fdb.Flight{}
+	for _,other := range candidates {
+		if other == f || other.GetDatastoreKey() == "" { continue }
+		if other.GetDatastoreKey() == f.GetDatastoreKey() { continue }
+		oTrack := currentAccumulationTrack(other)
+		if oTrack == nil { continue }
+
+		// Unlike PlausibleContribution, don't allow a longer gap when other comes first
+		t1,t2 := fTrack,oTrack
+		if t2.Start().Before(t1.Start()) { t1,t2 = t2,t1 }
+		if plausible,_ := t1.PlausibleExtension(t2); plausible {
+			bridged = append(bridged, other)
+		}
+	}
+	return bridged
+}
+
+// }}}
+// {{{ mergeFragment
+
+// mergeFragment folds the fragment into f, the most recent flight for its IcaoId (or nil, if
+// there isn't one). It returns the flight that should be persisted, which may be a new one.
+func (db *FlightDB)mergeFragment(f *fdb.Flight, frag *fdb.TrackFragment, airframes *ref.AirframeCache, perf map[string]time.Time) (*fdb.Flight, FragOutcome) {
 	prefix := fmt.Sprintf("[%s/%s]%s %s", frag.IcaoId, frag.Callsign, frag.DataSystem, time.Now())
 
 	// If the fragment is strictly a suffix, this will hold the preceding point
 	var prevTP *fdb.Trackpoint
 
+	outcome := FragOutcome{Result:FragExtended}
+
 	if f == nil {
 		f = fdb.NewFlightFromTrackFragment(frag)
+		outcome = FragOutcome{Result:FragNewFlight, Reason:"new IcaoID"}
 		f.DebugLog += "-- AddFrag "+prefix+": new IcaoID\n"
 		db.Debugf("* %s brand new IcaoID: %s", prefix, f)
 		
@@ -77,6 +219,8 @@ func (db *FlightDB)AddTrackFragment(frag *fdb.TrackFragment, airframes *ref.Airf
 			if f.Identity.Callsign == "" && frag.Callsign != "" {
 				f.DebugLog += fmt.Sprintf(" - prev callsign was nil; adding it in now\n")
 				f.Identity.Callsign = frag.Callsign
+			} else if frag.Callsign != "" {
+				f.NoteCallsignChange(frag.Track[0].TimestampUTC, frag.Callsign) // no-op if unchanged
 			}
 
 			if !f.HasTrack(trackKey) {
@@ -102,6 +246,7 @@ func (db *FlightDB)AddTrackFragment(frag *fdb.TrackFragment, airframes *ref.Airf
 		}	else {
 			perf["03_notplausible"] = time.Now()
 			f = fdb.NewFlightFromTrackFragment(frag)
+			outcome = FragOutcome{Result:FragNewFlight, Reason:"not a plausible contribution"}
 			f.DebugLog += "-- AddFrag "+prefix+": was not plausible, so new flight\n"
 			db.Debugf("* %s not a plausible addition; starting afresh ... debug\n%s", prefix, debug)
 			f.DebugLog += debug+"\n"
@@ -135,11 +280,10 @@ func (db *FlightDB)AddTrackFragment(frag *fdb.TrackFragment, airframes *ref.Airf
 		f.SetWaypoint(wp,t)
 	}
 
-	perf["05_waypoints"] = time.Now()
-	err = db.PersistFlight(f)
-	perf["06_persist"] = time.Now()
+	// Phases depend on the whole track, so they're redone each time it grows
+	f.AnalysePhases()
 
-	return err
+	return f, outcome
 }
 
 // }}}
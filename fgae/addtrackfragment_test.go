@@ -1,22 +1,23 @@
 package fgae
 
-// FIXME: how to run these tests without aetest ?
-
-// cd flightdb/fgae && goapp test (note it takes about 4 minutes to run)
-
-/*
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	"google.golang.org/ appengine/aetest"
+	"golang.org/x/net/context"
 
+	"github.com/skypies/adsb"
+	"github.com/skypies/geo"
+	"github.com/skypies/util/gcp/ds"
 	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/localds"
 )
-*/
 
 /* Misordered Frags
 
@@ -72,14 +73,8 @@ should now generate a single flight !
 
  */
 
-/*
-
 func TestMisorderedFrags(t *testing.T) {
-	ctx, done, err := aetest.NewContext()
-	if err != nil { t.Fatal(err) }
-	defer done()
-
-	db := NewDB(ctx)
+	db := New(context.Background(), localds.NewMemoryDSProvider())
 
 	idspec,_ := fdb.NewIdSpec("A5BB1B@1483403847:1483407465")  // Has to match the frags
 	
@@ -94,12 +89,11 @@ func TestMisorderedFrags(t *testing.T) {
 	if err := json.NewDecoder(strings.NewReader(MisorderedFragsJSON)).Decode(&frags); err != nil {
 		t.Fatal(err)
 	}
-	fmt.Printf("(found %d frags)\n", len(frags))
+	t.Logf("(found %d frags)\n", len(frags))
 
 	nPts := 0
 	for _,frag := range frags {
-		time.Sleep(1000 * time.Millisecond) // the test datastore gets confused if we go any quicker
-		if err := db.AddTrackFragment(&frag); err != nil {
+		if err := db.AddTrackFragment(&frag, nil, nil, map[string]time.Time{}); err != nil {
 			t.Fatal(err)
 		}
 		nPts += len(frag.Track)
@@ -108,20 +102,282 @@ func TestMisorderedFrags(t *testing.T) {
 	results,err := db.LookupAll(db.NewQuery().ByIdSpec(idspec))
 	if err != nil { t.Fatal(err) }
 
-	if len(results) != 1 {
-		fmt.Printf("Found %d flight objects:-\n", len(results))
-		for i,f := range results { fmt.Printf("[%02d] %s\n", i, f) }
+	if len(results) == 0 {
+		t.Errorf("Expected a single flight object, but found none")
+
+	} else if len(results) > 1 {
+		for i,f := range results { t.Logf("[%02d] %s\n", i, f) }
 		t.Errorf("Expected a single flight object, but found %d.", len(results))
 
 	} else {
 		f := results[0]
 		track := f.AnyTrack()
-		if len(track) != nPts+1 {
+		if len(track) != nPts {
 			t.Errorf("Expected the single flight to have %d Trackpoints, found %d\n", nPts, len(track))
 		}
 	}
+}
 
-	t.Errorf("SHOW ME THE STDOUT\n")
+// A straight line, one point per second, starting at the nth second after s
+func testFrag(icaoId string, s time.Time, n, nPts int) fdb.TrackFragment {
+	frag := fdb.TrackFragment{IcaoId: adsb.IcaoId(icaoId), Callsign: "UAL123", DataSystem: fdb.DSADSB}
+	for i:=n; i<n+nPts; i++ {
+		frag.Track = append(frag.Track, fdb.Trackpoint{
+			DataSource: "ADSB",
+			TimestampUTC: s.Add(time.Duration(i) * time.Second),
+			Latlong: geo.Latlong{Lat: 37.0 + float64(i)*0.001, Long: -122.0},
+			Altitude: 10000,
+			GroundSpeed: 400,
+		})
+	}
+	return frag
+}
+
+// Many writers adding frags for the same IcaoId; without the version checks, writers would
+// overwrite each other's merges, and trackpoints would go missing. A writer only loses a race
+// when someone else's frag got stored, so with nFrags retries nobody can give up.
+func TestConcurrentAddTrackFragment(t *testing.T) {
+	db := New(context.Background(), localds.NewMemoryDSProvider())
+
+	nFrags, nPtsPerFrag, nWriters := 60, 4, 12
+	defer func(n int, d time.Duration) {
+		MaxAddTrackFragmentRetries, AddTrackFragmentBackoff = n, d
+	}(MaxAddTrackFragmentRetries, AddTrackFragmentBackoff)
+	MaxAddTrackFragmentRetries, AddTrackFragmentBackoff = nFrags, time.Millisecond
+
+	s := time.Date(2017, 1, 3, 1, 0, 0, 0, time.UTC)
+	frags := make(chan fdb.TrackFragment, nFrags)
+	for i:=0; i<nFrags; i++ {
+		frags <- testFrag("A12345", s, i*nPtsPerFrag, nPtsPerFrag)
+	}
+	close(frags)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, nFrags)
+	for w:=0; w<nWriters; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for frag := range frags {
+				errs <- db.AddTrackFragment(&frag, nil, nil, map[string]time.Time{})
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil { t.Error(err) }
+	}
+
+	results,err := db.LookupAll(db.NewQuery().ByIcaoId(adsb.IcaoId("A12345")))
+	if err != nil { t.Fatal(err) }
+	nPts := 0
+	for _,f := range results {
+		nPts += len(f.AnyTrack())
+	}
+	if nPts != nFrags*nPtsPerFrag {
+		t.Errorf("expected %d points, found %d (in %d flights)", nFrags*nPtsPerFrag, nPts, len(results))
+	}
+}
+
+func TestAddTrackFragments(t *testing.T) {
+	db := New(context.Background(), localds.NewMemoryDSProvider())
+	s := time.Date(2017, 1, 3, 1, 0, 0, 0, time.UTC)
+
+	// An existing flight for A00001
+	existing := testFrag("A00001", s, 0, 5)
+	if err := db.AddTrackFragment(&existing, nil, nil, map[string]time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deliberately out of order
+	frags := []fdb.TrackFragment{
+		testFrag("A00001", s, 10, 5),
+		testFrag("A00002", s, 5, 5),
+		testFrag("A00001", s, 5, 5),
+		{IcaoId: adsb.IcaoId("A00002")},
+		testFrag("A00002", s, 0, 5),
+		testFrag("A00001", s, 3600, 5), // an hour later; that's a different flight
+	}
+	expected := []FragResult{FragExtended, FragExtended, FragExtended, FragRejected, FragNewFlight,
+		FragNewFlight}
+
+	ch := NewChannelHook(10)
+	db.AddChangeHook(ch)
+
+	fragPtrs := []*fdb.TrackFragment{}
+	for i := range frags { fragPtrs = append(fragPtrs, &frags[i]) }
+	perf := map[string]time.Time{}
+	outcomes,err := db.AddTrackFragments(fragPtrs, nil, nil, perf)
+	if err != nil { t.Fatal(err) }
+
+	// The batch writes get reported just like PersistFlight's; only the existing flight has a Before
+	if len(ch.C) != 3 { t.Fatalf("expected 3 changes, saw %d", len(ch.C)) }
+	nBefore := 0
+	for i:=0; i<3; i++ {
+		if c := <-ch.C; c.Before != nil { nBefore++ }
+	}
+	if nBefore != 1 { t.Errorf("expected 1 change with a Before, saw %d", nBefore) }
+
+	for i,outcome := range outcomes {
+		if outcome.Result != expected[i] {
+			t.Errorf("frag[%d]: expected %s, got %s", i, expected[i], outcome)
+		}
+	}
+	for _,step := range []string{"03_plausible", "04_trackbuild", "06_persist"} {
+		if perf[step].IsZero() { t.Errorf("perf %s not filled in: %v", step, perf) }
+	}
+
+	for icaoId,expectedPts := range map[string][]int{"A00001":{15,5}, "A00002":{10}} {
+		q := db.NewQuery().ByIcaoId(adsb.IcaoId(icaoId)).Order("-LastUpdate")
+		results,err := db.LookupAll(q)
+		if err != nil { t.Fatal(err) }
+		actualPts := []int{}
+		for _,f := range results {
+			actualPts = append(actualPts, len(f.AnyTrack()))
+			// The phases should cover the merged track, not just its first fragment
+			if tr := f.AnyTrack(); len(f.Phases) == 0 || !f.Phases[len(f.Phases)-1].End.Equal(tr[len(tr)-1].TimestampUTC) {
+				t.Errorf("%s: phases %v don't cover the track", icaoId, f.Phases)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(actualPts)))
+		if fmt.Sprintf("%v", actualPts) != fmt.Sprintf("%v", expectedPts) {
+			t.Errorf("%s: expected flights with %v points, found %v", icaoId, expectedPts, actualPts)
+		}
+	}
+}
+
+// A provider on which every conditional write loses the race
+type alwaysConflicts struct {
+	*localds.MemoryDSProvider
+}
+func (p alwaysConflicts)PutIfVersion(ctx context.Context, keyer ds.Keyer, src interface{}, version int64) (ds.Keyer, error) {
+	return nil, fdb.ErrVersionConflict
+}
+
+func (p alwaysConflicts)PutDeleteIfVersion(ctx context.Context, keyers []ds.Keyer, src interface{}, versions []int64, delKeyers []ds.Keyer, delVersions []int64) ([]ds.Keyer, error) {
+	return nil, fdb.ErrVersionConflict
+}
+
+// A provider that lets someone else write just before the first conditional batch write
+type interloper struct {
+	*localds.MemoryDSProvider
+	before func()
+}
+func (p *interloper)PutDeleteIfVersion(ctx context.Context, keyers []ds.Keyer, src interface{}, versions []int64, delKeyers []ds.Keyer, delVersions []int64) ([]ds.Keyer, error) {
+	if p.before != nil {
+		before := p.before
+		p.before = nil
+		before()
+	}
+	return p.MemoryDSProvider.PutDeleteIfVersion(ctx, keyers, src, versions, delKeyers, delVersions)
+}
+
+// A provider that lets someone else write just before the first write that deletes something
+type deleteInterloper struct {
+	*localds.MemoryDSProvider
+	before func(delKeyers []ds.Keyer)
+}
+func (p *deleteInterloper)PutDeleteIfVersion(ctx context.Context, keyers []ds.Keyer, src interface{}, versions []int64, delKeyers []ds.Keyer, delVersions []int64) ([]ds.Keyer, error) {
+	if p.before != nil && len(delKeyers) > 0 {
+		before := p.before
+		p.before = nil
+		before(delKeyers)
+	}
+	return p.MemoryDSProvider.PutDeleteIfVersion(ctx, keyers, src, versions, delKeyers, delVersions)
+}
+
+// A bridged flight is updated just before it would be folded in & deleted; the update should
+// make the write fail and get retried, rather than be lost.
+func TestBridgedFlightConflict(t *testing.T) {
+	p := &deleteInterloper{MemoryDSProvider: localds.NewMemoryDSProvider()}
+	db := New(context.Background(), p)
+
+	p.before = func(delKeyers []ds.Keyer) {
+		f,err := db.LookupKey(delKeyers[0])
+		if err != nil { t.Fatal(err) }
+		f.SetTag("INTERLOPER")
+		if err := db.PersistFlightIfUnchanged(f); err != nil { t.Error(err) }
+	}
+
+	frags := []fdb.TrackFragment{}
+	if err := json.NewDecoder(strings.NewReader(MisorderedFragsJSON)).Decode(&frags); err != nil {
+		t.Fatal(err)
+	}
+	for _,frag := range frags {
+		if err := db.AddTrackFragment(&frag, nil, nil, map[string]time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p.before != nil {
+		t.Fatalf("no bridging write happened")
+	}
+
+	idspec,_ := fdb.NewIdSpec("A5BB1B@1483403847:1483407465")
+	results,err := db.LookupAll(db.NewQuery().ByIdSpec(idspec))
+	if err != nil { t.Fatal(err) }
+	if len(results) != 1 {
+		t.Fatalf("expected a single flight, found %d", len(results))
+	}
+	if !results[0].HasTag("INTERLOPER") {
+		t.Errorf("the interloper's update to the bridged flight was lost")
+	}
+}
+
+// Another writer creates the same new flight while the batch is in progress; the batch should
+// notice, and merge into it rather than overwrite it.
+func TestAddTrackFragmentsNewFlightConflict(t *testing.T) {
+	p := &interloper{MemoryDSProvider: localds.NewMemoryDSProvider()}
+	db := New(context.Background(), p)
+	s := time.Date(2017, 1, 3, 1, 0, 0, 0, time.UTC)
+
+	other := testFrag("A00003", s, 0, 5)
+	p.before = func() {
+		if err := db.AddTrackFragment(&other, nil, nil, map[string]time.Time{}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	frag := testFrag("A00003", s, 0, 10)
+	outcomes,err := db.AddTrackFragments([]*fdb.TrackFragment{&frag}, nil, nil, map[string]time.Time{})
+	if err != nil { t.Fatal(err) }
+	if outcomes[0].Result != FragExtended {
+		t.Errorf("expected the retry to extend the other writer's flight, got %s", outcomes[0])
+	}
+
+	results,err := db.LookupAll(db.NewQuery().ByIcaoId(adsb.IcaoId("A00003")))
+	if err != nil { t.Fatal(err) }
+	if len(results) != 1 || len(results[0].AnyTrack()) != 15 {
+		t.Errorf("expected one flight with all 15 points, found %d flights: %v", len(results), results)
+	}
+}
+
+func TestAddTrackFragmentGivesUp(t *testing.T) {
+	defer func(d time.Duration) { AddTrackFragmentBackoff = d }(AddTrackFragmentBackoff)
+	AddTrackFragmentBackoff = time.Millisecond
+
+	db := New(context.Background(), alwaysConflicts{localds.NewMemoryDSProvider()})
+	frag := fdb.TrackFragment{
+		IcaoId: adsb.IcaoId("A12345"),
+		DataSystem: fdb.DSADSB,
+		Track: fdb.Track{{TimestampUTC: time.Now(), Latlong: geo.Latlong{Lat: 37, Long: -122}}},
+	}
+
+	err := db.AddTrackFragment(&frag, nil, nil, map[string]time.Time{})
+	if !errors.Is(err, fdb.ErrVersionConflict) {
+		t.Errorf("expected a version conflict, got %v", err)
+	} else if !strings.Contains(err.Error(), "gave up") {
+		t.Errorf("error didn't say it gave up: %v", err)
+	}
+
+	// The batch version shouldn't swallow it
+	outcomes,err := db.AddTrackFragments([]*fdb.TrackFragment{&frag}, nil, nil, map[string]time.Time{})
+	if !errors.Is(err, fdb.ErrVersionConflict) {
+		t.Errorf("expected AddTrackFragments to return the version conflict, got %v", err)
+	}
+	if outcomes[0].Result != FragRejected {
+		t.Errorf("expected the frag to be rejected, got %s", outcomes[0])
+	}
 }
 
 var (
@@ -17232,5 +17488,3 @@ var (
 ]
 `
 )
-
-*/
@@ -0,0 +1,287 @@
+package fgae
+
+import(
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skypies/adsb"
+	"github.com/skypies/util/gcp/ds"
+
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/ref"
+)
+
+// {{{ FragResult, FragOutcome
+
+type FragResult int
+const(
+	FragExtended  FragResult = iota // Merged into an existing flight
+	FragNewFlight                   // Started a new flight
+	FragRejected                    // Not stored; see the Reason
+)
+
+func (r FragResult)String() string {
+	switch r {
+	case FragExtended:  return "extended"
+	case FragNewFlight: return "newflight"
+	case FragRejected:  return "rejected"
+	default:            return fmt.Sprintf("FragResult(%d)", int(r))
+	}
+}
+
+// FragOutcome says what happened to a TrackFragment.
+type FragOutcome struct {
+	Result FragResult
+	Reason string // Why it was rejected, or why it started a new flight
+}
+
+func (o FragOutcome)String() string {
+	if o.Reason == "" { return o.Result.String() }
+	return fmt.Sprintf("%s (%s)", o.Result, o.Reason)
+}
+
+// }}}
+
+// {{{ AddTrackFragments
+
+// How many LookupMostRecent queries AddTrackFragments will run at once
+var MaxConcurrentFragmentLookups = 8
+
+// Datastore won't accept more than this many entities in a single PutMulti
+const kMaxPutMulti = 500
+
+// AddTrackFragments is the batch version of AddTrackFragment. The fragments are grouped by
+// IcaoId, and there is one LookupMostRecent query per IcaoId, rather than per fragment. Each
+// IcaoId's fragments are applied in time order, and all the modified flights are written back
+// in a few big batches. An outcome is returned for each fragment, in the same order as frags.
+// The perf timings cover the whole batch (the 03 & 04 timings are from the last fragment
+// merged).
+//
+// The writes are conditional on nobody else having written (or, for new flights, created) any
+// of the flights in the meantime. If someone has, that IcaoId's fragments are retried one at a
+// time via AddTrackFragment.
+//
+// The error is for things that sank the whole batch, or for retried fragments that still
+// couldn't be stored (e.g. because AddTrackFragment gave up); in the latter case, the other
+// fragments' outcomes still stand.
+func (db *FlightDB)AddTrackFragments(frags []*fdb.TrackFragment, airframes *ref.AirframeCache, schedules *ref.ScheduleCache, perf map[string]time.Time) ([]FragOutcome, error) {
+	perf["01_start"] = time.Now()
+	outcomes := make([]FragOutcome, len(frags))
+
+	// Group the fragment indices by IcaoId, in time order
+	icaoIds := []adsb.IcaoId{}
+	groups := map[adsb.IcaoId][]int{}
+	for i,frag := range frags {
+		if reason := rejectFragment(frag); reason != "" {
+			outcomes[i] = FragOutcome{Result:FragRejected, Reason:reason}
+			continue
+		}
+		if _,exists := groups[frag.IcaoId]; !exists {
+			icaoIds = append(icaoIds, frag.IcaoId)
+		}
+		groups[frag.IcaoId] = append(groups[frag.IcaoId], i)
+	}
+	for _,idxs := range groups {
+		sort.SliceStable(idxs, func(i,j int) bool {
+			return frags[idxs[i]].Track[0].TimestampUTC.Before(frags[idxs[j]].Track[0].TimestampUTC)
+		})
+	}
+
+	current,lookupErrs := db.lookupMostRecentFlights(icaoIds)
+	perf["02_mostrecent"] = time.Now()
+
+	// Apply the fragments. Each IcaoId may end up touching a few flights, if some of its
+	// fragments weren't plausible contributions.
+	writes := []*icaoWrite{}
+	for _,icaoId := range icaoIds {
+		if err := lookupErrs[icaoId]; err != nil {
+			for _,i := range groups[icaoId] {
+				outcomes[i] = FragOutcome{Result:FragRejected, Reason:err.Error()}
+			}
+			continue
+		}
+
+		w := icaoWrite{IcaoId:icaoId}
+		f := current[icaoId]
+		for _,i := range groups[icaoId] {
+			fragCopy := *frags[i]
+			fragCopy.Track = append(fdb.Track{}, frags[i].Track...)
+
+			var newF *fdb.Flight
+			newF,outcomes[i] = db.mergeFragment(f, &fragCopy, airframes, perf)
+			if newF != f || len(w.Flights) == 0 {
+				w.Flights = append(w.Flights, newF)
+			}
+			f = newF
+		}
+		writes = append(writes, &w)
+	}
+	perf["05_waypoints"] = time.Now()
+
+	// Anyone who loses a race goes down the slow path
+	var retryErr error
+	nRetryErrs := 0
+	retry := func(w *icaoWrite) {
+		db.Debugf("* [%s] AddTrackFragments conflict; retrying singly", w.IcaoId)
+		for _,i := range groups[w.IcaoId] {
+			var err error
+			outcomes[i],err = db.addTrackFragmentWithRetries(frags[i], airframes, schedules,
+				map[string]time.Time{})
+			if err != nil {
+				if retryErr == nil { retryErr = err }
+				nRetryErrs++
+			}
+		}
+	}
+	reject := func(ws []*icaoWrite, err error) {
+		for _,w := range ws {
+			for _,i := range groups[w.IcaoId] {
+				outcomes[i] = FragOutcome{Result:FragRejected, Reason:err.Error()}
+			}
+		}
+	}
+
+	ready := []*icaoWrite{}
+	for _,w := range writes {
+		if err := db.prepareIcaoWrite(w); err != nil {
+			reject([]*icaoWrite{w}, err)
+		} else {
+			ready = append(ready, w)
+		}
+	}
+
+	// If a batch conflicts, we don't know which IcaoId did it, so write them one by one
+	batches := batchIcaoWrites(ready, kMaxPutMulti)
+	for b,batch := range batches {
+		err := db.putIcaoWrites(batch)
+		if errors.Is(err, fdb.ErrVersionConflict) {
+			for _,w := range batch {
+				if err := db.putIcaoWrites([]*icaoWrite{w}); errors.Is(err, fdb.ErrVersionConflict) {
+					retry(w)
+				} else if err != nil {
+					reject([]*icaoWrite{w}, fmt.Errorf("AddTrackFragments: %v", err))
+				}
+			}
+
+		} else if err != nil {
+			err = fmt.Errorf("AddTrackFragments: %v", err)
+			for _,unwritten := range batches[b:] {
+				reject(unwritten, err)
+			}
+			perf["06_persist"] = time.Now()
+			return outcomes, err
+		}
+	}
+	perf["06_persist"] = time.Now()
+
+	if retryErr != nil {
+		return outcomes, fmt.Errorf("AddTrackFragments: %d retried fragments not stored, first: %w",
+			nRetryErrs, retryErr)
+	}
+	return outcomes, nil
+}
+
+// }}}
+// {{{ icaoWrite
+
+// The flights an IcaoId's fragments went into; these are written together, or not at all.
+type icaoWrite struct {
+	IcaoId    adsb.IcaoId
+	Flights   []*fdb.Flight
+	Keyers    []ds.Keyer
+	Blobs     []*fdb.IndexedFlightBlob
+	Versions  []int64 // What each flight's version should be in the DB, for the write to go ahead
+}
+
+func (db *FlightDB)prepareIcaoWrite(w *icaoWrite) error {
+	for _,f := range w.Flights {
+		blob,err := f.ToBlob()
+		if err != nil { return err }
+		keyer,err := db.prepareBlob(f, blob)
+		if err != nil { return err }
+		w.Keyers, w.Blobs = append(w.Keyers, keyer), append(w.Blobs, blob)
+		w.Versions = append(w.Versions, storedVersion(f))
+	}
+	return nil
+}
+
+// Splits the writes into batches of at most max flights, keeping each IcaoId's flights together.
+func batchIcaoWrites(ws []*icaoWrite, max int) [][]*icaoWrite {
+	batches := [][]*icaoWrite{}
+	batch, n := []*icaoWrite{}, 0
+	for _,w := range ws {
+		if n > 0 && n + len(w.Flights) > max {
+			batches = append(batches, batch)
+			batch, n = []*icaoWrite{}, 0
+		}
+		batch, n = append(batch, w), n + len(w.Flights)
+	}
+	if n > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// One conditional write for the lot; then the same bookkeeping as PersistFlight does.
+func (db *FlightDB)putIcaoWrites(ws []*icaoWrite) error {
+	keyers,blobs,versions := []ds.Keyer{}, []*fdb.IndexedFlightBlob{}, []int64{}
+	for _,w := range ws {
+		keyers,blobs = append(keyers, w.Keyers...), append(blobs, w.Blobs...)
+		versions = append(versions, w.Versions...)
+	}
+
+	if err := db.putMultiIfVersion(keyers, blobs, versions); err != nil {
+		return err
+	}
+
+	for _,w := range ws {
+		for i,f := range w.Flights {
+			db.afterPersist(w.Keyers[i], f, w.Blobs[i])
+		}
+	}
+	return nil
+}
+
+// }}}
+// {{{ lookupMostRecentFlights
+
+// One query per IcaoId, a few at a time. Missing flights are nil.
+func (db *FlightDB)lookupMostRecentFlights(icaoIds []adsb.IcaoId) (map[adsb.IcaoId]*fdb.Flight, map[adsb.IcaoId]error) {
+	flights := map[adsb.IcaoId]*fdb.Flight{}
+	errs := map[adsb.IcaoId]error{}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan bool, MaxConcurrentFragmentLookups)
+	for _,icaoId := range icaoIds {
+		wg.Add(1)
+		sem <- true
+		go func(icaoId adsb.IcaoId) {
+			defer func() { <-sem; wg.Done() }()
+			f,err := db.LookupMostRecent(db.NewQuery().ByIcaoId(icaoId))
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[icaoId] = err
+			} else {
+				flights[icaoId] = f
+			}
+		}(icaoId)
+	}
+	wg.Wait()
+
+	return flights, errs
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
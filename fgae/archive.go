@@ -0,0 +1,379 @@
+package fgae
+
+// An archive is a self-describing dump of datastore entities, for backups and for moving data
+// between projects and backends. It is a magic string, followed by a stream of records; each
+// is a 4-byte big-endian length, and then a JSON-encoded ArchiveRecord. The entity is stored
+// as-is (so flights keep their index fields, as well as the blob), along with its key as a
+// portable path. The final record is the manifest, which is how a reader can tell the archive
+// wasn't truncated.
+
+import(
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"github.com/skypies/util/gcp/ds"
+	"github.com/skypies/util/singleton"
+
+	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/localds"
+)
+
+const(
+	kArchiveMagic = "FDBARCHIVE/1\n"
+	kArchiveManifestKind = "_manifest"
+	kArchiveMaxRecordSize = 64 * 1024 * 1024
+	kArchivePageSize = 100
+)
+
+// Same shape as ui.IdSpecSetStruct (which we can't import from here)
+type idSpecSetEntity struct {
+	IdSpecStrings []string `datastore:",noindex"`
+}
+
+// The kinds that can be archived, and the structs they are loaded into
+var archiveKinds = map[string]reflect.Type{
+	kFlightKind:        reflect.TypeOf(fdb.IndexedFlightBlob{}),
+	kRestrictorSetKind: reflect.TypeOf(fdb.IndexedRestrictorSetBlob{}),
+	"IdSpecSet":        reflect.TypeOf(idSpecSetEntity{}),
+	"Singleton":        reflect.TypeOf(singleton.Singleton{}), // airframes, schedcache, etc
+}
+
+// ArchiveKinds lists the kinds that ExportKind and ImportArchive know how to handle.
+func ArchiveKinds() []string {
+	return []string{kFlightKind, kRestrictorSetKind, "IdSpecSet", "Singleton"}
+}
+
+type ArchiveKeyElem struct {
+	Kind  string
+	Name  string `json:",omitempty"`
+	ID    int64  `json:",omitempty"`
+}
+
+type ArchiveRecord struct {
+	Kind       string
+	Key        []ArchiveKeyElem // Root first; empty if the key type wasn't known ...
+	EncodedKey string           // ... in which case, this may still work in a similar provider
+	Entity     json.RawMessage
+}
+
+type ArchiveManifest struct {
+	Created  time.Time
+	Source   string         // The type of datastore provider it came from
+	Queries  []string       // What was exported
+	Counts   map[string]int // How many entities of each kind
+}
+
+func (m ArchiveManifest)String() string {
+	return fmt.Sprintf("archive from %s, created %s; %v; %v", m.Source,
+		m.Created.Format("2006/01/02 15:04:05 MST"), m.Counts, m.Queries)
+}
+
+// {{{ archiveKeyPath, keyFromArchivePath
+
+func archiveKeyPath(keyer ds.Keyer) []ArchiveKeyElem {
+	path := []ArchiveKeyElem{}
+	switch k := keyer.(type) {
+	case *localds.Key:
+		for ; k != nil; k = k.Parent {
+			path = append([]ArchiveKeyElem{{Kind:k.Kind, Name:k.Name, ID:k.ID}}, path...)
+		}
+	case *datastore.Key:
+		for ; k != nil; k = k.Parent {
+			path = append([]ArchiveKeyElem{{Kind:k.Kind, Name:k.Name, ID:k.ID}}, path...)
+		}
+	default:
+		return nil
+	}
+	return path
+}
+
+// Rebuilds the key in the target provider; incomplete if the record had no usable key.
+func (db *FlightDB)keyFromArchiveRecord(rec *ArchiveRecord) ds.Keyer {
+	p,ctx := db.Backend, db.Ctx()
+	if len(rec.Key) == 0 {
+		if keyer,err := p.DecodeKey(rec.EncodedKey); rec.EncodedKey != "" && err == nil {
+			return keyer
+		}
+		return p.NewIncompleteKey(ctx, rec.Kind, nil)
+	}
+
+	var keyer ds.Keyer
+	for _,elem := range rec.Key {
+		if elem.Name != "" {
+			keyer = p.NewNameKey(ctx, elem.Kind, elem.Name, keyer)
+		} else if elem.ID != 0 {
+			keyer = p.NewIDKey(ctx, elem.Kind, elem.ID, keyer)
+		} else {
+			keyer = p.NewIncompleteKey(ctx, elem.Kind, keyer)
+		}
+	}
+	return keyer
+}
+
+// }}}
+// {{{ ArchiveWriter
+
+type ArchiveWriter struct {
+	w         *bufio.Writer
+	Manifest  ArchiveManifest
+}
+
+func NewArchiveWriter(w io.Writer, source string) (*ArchiveWriter, error) {
+	aw := ArchiveWriter{
+		w: bufio.NewWriter(w),
+		Manifest: ArchiveManifest{Created:time.Now(), Source:source, Counts:map[string]int{}},
+	}
+	if _,err := aw.w.WriteString(kArchiveMagic); err != nil { return nil, err }
+	return &aw, nil
+}
+
+func (aw *ArchiveWriter)writeRecord(rec ArchiveRecord) error {
+	b,err := json.Marshal(rec)
+	if err != nil { return err }
+
+	var lenBytes [4]byte
+	binary.BigEndian.PutUint32(lenBytes[:], uint32(len(b)))
+	if _,err := aw.w.Write(lenBytes[:]); err != nil { return err }
+	_,err = aw.w.Write(b)
+	return err
+}
+
+// Write adds an entity to the archive.
+func (aw *ArchiveWriter)Write(kind string, keyer ds.Keyer, entity interface{}) error {
+	b,err := json.Marshal(entity)
+	if err != nil { return fmt.Errorf("archive %s: %v", kind, err) }
+
+	rec := ArchiveRecord{Kind:kind, Key:archiveKeyPath(keyer), Entity:b}
+	if rec.Key == nil && keyer != nil {
+		rec.EncodedKey = keyer.Encode()
+	}
+	if err := aw.writeRecord(rec); err != nil { return err }
+
+	aw.Manifest.Counts[kind]++
+	return nil
+}
+
+// Close writes the manifest, and flushes; it doesn't close the underlying writer.
+func (aw *ArchiveWriter)Close() error {
+	b,err := json.Marshal(aw.Manifest)
+	if err != nil { return err }
+	if err := aw.writeRecord(ArchiveRecord{Kind:kArchiveManifestKind, Entity:b}); err != nil {
+		return err
+	}
+	return aw.w.Flush()
+}
+
+// }}}
+// {{{ ArchiveReader
+
+type ArchiveReader struct {
+	r         *bufio.Reader
+	Manifest  *ArchiveManifest // Populated once the end of the archive is reached
+}
+
+func NewArchiveReader(r io.Reader) (*ArchiveReader, error) {
+	ar := ArchiveReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(kArchiveMagic))
+	if _,err := io.ReadFull(ar.r, magic); err != nil || string(magic) != kArchiveMagic {
+		return nil, fmt.Errorf("not an flightdb archive (%q, %v)", magic, err)
+	}
+	return &ar, nil
+}
+
+// Next returns the next entity's record, or io.EOF after the manifest has been read.
+func (ar *ArchiveReader)Next() (*ArchiveRecord, error) {
+	if ar.Manifest != nil { return nil, io.EOF }
+
+	var lenBytes [4]byte
+	if _,err := io.ReadFull(ar.r, lenBytes[:]); err == io.EOF {
+		return nil, fmt.Errorf("archive is truncated (no manifest)")
+	} else if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBytes[:])
+	if n > kArchiveMaxRecordSize {
+		return nil, fmt.Errorf("archive record too big (%d bytes); corrupt ?", n)
+	}
+
+	b := make([]byte, n)
+	if _,err := io.ReadFull(ar.r, b); err != nil {
+		return nil, fmt.Errorf("archive is truncated: %v", err)
+	}
+	rec := ArchiveRecord{}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, fmt.Errorf("bad archive record: %v", err)
+	}
+
+	if rec.Kind == kArchiveManifestKind {
+		m := ArchiveManifest{}
+		if err := json.Unmarshal(rec.Entity, &m); err != nil {
+			return nil, fmt.Errorf("bad archive manifest: %v", err)
+		}
+		ar.Manifest = &m
+		return nil, io.EOF
+	}
+
+	return &rec, nil
+}
+
+// }}}
+
+// {{{ db.ExportFlights
+
+// ExportFlights writes the flights that match the query into the archive. Any externalized
+// blobs are pulled back in, so that the archive is self-contained. The keys are fetched a page
+// at a time, as the export gets to them.
+func (db *FlightDB)ExportFlights(aw *ArchiveWriter, fq *FQuery) (int, error) {
+	ks,err := db.newKeyStream(fq)
+	if err != nil { return 0, fmt.Errorf("ExportFlights: %v", err) }
+
+	// Multi-valued inequality filters (e.g. Timeslots) can return an entity more than once
+	seen := map[string]bool{}
+
+	n := 0
+	for i:=0; ; i+=kArchivePageSize {
+		keyers,err := ks.get(i, kArchivePageSize)
+		if err != nil {
+			return n, fmt.Errorf("ExportFlights: %v", err)
+		} else if len(keyers) == 0 {
+			break
+		}
+
+		uniq := []ds.Keyer{}
+		for _,keyer := range keyers {
+			if !seen[keyer.Encode()] { uniq = append(uniq, keyer) }
+			seen[keyer.Encode()] = true
+		}
+
+		blobs := make([]fdb.IndexedFlightBlob, len(uniq))
+		if err := db.Backend.GetMulti(db.Ctx(), uniq, blobs); err != nil {
+			return n, fmt.Errorf("ExportFlights: %v", err)
+		}
+		for j := range blobs {
+			if err := blobs[j].Internalize(db.Ctx(), fdb.DefaultBlobStore); err != nil {
+				return n, fmt.Errorf("ExportFlights: %v", err)
+			}
+			blobs[j].BlobRef = ""
+			if err := aw.Write(kFlightKind, uniq[j], blobs[j]); err != nil {
+				return n, fmt.Errorf("ExportFlights: %v", err)
+			}
+			n++
+		}
+	}
+
+	aw.Manifest.Queries = append(aw.Manifest.Queries, fq.String())
+	return n, nil
+}
+
+// }}}
+// {{{ db.ExportKind
+
+// ExportKind writes every entity of the kind into the archive; it is for the small kinds
+// (restrictor sets, idspec sets, singletons). Use ExportFlights for flights.
+func (db *FlightDB)ExportKind(aw *ArchiveWriter, kind string) (int, error) {
+	t,exists := archiveKinds[kind]
+	if !exists || kind == kFlightKind {
+		return 0, fmt.Errorf("ExportKind: can't export kind '%s'", kind)
+	}
+
+	dst := reflect.New(reflect.SliceOf(t))
+	keyers,err := db.Backend.GetAll(db.Ctx(), ds.NewQuery(kind), dst.Interface())
+	if err != nil { return 0, fmt.Errorf("ExportKind %s: %v", kind, err) }
+
+	entities := dst.Elem()
+	for i,keyer := range keyers {
+		if err := aw.Write(kind, keyer, entities.Index(i).Interface()); err != nil {
+			return i, fmt.Errorf("ExportKind %s: %v", kind, err)
+		}
+	}
+
+	aw.Manifest.Queries = append(aw.Manifest.Queries, "kind="+kind)
+	return len(keyers), nil
+}
+
+// }}}
+// {{{ db.ImportArchive
+
+// ImportArchive loads every entity in the archive into the datastore, keeping the original
+// keys where it can (so URLs containing flight & idspecset keys keep working); entities that
+// already exist are overwritten. Flights are written the way PersistFlight would write them, so
+// the condensed days and change hooks hear about them. It returns the counts by kind, and an
+// error if the counts don't match the archive's manifest.
+func (db *FlightDB)ImportArchive(ar *ArchiveReader) (map[string]int, error) {
+	counts := map[string]int{}
+	for {
+		rec,err := ar.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return counts, fmt.Errorf("ImportArchive: %v", err)
+		}
+
+		t,exists := archiveKinds[rec.Kind]
+		if !exists {
+			return counts, fmt.Errorf("ImportArchive: unknown kind '%s'", rec.Kind)
+		}
+		entity := reflect.New(t).Interface()
+		if err := json.Unmarshal(rec.Entity, entity); err != nil {
+			return counts, fmt.Errorf("ImportArchive: %s: %v", rec.Kind, err)
+		}
+
+		keyer := db.keyFromArchiveRecord(rec)
+		if blob,ok := entity.(*fdb.IndexedFlightBlob); ok {
+			err = db.importFlight(keyer, blob)
+		} else {
+			_,err = db.Backend.Put(db.Ctx(), keyer, entity)
+		}
+		if err != nil {
+			return counts, fmt.Errorf("ImportArchive: %s: %w", rec.Kind, err)
+		}
+		counts[rec.Kind]++
+	}
+
+	for kind,n := range ar.Manifest.Counts {
+		if counts[kind] != n {
+			return counts, fmt.Errorf("ImportArchive: manifest has %d %s, but loaded %d", n, kind,
+				counts[kind])
+		}
+	}
+	return counts, nil
+}
+
+// importFlight writes the archived blob as is, replacing whatever is stored under the key. The
+// write is conditional on what was there, so that the hooks are told the right before & after.
+func (db *FlightDB)importFlight(keyer ds.Keyer, blob *fdb.IndexedFlightBlob) error {
+	f,err := blob.ToFlight(keyer.Encode())
+	if err != nil { return err }
+
+	existing := fdb.IndexedFlightBlob{}
+	if err := db.Backend.Get(db.Ctx(), keyer, &existing); err == nil {
+		f.SetVersion(existing.Version)
+		f.SetStoredIndex(existing.IndexSummary())
+		f.SetBlobRef(existing.BlobRef)
+	} else if err == ds.ErrNoSuchEntity {
+		f.SetVersion(-1)
+		f.SetStoredIndex(nil)
+		f.SetBlobRef("")
+	} else {
+		return err
+	}
+
+	return db.persistBlob(f, blob, true)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
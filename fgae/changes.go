@@ -0,0 +1,160 @@
+package fgae
+
+// A change feed for flights. Every time a flight is persisted or deleted, the FlightDB's
+// ChangeHooks get told about it, with how the flight was indexed before and after, so that
+// downstream consumers don't need to keep re-scanning by date. Hooks run synchronously, after
+// the write has happened; errors are logged, but don't fail the write.
+
+import(
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/skypies/util/gcp/ds"
+
+	fdb "github.com/skypies/flightdb"
+)
+
+type FlightChange struct {
+	Time     time.Time
+	Key      string            // The encoded datastore key of the flight
+	Deleted  bool
+	Version  int64             // After the change; zero for deletes
+	Before  *fdb.IndexSummary  // Nil for new flights (or ones not read from the DB before writing)
+	After   *fdb.IndexSummary  // Nil for deletes
+}
+
+func (c FlightChange)String() string {
+	s := c.After
+	if c.Deleted { s = c.Before }
+	op := "persist"
+	if c.Deleted { op = "delete" }
+	if s == nil { return fmt.Sprintf("%s %s", op, c.Key) }
+	return fmt.Sprintf("%s %s (%s/%s, v%d) %v", op, c.Key, s.Icao24, s.Ident, c.Version, s.Tags)
+}
+
+type ChangeHook interface {
+	FlightChanged(ctx context.Context, c FlightChange) error
+}
+
+// These get copied into every FlightDB made by New(), so register hooks here at startup.
+var DefaultChangeHooks = []ChangeHook{}
+
+func (db *FlightDB)AddChangeHook(h ChangeHook) { db.ChangeHooks = append(db.ChangeHooks, h) }
+
+func (db *FlightDB)notifyChange(c FlightChange) {
+	if c.Time.IsZero() { c.Time = time.Now() }
+	for _,h := range db.ChangeHooks {
+		if err := h.FlightChanged(db.Ctx(), c); err != nil {
+			db.Warningf("change hook %T, %s: %v", h, c, err)
+		}
+	}
+}
+
+// Looks up how each flight is indexed, and where its payload is if it was externalized; nil
+// (and "") for ones that can't be found.
+func (db *FlightDB)lookupStored(keyers []ds.Keyer) ([]*fdb.IndexSummary, []string) {
+	summaries,refs := make([]*fdb.IndexSummary, len(keyers)), make([]string, len(keyers))
+	for i,keyer := range keyers {
+		blob := fdb.IndexedFlightBlob{}
+		if err := db.Backend.Get(db.Ctx(), keyer, &blob); err == nil {
+			summaries[i],refs[i] = blob.IndexSummary(), blob.BlobRef
+		}
+	}
+	return summaries, refs
+}
+
+// {{{ ChannelHook
+
+// ChannelHook sends each change down a channel, for consumers in the same process. If the
+// channel is full, the change is dropped (and counted) rather than holding up the write.
+type ChannelHook struct {
+	C        chan FlightChange
+	mu       sync.Mutex
+	dropped  int
+}
+
+func NewChannelHook(bufferSize int) *ChannelHook {
+	return &ChannelHook{C: make(chan FlightChange, bufferSize)}
+}
+
+func (h *ChannelHook)FlightChanged(ctx context.Context, c FlightChange) error {
+	select {
+	case h.C <- c:
+		return nil
+	default:
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.dropped++
+		return fmt.Errorf("channel full, change dropped (%d so far)", h.dropped)
+	}
+}
+
+func (h *ChannelHook)Dropped() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dropped
+}
+
+// }}}
+// {{{ JournalHook
+
+// JournalHook appends each change to a local file, as a line of JSON. ReadJournal reads them
+// back.
+type JournalHook struct {
+	mu    sync.Mutex
+	file  *os.File
+}
+
+func NewJournalHook(filename string) (*JournalHook, error) {
+	file,err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil { return nil, fmt.Errorf("NewJournalHook: %v", err) }
+	return &JournalHook{file:file}, nil
+}
+
+func (h *JournalHook)FlightChanged(ctx context.Context, c FlightChange) error {
+	line,err := json.Marshal(c)
+	if err != nil { return err }
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_,err = h.file.Write(append(line, '\n')) // A single write, so lines don't get interleaved
+	return err
+}
+
+func (h *JournalHook)Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.file.Close()
+}
+
+// ReadJournal calls the func on each change in the journal, in order. If the func returns an
+// error, reading stops and the error is returned.
+func ReadJournal(r io.Reader, f func(FlightChange) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // Some flights have a lot of timeslots
+	for i:=1; scanner.Scan(); i++ {
+		c := FlightChange{}
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return fmt.Errorf("ReadJournal, line %d: %v", i, err)
+		}
+		if err := f(c); err != nil { return err }
+	}
+	return scanner.Err()
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,184 @@
+package fgae
+
+import(
+	"fmt"
+
+	"golang.org/x/net/context"
+	"cloud.google.com/go/datastore"
+	"google.golang.org/api/iterator"
+
+	"github.com/skypies/util/gcp/ds"
+
+	fdb "github.com/skypies/flightdb"
+)
+
+// TxCloudDSProvider is a ds.CloudDSProvider that is also a VersionedProvider, using datastore
+// transactions. The embedded provider doesn't expose its client, so we open another.
+//
+// Each provider holds open gRPC connections, so make one per process (with a context that
+// outlives every request, e.g. context.Background()), and share it; every method takes the
+// request's context.
+type TxCloudDSProvider struct {
+	*ds.CloudDSProvider
+	client  *datastore.Client
+}
+
+func NewTxCloudDSProvider(ctx context.Context, project string) (*TxCloudDSProvider, error) {
+	p,err := ds.NewCloudDSProvider(ctx, project)
+	if err != nil { return nil, err }
+	client,err := datastore.NewClient(ctx, project)
+	if err != nil { return nil, err }
+	return &TxCloudDSProvider{CloudDSProvider: p, client: client}, nil
+}
+
+// Close closes our own client; the embedded provider has no way to close its one.
+func (p *TxCloudDSProvider)Close() error {
+	return p.client.Close()
+}
+
+// PutIfVersion reads the entity's Version, and writes src, inside a single transaction; so
+// unlike a Get followed by a Put, there is no window for another writer to sneak in.
+func (p *TxCloudDSProvider)PutIfVersion(ctx context.Context, keyer ds.Keyer, src interface{}, version int64) (ds.Keyer, error) {
+	_,err := p.PutMultiIfVersion(ctx, []ds.Keyer{keyer}, []interface{}{src}, []int64{version})
+	if err != nil { return nil, err }
+	return keyer, nil
+}
+
+// PutMultiIfVersion does the lot in one transaction; if any version doesn't match, nothing is
+// written. Transactions are limited to 500 entities.
+func (p *TxCloudDSProvider)PutMultiIfVersion(ctx context.Context, keyers []ds.Keyer, src interface{}, versions []int64) ([]ds.Keyer, error) {
+	return p.PutDeleteIfVersion(ctx, keyers, src, versions, nil, nil)
+}
+
+// PutDeleteIfVersion is PutMultiIfVersion, that also deletes delKeyers (which must be at
+// delVersions) in the same transaction.
+func (p *TxCloudDSProvider)PutDeleteIfVersion(ctx context.Context, keyers []ds.Keyer, src interface{}, versions []int64, delKeyers []ds.Keyer, delVersions []int64) ([]ds.Keyer, error) {
+	if len(versions) != len(keyers) || len(delVersions) != len(delKeyers) {
+		return nil, fmt.Errorf("PutDeleteIfVersion{cloud}: need a version for each key")
+	}
+	keys,err := completeKeys(keyers)
+	if err != nil { return nil, fmt.Errorf("PutDeleteIfVersion{cloud}: %v", err) }
+	delKeys,err := completeKeys(delKeyers)
+	if err != nil { return nil, fmt.Errorf("PutDeleteIfVersion{cloud}: %v", err) }
+
+	_,err = p.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		current,err := txVersions(tx, append(append([]*datastore.Key{}, keys...), delKeys...))
+		if err != nil { return err }
+		for i,v := range append(append([]int64{}, versions...), delVersions...) {
+			if current[i] != v { return fdb.ErrVersionConflict }
+		}
+		if len(keys) > 0 {
+			if _,err = tx.PutMulti(keys, src); err != nil { return err }
+		}
+		if len(delKeys) > 0 {
+			return tx.DeleteMulti(delKeys)
+		}
+		return nil
+	})
+	if err == datastore.ErrConcurrentTransaction {
+		return nil, fdb.ErrVersionConflict // Lost the race even after retries; caller should re-read
+	} else if err != nil {
+		return nil, err
+	}
+
+	return keyers, nil
+}
+
+func completeKeys(keyers []ds.Keyer) ([]*datastore.Key, error) {
+	keys := []*datastore.Key{}
+	for _,keyer := range keyers {
+		key := keyer.(*datastore.Key)
+		if key.Incomplete() { return nil, fmt.Errorf("need complete keys") }
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// The Version property of each stored entity, or -1 if there isn't one.
+func txVersions(tx *datastore.Transaction, keys []*datastore.Key) ([]int64, error) {
+	props := make([]datastore.PropertyList, len(keys))
+	errs := make(datastore.MultiError, len(keys))
+	if err := tx.GetMulti(keys, props); err != nil {
+		if me,ok := err.(datastore.MultiError); ok {
+			errs = me
+		} else {
+			return nil, err
+		}
+	}
+
+	versions := make([]int64, len(keys))
+	for i := range keys {
+		if errs[i] == datastore.ErrNoSuchEntity {
+			versions[i] = -1
+			continue
+		} else if errs[i] != nil {
+			return nil, errs[i]
+		}
+		for _,prop := range props[i] {
+			if v,ok := prop.Value.(int64); ok && prop.Name == "Version" { versions[i] = v }
+		}
+		// (Entities written before versions existed come out as zero)
+	}
+	return versions, nil
+}
+
+// GetMulti is the embedded provider's, except that if the only thing wrong is that some of the
+// entities are missing, the error is ds.ErrNoSuchEntity (as it is from the local providers),
+// rather than a datastore.MultiError; the missing ones are left as they were in dst.
+func (p *TxCloudDSProvider)GetMulti(ctx context.Context, keyers []ds.Keyer, dst interface{}) error {
+	err := p.CloudDSProvider.GetMulti(ctx, keyers, dst)
+	if me,ok := err.(datastore.MultiError); ok {
+		for _,e := range me {
+			if e != nil && e != datastore.ErrNoSuchEntity { return err }
+		}
+		return ds.ErrNoSuchEntity
+	}
+	return err
+}
+
+// GetKeysPage implements KeysPager, with real datastore cursors; so resuming a query doesn't
+// mean rerunning it from the start.
+func (p *TxCloudDSProvider)GetKeysPage(ctx context.Context, in *ds.Query, start string, n int) ([]ds.Keyer, string, error) {
+	q := datastore.NewQuery(in.Kind).KeysOnly()
+	if in.AncestorKeyer != nil { q = q.Ancestor(in.AncestorKeyer.(*datastore.Key)) }
+	for _,filter := range in.Filters {
+		q = q.Filter(filter.Field, filter.Value)
+	}
+	if in.OrderStr != "" { q = q.Order(in.OrderStr) }
+	if in.DistinctVals   { q = q.Distinct() }
+	if start != "" {
+		c,err := datastore.DecodeCursor(start)
+		if err != nil { return nil, "", fmt.Errorf("GetKeysPage{cloud}: %v", err) }
+		q = q.Start(c)
+	}
+	if n > 0 { q = q.Limit(n+1) } // One extra, to see if there are more
+
+	keyers := []ds.Keyer{}
+	it := p.client.Run(ctx, q)
+	for n <= 0 || len(keyers) < n {
+		key,err := it.Next(nil)
+		if err == iterator.Done {
+			return keyers, "", nil
+		} else if err != nil {
+			return nil, "", fmt.Errorf("GetKeysPage{cloud}: %v\nQuery: %s", err, in)
+		}
+		keyers = append(keyers, key)
+	}
+
+	next,err := it.Cursor()
+	if err != nil { return nil, "", fmt.Errorf("GetKeysPage{cloud}: %v", err) }
+	if _,err := it.Next(nil); err == iterator.Done {
+		return keyers, "", nil
+	} else if err != nil {
+		return nil, "", fmt.Errorf("GetKeysPage{cloud}: %v\nQuery: %s", err, in)
+	}
+	return keyers, next.String(), nil
+}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
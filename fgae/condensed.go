@@ -1,85 +1,560 @@
 package fgae
 
+// Condensed flights are served from materialized sets, one per (PDT) day. Each day is sharded
+// by the hour in which its flights start (or enter the day), so no one entity gets too big,
+// and patching a flight only rewrites its hour. A day's shards are built the first time
+// someone asks for it once the day is over (plus a cooling-off period); from then on, they are
+// patched whenever a flight that touches them is persisted or deleted; the patching is handed
+// to the FlightDB's CondensedDayPatcher, so it needn't hold up the write. Days that aren't over
+// yet are looked up directly each time.
+
 import(
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/skypies/util/date"
 	"github.com/skypies/util/gcp/ds"
-	sprovider "github.com/skypies/util/gcp/singleton"
-	"github.com/skypies/util/singleton"
+	"github.com/skypies/util/gcp/tasks"
 
 	fdb "github.com/skypies/flightdb"
 )
 
-// {{{ db.FetchCondensedFlights
+const kCondensedDayKind = "CondensedDay"
+const kMaxCondensedShardBytes = 950000
+
+// Days aren't materialized until they've been over for this long, so that the last flights of
+// the day have landed (and been persisted) first.
+var CondensedDayCoolOff = time.Hour * 2
+
+// A materialized hour of a day; Blob is a gzipped gob of map[string]fdb.CondensedFlight,
+// keyed by the encoded datastore key of each flight.
+type condensedShard struct {
+	Version     int64     // When it was written (in nanos); only ever goes up, even across rebuilds
+	LastUpdate  time.Time
+	Unbuilt     bool      // A placeholder, while someone builds the shard; there's no Blob yet
+	Blob        []byte    `datastore:",noindex"`
+}
+
+// CondensedFlightSet is what FetchCondensedFlightSet returns.
+type CondensedFlightSet struct {
+	Flights     []fdb.CondensedFlight
+	Generation  string // A hash of the materialized shards' versions; changes if any of them do
+	Live        bool   // Some days weren't over yet; their flights can change without a new generation
+}
+
+// {{{ db.FetchCondensedFlights, db.FetchCondensedFlightSet
 
 func (db FlightDB)FetchCondensedFlights(s,e time.Time, tags []string) ([]fdb.CondensedFlight,error,string) {
-	key := fmt.Sprintf("condensed-%d:%d-%v", s.Unix(), e.Unix(), tags)
-	str := fmt.Sprintf("FetchCondensedFlights\n* s: %s\n* e: %s\nt: %v\nk: %s\n\n", s, e, tags, key)
+	set,err,str := db.FetchCondensedFlightSet(s,e,tags)
+	if err != nil {
+		return []fdb.CondensedFlight{}, err, str
+	}
+	return set.Flights, nil, str
+}
+
+// FetchCondensedFlightSet stitches together the condensed flights from each day that overlaps
+// [s,e], and returns the ones that overlap [s,e] and have all the tags.
+func (db FlightDB)FetchCondensedFlightSet(s,e time.Time, tags []string) (*CondensedFlightSet,error,string) {
+	str := fmt.Sprintf("FetchCondensedFlightSet\n* s: %s\n* e: %s\nt: %v\n\n", s, e, tags)
+
+	set := CondensedFlightSet{Flights: []fdb.CondensedFlight{}}
+	generation := sha1.New()
+	seen := map[string]bool{}
+	for _,day := range condensedDaysFor(s,e) {
+		var cfs map[string]fdb.CondensedFlight
+		var err error
+		dayStr := condensedDayName(day)
+
+		if isCondensedDayLive(day) {
+			dayS,dayE := date.WindowForTime(day)
+			if cfs,err = db.condenseFlights(dayS, dayE, tags); err != nil { return nil, err, str }
+			set.Live = true
+			str += fmt.Sprintf("* %s: live, %d flights\n", dayStr, len(cfs))
+
+		} else {
+			var versions []string
+			if cfs,versions,err = db.materializedCondensedDay(day); err != nil { return nil, err, str }
+			if len(versions) == 0 {
+				set.Live = true // Too big to materialize
+			}
+			for _,v := range versions { fmt.Fprintf(generation, "%s\n", v) }
+			str += fmt.Sprintf("* %s: %d shards, %d flights\n", dayStr, len(versions), len(cfs))
+		}
+
+		for key,cf := range cfs {
+			if seen[key] || cf.End.Before(s) || cf.Start.After(e) || !condensedHasTags(cf, tags) {
+				continue
+			}
+			seen[key] = true
+			set.Flights = append(set.Flights, cf)
+		}
+	}
+	set.Generation = fmt.Sprintf("%x", generation.Sum(nil))
 
-	coolOff := time.Hour*2 // time.Hour*25 {  // I can't remember why it needed to be 25h ?
-	if time.Since(e) < coolOff {
-		return []fdb.CondensedFlight{}, fmt.Errorf("Can't condense; inside cooling period %v", coolOff), str
+	sort.Slice(set.Flights, func(i,j int) bool {
+		if !set.Flights[i].Start.Equal(set.Flights[j].Start) {
+			return set.Flights[i].Start.Before(set.Flights[j].Start)
+		}
+		return set.Flights[i].IdSpec < set.Flights[j].IdSpec
+	})
+	str += fmt.Sprintf("\n%d matches, generation %s (live: %v)\n", len(set.Flights), set.Generation,
+		set.Live)
+
+	return &set, nil, str
+}
+
+// Waypoint tags ("^EPICK") aren't in the condensed tags, so look them up separately
+func condensedHasTags(cf fdb.CondensedFlight, tags []string) bool {
+	have := map[string]bool{}
+	for _,tag := range cf.Tags { have[tag] = true }
+	for wp,_ := range cf.Waypoints { have[fdb.KWaypointTagPrefix + wp] = true }
+	for _,tag := range tags {
+		if !have[tag] { return false }
 	}
-	
-	cfs := []fdb.CondensedFlight{}
+	return true
+}
 
-	sp := sprovider.NewProvider(db.Backend)
-	sp.ErrIfNotFound = true // We care about this
+// }}}
 
-	// If we find something, return it; else carry on
-	if err := sp.ReadSingleton(db.Ctx(), key, nil, &cfs); err == nil {
-		str += fmt.Sprintf("found %d OK\n", len(cfs))
-		return cfs,nil,str
+// {{{ days & shards
 
-	} else if err != singleton.ErrNoSuchEntity {
-		return []fdb.CondensedFlight{}, fmt.Errorf("condense load: %v",err), str
+// The start (PDT midnight) of each day overlapping [s,e]
+func condensedDaysFor(s,e time.Time) []time.Time {
+	days := []time.Time{}
+	for day,_ := date.WindowForTime(date.InPdt(s)); !day.After(e); {
+		days = append(days, day)
+		_,end := date.WindowForTime(day)
+		day,_ = date.WindowForTime(end.Add(time.Hour)) // DST-proof
 	}
+	return days
+}
 
-	// OK, do it the hard way
-	cfs,err,fetchstr := fetchCondensedFlightsIndividually(db.Ctx(), db.Backend, s,e,tags);
-	str += "--\n" + fetchstr + "--\n"
-	if err != nil {
-		return []fdb.CondensedFlight{}, err, str
+func condensedDayName(day time.Time) string { return date.InPdt(day).Format("2006-01-02") }
+
+func isCondensedDayLive(day time.Time) bool {
+	_,e := date.WindowForTime(day)
+	return time.Since(e) < CondensedDayCoolOff
+}
+
+// How many hours the day has (23 or 25, on DST changes)
+func condensedDayHours(day time.Time) int {
+	s,e := date.WindowForTime(day)
+	return int(math.Ceil(e.Sub(s).Hours()))
+}
+
+// A condensedShardId names an hour of a day; e.g. "2017-04-01/07".
+type condensedShardId struct {
+	Day  time.Time
+	Hour int
+}
+
+func (id condensedShardId)String() string {
+	return fmt.Sprintf("%s/%02d", condensedDayName(id.Day), id.Hour)
+}
+
+func parseCondensedShardId(str string) (condensedShardId, error) {
+	bits := strings.Split(str, "/")
+	if len(bits) == 2 {
+		if t,err := time.ParseInLocation("2006-01-02", bits[0], date.InPdt(time.Now()).Location()); err == nil {
+			id := condensedShardId{}
+			id.Day,_ = date.WindowForTime(t)
+			if _,err := fmt.Sscanf(bits[1], "%d", &id.Hour); err == nil {
+				return id, nil
+			}
+		}
 	}
-	str += fmt.Sprintf("raw lookup found %d matches\n", len(cfs))
+	return condensedShardId{}, fmt.Errorf("bad condensed shard %q", str)
+}
 
-	if err := sp.WriteSingleton(db.Ctx(), key, nil, &cfs); err != nil {
-		return []fdb.CondensedFlight{}, fmt.Errorf("condense save: %v",err), str
+// The shard, in each day the timeslots touch, that a flight with them belongs in: the hour of
+// its first timeslot in that day.
+func condensedShardsForTimeslots(slots []time.Time) map[string]condensedShardId {
+	shards := map[string]condensedShardId{}
+	days := map[string]bool{}
+	sorted := append([]time.Time{}, slots...)
+	sort.Slice(sorted, func(i,j int) bool { return sorted[i].Before(sorted[j]) })
+
+	for _,slot := range sorted {
+		day,_ := date.WindowForTime(date.InPdt(slot))
+		if days[condensedDayName(day)] { continue }
+		days[condensedDayName(day)] = true
+
+		id := condensedShardId{Day:day, Hour:int(slot.Sub(day) / time.Hour)}
+		if id.Hour >= condensedDayHours(day) { id.Hour = condensedDayHours(day) - 1 }
+		shards[id.String()] = id
 	}
+	return shards
+}
 
-	return cfs, nil, str
+func (db *FlightDB)condensedShardKey(id condensedShardId) ds.Keyer {
+	return db.Backend.NewNameKey(db.Ctx(), kCondensedDayKind, id.String(), nil)
+}
+
+// A new version for a shard; it has to be bigger than the last one, even if the shard was
+// deleted since, so we go by the clock.
+func nextCondensedVersion(prev int64) int64 {
+	v := time.Now().UnixNano()
+	if v <= prev { v = prev + 1 }
+	return v
 }
 
 // }}}
+// {{{ db.materializedCondensedDay
+
+// Reads the day's shards, building and storing any that aren't there yet. Also returns the
+// name & version of each shard; these are empty if the day couldn't be materialized.
+func (db *FlightDB)materializedCondensedDay(day time.Time) (map[string]fdb.CondensedFlight, []string, error) {
+	ids := []condensedShardId{}
+	keyers := []ds.Keyer{}
+	for h:=0; h<condensedDayHours(day); h++ {
+		ids = append(ids, condensedShardId{Day:day, Hour:h})
+		keyers = append(keyers, db.condensedShardKey(ids[h]))
+	}
+
+	for i:=0; i<3; i++ {
+		shards := make([]condensedShard, len(keyers))
+		if err := db.getMultiAllowMissing(keyers, shards); err != nil {
+			return nil, nil, fmt.Errorf("condensed day %s: %v", condensedDayName(day), err)
+		}
+
+		missing := []int{}
+		for j,shard := range shards {
+			if shard.Version == 0 || shard.Unbuilt { missing = append(missing, j) }
+		}
+		if len(missing) == 0 {
+			cfs := map[string]fdb.CondensedFlight{}
+			versions := []string{}
+			for j,shard := range shards {
+				shardCfs,err := shard.flights()
+				if err != nil { return nil, nil, fmt.Errorf("condensed shard %s: %v", ids[j], err) }
+				for key,cf := range shardCfs { cfs[key] = cf }
+				versions = append(versions, fmt.Sprintf("%s:%d", ids[j], shard.Version))
+			}
+			return cfs, versions, nil
+		}
 
-// {{{ fetchCondensedFlightsIndividually
+		// Put placeholders in for the missing shards before we start building them; a flight
+		// persisted while we're building will be patched into the placeholder, bumping its
+		// version, so the write below fails rather than storing a shard that lacks the change.
+		claimKeyers,claims,claimVersions := []ds.Keyer{}, []*condensedShard{}, []int64{}
+		for _,j := range missing {
+			if shards[j].Unbuilt { continue } // Someone else's; ours now
+			shards[j] = condensedShard{Version:nextCondensedVersion(0), LastUpdate:time.Now(), Unbuilt:true}
+			claimKeyers = append(claimKeyers, keyers[j])
+			claims = append(claims, &shards[j])
+			claimVersions = append(claimVersions, -1)
+		}
+		if err := db.putCondensedShards(claimKeyers, claims, claimVersions); errors.Is(err, fdb.ErrVersionConflict) {
+			continue
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("condensed day %s: %v", condensedDayName(day), err)
+		}
 
-func fetchCondensedFlightsIndividually(ctx context.Context, p ds.DatastoreProvider, s,e time.Time, tags []string) ([]fdb.CondensedFlight,error,string) {
-	str := "# individual lookup\n"
+		// Build the whole day, and store the shards that were missing
+		s,e := date.WindowForTime(day)
+		cfs,byShard,err := db.condenseShards(s, e)
+		if err != nil { return nil, nil, err }
 
-	ret := []fdb.CondensedFlight{}
+		putKeyers,putShards,putVersions := []ds.Keyer{}, []*condensedShard{}, []int64{}
+		for _,j := range missing {
+			shard := condensedShard{Version:nextCondensedVersion(shards[j].Version), LastUpdate:time.Now()}
+			if err := shard.setFlights(byShard[ids[j].String()]); err != nil {
+				db.Warningf("condensed shard %s not stored: %v", ids[j], err)
+				return cfs, nil, nil
+			}
+			putKeyers = append(putKeyers, keyers[j])
+			putShards = append(putShards, &shard)
+			putVersions = append(putVersions, shards[j].Version)
+		}
 
-	q := QueryForTimeRange(tags, s, e)
-	it := NewFlightIterator(ctx, p, q)
-	i := 0
-	tStart := time.Now()
-	for it.Iterate(ctx) {
-		cf := it.Flight().Condense()
-		ret = append(ret, *cf)
-		if i<50 {
-			str += fmt.Sprintf("# [%3d] %s\n", i, cf)
+		err = db.putCondensedShards(putKeyers, putShards, putVersions)
+		if err != nil && !errors.Is(err, fdb.ErrVersionConflict) {
+			return nil, nil, fmt.Errorf("condensed day %s: %v", condensedDayName(day), err)
 		}
-		i++
+		// Go round again, to read what got stored (ours, or whoever beat us to it); or, if a
+		// flight changed while we were building, to build it again
+	}
+
+	return nil, nil, fmt.Errorf("condensed day %s: kept changing", condensedDayName(day))
+}
+
+// Looks up all the flights that overlap [s,e], and condenses them
+func (db *FlightDB)condenseFlights(s,e time.Time, tags []string) (map[string]fdb.CondensedFlight, error) {
+	ret := map[string]fdb.CondensedFlight{}
+
+	it := db.NewIterator(QueryForTimeRange(tags, s, e)).Prefetch(DefaultPrefetchWorkers)
+	defer it.Close()
+	for it.Iterate(db.Ctx()) {
+		f := it.Flight()
+		ret[f.GetDatastoreKey()] = *f.Condense()
 	}
 	if it.Err() != nil {
-		return ret,it.Err(),str
+		return nil, fmt.Errorf("condenseFlights: %v", it.Err())
+	}
+
+	return ret, nil
+}
+
+// As condenseFlights, for a whole day; also splits them up by shard.
+func (db *FlightDB)condenseShards(s,e time.Time) (map[string]fdb.CondensedFlight, map[string]map[string]fdb.CondensedFlight, error) {
+	all := map[string]fdb.CondensedFlight{}
+	byShard := map[string]map[string]fdb.CondensedFlight{}
+	dayName := condensedDayName(s)
+
+	it := db.NewIterator(QueryForTimeRange(nil, s, e)).Prefetch(DefaultPrefetchWorkers)
+	defer it.Close()
+	for it.Iterate(db.Ctx()) {
+		f := it.Flight()
+		key,cf := f.GetDatastoreKey(), *f.Condense()
+		all[key] = cf
+		for name,id := range condensedShardsForTimeslots(f.Timeslots()) {
+			if condensedDayName(id.Day) != dayName { continue }
+			if byShard[name] == nil { byShard[name] = map[string]fdb.CondensedFlight{} }
+			byShard[name][key] = cf
+		}
+	}
+	if it.Err() != nil {
+		return nil, nil, fmt.Errorf("condenseShards: %v", it.Err())
+	}
+
+	return all, byShard, nil
+}
+
+// GetMulti, where missing entities are left as zero values rather than being an error. (The
+// providers all say ds.ErrNoSuchEntity if some are missing; see TxCloudDSProvider.GetMulti.)
+func (db *FlightDB)getMultiAllowMissing(keyers []ds.Keyer, dst interface{}) error {
+	if err := db.Backend.GetMulti(db.Ctx(), keyers, dst); err != ds.ErrNoSuchEntity {
+		return err
+	}
+	return nil
+}
+
+// }}}
+// {{{ CondensedDayPatcher
+
+// A CondensedDayPatcher arranges for db.PatchCondensedDays to be called, with the shards that
+// a persisted (or deleted) flight touched, sometime after the write. If a FlightDB doesn't
+// have one, it patches them there and then.
+type CondensedDayPatcher interface {
+	PatchLater(ctx context.Context, key string, shards []string) error
+}
+
+// This gets copied into every FlightDB made by New(), so set it at startup.
+var DefaultCondensedDayPatcher CondensedDayPatcher
+
+// Where the backend (app/backend) runs its batch tasks, and where it handles the condensed day
+// patches; the frontend sends its patches there too.
+const(
+	BatchLocationID   = "us-central1" // "us-central" in appengine-land; cloud tasks needs the 1
+	BatchQueueName    = "batch"
+	CondensedPatchURL = "/batch/condensed/patch"
+)
+
+// TaskCondensedDayPatcher enqueues a task to do the patching; the handler at URL should pass
+// its "key" & "shard" params to db.PatchCondensedDays, and fail if it does, so it is retried.
+type TaskCondensedDayPatcher struct {
+	ProjectID, LocationID, QueueName string
+	URL                              string
+}
+
+func (p TaskCondensedDayPatcher)PatchLater(ctx context.Context, key string, shards []string) error {
+	client,err := tasks.GetClient(ctx)
+	if err != nil { return err }
+	params := url.Values{"key":{key}, "shard":shards}
+	_,err = tasks.SubmitAETask(ctx, client, p.ProjectID, p.LocationID, p.QueueName, 0, p.URL, params)
+	return err
+}
+
+// }}}
+// {{{ db.condensedDaysChanged
+
+// condensedDaysChanged is called after a flight is written (or deleted), with the timeslots it
+// had before and has now; it gets the materialized shards it touched patched.
+func (db *FlightDB)condensedDaysChanged(key string, oldSlots, newSlots []time.Time) {
+	shards := []string{}
+	for _,slots := range [][]time.Time{oldSlots, newSlots} {
+		for name,id := range condensedShardsForTimeslots(slots) {
+			if !isCondensedDayLive(id.Day) { shards = append(shards, name) } // Else can't exist yet
+		}
+	}
+	if len(shards) == 0 { return }
+	sort.Strings(shards)
+
+	if db.CondensedDayPatcher != nil {
+		err := db.CondensedDayPatcher.PatchLater(db.Ctx(), key, shards)
+		if err == nil { return }
+		db.Warningf("condensed shards %v: PatchLater failed, patching now: %v", shards, err)
+	}
+	if err := db.PatchCondensedDays(key, shards); err != nil {
+		db.Errorf("condensed shards %v: %v", shards, err)
+	}
+}
+
+// }}}
+// {{{ db.PatchCondensedDays
+
+// PatchCondensedDays brings the flight's entry in each of the materialized shards up to date
+// with the flight as it is now stored (or removes it, if the flight is gone, or no longer
+// belongs in the shard). Shards that fail to update are deleted, so they get rebuilt.
+func (db *FlightDB)PatchCondensedDays(key string, shards []string) error {
+	keyer,err := db.Backend.DecodeKey(key)
+	if err != nil { return fmt.Errorf("PatchCondensedDays: %v", err) }
+
+	var cf *fdb.CondensedFlight
+	current := map[string]condensedShardId{}
+	if f,err := db.LookupKey(keyer); errors.Is(err, ds.ErrNoSuchEntity) {
+		// Deleted
+	} else if err != nil {
+		return fmt.Errorf("PatchCondensedDays: %v", err)
+	} else {
+		cf = f.Condense()
+		current = condensedShardsForTimeslots(f.Timeslots())
+	}
+
+	var firstErr error
+	for _,name := range shards {
+		id,err := parseCondensedShardId(name)
+		if err != nil { return fmt.Errorf("PatchCondensedDays: %v", err) }
+		if isCondensedDayLive(id.Day) { continue }
+
+		shardCf := cf
+		if _,exists := current[name]; !exists { shardCf = nil }
+
+		if err := db.patchCondensedShard(id, key, shardCf); err != nil {
+			db.Warningf("condensed shard %s: patch failed, deleting: %v", name, err)
+			if err := db.Backend.Delete(db.Ctx(), db.condensedShardKey(id)); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("condensed shard %s: delete failed, will be stale: %v", name, err)
+			}
+		}
 	}
 
-	str += fmt.Sprintf("# All done ! %d results, took %s\n", i, time.Since(tStart))
-	return ret,nil,str
+	return firstErr
+}
+
+// Sets (or, if cf is nil, removes) the flight's entry in the shard, if the shard exists. If
+// the shard is being built, its placeholder is bumped instead, so the builder starts again.
+func (db *FlightDB)patchCondensedShard(id condensedShardId, key string, cf *fdb.CondensedFlight) error {
+	keyer := db.condensedShardKey(id)
+
+	for i:=0; i<3; i++ {
+		shard := condensedShard{}
+		if err := db.Backend.Get(db.Ctx(), keyer, &shard); err == ds.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !shard.Unbuilt {
+			cfs,err := shard.flights()
+			if err != nil { return err }
+			if old,exists := cfs[key]; cf == nil && !exists {
+				return nil
+			} else if cf != nil && exists && condensedEqual(old, *cf) {
+				return nil
+			}
+
+			if cf == nil {
+				delete(cfs, key)
+			} else {
+				cfs[key] = *cf
+			}
+			if err := shard.setFlights(cfs); err != nil { return err }
+		}
+
+		version := shard.Version
+		shard.Version = nextCondensedVersion(version)
+		shard.LastUpdate = time.Now()
+
+		err := db.putCondensedShards([]ds.Keyer{keyer}, []*condensedShard{&shard}, []int64{version})
+		if err == nil {
+			return nil
+		} else if !errors.Is(err, fdb.ErrVersionConflict) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("too many conflicting writes")
+}
+
+func condensedEqual(a, b fdb.CondensedFlight) bool {
+	if a.IdSpec != b.IdSpec || a.BestFlightNumber != b.BestFlightNumber || a.IcaoId != b.IcaoId ||
+		!a.Start.Equal(b.Start) || !a.End.Equal(b.End) || a.Procedure != b.Procedure ||
+		len(a.Tags) != len(b.Tags) || len(a.Waypoints) != len(b.Waypoints) {
+		return false
+	}
+	for i := range a.Tags {
+		if a.Tags[i] != b.Tags[i] { return false }
+	}
+	for wp,t := range a.Waypoints {
+		if tb,exists := b.Waypoints[wp]; !exists || !t.Equal(tb) { return false }
+	}
+	return true
+}
+
+// }}}
+// {{{ db.putCondensedShards
+
+// putCondensedShards only writes if the shards are at the given versions (-1 for not existing
+// yet), and for a VersionedProvider, the check & the write are atomic. Other providers can't
+// do that, so the versions are checked first, and then built shards are deleted rather than
+// patched, to be rebuilt by the next reader; that way, the worst a race can do is make the
+// rebuild happen twice.
+func (db *FlightDB)putCondensedShards(keyers []ds.Keyer, shards []*condensedShard, versions []int64) error {
+	if len(keyers) == 0 { return nil }
+	if vp,ok := db.Backend.(VersionedProvider); ok {
+		_,err := vp.PutMultiIfVersion(db.Ctx(), keyers, shards, versions)
+		return err
+	}
+
+	current := make([]condensedShard, len(keyers))
+	if err := db.getMultiAllowMissing(keyers, current); err != nil { return err }
+	for i,v := range versions {
+		if v < 0 { v = 0 } // Missing shards come back as zero values
+		if current[i].Version != v { return fdb.ErrVersionConflict }
+	}
+	for i := range versions {
+		if current[i].Version != 0 && !current[i].Unbuilt {
+			return db.Backend.DeleteMulti(db.Ctx(), keyers)
+		}
+	}
+	_,err := db.Backend.PutMulti(db.Ctx(), keyers, shards)
+	return err
+}
+
+// }}}
+// {{{ shard.flights, shard.setFlights
+
+func (shard condensedShard)flights() (map[string]fdb.CondensedFlight, error) {
+	cfs := map[string]fdb.CondensedFlight{}
+	gzr,err := gzip.NewReader(bytes.NewReader(shard.Blob))
+	if err != nil { return nil, err }
+	if err := gob.NewDecoder(gzr).Decode(&cfs); err != nil { return nil, err }
+	return cfs, gzr.Close()
+}
+
+func (shard *condensedShard)setFlights(cfs map[string]fdb.CondensedFlight) error {
+	if cfs == nil { cfs = map[string]fdb.CondensedFlight{} }
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(gzw).Encode(cfs); err != nil { return err }
+	if err := gzw.Close(); err != nil { return err }
+
+	if buf.Len() > kMaxCondensedShardBytes {
+		return fmt.Errorf("%d flights is too big (%d bytes)", len(cfs), buf.Len())
+	}
+	shard.Blob = buf.Bytes()
+	return nil
 }
 
 // }}}
@@ -0,0 +1,46 @@
+package fgae
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skypies/util/date"
+	fdb "github.com/skypies/flightdb"
+)
+
+func TestCondensedEqual(t *testing.T) {
+	tm := time.Now()
+	cf := func() fdb.CondensedFlight {
+		wps := map[string]time.Time{}
+		for i,wp := range []string{"EPICK", "EDDYY", "SWELS", "MENLO", "BRIXX", "SERFR"} {
+			wps[wp] = tm.Add(time.Duration(i) * time.Minute)
+		}
+		return fdb.CondensedFlight{IdSpec:"A12345@1", Start:tm, End:tm, Tags:[]string{"FOIA"},
+			Waypoints:wps}
+	}
+
+	// Map order mustn't matter
+	for i:=0; i<20; i++ {
+		if !condensedEqual(cf(), cf()) { t.Fatalf("identical flights compared unequal") }
+	}
+	b := cf()
+	b.Waypoints["EPICK"] = tm.Add(time.Hour)
+	if condensedEqual(cf(), b) { t.Errorf("different waypoint times compared equal") }
+}
+
+func TestCondensedShards(t *testing.T) {
+	// A flight from 23:40 to 01:10 (PDT) is in the last hour of one day, and the first of the next
+	s := date.ArbitraryDatestring2MidnightPdt("2017/03/31", "2006/01/02").Add(23*time.Hour + 40*time.Minute)
+	shards := condensedShardsForTimeslots(date.Timeslots(s, s.Add(90*time.Minute), fdb.TimeslotDuration))
+	if _,exists := shards["2017-03-31/23"]; !exists || len(shards) != 2 {
+		t.Errorf("wrong shards: %v", shards)
+	}
+	for name,id := range shards {
+		if parsed,err := parseCondensedShardId(name); err != nil || parsed != id {
+			t.Errorf("%s didn't parse back: %v, %v", name, parsed, err)
+		}
+	}
+	if _,exists := shards["2017-04-01/00"]; !exists {
+		t.Errorf("wrong shards: %v", shards)
+	}
+}
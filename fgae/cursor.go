@@ -0,0 +1,378 @@
+package fgae
+
+// The ds.DatastoreProvider interface doesn't do cursors. Providers that also implement
+// KeysPager (TxCloudDSProvider, using real datastore cursors) can run a keys-only query a
+// page at a time, resuming from a cursor of their own; a cursor of ours records the
+// provider's cursor for the start of a page, how far into that page we got, and the key we
+// got to. To resume, we fetch that page and skip past the key. If the key has since gone
+// away (e.g. the flight was deleted), we fall back to the offset.
+//
+// For other providers, and for queries the provider can't page (AnyOf unions, or those with
+// a limit), we rerun the whole keys-only query, and the page's cursor is just an offset into
+// it.
+
+import(
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/skypies/util/gcp/ds"
+	fdb "github.com/skypies/flightdb"
+)
+
+// {{{ KeysPager
+
+// KeysPager runs a keys-only query, returning up to n keys from the start cursor (or all of
+// them, if n <= 0), and the cursor for the rest; this is "" if there are no more.
+type KeysPager interface {
+	GetKeysPage(ctx context.Context, q *ds.Query, start string, n int) ([]ds.Keyer, string, error)
+}
+
+// How many keys to fetch at a time from a KeysPager. A resumed iterator has to skip over
+// at most this many.
+var KeysPageSize = 500
+
+// A rescanPager reruns the whole query every time.
+type rescanPager struct {
+	db *FlightDB
+	fq *FQuery
+}
+
+func (rp rescanPager)GetKeysPage(ctx context.Context, q *ds.Query, start string, n int) ([]ds.Keyer, string, error) {
+	keyers,err := rp.db.runKeysOnly(rp.fq)
+	if err != nil { return nil, "", err }
+
+	from := 0
+	if start != "" {
+		if from,err = strconv.Atoi(start); err != nil { return nil, "", fmt.Errorf("bad page %q", start) }
+	}
+	if from > len(keyers) { from = len(keyers) }
+	keyers = keyers[from:]
+
+	if n <= 0 || len(keyers) <= n {
+		return keyers, "", nil
+	}
+	return keyers[:n], strconv.Itoa(from+n), nil
+}
+
+// pagerFor returns the pager to use, and whether it is a real one.
+func (db *FlightDB)pagerFor(fq *FQuery) (KeysPager, bool) {
+	if kp,ok := db.Backend.(KeysPager); ok && len(fq.AnyOf) == 0 && len(fq.AnyOfAlone) == 0 &&
+		fq.LimitVal == 0 {
+		return kp, true
+	}
+	return rescanPager{db:db, fq:fq}, false
+}
+
+// }}}
+// {{{ cursor
+
+type cursor struct {
+	Page   string `json:"p,omitempty"` // The provider's cursor for the page the resume point is in
+	Offset int    `json:"o"`           // How many results of that page precede the resume point
+	Key    string `json:"k"`           // The last result before the resume point
+}
+
+func (c cursor)Encode() string {
+	jsonBytes,_ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(jsonBytes)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	c := cursor{}
+	jsonBytes,err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(jsonBytes, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("bad cursor %q: %v", s, err)
+	}
+	return c, nil
+}
+
+func startCursor(fq *FQuery) (cursor, error) {
+	if fq.StartCursor == "" { return cursor{}, nil }
+	return decodeCursor(fq.StartCursor)
+}
+
+// skip returns how many of the keys (from the start of the cursor's page) to skip over.
+func (c cursor)skip(keyers []ds.Keyer) int {
+	if c.Key == "" {
+		// Nothing to look for
+	} else if c.Offset > 0 && c.Offset <= len(keyers) && keyers[c.Offset-1].Encode() == c.Key {
+		return c.Offset
+	} else {
+		for i,keyer := range keyers {
+			if keyer.Encode() == c.Key { return i+1 }
+		}
+	}
+	if c.Offset > len(keyers) { return len(keyers) }
+	return c.Offset
+}
+
+// A keyMark records the provider's cursor for the page that starts at position Index.
+type keyMark struct {
+	Index int
+	Page  string
+}
+
+// cursorAt returns the cursor for the position after keyers[i-1], given the marks for the
+// pages they came in.
+func cursorAt(marks []keyMark, i int, key string) cursor {
+	m := marks[0]
+	for _,mark := range marks {
+		if mark.Index <= i { m = mark }
+	}
+	return cursor{Page:m.Page, Offset:i-m.Index, Key:key}
+}
+
+// }}}
+// {{{ keyStream
+
+// A keyStream runs the query as keys-only, fetching the keys from the pager a page at a time,
+// as they're needed. Positions in the stream count from the start cursor. It only goes
+// forwards: asking for keys from a position forgets the ones before it. It can be shared
+// between goroutines.
+type keyStream struct {
+	db       *FlightDB
+	pager    KeysPager
+	q        ds.Query
+	n        int        // How many keys to ask the pager for at a time (all of them, if <= 0)
+
+	mu       sync.Mutex
+	keyers   []ds.Keyer // The keys we've fetched but not yet forgotten ...
+	from     int        // ... and the position of keyers[0]
+	marks    []keyMark  // The position at which each of the provider's pages started
+	next     string     // The provider's cursor for the next page; "" if there are no more
+}
+
+// newKeyStream fetches the first page of keys after the query's StartCursor (if it has one).
+func (db *FlightDB)newKeyStream(fq *FQuery) (*keyStream, error) {
+	c,err := startCursor(fq)
+	if err != nil { return nil, err }
+
+	pager,paged := db.pagerFor(fq)
+	ks := keyStream{db:db, pager:pager, q:fq.Query} // Don't stomp on the caller's query
+	if paged { ks.n = KeysPageSize }
+	ks.q.KeysOnly()
+
+	keyers,next,err := pager.GetKeysPage(db.Ctx(), &ks.q, c.Page, ks.n)
+	if err != nil { return nil, err }
+
+	skip := c.skip(keyers)
+	ks.keyers, ks.next = keyers[skip:], next
+	ks.marks = []keyMark{{Index:-skip, Page:c.Page}}
+	return &ks, nil
+}
+
+// end is the position after the last key fetched so far. Call with mu held.
+func (ks *keyStream)end() int { return ks.from + len(ks.keyers) }
+
+// fetchTo fetches pages until we have the key at position i, or there are no more. Call with
+// mu held.
+func (ks *keyStream)fetchTo(i int) error {
+	for i >= ks.end() && ks.next != "" {
+		page,next,err := ks.pager.GetKeysPage(ks.db.Ctx(), &ks.q, ks.next, ks.n)
+		if err != nil { return err }
+		ks.marks = append(ks.marks, keyMark{Index:ks.end(), Page:ks.next})
+		ks.keyers, ks.next = append(ks.keyers, page...), next
+	}
+	return nil
+}
+
+// get returns up to n of the keys, starting at position from; or all the rest, if n <= 0.
+// Keys before from are forgotten.
+func (ks *keyStream)get(from, n int) ([]ds.Keyer, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if from < ks.from {
+		return nil, fmt.Errorf("keyStream: position %d has been forgotten", from)
+	} else if from > ks.end() {
+		from = ks.end()
+	}
+	ks.keyers, ks.from = ks.keyers[from-ks.from:], from
+
+	if n <= 0 {
+		for ks.next != "" {
+			if err := ks.fetchTo(ks.end()); err != nil { return nil, err }
+		}
+	} else if err := ks.fetchTo(from+n-1); err != nil {
+		return nil, err
+	}
+
+	if n <= 0 || n > len(ks.keyers) { n = len(ks.keyers) }
+	return ks.keyers[:n], nil
+}
+
+// count returns how many keys there are from position i onwards; it has to fetch them all.
+func (ks *keyStream)count(i int) (int, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for ks.next != "" {
+		if err := ks.fetchTo(ks.end()); err != nil { return 0, err }
+	}
+	if i > ks.end() { return 0, nil }
+	return ks.end() - i, nil
+}
+
+// cursorAt returns the cursor for the position i, just after the given key; or "" if there
+// are no keys from there on.
+func (ks *keyStream)cursorAt(i int, key string) (string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if err := ks.fetchTo(i); err != nil { return "", err }
+	if i >= ks.end() { return "", nil }
+	return cursorAt(ks.marks, i, key).Encode(), nil
+}
+
+// }}}
+// {{{ db.keysFromCursor
+
+// keysFromCursor runs the query as keys-only, and returns all the keys after the query's
+// StartCursor (if it has one).
+func (db *FlightDB)keysFromCursor(fq *FQuery) ([]ds.Keyer, error) {
+	ks,err := db.newKeyStream(fq)
+	if err != nil { return nil, err }
+	return ks.get(0, 0)
+}
+
+// }}}
+// {{{ db.runKeysOnly
+
+// runKeysOnly runs the query as keys-only, taking care of any AnyOf filters.
+func (db *FlightDB)runKeysOnly(fq *FQuery) ([]ds.Keyer, error) {
+	if len(fq.AnyOf) == 0 && len(fq.AnyOfAlone) == 0 {
+		q := fq.Query // Don't stomp on the caller's query
+		return db.Backend.GetAll(db.Ctx(), q.KeysOnly(), nil)
+	}
+
+	// The union of each group, intersected with the groups before it
+	var keyers []ds.Keyer
+	if len(fq.AnyOf) == 0 {
+		q := fq.Query
+		q.LimitVal = 0 // Apply it after the intersection
+		results,err := db.Backend.GetAll(db.Ctx(), q.KeysOnly(), nil)
+		if err != nil { return nil, err }
+		keyers = results
+	}
+	for i,group := range fq.AnyOf {
+		queries := []*ds.Query{}
+		for _,f := range group {
+			q := fq.Query
+			q.Filters = append(append([]ds.Filter{}, fq.Filters...), f)
+			q.LimitVal = 0
+			queries = append(queries, &q)
+		}
+		union,seen,err := db.unionKeysOnly(queries)
+		if err != nil { return nil, err }
+		if i == 0 {
+			keyers = union
+		} else {
+			keyers = intersectKeys(keyers, seen)
+		}
+	}
+	for _,group := range fq.AnyOfAlone {
+		queries := []*ds.Query{}
+		for _,f := range group {
+			q := ds.NewQuery(fq.Kind).Filter(f.Field, f.Value)
+			if fq.AncestorKeyer != nil { q.Ancestor(fq.AncestorKeyer) }
+			queries = append(queries, q)
+		}
+		_,seen,err := db.unionKeysOnly(queries)
+		if err != nil { return nil, err }
+		keyers = intersectKeys(keyers, seen)
+	}
+
+	if fq.LimitVal > 0 && len(keyers) > fq.LimitVal {
+		keyers = keyers[:fq.LimitVal]
+	}
+
+	return keyers, nil
+}
+
+// The keys matched by any of the queries, in order of first appearance; also as a set.
+func (db *FlightDB)unionKeysOnly(queries []*ds.Query) ([]ds.Keyer, map[string]bool, error) {
+	union := []ds.Keyer{}
+	seen := map[string]bool{}
+	for _,q := range queries {
+		results,err := db.Backend.GetAll(db.Ctx(), q.KeysOnly(), nil)
+		if err != nil { return nil, nil, err }
+		for _,keyer := range results {
+			if !seen[keyer.Encode()] {
+				seen[keyer.Encode()] = true
+				union = append(union, keyer)
+			}
+		}
+	}
+	return union, seen, nil
+}
+
+func intersectKeys(keyers []ds.Keyer, seen map[string]bool) []ds.Keyer {
+	kept := []ds.Keyer{}
+	for _,keyer := range keyers {
+		if seen[keyer.Encode()] { kept = append(kept, keyer) }
+	}
+	return kept
+}
+
+// }}}
+// {{{ db.LookupPage, db.LookupKeysPage
+
+// LookupPage returns up to n flights, starting at the query's StartCursor, and the cursor
+// for the next page; this is "" if there are no more results.
+func (db *FlightDB)LookupPage(fq *FQuery, n int) ([]*fdb.Flight, string, error) {
+	keyers,next,err := db.LookupKeysPage(fq, n)
+	if err != nil { return nil, "", err }
+
+	blobs := make([]fdb.IndexedFlightBlob, len(keyers))
+	if err := db.Backend.GetMulti(db.Ctx(), keyers, blobs); err != nil {
+		return nil, "", fmt.Errorf("LookupPage: %v", err)
+	}
+
+	flights,err := db.blobsToFlights(keyers, blobs)
+	return flights, next, err
+}
+
+// LookupKeysPage is LookupPage for keys.
+func (db *FlightDB)LookupKeysPage(fq *FQuery, n int) ([]ds.Keyer, string, error) {
+	c,err := startCursor(fq)
+	if err != nil { return nil, "", fmt.Errorf("LookupKeysPage: %v", err) }
+
+	pager,_ := db.pagerFor(fq)
+	q := fq.Query
+	q.KeysOnly()
+	keyers,next,err := pager.GetKeysPage(db.Ctx(), &q, c.Page, c.Offset+n)
+	if err != nil { return nil, "", fmt.Errorf("LookupKeysPage: %v", err) }
+
+	skip := c.skip(keyers)
+	keyers = keyers[skip:]
+
+	if len(keyers) > n {
+		// The resume key moved up the page, so there's some of it left over
+		keyers = keyers[:n]
+		return keyers, cursor{Page:c.Page, Offset:skip+n, Key:keyers[n-1].Encode()}.Encode(), nil
+	} else if next == "" {
+		return keyers, "", nil
+	}
+
+	nextCursor := cursor{Page:next}
+	if len(keyers) > 0 { nextCursor.Key = keyers[len(keyers)-1].Encode() }
+	return keyers, nextCursor.Encode(), nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -1,6 +1,7 @@
 package fgae
 
 import(
+	"crypto/sha1"
 	"fmt"
 	"golang.org/x/net/context"
 	"github.com/skypies/util/gcp/ds"
@@ -32,26 +33,226 @@ func (db *FlightDB)MergeCachedAirframes(flights []*fdb.Flight) error {
 
 // {{{ db.PersistFlight
 
+// Datastore entities can't be bigger than 1MB; flights with blobs bigger than this get their
+// payload put into fdb.DefaultBlobStore instead.
+var MaxInlineBlobSize = 1000000
+
+// externalBlobName is where a flight's payload lives, if it's too big for datastore. Each
+// payload gets its own name, so a writer that loses a race can't clobber the winner's payload;
+// the previous payload is only deleted once the entity no longer points at it.
+func externalBlobName(keyer ds.Keyer, data []byte) string {
+	return fmt.Sprintf("%s/%s/%x", kFlightKind, keyer.Encode(), sha1.Sum(data))
+}
+
 func (db *FlightDB)PersistFlight(f *fdb.Flight) error {
-	keyer,err := findOrGenerateFlightKey(db.Ctx(), db.Backend, f)
+	blob,err := f.ToBlob()
 	if err != nil { return fmt.Errorf("PersistFlight: %v", err) }
-	
-	if blob,err := f.ToBlob(); err != nil {
-		return fmt.Errorf("PersistFlight: %v", err)
-	} else {
-		if len(blob.Blob) > 1000000 {
-			return fmt.Errorf("PersistFlight %q: blob too big (%d)", f.IdentityString(), len(blob.Blob))
+	return db.persistBlob(f, blob, false)
+}
+
+// PersistFlightIfUnchanged only writes the flight if nobody else has written it since it was
+// read (or, for a new flight, if nobody else has created it); if they have, it returns an
+// error that wraps fdb.ErrVersionConflict, and the caller should re-read and try again.
+func (db *FlightDB)PersistFlightIfUnchanged(f *fdb.Flight) error {
+	blob,err := f.ToBlob()
+	if err != nil { return fmt.Errorf("PersistFlight: %v", err) }
+	return db.persistBlob(f, blob, true)
+}
+
+// ReencodeFlight rewrites the flight's blob using the given encoding. The LastUpdate is left
+// as it was, so that this doesn't disturb LookupMostRecent.
+func (db *FlightDB)ReencodeFlight(f *fdb.Flight, enc fdb.BlobEncoding) error {
+	blob,err := f.ToBlobWithEncoding(enc)
+	if err != nil { return fmt.Errorf("ReencodeFlight: %v", err) }
+	if !f.GetLastUpdate().IsZero() {
+		blob.LastUpdate = f.GetLastUpdate()
+	}
+	return db.persistBlob(f, blob, false)
+}
+
+// VersionedProvider is implemented by datastore providers that can do an atomic compare-and-swap
+// on an entity's Version field (the localds providers do, as does TxCloudDSProvider). A
+// negative version means the entity must not exist yet.
+type VersionedProvider interface {
+	PutIfVersion(ctx context.Context, keyer ds.Keyer, src interface{}, version int64) (ds.Keyer, error)
+
+	// All or nothing; if any of the versions don't match, nothing is written.
+	PutMultiIfVersion(ctx context.Context, keyers []ds.Keyer, src interface{}, versions []int64) ([]ds.Keyer, error)
+
+	// As PutMultiIfVersion, but also deletes delKeyers, which must be at delVersions.
+	PutDeleteIfVersion(ctx context.Context, keyers []ds.Keyer, src interface{}, versions []int64, delKeyers []ds.Keyer, delVersions []int64) ([]ds.Keyer, error)
+}
+
+// For providers that can't compare-and-swap, re-read the version just before writing. This
+// shrinks the window for a lost update, but can't close it; in production, use a
+// TxCloudDSProvider rather than a plain ds.CloudDSProvider.
+func (db *FlightDB)putIfVersion(keyer ds.Keyer, blob *fdb.IndexedFlightBlob, version int64) error {
+	if vp,ok := db.Backend.(VersionedProvider); ok {
+		_,err := vp.PutIfVersion(db.Ctx(), keyer, blob, version)
+		return err
+	}
+
+	current := int64(-1)
+	existing := fdb.IndexedFlightBlob{}
+	if err := db.Backend.Get(db.Ctx(), keyer, &existing); err == nil {
+		current = existing.Version
+	} else if err != ds.ErrNoSuchEntity {
+		return err
+	}
+	if current != version {
+		return fdb.ErrVersionConflict
+	}
+
+	_,err := db.Backend.Put(db.Ctx(), keyer, blob)
+	return err
+}
+
+// As putIfVersion, for a batch of blobs; with the same caveat for unversioned providers.
+func (db *FlightDB)putMultiIfVersion(keyers []ds.Keyer, blobs []*fdb.IndexedFlightBlob, versions []int64) error {
+	return db.putDeleteIfVersion(keyers, blobs, versions, nil, nil)
+}
+
+// As putMultiIfVersion, also deleting delKeyers (which must be at delVersions).
+func (db *FlightDB)putDeleteIfVersion(keyers []ds.Keyer, blobs []*fdb.IndexedFlightBlob, versions []int64, delKeyers []ds.Keyer, delVersions []int64) error {
+	if vp,ok := db.Backend.(VersionedProvider); ok {
+		_,err := vp.PutDeleteIfVersion(db.Ctx(), keyers, blobs, versions, delKeyers, delVersions)
+		return err
+	}
+
+	allKeyers := append(append([]ds.Keyer{}, keyers...), delKeyers...)
+	allVersions := append(append([]int64{}, versions...), delVersions...)
+	for i,keyer := range allKeyers {
+		current := int64(-1)
+		existing := fdb.IndexedFlightBlob{}
+		if err := db.Backend.Get(db.Ctx(), keyer, &existing); err == nil {
+			current = existing.Version
+		} else if err != ds.ErrNoSuchEntity {
+			return err
 		}
+		if current != allVersions[i] {
+			return fdb.ErrVersionConflict
+		}
+	}
 
-		_, err = db.Backend.Put(db.Ctx(), keyer, blob)
+	if len(keyers) > 0 {
+		if _,err := db.Backend.PutMulti(db.Ctx(), keyers, blobs); err != nil { return err }
+	}
+	if len(delKeyers) > 0 {
+		return db.Backend.DeleteMulti(db.Ctx(), delKeyers)
+	}
+	return nil
+}
+
+// prepareBlob works out the flight's key, bumps the version, and moves the payload out into
+// the blobstore if it's too big.
+func (db *FlightDB)prepareBlob(f *fdb.Flight, blob *fdb.IndexedFlightBlob) (ds.Keyer, error) {
+	keyer,err := findOrGenerateFlightKey(db.Ctx(), db.Backend, f)
+	if err != nil { return nil, fmt.Errorf("PersistFlight: %v", err) }
+
+	blob.Version = f.GetVersion() + 1
+
+	if len(blob.Blob) > MaxInlineBlobSize {
+		if fdb.DefaultBlobStore == nil {
+			return nil, fmt.Errorf("PersistFlight %q: blob too big (%d), and no blobstore",
+				f.IdentityString(), len(blob.Blob))
+		}
+		err := blob.Externalize(db.Ctx(), fdb.DefaultBlobStore, externalBlobName(keyer, blob.Blob))
 		if err != nil {
-			return fmt.Errorf("PersistFlight %q: %v", f.IdentityString(), err)
+			return nil, fmt.Errorf("PersistFlight %q: %v", f.IdentityString(), err)
 		}
 	}
 
+	return keyer, nil
+}
+
+// The version the flight should have in the DB. A flight without a key has never been read from
+// the DB, so shouldn't exist in it yet.
+func storedVersion(f *fdb.Flight) int64 {
+	if f.GetDatastoreKey() == "" { return -1 }
+	return f.GetVersion()
+}
+
+func (db *FlightDB)persistBlob(f *fdb.Flight, blob *fdb.IndexedFlightBlob, conditional bool) error {
+	keyer,err := db.prepareBlob(f, blob)
+	if err != nil { return err }
+
+	expectedVersion := storedVersion(f)
+
+	// If this write fails, an externalized payload is left behind unreferenced (we can't delete
+	// it; an identical payload from the winner would have the same name). That's only a risk for
+	// huge flights, and an orphaned blob is harmless.
+	if conditional {
+		err = db.putIfVersion(keyer, blob, expectedVersion)
+	} else {
+		_, err = db.Backend.Put(db.Ctx(), keyer, blob)
+	}
+	if err != nil {
+		return fmt.Errorf("PersistFlight %q: %w", f.IdentityString(), err)
+	}
+
+	db.afterPersist(keyer, f, blob)
 	return nil
 }
 
+// persistReplacing writes the flights, and deletes the doomed ones, in a single write that only
+// goes ahead if none of them have been modified since they were read (or, for new flights,
+// created); else it returns an error wrapping fdb.ErrVersionConflict. If blobs is nil, the
+// flights' blobs are built afresh.
+func (db *FlightDB)persistReplacing(flights []*fdb.Flight, blobs []*fdb.IndexedFlightBlob, doomed []*fdb.Flight) error {
+	if blobs == nil {
+		blobs = make([]*fdb.IndexedFlightBlob, len(flights))
+	}
+	keyers,versions := []ds.Keyer{}, []int64{}
+	for i,f := range flights {
+		if blobs[i] == nil {
+			blob,err := f.ToBlob()
+			if err != nil { return fmt.Errorf("PersistFlight: %v", err) }
+			blobs[i] = blob
+		}
+		keyer,err := db.prepareBlob(f, blobs[i])
+		if err != nil { return err }
+		keyers,versions = append(keyers, keyer), append(versions, storedVersion(f))
+	}
+
+	delKeyers,delVersions := []ds.Keyer{}, []int64{}
+	for _,f := range doomed {
+		keyer,err := db.Backend.DecodeKey(f.GetDatastoreKey())
+		if err != nil { return fmt.Errorf("PersistFlight: %v", err) }
+		delKeyers,delVersions = append(delKeyers, keyer), append(delVersions, f.GetVersion())
+	}
+
+	if err := db.putDeleteIfVersion(keyers, blobs, versions, delKeyers, delVersions); err != nil {
+		return fmt.Errorf("PersistFlight: %w", err)
+	}
+
+	for i,f := range flights {
+		db.afterPersist(keyers[i], f, blobs[i])
+	}
+	for i,f := range doomed {
+		db.afterDelete(delKeyers[i], f.GetStoredIndex(), f.GetBlobRef())
+	}
+	return nil
+}
+
+// afterPersist is for every flight that gets written, however it was written: the flight picks
+// up its new version, any payload it no longer uses is deleted, and the condensed days & the
+// change hooks get told.
+func (db *FlightDB)afterPersist(keyer ds.Keyer, f *fdb.Flight, blob *fdb.IndexedFlightBlob) {
+	if old := f.GetBlobRef(); old != "" && old != blob.BlobRef && fdb.DefaultBlobStore != nil {
+		if err := fdb.DefaultBlobStore.DeleteBlob(db.Ctx(), old); err != nil {
+			db.Warningf("PersistFlight %q: stale blob not deleted: %v", f.IdentityString(), err)
+		}
+	}
+	f.SetBlobRef(blob.BlobRef)
+
+	f.SetDatastoreKey(keyer.Encode()) // New flights now exist in the DB
+	f.SetVersion(blob.Version)
+	before,after := f.GetStoredIndex(), blob.IndexSummary()
+	db.condensedDaysChanged(keyer.Encode(), before.GetTimeslots(), after.Timeslots)
+	db.notifyChange(FlightChange{Key:keyer.Encode(), Version:blob.Version, Before:before, After:after})
+	f.SetStoredIndex(after)
+}
+
 // }}}
 
 // {{{ db.LookupKey
@@ -60,6 +261,8 @@ func (db *FlightDB)LookupKey(keyer ds.Keyer) (*fdb.Flight, error) {
 	blob := fdb.IndexedFlightBlob{}
 
 	if err := db.Backend.Get(db.Ctx(), keyer, &blob); err != nil {
+		return nil, fmt.Errorf("GetByKey: %w", err)
+	} else if err := blob.Internalize(db.Ctx(), fdb.DefaultBlobStore); err != nil {
 		return nil, fmt.Errorf("GetByKey: %v", err)
 	}
 
@@ -75,14 +278,29 @@ func (db *FlightDB)LookupAll(fq *FQuery) ([]*fdb.Flight, error) {
 	// Results are not ordered ... for timerange idspecs, would need to sort on Timeslots
 	blobs := []fdb.IndexedFlightBlob{}
 
-	keyers, err := db.Backend.GetAll(db.Ctx(), (*ds.Query)(fq), &blobs)
+	var keyers []ds.Keyer
+	var err error
+	if fq.StartCursor != "" || len(fq.AnyOf) > 0 || len(fq.AnyOfAlone) > 0 {
+		if keyers,err = db.keysFromCursor(fq); err == nil {
+			blobs = make([]fdb.IndexedFlightBlob, len(keyers))
+			err = db.Backend.GetMulti(db.Ctx(), keyers, blobs)
+		}
+	} else {
+		keyers, err = db.Backend.GetAll(db.Ctx(), &fq.Query, &blobs)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("GetAllByQuery: %v", err)
 	}
 
+	return db.blobsToFlights(keyers, blobs)
+}
+
+func (db *FlightDB)blobsToFlights(keyers []ds.Keyer, blobs []fdb.IndexedFlightBlob) ([]*fdb.Flight, error) {
 	flights := []*fdb.Flight{}
 	for i,blob := range blobs {
-		if flight,err := blob.ToFlight(keyers[i].Encode()); err != nil {
+		if err := blob.Internalize(db.Ctx(), fdb.DefaultBlobStore); err != nil {
+			return nil, fmt.Errorf("GetAllByQuery: %v", err)
+		} else if flight,err := blob.ToFlight(keyers[i].Encode()); err != nil {
 			return nil, fmt.Errorf("GetAllByQuery: %v", err)
 		} else {
 			flights = append(flights, flight)
@@ -123,8 +341,7 @@ func (db *FlightDB)LookupMostRecent(fq *FQuery) (*fdb.Flight, error) {
 // {{{ db.LookupAllKeys
 
 func (db *FlightDB)LookupAllKeys(fq *FQuery) ([]ds.Keyer, error) {
-	q := (*ds.Query)(fq)
-	return db.Backend.GetAll(db.Ctx(), q.KeysOnly(), nil)
+	return db.keysFromCursor(fq)
 }
 
 // }}}
@@ -132,14 +349,38 @@ func (db *FlightDB)LookupAllKeys(fq *FQuery) ([]ds.Keyer, error) {
 // {{{ db.DeleteByKey
 
 func (db *FlightDB)DeleteByKey(keyer ds.Keyer) error {
-	return db.Backend.Delete(db.Ctx(), keyer)
+	return db.DeleteAllKeys([]ds.Keyer{keyer})
 }
 
 // }}}
 // {{{ db.DeleteAllKeys
 
 func (db *FlightDB)DeleteAllKeys(keyers []ds.Keyer) error {
-	return db.Backend.DeleteMulti(db.Ctx(), keyers)
+	befores,blobRefs := db.lookupStored(keyers) // Need these for the hooks, before they're gone
+
+	if err := db.Backend.DeleteMulti(db.Ctx(), keyers); err != nil {
+		return err
+	}
+
+	var err error
+	for i,keyer := range keyers {
+		if err2 := db.afterDelete(keyer, befores[i], blobRefs[i]); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+// afterDelete is for every flight that gets deleted: the condensed days & the change hooks get
+// told, and its payload is deleted, if it was externalized.
+func (db *FlightDB)afterDelete(keyer ds.Keyer, before *fdb.IndexSummary, blobRef string) error {
+	db.condensedDaysChanged(keyer.Encode(), before.GetTimeslots(), nil)
+	db.notifyChange(FlightChange{Key:keyer.Encode(), Deleted:true, Before:before})
+
+	if blobRef != "" && fdb.DefaultBlobStore != nil {
+		return fdb.DefaultBlobStore.DeleteBlob(db.Ctx(), blobRef)
+	}
+	return nil
 }
 
 // }}}
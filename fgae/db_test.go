@@ -1,81 +1,61 @@
-package fgae
+package fgae_test
 
-// FIXME: how to run these tests without aetest ?
+// These tests run against the in-memory datastore provider, so need no cloud access.
+// (They're in a separate package, as faadata imports fgae.)
 
-/*
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
-	"google.golang.org/ appengine"
-	"google.golang.org/ appengine/aetest" // Also used for testing Cloud API
-
+	"github.com/skypies/geo"
+	"github.com/skypies/util/date"
 	"github.com/skypies/util/gcp/ds"
 	fdb "github.com/skypies/flightdb"
+	"github.com/skypies/flightdb/blobstore"
 	"github.com/skypies/flightdb/faadata" // for quick ascii loading of trackpoints
+	"github.com/skypies/flightdb/fgae"
+	"github.com/skypies/flightdb/localds"
 )
 
-const appid = "mytestapp"
-
 // {{{ loadFlights
 
-func loadFlights(t *testing.T, data string) []*fdb.Flight {
+func loadFlights(t *testing.T, db fgae.FlightDB, data string) []*fdb.Flight {
 	flights := []*fdb.Flight{}
-	callback := func(ctx context.Context, f *fdb.Flight) (bool,string,error) {
+	callback := func(db fgae.FlightDB, f *fdb.Flight) (bool,string,error) {
 		flights = append(flights,f)
 		return true,"",nil
 	}
 
-	_,_,err := faadata.ReadFrom(context.TODO(), "testdata", strings.NewReader(data), callback)
+	_,_,err := faadata.ReadFrom(db, "testdata", "", strings.NewReader(data), callback)
 	if err != nil { t.Fatal(err) }
 
 	return flights
 }
 
-// }}}
-// {{{ newConsistentContext
-
-// A version of aetest.NewContext() that has a consistent datastore - so we can read our writes.
-func newConsistentContext() (context.Context, func(), error) {
-	inst, err := aetest.NewInstance(&aetest.Options{
-		StronglyConsistentDatastore: true,
-		AppID: appid,
-	})
-	if err != nil {
-		return nil, nil, err
-	}
-	req, err := inst.NewRequest("GET", "/", nil)
-	if err != nil {
-		inst.Close()
-		return nil, nil, err
-	}
-	ctx := appengine.NewContext(req)
-	return ctx, func() {
-		inst.Close()
-	}, nil
-}
-
 // }}}
 
 // {{{ testEverything
 
 func testEverything(t *testing.T, p ds.DatastoreProvider) {
-	ctx, done, err := newConsistentContext()
-	if err != nil { t.Fatal(err) }
-	defer done()
-
-	db := NewDB(ctx)
-	db.Backend = p
+	ctx := context.Background()
+	db := fgae.New(ctx, p)
 	
-	flights := loadFlights(t, fakeFlights)
+	flights := loadFlights(t, db, fakeFlights)
+	flights[0].SetWaypoint("EPICK", flights[0].AnyTrack()[0].TimestampUTC)
 	for _,f := range flights {
 		if err := db.PersistFlight(f); err != nil { t.Fatal(err) }
 	}
 	
-	run := func(expected int, q *FQuery) {
+	run := func(expected int, q *fgae.FQuery) {
 		if results,err := db.LookupAll(q); err != nil {
 			t.Fatal(err)
 		} else if len(results) != expected {
@@ -87,6 +67,48 @@ func testEverything(t *testing.T, p ds.DatastoreProvider) {
 	run(len(flights), db.NewQuery())
 	run(3,            db.NewQuery().Limit(3))
 	run(1,            db.NewQuery().ByCallsign(flights[0].Callsign))
+	run(len(flights), fgae.QueryForRecent([]string{}, 100))
+	run(len(flights), db.NewQuery().ByTags([]string{"FOIA"}))
+	run(0,            db.NewQuery().ByTags([]string{"FOIA", "nonesuch"}))
+	run(1,            db.NewQuery().ByWaypoints([]string{"EPICK"}))
+	run(1,            fgae.QueryForRecentWaypoint([]string{"FOIA"}, []string{"EPICK"}, 10))
+
+	// Timeslot queries; all the fake flights are on 2017/04/01 (PDT), between 00:39 and 21:16 UTC
+	s := flights[0].AnyTrack()[0].TimestampUTC
+	run(1,            db.NewQuery().ByTime(s))
+	run(0,            db.NewQuery().ByTime(s.AddDate(0,0,1)))
+	run(len(flights), db.NewQuery().ByTimeRange(s.Add(-24*time.Hour), s.Add(24*time.Hour)))
+
+	// Attribute queries
+	run(3,            db.NewQuery().ByOrigin("sfo"))
+	run(4,            db.NewQuery().ByDestination("SFO"))
+	run(2,            db.NewQuery().ByEquipment("B707"))
+	run(1,            db.NewQuery().ByEquipment("B707").ByOrigin("SFO").ByTimeRange(s, s))
+	run(1,            db.NewQuery().ByAirline("AAA"))
+	run(0,            db.NewQuery().ByRegistration("N12345"))
+
+	// Spatial queries; the fake flights are short, and scattered around the state
+	pos := flights[1].AnyTrack()[0].Latlong
+	run(1,            db.NewQuery().ByBoundingBox(pos.Box(10,10)))
+	run(1,            db.NewQuery().ByBoundingBox(pos.Box(10,10)).ByCallsign(flights[1].Callsign))
+	run(0,            db.NewQuery().ByBoundingBox(pos.Box(10,10)).ByCallsign(flights[0].Callsign))
+	run(2,            db.NewQuery().ByBoundingBox(pos.BoxTo(flights[2].AnyTrack()[0].Latlong)).Limit(2))
+	run(0,            db.NewQuery().ByBoundingBox(geo.Latlong{Lat:-33.9, Long:151.2}.Box(10,10)))
+
+	// Cell time queries, run alone and intersected with the time range query
+	p1 := flights[1].AnyTrack()[0]
+	cells := fdb.CellsForBox(p1.Latlong.Box(10,10))
+	run(1,            db.NewQuery().ByCellsDuring(cells, p1.TimestampUTC, p1.TimestampUTC))
+	run(1,            db.NewQuery().ByTimeRange(s.Add(-24*time.Hour), s.Add(24*time.Hour)).ByCellsDuring(cells, p1.TimestampUTC, p1.TimestampUTC))
+	run(0,            db.NewQuery().ByTime(s).ByCellsDuring(cells, p1.TimestampUTC, p1.TimestampUTC))
+	run(0,            db.NewQuery().ByCellsDuring(cells, p1.TimestampUTC.AddDate(0,0,2), p1.TimestampUTC.AddDate(0,0,3)))
+
+	// Waypoint time queries; these intersect with the cell query
+	run(1,            db.NewQuery().ByWaypointAt("EPICK", s.Add(-time.Minute), s.Add(time.Minute)))
+	run(0,            db.NewQuery().ByWaypointAt("EPICK", s.Add(time.Hour), s.Add(2*time.Hour)))
+	run(0,            db.NewQuery().ByWaypointAt("BRIXX", s, s))
+	run(1,            db.NewQuery().ByWaypointAt("EPICK", s, s).ByBoundingBox(flights[0].AnyTrack()[0].Latlong.Box(10,10)))
+	run(0,            db.NewQuery().ByWaypointAt("EPICK", s, s).ByBoundingBox(pos.Box(10,10)))
 
 	// Now delete something
 	first,err := db.LookupFirst(db.NewQuery())
@@ -104,9 +126,9 @@ func testEverything(t *testing.T, p ds.DatastoreProvider) {
 	// Now test the iterator
 	n := 0
 	fi := db.NewIterator(db.NewQuery())
-		for fi.Iterate(ctx) {
+	for fi.Iterate(ctx) {
 		f := fi.Flight()
-		fmt.Printf(" iterator result: %s\n", f)
+		if f == nil { break }
 		n++
 	}
 	if fi.Err() != nil {
@@ -117,14 +139,673 @@ func testEverything(t *testing.T, p ds.DatastoreProvider) {
 		t.Errorf("test expected to see %d, but saw %d\n", nExpected, n)
 	}
 
+	// Stop the iterator partway, and resume it from its cursor
+	seen := map[string]int{}
+	fi = db.NewIterator(db.NewQuery())
+	for i:=0; i<3 && fi.Iterate(ctx); i++ {
+		seen[fi.Flight().GetDatastoreKey()]++
+	}
+	cursor := fi.Cursor()
+	if cursor == "" {
+		t.Fatalf("iterator had no cursor, after 3 of %d", nExpected)
+	}
+	fi = db.NewIterator(db.NewQuery().StartAt(cursor))
+	for fi.Iterate(ctx) {
+		seen[fi.Flight().GetDatastoreKey()]++
+	}
+	if fi.Err() != nil || fi.Cursor() != "" {
+		t.Errorf("resumed iterator: err=%v, cursor=%q", fi.Err(), fi.Cursor())
+	}
+	if len(seen) != nExpected {
+		t.Errorf("cursor: expected to see %d, but saw %d", nExpected, len(seen))
+	}
+	for k,v := range seen {
+		if v != 1 { t.Errorf("cursor: saw %s %d times", k, v) }
+	}
+
+	// And page through it
+	nPaged,nPages := 0,0
+	for cursor = ""; nPages==0 || cursor != ""; nPages++ {
+		page,next,err := db.LookupPage(db.NewQuery().StartAt(cursor), 4)
+		if err != nil { t.Fatal(err) }
+		nPaged += len(page)
+		cursor = next
+	}
+	if nPaged != nExpected || nPages != (nExpected+3)/4 {
+		t.Errorf("LookupPage: expected %d in %d pages, saw %d in %d", nExpected, (nExpected+3)/4,
+			nPaged, nPages)
+	}
 }
 
 // }}}
 
+// A provider that pages its keys with offsets, the way a real cursor would be used
+type offsetPager struct {
+	*localds.MemoryDSProvider
+	pages *int // If set, counts the pages fetched
+}
+func (p offsetPager)GetKeysPage(ctx context.Context, q *ds.Query, start string, n int) ([]ds.Keyer, string, error) {
+	if p.pages != nil { *p.pages++ }
+	keyers,err := p.GetAll(ctx, q, nil)
+	if err != nil { return nil, "", err }
+	from := 0
+	if start != "" { fmt.Sscanf(start, "%d", &from) }
+	if from > len(keyers) { from = len(keyers) }
+	keyers = keyers[from:]
+	if n <= 0 || len(keyers) <= n { return keyers, "", nil }
+	return keyers[:n], fmt.Sprintf("%d", from+n), nil
+}
+
+// The iterator should only fetch pages of keys as it gets to them
+func TestLazyKeys(t *testing.T) {
+	ctx := context.Background()
+	defer func(n int) { fgae.KeysPageSize = n }(fgae.KeysPageSize)
+	fgae.KeysPageSize = 2
+
+	nPages := 0
+	db := fgae.New(ctx, offsetPager{localds.NewMemoryDSProvider(), &nPages})
+	flights := loadFlights(t, db, fakeFlights)
+	for _,f := range flights {
+		if err := db.PersistFlight(f); err != nil { t.Fatal(err) }
+	}
+
+	fi := db.NewIterator(db.NewQuery())
+	fi.PageSize = 1
+	if !fi.Iterate(ctx) { t.Fatalf("iterator didn't start: %v", fi.Err()) }
+	if nPages != 1 {
+		t.Errorf("expected 1 page of keys for the first flight, saw %d", nPages)
+	}
+
+	n := 1
+	for fi.Iterate(ctx) { n++ }
+	if fi.Err() != nil || n != len(flights) {
+		t.Errorf("expected %d flights, saw %d (err=%v)", len(flights), n, fi.Err())
+	} else if expected := (len(flights)+1)/2; nPages != expected {
+		t.Errorf("expected %d pages of keys, saw %d", expected, nPages)
+	}
+}
+
 func TestEverything(t *testing.T) {
-	//testEverything(t, dsprovider.AppengineDSProvider{})
-	// Sadly, the aetest framework hangs on the first Put from the cloud client
-	// testEverything(t, dsprovider.CloudDSProvider{appid})
+	testEverything(t, localds.NewMemoryDSProvider())
+
+	// Small pages, so the iterator's cursor isn't in the first one
+	defer func(n int) { fgae.KeysPageSize = n }(fgae.KeysPageSize)
+	fgae.KeysPageSize = 2
+	testEverything(t, offsetPager{MemoryDSProvider:localds.NewMemoryDSProvider()})
+
+	dir,err := os.MkdirTemp("", "fgae")
+	if err != nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	p,err := localds.NewSQLiteDSProvider(filepath.Join(dir, "test.sqlite"))
+	if err != nil { t.Fatal(err) }
+	defer p.Close()
+	testEverything(t, p)
+}
+
+func TestExternalBlobs(t *testing.T) {
+	dir,err := os.MkdirTemp("", "fgae")
+	if err != nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+
+	// Make every flight too big to store inline
+	defer func(n int) { fgae.MaxInlineBlobSize = n }(fgae.MaxInlineBlobSize)
+	defer func(s fdb.BlobStore) { fdb.DefaultBlobStore = s }(fdb.DefaultBlobStore)
+	fgae.MaxInlineBlobSize = 10
+
+	ctx := context.Background()
+	p := localds.NewMemoryDSProvider()
+	db := fgae.New(ctx, p)
+	flights := loadFlights(t, db, fakeFlights)
+
+	if err := db.PersistFlight(flights[0]); err == nil {
+		t.Errorf("oversized flight was persisted, despite no blobstore")
+	}
+
+	fdb.DefaultBlobStore = blobstore.NewDirBlobStore(dir)
+	for _,f := range flights {
+		if err := db.PersistFlight(f); err != nil { t.Fatal(err) }
+	}
+
+	// The entities should only have the reference, and the indexed fields
+	blobs := []fdb.IndexedFlightBlob{}
+	keyers,err := p.GetAll(ctx, &db.NewQuery().ByCallsign(flights[0].Callsign).Query, &blobs)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(blobs) != 1 || len(blobs[0].Blob) != 0 || blobs[0].BlobRef == "" {
+		t.Fatalf("entity didn't look externalized: %d results, %v", len(blobs), blobs)
+	}
+
+	if results,err := db.LookupAll(db.NewQuery().ByTags([]string{"FOIA"})); err != nil {
+		t.Fatal(err)
+	} else if len(results) != len(flights) {
+		t.Errorf("expected %d flights, found %d", len(flights), len(results))
+	} else if len(results[0].AnyTrack()) != 3 {
+		t.Errorf("flight didn't have its track: %s", results[0])
+	}
+
+	n := 0
+	fi := db.NewIterator(db.NewQuery())
+	for fi.Iterate(ctx) {
+		if f := fi.Flight(); f == nil || len(f.AnyTrack()) != 3 {
+			t.Errorf("iterator returned a bad flight: %v", f)
+			break
+		}
+		n++
+	}
+	if fi.Err() != nil || n != len(flights) {
+		t.Errorf("iterator saw %d flights (expected %d), err=%v", n, len(flights), fi.Err())
+	}
+
+	// A rewrite leaves only the new payload; and a writer who lost the race doesn't clobber it
+	f,err := db.LookupKey(keyers[0])
+	if err != nil { t.Fatal(err) }
+	stale,err := db.LookupKey(keyers[0])
+	if err != nil { t.Fatal(err) }
+	f.SetTag("REWRITTEN")
+	if err := db.PersistFlightIfUnchanged(f); err != nil { t.Fatal(err) }
+	stale.SetTag("LOSER")
+	if err := db.PersistFlightIfUnchanged(stale); !errors.Is(err, fdb.ErrVersionConflict) {
+		t.Errorf("expected a version conflict, got %v", err)
+	}
+	if _,err := os.Stat(filepath.Join(dir, blobs[0].BlobRef)); !os.IsNotExist(err) {
+		t.Errorf("superseded blob %s still exists (%v)", blobs[0].BlobRef, err)
+	}
+	if f2,err := db.LookupKey(keyers[0]); err != nil || !f2.HasTag("REWRITTEN") || f2.HasTag("LOSER") {
+		t.Errorf("stored payload is wrong: %v, %v", f2, err)
+	}
+
+	// Deleting the flight should delete the external blob
+	if err := db.DeleteByKey(keyers[0]); err != nil {
+		t.Fatal(err)
+	} else if _,err := os.Stat(filepath.Join(dir, f.GetBlobRef())); !os.IsNotExist(err) {
+		t.Errorf("external blob %s still exists after delete (%v)", f.GetBlobRef(), err)
+	}
+}
+
+func TestReencodeFlight(t *testing.T) {
+	ctx := context.Background()
+	p := localds.NewMemoryDSProvider()
+	db := fgae.New(ctx, p)
+	flights := loadFlights(t, db, fakeFlights)
+	if err := db.PersistFlight(flights[0]); err != nil { t.Fatal(err) }
+
+	q := db.NewQuery().ByCallsign(flights[0].Callsign)
+	f,err := db.LookupFirst(q)
+	if err != nil || f == nil { t.Fatalf("lookup: %v / %v", err, f) }
+	if err := db.ReencodeFlight(f, fdb.AsColumnar); err != nil { t.Fatal(err) }
+
+	blobs := []fdb.IndexedFlightBlob{}
+	if _,err := p.GetAll(ctx, &q.Query, &blobs); err != nil {
+		t.Fatal(err)
+	} else if len(blobs) != 1 || blobs[0].BlobEncoding != fdb.AsColumnar {
+		t.Fatalf("expected one columnar entity, got %d: %v", len(blobs), blobs)
+	} else if !blobs[0].LastUpdate.Equal(f.GetLastUpdate()) {
+		t.Errorf("LastUpdate changed: %s -> %s", f.GetLastUpdate(), blobs[0].LastUpdate)
+	}
+
+	if f2,err := db.LookupFirst(q); err != nil {
+		t.Fatal(err)
+	} else if f2.AnyTrack().String() != f.AnyTrack().String() {
+		t.Errorf("track changed:\n%s\n%s", f.AnyTrack(), f2.AnyTrack())
+	}
+}
+
+func TestPrefetchingIterator(t *testing.T) {
+	ctx := context.Background()
+	p := localds.NewMemoryDSProvider()
+	db := fgae.New(ctx, p)
+	for _,f := range loadFlights(t, db, fakeFlights) {
+		if err := db.PersistFlight(f); err != nil { t.Fatal(err) }
+	}
+
+	iterate := func(fi *fgae.FlightIterator, ctx context.Context) []string {
+		defer fi.Close()
+		fi.PageSize = 2
+		ids := []string{}
+		for fi.Iterate(ctx) {
+			ids = append(ids, fi.Flight().IdentityString())
+		}
+		if fi.Err() != nil { t.Errorf("iterator error: %v", fi.Err()) }
+		return ids
+	}
+
+	q := db.NewQuery().Order("-LastUpdate")
+	expected := iterate(db.NewIterator(q), ctx)
+	if actual := iterate(db.NewIterator(q).Prefetch(3), ctx); len(expected) != 9 ||
+		strings.Join(expected,",") != strings.Join(actual,",") {
+		t.Errorf("prefetched flights were out of order:\n%v\n%v", expected, actual)
+	}
+
+	cctx,cancel := context.WithCancel(ctx)
+	fi := db.NewIterator(q).Prefetch(3)
+	defer fi.Close()
+	if !fi.Iterate(cctx) { t.Fatalf("iterator didn't start: %v", fi.Err()) }
+	cancel()
+	for fi.Iterate(cctx) {}
+	if fi.Err() != context.Canceled {
+		t.Errorf("expected the iterator to be cancelled, saw err=%v", fi.Err())
+	}
+}
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	db := fgae.New(ctx, localds.NewMemoryDSProvider())
+	flights := loadFlights(t, db, fakeFlights)
+	for _,f := range flights {
+		if err := db.PersistFlight(f); err != nil { t.Fatal(err) }
+	}
+	grs := fdb.GeoRestrictorSet{Name:"test", User:"someone@example.com"}
+	if err := db.PersistRestrictorSet(grs); err != nil { t.Fatal(err) }
+
+	var buf bytes.Buffer
+	aw,err := fgae.NewArchiveWriter(&buf, "test")
+	if err != nil { t.Fatal(err) }
+	if n,err := db.ExportFlights(aw, db.NewQuery().ByTags([]string{"FOIA"})); err != nil {
+		t.Fatal(err)
+	} else if n != len(flights) {
+		t.Errorf("exported %d flights, expected %d", n, len(flights))
+	}
+	if _,err := db.ExportKind(aw, "RSet"); err != nil { t.Fatal(err) }
+	if err := aw.Close(); err != nil { t.Fatal(err) }
+	archive := buf.Bytes()
+
+	dir,err := os.MkdirTemp("", "fgae")
+	if err != nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	p,err := localds.NewSQLiteDSProvider(filepath.Join(dir, "test.sqlite"))
+	if err != nil { t.Fatal(err) }
+	defer p.Close()
+	db2 := fgae.New(ctx, p)
+	ch := fgae.NewChannelHook(len(flights))
+	db2.AddChangeHook(ch)
+
+	// Importing twice should overwrite; the hooks should hear about every flight, both times
+	for _,again := range []bool{false, true} {
+		ar,err := fgae.NewArchiveReader(bytes.NewReader(archive))
+		if err != nil { t.Fatal(err) }
+		if counts,err := db2.ImportArchive(ar); err != nil {
+			t.Fatal(err)
+		} else if counts["flight"] != len(flights) || counts["RSet"] != 1 {
+			t.Errorf("unexpected counts: %v", counts)
+		}
+		for i:=0; i<len(flights); i++ {
+			select {
+			case c := <-ch.C:
+				if (c.Before != nil) != again {
+					t.Errorf("import (again=%v) had a bad before: %v", again, c.Before)
+				}
+			default:
+				t.Fatalf("import (again=%v) told the hooks about %d flights, not %d", again, i,
+					len(flights))
+			}
+		}
+	}
+
+	// The keys should have survived the move
+	q := db.NewQuery().ByCallsign(flights[3].Callsign)
+	if f1,err := db.LookupFirst(q); err != nil {
+		t.Fatal(err)
+	} else if f2,err := db2.LookupFirst(q); err != nil || f2 == nil {
+		t.Fatalf("restored flight not found: %v", err)
+	} else if f1.GetDatastoreKey() != f2.GetDatastoreKey() || f1.String() != f2.String() {
+		t.Errorf("restored flight differs:\n%s %s\n%s %s", f1.GetDatastoreKey(), f1,
+			f2.GetDatastoreKey(), f2)
+	}
+	if sets,err := db2.LookupRestrictorSets(grs.User); err != nil || len(sets) != 1 {
+		t.Errorf("restored restrictor sets: %v, %v", sets, err)
+	}
+
+	// A truncated archive should be noticed
+	ar,_ := fgae.NewArchiveReader(bytes.NewReader(archive[:len(archive)-10]))
+	if _,err := db2.ImportArchive(ar); err == nil {
+		t.Errorf("truncated archive was imported without error")
+	}
+}
+
+func TestDuplicateMerge(t *testing.T) {
+	ctx := context.Background()
+	p := localds.NewMemoryDSProvider()
+	db := fgae.New(ctx, p)
+	f1 := loadFlights(t, db, fakeFlights)[0]
+	f2 := loadFlights(t, db, fakeFlights)[0]
+
+	// An overlapping copy, with a later start (so a different key), an extra point & a new tag
+	t2 := (*f2.Tracks["FOIA"])[1:]
+	tp := t2[len(t2)-1]
+	tp.TimestampUTC = tp.TimestampUTC.Add(5*time.Second)
+	t2 = append(t2, tp)
+	f2.Tracks["FOIA"] = &t2
+	f2.SetTag("DUP")
+
+	for _,f := range []*fdb.Flight{f1,f2} {
+		if err := db.PersistFlight(f); err != nil { t.Fatal(err) }
+	}
+	q := func() *fgae.FQuery { return db.NewQuery().ByCallsign(f1.Callsign) } // LookupFirst sets a limit
+	if results,err := db.LookupAll(q()); err != nil {
+		t.Fatal(err)
+	} else if len(results) != 2 {
+		t.Fatalf("expected 2 flights before merge, saw %d", len(results))
+	}
+
+	f,err := db.LookupFirst(q())
+	if err != nil { t.Fatal(err) }
+	dm,err := db.PlanDuplicateMerge(f)
+	if err != nil {
+		t.Fatal(err)
+	} else if dm == nil || len(dm.Redundant) != 1 || len(dm.Diffs) != 2 {
+		t.Fatalf("bad merge plan: %v", dm)
+	} else if s,_ := dm.Survivor.Times(); !s.Equal(f1.AnyTrack()[0].TimestampUTC) {
+		t.Errorf("survivor wasn't the earliest flight: %s", dm.Survivor)
+	}
+
+	// Someone else updates the redundant flight after the plan was made; the merge mustn't go
+	// ahead, else their update would be deleted along with it
+	keyer,err := db.Backend.DecodeKey(dm.Redundant[0].GetDatastoreKey())
+	if err != nil { t.Fatal(err) }
+	other,err := db.LookupKey(keyer)
+	if err != nil { t.Fatal(err) }
+	other.SetTag("LATE")
+	if err := db.PersistFlightIfUnchanged(other); err != nil { t.Fatal(err) }
+
+	if err := db.ApplyDuplicateMerge(dm); !errors.Is(err, fdb.ErrVersionConflict) {
+		t.Fatalf("expected a version conflict, got %v", err)
+	} else if results,err := db.LookupAll(q()); err != nil {
+		t.Fatal(err)
+	} else if len(results) != 2 {
+		t.Fatalf("expected both flights to survive the conflict, saw %d", len(results))
+	}
+
+	// Replan & retry
+	f,err = db.LookupFirst(q())
+	if err != nil { t.Fatal(err) }
+	if dm,err = db.PlanDuplicateMerge(f); err != nil { t.Fatal(err) }
+
+	if err := db.ApplyDuplicateMerge(dm); err != nil { t.Fatal(err) }
+	if results,err := db.LookupAll(q()); err != nil {
+		t.Fatal(err)
+	} else if len(results) != 1 {
+		t.Fatalf("expected 1 flight after merge, saw %d", len(results))
+	} else if n := len(results[0].AnyTrack()); n != 4 {
+		t.Errorf("expected 4 points in merged track, saw %d", n)
+	} else if !results[0].HasTag("DUP") || !results[0].HasTag("LATE") {
+		t.Errorf("merged flight lost a tag: %s", results[0])
+	}
+}
+
+func TestSplitFlight(t *testing.T) {
+	db := fgae.New(context.Background(), localds.NewMemoryDSProvider())
+
+	// Three legs: 10m airborne, 5m on the ground, 10m airborne, 20m gap, 10m airborne
+	s := time.Date(2017, 4, 1, 16, 0, 0, 0, time.UTC)
+	track := fdb.Track{}
+	add := func(from, to int, alt, gs float64) {
+		for i:=from; i<to; i+=10 {
+			track = append(track, fdb.Trackpoint{
+				TimestampUTC: s.Add(time.Duration(i) * time.Second),
+				Latlong: geo.Latlong{Lat: 37.6 + float64(i)/10000.0, Long: -122.4},
+				Altitude: alt,
+				GroundSpeed: gs,
+			})
+		}
+	}
+	add(0, 600, 3000, 150)
+	add(600, 900, 10, 10)
+	add(900, 1500, 3000, 150)
+	add(2700, 3300, 3000, 150)
+	f := fdb.BlankFlight()
+	f.IcaoId, f.Callsign = "A12345", "N12345"
+	f.Tracks["ADSB"] = &track
+	if err := db.PersistFlight(&f); err != nil { t.Fatal(err) }
+
+	q := func() *fgae.FQuery { return db.NewQuery().ByCallsign("N12345") }
+
+	// Someone else updates the flight after we read it; none of the legs should get written
+	keyer,err := db.Backend.DecodeKey(f.GetDatastoreKey())
+	if err != nil { t.Fatal(err) }
+	other,err := db.LookupKey(keyer)
+	if err != nil { t.Fatal(err) }
+	other.SetTag("LATE")
+	if err := db.PersistFlightIfUnchanged(other); err != nil { t.Fatal(err) }
+
+	if _,err := db.SplitFlight(&f, fdb.DefaultLegSplitOptions); !errors.Is(err, fdb.ErrVersionConflict) {
+		t.Fatalf("expected a version conflict, got %v", err)
+	} else if results,err := db.LookupAll(q()); err != nil {
+		t.Fatal(err)
+	} else if len(results) != 1 {
+		t.Fatalf("expected just the original flight after the conflict, saw %d", len(results))
+	}
+
+	// Re-read & retry
+	if legs,err := db.SplitFlight(other, fdb.DefaultLegSplitOptions); err != nil {
+		t.Fatal(err)
+	} else if len(legs) != 3 {
+		t.Fatalf("expected 3 legs, saw %d", len(legs))
+	}
+	if results,err := db.LookupAll(q()); err != nil {
+		t.Fatal(err)
+	} else if len(results) != 3 {
+		t.Errorf("expected 3 flights after the split, saw %d", len(results))
+	}
+}
+
+func TestCondensedDays(t *testing.T) {
+	ctx := context.Background()
+	db := fgae.New(ctx, localds.NewMemoryDSProvider())
+	patcher := &laterPatcher{}
+	db.CondensedDayPatcher = patcher
+	flights := loadFlights(t, db, fakeFlights)
+	for _,f := range flights {
+		if err := db.PersistFlight(f); err != nil { t.Fatal(err) }
+	}
+
+	// The fake flights straddle two PDT days, 2017/03/31 and 2017/04/01
+	s := date.ArbitraryDatestring2MidnightPdt("2017/03/31", "2006/01/02")
+	e := s.AddDate(0,0,2).Add(-time.Second)
+	generations := map[string]bool{}
+	fetch := func(tags []string, expected int) string {
+		set,err,str := db.FetchCondensedFlightSet(s,e,tags)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(set.Flights) != expected || set.Live {
+			t.Errorf("expected %d flights, saw %d\n%s", expected, len(set.Flights), str)
+		}
+		return set.Generation
+	}
+	// Each change should bring a generation we haven't seen before
+	fetchNew := func(tags []string, expected int) {
+		if g := fetch(tags, expected); generations[g] {
+			t.Errorf("generation %s has been seen before", g)
+		} else {
+			generations[g] = true
+		}
+	}
+
+	fetchNew(nil, len(flights))
+	if g1,g2 := fetch(nil, len(flights)), fetch([]string{"^EPICK"}, 0); !generations[g1] || g1 != g2 {
+		t.Errorf("generation changed without any changes: %s, %s", g1, g2)
+	}
+
+	// Changes get patched into the materialized days, once the patcher gets round to it
+	f,err := db.LookupFirst(db.NewQuery().ByCallsign(flights[0].Callsign))
+	if err != nil || f == nil { t.Fatalf("lookup: %v / %v", err, f) }
+	f.SetWaypoint("EPICK", f.AnyTrack()[0].TimestampUTC)
+	if err := db.PersistFlight(f); err != nil { t.Fatal(err) }
+	fetch([]string{"^EPICK"}, 0)
+	patcher.run(t, db)
+	fetchNew([]string{"^EPICK"}, 1)
+
+	keyer,err := db.Backend.DecodeKey(f.GetDatastoreKey())
+	if err != nil { t.Fatal(err) }
+	if err := db.DeleteByKey(keyer); err != nil { t.Fatal(err) }
+	patcher.run(t, db)
+	fetchNew(nil, len(flights)-1)
+
+	// A rebuilt day mustn't reuse an old generation
+	shards,err := db.Backend.GetAll(ctx, ds.NewQuery("CondensedDay").KeysOnly(), nil)
+	if err != nil || len(shards) == 0 { t.Fatalf("no shards: %v", err) }
+	if err := db.Backend.DeleteMulti(ctx, shards); err != nil { t.Fatal(err) }
+	fetchNew(nil, len(flights)-1)
+}
+
+// A provider that lets someone else write just after the first time flights are read
+type readInterloper struct {
+	*localds.MemoryDSProvider
+	mu     sync.Mutex
+	after  func()
+}
+func (p *readInterloper)GetMulti(ctx context.Context, keyers []ds.Keyer, dst interface{}) error {
+	err := p.MemoryDSProvider.GetMulti(ctx, keyers, dst)
+	if _,ok := dst.([]fdb.IndexedFlightBlob); ok {
+		p.mu.Lock()
+		after := p.after
+		p.after = nil
+		p.mu.Unlock()
+		if after != nil { after() }
+	}
+	return err
+}
+
+// A flight that changes while its day is being materialized (after the build has read it)
+// mustn't be left out of date in the stored shards.
+func TestCondensedDayBuildRace(t *testing.T) {
+	ctx := context.Background()
+	p := &readInterloper{MemoryDSProvider: localds.NewMemoryDSProvider()}
+	db := fgae.New(ctx, p)
+	flights := loadFlights(t, db, fakeFlights)
+	for _,f := range flights {
+		if err := db.PersistFlight(f); err != nil { t.Fatal(err) }
+	}
+
+	f := flights[0]
+	s,e := date.WindowForTime(date.InPdt(f.AnyTrack()[0].TimestampUTC))
+	p.after = func() {
+		f.SetWaypoint("EPICK", f.AnyTrack()[0].TimestampUTC)
+		if err := db.PersistFlight(f); err != nil { t.Error(err) }
+	}
+
+	for i:=0; i<2; i++ { // The second time, it comes from the stored shards
+		if set,err,str := db.FetchCondensedFlightSet(s,e,[]string{"^EPICK"}); err != nil {
+			t.Fatal(err)
+		} else if len(set.Flights) != 1 {
+			t.Errorf("[%d] expected the changed flight, saw %d flights\n%s", i, len(set.Flights), str)
+		}
+	}
+	if p.after != nil {
+		t.Errorf("the flight never got changed")
+	}
+}
+
+// A CondensedDayPatcher that waits to be told to run
+type laterPatcher struct {
+	keys     []string
+	shards [][]string
+}
+func (p *laterPatcher)PatchLater(ctx context.Context, key string, shards []string) error {
+	p.keys, p.shards = append(p.keys, key), append(p.shards, shards)
+	return nil
+}
+func (p *laterPatcher)run(t *testing.T, db fgae.FlightDB) {
+	for i,key := range p.keys {
+		if err := db.PatchCondensedDays(key, p.shards[i]); err != nil { t.Error(err) }
+	}
+	p.keys, p.shards = nil, nil
+}
+
+func TestChangeHooks(t *testing.T) {
+	dir,err := os.MkdirTemp("", "fgae")
+	if err != nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	db := fgae.New(ctx, localds.NewMemoryDSProvider())
+	ch := fgae.NewChannelHook(10)
+	jh,err := fgae.NewJournalHook(filepath.Join(dir, "journal"))
+	if err != nil { t.Fatal(err) }
+	db.AddChangeHook(ch)
+	db.AddChangeHook(jh)
+
+	f := loadFlights(t, db, fakeFlights)[0]
+	if err := db.PersistFlight(f); err != nil { t.Fatal(err) }
+	f.SetTag("RETAGGED")
+	if err := db.PersistFlight(f); err != nil { t.Fatal(err) }
+	stored,err := db.LookupFirst(db.NewQuery().ByCallsign(f.Callsign))
+	if err != nil || stored == nil { t.Fatalf("lookup: %v / %v", err, stored) }
+	keyer,err := db.Backend.DecodeKey(stored.GetDatastoreKey())
+	if err != nil { t.Fatal(err) }
+	if err := db.DeleteByKey(keyer); err != nil { t.Fatal(err) }
+	if err := jh.Close(); err != nil { t.Fatal(err) }
+
+	check := func(changes []fgae.FlightChange) {
+		if len(changes) != 3 {
+			t.Fatalf("expected 3 changes, saw %d: %v", len(changes), changes)
+		}
+		if c := changes[0]; c.Before != nil || c.After == nil || c.After.Ident != f.Callsign {
+			t.Errorf("bad create: %s", c)
+		}
+		if c := changes[1]; c.Before == nil || len(c.After.Tags) != len(c.Before.Tags)+1 {
+			t.Errorf("bad retag: %s", c)
+		}
+		if c := changes[2]; !c.Deleted || c.After != nil || c.Before == nil ||
+			c.Key != stored.GetDatastoreKey() {
+			t.Errorf("bad delete: %s", c)
+		}
+	}
+
+	check([]fgae.FlightChange{<-ch.C, <-ch.C, <-ch.C})
+
+	journal,err := os.Open(filepath.Join(dir, "journal"))
+	if err != nil { t.Fatal(err) }
+	defer journal.Close()
+	changes := []fgae.FlightChange{}
+	err = fgae.ReadJournal(journal, func(c fgae.FlightChange) error {
+		changes = append(changes, c)
+		return nil
+	})
+	if err != nil { t.Fatal(err) }
+	check(changes)
+}
+
+func TestSharedRestrictorSets(t *testing.T) {
+	db := fgae.New(context.Background(), localds.NewMemoryDSProvider())
+
+	shared := fdb.GeoRestrictorSet{Name:"shared", User:"owner@example.com",
+		Editors:[]string{"Editor@example.com"}, Viewers:[]string{"viewer@example.com"}}
+	public := fdb.GeoRestrictorSet{Name:"public", User:"other@example.com", Public:true}
+	for _,grs := range []fdb.GeoRestrictorSet{shared, public} {
+		if err := db.PersistRestrictorSet(grs); err != nil { t.Fatal(err) }
+	}
+
+	lookup := func(user string, expected int) []fdb.GeoRestrictorSet {
+		sets,err := db.LookupRestrictorSets(user)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(sets) != expected {
+			t.Errorf("%s: expected %d sets, saw %d: %v", user, expected, len(sets), sets)
+		}
+		return sets
+	}
+
+	if sets := lookup("owner@example.com", 2); len(sets) > 0 && !sets[0].IsOwner("owner@example.com") {
+		t.Errorf("owned sets should come first: %v", sets)
+	}
+	if sets := lookup("editor@example.com", 2); len(sets) == 2 && !sets[1].CanEdit("editor@example.com") {
+		t.Errorf("editor can't edit: %v", sets[1])
+	}
+	lookup("other@example.com", 1)
+	lookup("nobody@example.com", 1)
+
+	sets := lookup("viewer@example.com", 2)
+	if len(sets) != 2 { return }
+	if sets[1].CanEdit("viewer@example.com") {
+		t.Errorf("viewer can edit: %v", sets[1])
+	}
+	cp,err := db.CopyRestrictorSet(sets[1].DSKey, "viewer@example.com")
+	if err != nil { t.Fatal(err) }
+	if !cp.IsOwner("viewer@example.com") || len(cp.Editors) != 0 || cp.DSKey == sets[1].DSKey {
+		t.Errorf("bad copy: %v", cp)
+	}
+	lookup("viewer@example.com", 3)
+	lookup("editor@example.com", 2)
 }
 
 var (
@@ -164,8 +845,6 @@ III1234,20170401607,20170401NCT9111III1234,NCT,9234,SFO,HYA,CRJ3,37.7868,-122.27
 	// }}}
 )
 
-*/
-
 // {{{ -------------------------={ E N D }=----------------------------------
 
 // Local variables:
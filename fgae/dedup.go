@@ -0,0 +1,129 @@
+package fgae
+
+import(
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/skypies/adsb"
+	fdb "github.com/skypies/flightdb"
+)
+
+// {{{ db.FindDuplicates
+
+// FindDuplicates returns the other stored flights that look like they're the same flight as
+// f (see fdb.Flight.IsDuplicateOf).
+func (db *FlightDB)FindDuplicates(f *fdb.Flight) ([]*fdb.Flight, error) {
+	if len(f.Tracks) == 0 { return nil, nil }
+
+	q := db.NewQuery()
+	if f.IcaoId != "" {
+		q.ByIcaoId(adsb.IcaoId(f.IcaoId))
+	} else if f.Callsign != "" {
+		q.ByCallsign(f.Callsign)
+	} else {
+		return nil, nil
+	}
+	s,e := f.Times()
+	q.ByTimeRange(s,e)
+
+	candidates,err := db.LookupAll(q)
+	if err != nil { return nil, fmt.Errorf("FindDuplicates: %v", err) }
+
+	dups := []*fdb.Flight{}
+	for _,cand := range candidates {
+		if cand.GetDatastoreKey() == f.GetDatastoreKey() { continue }
+		if f.IsDuplicateOf(*cand) {
+			dups = append(dups, cand)
+		}
+	}
+	return dups, nil
+}
+
+// }}}
+// {{{ db.PlanDuplicateMerge
+
+// DuplicateMerge describes how a set of duplicate flights would be folded into one.
+type DuplicateMerge struct {
+	Survivor   *fdb.Flight   // The flight that everything gets merged into ...
+	Redundant  []*fdb.Flight // ... and the ones that get deleted afterwards
+	Diffs      []string      // What would change in the survivor
+}
+
+// PlanDuplicateMerge finds f's duplicates, and works out how they would be merged; it is nil
+// if there are none. The survivor is the flight that started first (ties broken by key), so
+// that all the flights in a set pick the same one. The flights are not modified.
+func (db *FlightDB)PlanDuplicateMerge(f *fdb.Flight) (*DuplicateMerge, error) {
+	dups,err := db.FindDuplicates(f)
+	if err != nil || len(dups) == 0 { return nil, err }
+
+	all := append([]*fdb.Flight{f}, dups...)
+	sort.Slice(all, func(i,j int) bool {
+		si,_ := all[i].Times()
+		sj,_ := all[j].Times()
+		if !si.Equal(sj) { return si.Before(sj) }
+		return all[i].GetDatastoreKey() < all[j].GetDatastoreKey()
+	})
+
+	// Do the merge on a copy, to see what would change
+	merged := copyFlight(all[0])
+	dm := DuplicateMerge{Survivor: all[0], Redundant: all[1:]}
+	for _,dup := range dm.Redundant {
+		for _,diff := range merged.MergeDuplicate(*dup) {
+			dm.Diffs = append(dm.Diffs, fmt.Sprintf("[%s] %s", dup.GetDatastoreKey(), diff))
+		}
+	}
+
+	return &dm, nil
+}
+
+// Copies enough of the flight that merging into the copy leaves the original alone
+func copyFlight(f *fdb.Flight) *fdb.Flight {
+	c := *f
+	c.Tracks,c.Tags,c.Waypoints = map[string]*fdb.Track{}, map[string]int{}, map[string]time.Time{}
+	for k,v := range f.Tracks {
+		t := append(fdb.Track{}, (*v)...)
+		c.Tracks[k] = &t
+	}
+	for k,v := range f.Tags { c.Tags[k] = v }
+	for k,v := range f.Waypoints { c.Waypoints[k] = v }
+	return &c
+}
+
+// }}}
+// {{{ db.ApplyDuplicateMerge
+
+// ApplyDuplicateMerge merges the redundant flights into the survivor, and persists it while
+// deleting the redundant flights, in a single write. The survivor keeps the most recent
+// LastUpdate of the set, so LookupMostRecent still finds it. If someone else modified any of
+// the flights in the meantime, an error wrapping fdb.ErrVersionConflict is returned, and
+// nothing is written or deleted.
+func (db *FlightDB)ApplyDuplicateMerge(dm *DuplicateMerge) error {
+	f := dm.Survivor
+	lastUpdate := f.GetLastUpdate()
+	for _,dup := range dm.Redundant {
+		f.MergeDuplicate(*dup)
+		if dup.GetLastUpdate().After(lastUpdate) { lastUpdate = dup.GetLastUpdate() }
+	}
+
+	blob,err := f.ToBlob()
+	if err != nil { return fmt.Errorf("ApplyDuplicateMerge: %v", err) }
+	if !lastUpdate.IsZero() {
+		blob.LastUpdate = lastUpdate
+	}
+	blobs := []*fdb.IndexedFlightBlob{blob}
+	if err := db.persistReplacing([]*fdb.Flight{f}, blobs, dm.Redundant); err != nil {
+		return fmt.Errorf("ApplyDuplicateMerge: %w", err)
+	}
+	return nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
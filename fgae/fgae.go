@@ -19,6 +19,8 @@ type FlightDB struct {
 	StartTime         time.Time
 	Backend           ds.DatastoreProvider
 	SingletonProvider singleton.SingletonProvider
+	ChangeHooks     []ChangeHook // Told about every persist & delete; see changes.go
+	CondensedDayPatcher CondensedDayPatcher // Patches the materialized days; see condensed.go
 }
 
 func New(ctx context.Context, p ds.DatastoreProvider) FlightDB {
@@ -31,6 +33,9 @@ func New(ctx context.Context, p ds.DatastoreProvider) FlightDB {
 		// will read/write to datastore. High volume functions should use one with a
 		// memcaching layer on top.
 		SingletonProvider: sprovider.NewProvider(p),
+
+		ChangeHooks: append([]ChangeHook{}, DefaultChangeHooks...),
+		CondensedDayPatcher: DefaultCondensedDayPatcher,
 	}
 }
 
@@ -2,39 +2,218 @@ package fgae
 
 import(
 	"golang.org/x/net/context"
+
 	"github.com/skypies/util/gcp/ds"
 	fdb "github.com/skypies/flightdb"
 )
 
-// A shim on the dsprovider iterator that can talk flights
-type FlightIterator ds.Iterator
+// A batching iterator that can talk flights. Like ds.Iterator, it runs the query as
+// keys-only, and then fetches pages of flights as it goes; unlike it, it can be resumed, via
+// Cursor() and FQuery.StartAt(). The keys are fetched a page at a time too, as the iterator
+// gets to them. Call Prefetch() to have the pages fetched & decoded in the background.
+type FlightIterator struct {
+	p          ds.DatastoreProvider
+	PageSize   int
+
+	keys      *keyStream  // All the keys after the start cursor
+	next       int        // Position in the keys of the next flight to return
+
+	page     []fdb.IndexedFlightBlob
+	pageKeyers []ds.Keyer // The keys for the current page
+	pageStart  int        // Position in the keys of the current page's first flight
+
+	blob       fdb.IndexedFlightBlob // The current flight ...
+	keyer      ds.Keyer              // ... and its key
+	err        error
+
+	// Only used when prefetching
+	workers    int
+	pages      chan chan prefetchedPage // In query order; closed when there are no more
+	flights    []*fdb.Flight            // The current page, decoded
+	flight     *fdb.Flight
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// How many goroutines fetch & decode flights, for callers that want to use Prefetch
+var DefaultPrefetchWorkers = 8
+
+type prefetchedPage struct {
+	keyers   []ds.Keyer
+	flights  []*fdb.Flight
+	err      error
+}
 
 func NewFlightIterator(ctx context.Context, p ds.DatastoreProvider, fq *FQuery) *FlightIterator {
-	it := ds.NewIterator(ctx, p, (*ds.Query)(fq), fdb.IndexedFlightBlob{})
-	return (*FlightIterator)(it)
+	fi := FlightIterator{p:p, PageSize:10}
+	db := FlightDB{ctx:ctx, Backend:p}
+	fi.keys,fi.err = db.newKeyStream(fq)
+	return &fi
 }
 
 func (fi *FlightIterator)Iterate(ctx context.Context) bool {
-	it := (*ds.Iterator)(fi)
-	return it.Iterate(ctx)
+	if fi.err != nil {
+		return false
+	} else if fi.workers > 0 {
+		return fi.iteratePrefetched(ctx)
+	}
+
+	// Fetch the next page, if we've run off the end of this one
+	if fi.page == nil || fi.next >= fi.pageStart+len(fi.page) {
+		keyers,err := fi.keys.get(fi.next, fi.PageSize)
+		if err != nil {
+			fi.err = err
+			return false
+		} else if len(keyers) == 0 {
+			return false
+		}
+		fi.page, fi.pageKeyers = make([]fdb.IndexedFlightBlob, len(keyers)), keyers
+		fi.pageStart = fi.next
+		if err := fi.p.GetMulti(ctx, keyers, fi.page); err != nil {
+			fi.err = err
+			return false
+		}
+	}
+
+	fi.blob, fi.keyer = fi.page[fi.next-fi.pageStart], fi.pageKeyers[fi.next-fi.pageStart]
+	fi.next++
+	return true
 }
 
-func (fi *FlightIterator)Err() error {
-	it := (*ds.Iterator)(fi)
-	return it.Err()
+func (fi *FlightIterator)Err() error { return fi.err }
+
+// Remaining returns how many flights are yet to be returned. It has to fetch all the rest of
+// the keys to find out.
+func (fi *FlightIterator)Remaining() int {
+	if fi.err != nil { return 0 }
+	n,err := fi.keys.count(fi.next)
+	if err != nil { fi.err = err }
+	return n
 }
 
-func (fi *FlightIterator)Flight() *fdb.Flight {
-	blob := fdb.IndexedFlightBlob{}
+// Cursor returns an opaque string which marks the position after the most recently returned
+// flight; pass it to FQuery.StartAt to resume from there. It is "" if there are no more.
+func (fi *FlightIterator)Cursor() string {
+	if fi.err != nil { return "" }
+	key := ""
+	if fi.keyer != nil {
+		key = fi.keyer.Encode()
+	}
+	c,err := fi.keys.cursorAt(fi.next, key)
+	if err != nil { fi.err = err }
+	return c
+}
 
-	it := (*ds.Iterator)(fi)
-	keyer := it.Val(&blob)
+func (fi *FlightIterator)Flight() *fdb.Flight {
+	if fi.keyer == nil { return nil }
+	if fi.workers > 0 { return fi.flight }
 
-	f, err := blob.ToFlight(keyer.Encode())
+	f, err := fi.blob.ToFlight(fi.keyer.Encode())
 	if err != nil {
-		it.SetErr(err)
+		fi.err = err
 		return nil
 	}
 
 	return f
 }
+
+// Prefetch makes the iterator fetch and decode pages of flights on a pool of this many
+// goroutines, running ahead of the caller; the flights are still returned in query order. If
+// any page fails, iteration stops and Err() returns the first error. Cancelling the context
+// passed to Iterate stops the workers; so does Close(), which callers that might stop early
+// should defer.
+func (fi *FlightIterator)Prefetch(workers int) *FlightIterator {
+	fi.workers = workers
+	return fi
+}
+
+func (fi *FlightIterator)Close() {
+	if fi.cancel != nil { fi.cancel() }
+}
+
+func (fi *FlightIterator)iteratePrefetched(ctx context.Context) bool {
+	if fi.pages == nil {
+		fi.startPrefetch(ctx)
+	}
+	if err := fi.ctx.Err(); err != nil {
+		fi.err = err
+		return false
+	}
+
+	if fi.flights == nil || fi.next >= fi.pageStart+len(fi.flights) {
+		page := prefetchedPage{}
+		select {
+		case ch,ok := <-fi.pages:
+			if !ok { return false }
+			select {
+			case page = <-ch:
+			case <-fi.ctx.Done(): page.err = fi.ctx.Err()
+			}
+		case <-fi.ctx.Done(): page.err = fi.ctx.Err()
+		}
+		if page.err != nil {
+			fi.err = page.err
+			fi.Close()
+			return false
+		}
+		fi.flights, fi.pageKeyers, fi.pageStart = page.flights, page.keyers, fi.next
+	}
+
+	fi.flight, fi.keyer = fi.flights[fi.next-fi.pageStart], fi.pageKeyers[fi.next-fi.pageStart]
+	fi.next++
+	return true
+}
+
+// The dispatcher hands out pages to the workers in order, and queues up a channel for each
+// page's results; the queue's length limits how far ahead of the caller we get (and so how
+// far ahead the keys get fetched).
+func (fi *FlightIterator)startPrefetch(ctx context.Context) {
+	fi.ctx,fi.cancel = context.WithCancel(ctx)
+	fi.pages = make(chan chan prefetchedPage, fi.workers)
+	ctx = fi.ctx
+
+	go func() {
+		defer close(fi.pages)
+		sem := make(chan bool, fi.workers)
+		for start := fi.next; ; start += fi.PageSize {
+			keyers,err := fi.keys.get(start, fi.PageSize)
+			if err == nil && len(keyers) == 0 { return }
+
+			ch := make(chan prefetchedPage, 1)
+			select {
+			case fi.pages <- ch:
+			case <-ctx.Done(): return
+			}
+			if err != nil {
+				ch <- prefetchedPage{err: err}
+				return
+			}
+			select {
+			case sem <- true:
+			case <-ctx.Done(): return
+			}
+
+			go func(keyers []ds.Keyer) {
+				defer func() { <-sem }()
+				ch <- fetchPage(ctx, fi.p, keyers)
+			}(keyers)
+		}
+	}()
+}
+
+func fetchPage(ctx context.Context, p ds.DatastoreProvider, keyers []ds.Keyer) prefetchedPage {
+	blobs := make([]fdb.IndexedFlightBlob, len(keyers))
+	if err := p.GetMulti(ctx, keyers, blobs); err != nil {
+		return prefetchedPage{err: err}
+	}
+
+	page := prefetchedPage{keyers: keyers}
+	for i,blob := range blobs {
+		if ctx.Err() != nil { return prefetchedPage{err: ctx.Err()} }
+		f,err := blob.ToFlight(keyers[i].Encode())
+		if err != nil { return prefetchedPage{err: err} }
+		page.flights = append(page.flights, f)
+	}
+	return page
+}
+
@@ -3,8 +3,11 @@ package fgae
 // This package contains flight query builders that sit on top of db/query.go
 
 import(
+	"fmt"
+	"strings"
 	"time"
 	"github.com/skypies/adsb"
+	"github.com/skypies/geo"
 	"github.com/skypies/util/date"
 
 	ds "github.com/skypies/util/gcp/ds"
@@ -13,14 +16,64 @@ import(
 
 const kFlightKind = "flight" // where should this *really* live ?
 
-type FQuery ds.Query // Create our own type, so we can hang a fluent API off it
+// Create our own type, so we can hang a fluent API off it
+type FQuery struct {
+	ds.Query
+	StartCursor string // If set, results resume from here; see FlightIterator.Cursor
 
-func NewFlightQuery() *FQuery { return (*FQuery)(ds.NewQuery(kFlightKind)) }
+	// Datastore can't do OR, so if these are set, we run one query per filter (each one added
+	// to the regular filters), and take the union. Each call to FilterAnyOf adds a group; a
+	// match has to be in the union of every group. The results aren't ordered, though.
+	AnyOf     [][]ds.Filter
 
-func (fq *FQuery)Order(str string) *FQuery { return (*FQuery)((*ds.Query)(fq).Order(str)) }
-func (fq *FQuery)Limit(val int) *FQuery { return (*FQuery)((*ds.Query)(fq).Limit(val)) }
+	// Like AnyOf, but each query has just the one filter, not the regular filters as well; so
+	// they need no composite index with them. Only for tokens that are selective by themselves.
+	AnyOfAlone [][]ds.Filter
+}
+
+func NewFlightQuery() *FQuery { return &FQuery{Query: *ds.NewQuery(kFlightKind)} }
+
+func (fq *FQuery)Order(str string) *FQuery { fq.Query.Order(str); return fq }
+func (fq *FQuery)Limit(val int) *FQuery { fq.Query.Limit(val); return fq }
 func (fq *FQuery)Filter(str string, val interface{}) *FQuery {
-	return (*FQuery)((*ds.Query)(fq).Filter(str,val))
+	fq.Query.Filter(str,val)
+	return fq
+}
+func (fq *FQuery)StartAt(cursor string) *FQuery { fq.StartCursor = cursor; return fq }
+func (fq *FQuery)FilterAnyOf(str string, vals []interface{}) *FQuery {
+	group := []ds.Filter{}
+	for _,val := range vals {
+		group = append(group, ds.Filter{Field:str, Value:val})
+	}
+	fq.AnyOf = append(fq.AnyOf, group)
+	return fq
+}
+func (fq *FQuery)FilterAnyOfAlone(str string, vals []interface{}) *FQuery {
+	n := len(fq.AnyOf)
+	fq.FilterAnyOf(str, vals)
+	fq.AnyOfAlone = append(fq.AnyOfAlone, fq.AnyOf[n])
+	fq.AnyOf = fq.AnyOf[:n]
+	return fq
+}
+
+func (fq *FQuery)String() string {
+	str := fq.Query.String()
+	for _,group := range fq.AnyOf {
+		vals := []interface{}{}
+		for _,f := range group { vals = append(vals, f.Value) }
+		if len(group) > 0 {
+			str += fmt.Sprintf("  .FilterAnyOf(%q, %v)\n", group[0].Field, vals)
+		}
+	}
+	for _,group := range fq.AnyOfAlone {
+		vals := []interface{}{}
+		for _,f := range group { vals = append(vals, f.Value) }
+		if len(group) > 0 {
+			str += fmt.Sprintf("  .FilterAnyOfAlone(%q, %v)\n", group[0].Field, vals)
+		}
+	}
+	if fq.StartCursor != "" { str += fmt.Sprintf("  .StartAt(%q)\n", fq.StartCursor) }
+	return str
 }
 
 
@@ -67,6 +120,71 @@ func (q *FQuery)ByWaypoints(waypoints []string) *FQuery {
 	return q
 }
 
+func (q *FQuery)ByEquipment(equip string) *FQuery {
+	return q.Filter("EquipmentType = ", strings.ToUpper(equip))
+}
+// Two letters for the IATA airline code (UA), else the ICAO one (UAL)
+func (q *FQuery)ByAirline(code string) *FQuery {
+	code = strings.ToUpper(code)
+	if len(code) == 2 {
+		return q.Filter("AirlineIATA = ", code)
+	}
+	return q.Filter("AirlineICAO = ", code)
+}
+func (q *FQuery)ByOrigin(airport string) *FQuery {
+	return q.Filter("Origin = ", strings.ToUpper(airport))
+}
+func (q *FQuery)ByDestination(airport string) *FQuery {
+	return q.Filter("Destination = ", strings.ToUpper(airport))
+}
+func (q *FQuery)ByRegistration(reg string) *FQuery {
+	return q.Filter("Registration = ", strings.ToUpper(reg))
+}
+
+// ByBoundingBox matches flights that might have passed through the area, using the coarse cell
+// index (see fdb.CellsForBox); flights indexed before cells existed will not be found. There
+// is no index for Cells with Timeslots, so don't use it with ByTimeRange; use ByCellsDuring.
+func (q *FQuery)ByBoundingBox(box geo.LatlongBox) *FQuery {
+	vals := []interface{}{}
+	for _,cell := range fdb.CellsForBox(box) { vals = append(vals, cell) }
+	return q.FilterAnyOf("Cells = ", vals)
+}
+
+// ByCellsDuring matches flights that passed through at least one of the cells during [s,e],
+// to the nearest fdb.CellTimeslotDuration. Each cell & slot is queried alone, and the results
+// intersected with the rest of the query; flights indexed before cell times existed will not
+// be found.
+func (q *FQuery)ByCellsDuring(cells []string, s,e time.Time) *FQuery {
+	vals := []interface{}{}
+	for _,cell := range cells {
+		for _,token := range fdb.CellTimeTokens(cell, s, e) {
+			vals = append(vals, token)
+		}
+	}
+	return q.FilterAnyOfAlone("CellTimes = ", vals)
+}
+
+// ByWaypointAt matches flights that passed the waypoint sometime in [s,e], to the nearest
+// fdb.WaypointTimeslotDuration; flights indexed before waypoint times existed will not be found.
+func (q *FQuery)ByWaypointAt(wp string, s,e time.Time) *FQuery {
+	return q.ByAnyWaypointAt([]string{wp}, []geo.TimeRange{{U:s, V:e}})
+}
+// ByAnyWaypointAt matches flights that passed at least one of the waypoints during at least
+// one of the time ranges.
+func (q *FQuery)ByAnyWaypointAt(waypoints []string, trs []geo.TimeRange) *FQuery {
+	vals := []interface{}{}
+	seen := map[string]bool{}
+	for _,wp := range waypoints {
+		for _,tr := range trs {
+			for _,token := range fdb.WaypointTimeTokens(wp, tr.U, tr.V) {
+				if !seen[token] { vals = append(vals, token) }
+				seen[token] = true
+			}
+		}
+	}
+	return q.FilterAnyOf("WaypointTimes = ", vals)
+}
+
 func (q *FQuery)ByIdSpec(idspec fdb.IdSpec) *FQuery {
 	if idspec.Duration != 0 {
 		q.ByTimeRange(idspec.Time, idspec.Time.Add(idspec.Duration))
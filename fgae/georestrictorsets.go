@@ -2,6 +2,8 @@ package fgae
 
 import(
 	"fmt"
+	"io"
+	"sort"
 	"strings"
 	"golang.org/x/net/context"
 
@@ -17,33 +19,57 @@ func userToRootKey(ctx context.Context, p ds.DatastoreProvider, user string) ds.
 
 // {{{ db.LookupRestrictorSets
 
+// LookupRestrictorSets returns the sets the user owns, followed by the ones that have been
+// shared with them (including public ones), sorted by name.
 func (flightdb *FlightDB)LookupRestrictorSets(userEmail string) ([]fdb.GeoRestrictorSet, error) {
-	q := ds.NewQuery(kRestrictorSetKind).
-		Ancestor(userToRootKey(flightdb.Ctx(), flightdb.Backend, userEmail))
-
-	blobs := []fdb.IndexedRestrictorSetBlob{}
-	keyers, err := flightdb.Backend.GetAll(flightdb.Ctx(), q, &blobs)
-	if err != nil {
-		return nil, err
+	user := strings.ToLower(userEmail)
+	queries := []*ds.Query{
+		ds.NewQuery(kRestrictorSetKind).Ancestor(userToRootKey(flightdb.Ctx(), flightdb.Backend, user)),
+		ds.NewQuery(kRestrictorSetKind).Filter("Editors = ", user),
+		ds.NewQuery(kRestrictorSetKind).Filter("Viewers = ", user),
+		ds.NewQuery(kRestrictorSetKind).Filter("Public = ", true),
 	}
 
-	rsets := []fdb.GeoRestrictorSet{}
-	for i,blob := range blobs {
-		if rset,err := blob.ToRestrictorSet(keyers[i].Encode()); err != nil {
+	owned, shared := []fdb.GeoRestrictorSet{}, []fdb.GeoRestrictorSet{}
+	seen := map[string]bool{}
+	for _,q := range queries {
+		blobs := []fdb.IndexedRestrictorSetBlob{}
+		keyers, err := flightdb.Backend.GetAll(flightdb.Ctx(), q, &blobs)
+		if err != nil {
 			return nil, err
-		} else {
-			rsets = append(rsets, *rset)
+		}
+
+		for i,blob := range blobs {
+			key := keyers[i].Encode()
+			if seen[key] { continue }
+			seen[key] = true
+			if rset,err := blob.ToRestrictorSet(key); err != nil {
+				return nil, err
+			} else if rset.IsOwner(user) {
+				owned = append(owned, *rset)
+			} else if rset.CanView(user) {
+				shared = append(shared, *rset)
+			}
 		}
 	}
 
-	return rsets, nil
+	sort.SliceStable(shared, func(i,j int) bool { return shared[i].Name < shared[j].Name })
+	return append(owned, shared...), nil
 }
 
 // }}}
 // {{{ db.PersistRestrictorSet
 
 func (flightdb *FlightDB)PersistRestrictorSet(grs fdb.GeoRestrictorSet) error {
+	_,err := flightdb.persistRestrictorSet(grs)
+	return err
+}
+
+// Returns the encoded key of the set
+func (flightdb *FlightDB)persistRestrictorSet(grs fdb.GeoRestrictorSet) (string, error) {
 	strings.ToLower(grs.User)
+	grs.Editors = fdb.NormalizeUsers(grs.Editors)
+	grs.Viewers = fdb.NormalizeUsers(grs.Viewers)
 
 	// Default to an incomplete key (i.e. a new thing), but overwrite if we have a real key
 	keyer := flightdb.Backend.NewIncompleteKey(flightdb.Ctx(), kRestrictorSetKind,
@@ -53,21 +79,78 @@ func (flightdb *FlightDB)PersistRestrictorSet(grs fdb.GeoRestrictorSet) error {
 		var err error
 		keyer,err = flightdb.Backend.DecodeKey(grs.DSKey)
 		if err != nil {
-			return fmt.Errorf("PersistRestrictorSet[%s]: bad key '%s': %v", grs, grs.DSKey, err)
+			return "", fmt.Errorf("PersistRestrictorSet[%s]: bad key '%s': %v", grs, grs.DSKey, err)
 		}
 	}
 
 	blob,err := grs.ToBlob()
 	if err != nil {
-		return fmt.Errorf("PersistRestrictorSet[%s]: ToBlob err: %v", grs, err)
+		return "", fmt.Errorf("PersistRestrictorSet[%s]: ToBlob err: %v", grs, err)
 	}
 
-	_,err = flightdb.Backend.Put(flightdb.Ctx(), keyer, blob)
+	keyer,err = flightdb.Backend.Put(flightdb.Ctx(), keyer, blob)
 	if err != nil {
-		return fmt.Errorf("PersistRestrictorSet[%s]: Put err: %v", grs, err)
+		return "", fmt.Errorf("PersistRestrictorSet[%s]: Put err: %v", grs, err)
 	}
 
-	return nil
+	return keyer.Encode(), nil
+}
+
+// }}}
+// {{{ db.CopyRestrictorSet
+
+// CopyRestrictorSet makes a private copy of the set, owned by the user.
+func (flightdb *FlightDB)CopyRestrictorSet(dskey string, userEmail string) (fdb.GeoRestrictorSet, error) {
+	grs,err := flightdb.LoadRestrictorSet(dskey)
+	if err != nil {
+		return grs, err
+	} else if !grs.CanView(userEmail) {
+		return grs, fmt.Errorf("CopyRestrictorSet '%s': %s can't see it", dskey, userEmail)
+	}
+
+	grs.User = strings.ToLower(userEmail)
+	grs.Editors, grs.Viewers, grs.Public = nil, nil, false
+	grs.DSKey = ""
+	if grs.DSKey,err = flightdb.persistRestrictorSet(grs); err != nil {
+		return grs, fmt.Errorf("CopyRestrictorSet '%s': %v", dskey, err)
+	}
+
+	return grs, nil
+}
+
+// }}}
+// {{{ db.ImportRestrictorSet
+
+// ImportRestrictorSet reads GeoJSON or KML (see fdb.ParseGeoRestrictorSet); the restrictors are
+// appended to the set named by dskey, or if that's empty, stored as a new set owned by the user.
+func (flightdb *FlightDB)ImportRestrictorSet(r io.Reader, dskey string, userEmail string) (fdb.GeoRestrictorSet, error) {
+	in,err := fdb.ParseGeoRestrictorSet(r)
+	if err != nil {
+		return in, fmt.Errorf("ImportRestrictorSet: %v", err)
+	} else if len(in.R) == 0 {
+		return in, fmt.Errorf("ImportRestrictorSet: no shapes found")
+	}
+
+	grs := in
+	if dskey != "" {
+		if grs,err = flightdb.LoadRestrictorSet(dskey); err != nil {
+			return grs, err
+		} else if !grs.CanEdit(userEmail) {
+			return grs, fmt.Errorf("ImportRestrictorSet '%s': %s can't edit it", dskey, userEmail)
+		}
+		grs.R = append(grs.R, in.R...)
+
+	} else {
+		grs.User = strings.ToLower(userEmail)
+		grs.Name = strings.ToLower(grs.Name)
+		if grs.Name == "" { grs.Name = "imported" }
+	}
+
+	if grs.DSKey,err = flightdb.persistRestrictorSet(grs); err != nil {
+		return grs, fmt.Errorf("ImportRestrictorSet: %v", err)
+	}
+
+	return grs, nil
 }
 
 // }}}
@@ -0,0 +1,36 @@
+package fgae
+
+import(
+	"fmt"
+
+	fdb "github.com/skypies/flightdb"
+)
+
+// {{{ db.SplitFlight
+
+// SplitFlight splits a stored flight into its legs (see fdb.Flight.SplitIntoLegs), and
+// persists them; it returns the legs, or nil if there was nothing to split. The first leg
+// replaces the original flight, and the others are created alongside it, all in a single write.
+// If someone else modified the original in the meantime (or a new leg's key is already taken),
+// an error wrapping fdb.ErrVersionConflict is returned, nothing is written, and the job should
+// be retried.
+func (db *FlightDB)SplitFlight(f *fdb.Flight, opt fdb.LegSplitOptions) ([]*fdb.Flight, error) {
+	legs := f.SplitIntoLegs(opt)
+	if legs == nil { return nil, nil }
+
+	if err := db.persistReplacing(legs, nil, nil); err != nil {
+		return nil, fmt.Errorf("SplitFlight: %w", err)
+	}
+
+	return legs, nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
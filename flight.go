@@ -15,10 +15,16 @@ type Flight struct {
 	Tracks map[string]*Track
 	Tags map[string]int
 	Waypoints map[string]time.Time
+	Downsampled DownsampleRecord // Zero, unless a RetentionPolicy has thinned out the tracks
+	CallsignChanges []CallsignChange // If the callsign changed mid-flight; see legs.go
+	Phases []PhaseSegment // Phases of flight, redone as fragments arrive; see track-phases.go
 	
 	// Internal fields
 	datastoreKey  string
 	lastUpdate    time.Time
+	version       int64
+	stored        *IndexSummary // How it was indexed when read from the DB
+	blobRef       string        // Where its payload was in the blobstore, if it was externalized
 	DebugLog      string
 }
 
@@ -247,6 +253,8 @@ func (f *Flight)Analyse() (error, string) {
 	// useful, depending on how much track we have. Need a streaming solution.
 	f.AnalyseWaypoints()
 	f.TagCoarseFlightpathForSFO()  // SFO_S:, :SFO_S
+	f.AnalysePhases()              // PHASE:LANDING, etc
+	f.IdentifyRunways(DefaultRunways) // RWY:SFO:28L, etc
 	
 	return nil, ""
 }
@@ -330,6 +338,12 @@ func (f *Flight)GetDatastoreKey() string { return f.datastoreKey }
 func (f *Flight)SetDatastoreKey(k string) { f.datastoreKey = k }
 func (f *Flight)GetLastUpdate() time.Time { return f.lastUpdate }
 func (f *Flight)SetLastUpdate(t time.Time) { f.lastUpdate = t }
+func (f *Flight)GetVersion() int64 { return f.version }
+func (f *Flight)SetVersion(v int64) { f.version = v }
+func (f *Flight)GetStoredIndex() *IndexSummary { return f.stored }
+func (f *Flight)SetStoredIndex(s *IndexSummary) { f.stored = s }
+func (f *Flight)GetBlobRef() string { return f.blobRef }
+func (f *Flight)SetBlobRef(ref string) { f.blobRef = ref }
 func (f *Flight)Timeslots() []time.Time { return f.ArbitraryTimeslots(TimeslotDuration) }
 
 func (f *Flight)ArbitraryTimeslots(d time.Duration) []time.Time {
@@ -8,4 +8,12 @@ const(
 	// which timeslots it overlaps. Never change this value once you've
 	// started populating a database, unless you're going to regenerate it
 	TimeslotDuration = 30 * time.Minute
+
+	// Waypoints are also indexed alongside the timeslot in which they were passed; see
+	// Flight.WaypointTimeTokens. The same warning applies.
+	WaypointTimeslotDuration = 30 * time.Minute
+
+	// Cells are also indexed by the day in which they were passed through; see
+	// Flight.CellTimeTokens. The same warning applies.
+	CellTimeslotDuration = 24 * time.Hour
 )
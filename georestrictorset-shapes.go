@@ -0,0 +1,564 @@
+package flightdb
+
+// Import & export of GeoRestrictorSets as GeoJSON and KML, so that shapes can be drawn in other
+// tools (or taken from official airspace definitions), instead of typed in point by point.
+//
+// Polygons become PolygonRestrictions, LineStrings become a VerticalPlaneRestriction per
+// segment, and Points become SquareBoxRestrictions (if they have a side_km). Polygon holes are
+// ignored. A flight crosses a line if it crosses any one of its segments, so a set with a
+// multi-segment line is imported as an any-of set; asking for all-of logic is an error. Each
+// feature's properties (ExtendedData, in KML) can set these:
+//   altitude_min, altitude_max  - floor & ceiling, in feet (also: floor, ceiling)
+//   excluding                   - if true, flights must *not* satisfy the restriction
+//   side_km                     - the size of a square box
+//   name, start, end            - names for the point, or the ends of a plane
+// A FeatureCollection can also carry the set's name, tags & logic as "name", "tags", "logic"; a
+// KML Document carries its tags & logic as ExtendedData.
+
+import(
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/skypies/geo"
+)
+
+// {{{ ParseGeoRestrictorSet
+
+// ParseGeoRestrictorSet reads either GeoJSON or KML, depending on what it looks like.
+func ParseGeoRestrictorSet(r io.Reader) (GeoRestrictorSet, error) {
+	data,err := ioutil.ReadAll(r)
+	if err != nil { return GeoRestrictorSet{}, err }
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '<' {
+		return GeoRestrictorSetFromKML(bytes.NewReader(data))
+	}
+	return GeoRestrictorSetFromGeoJSON(bytes.NewReader(data))
+}
+
+// }}}
+
+// {{{ shapeProps
+
+// The properties of a feature, whichever format it came from
+type shapeProps map[string]interface{}
+
+func (p shapeProps)String(key string) string {
+	if v,exists := p[key]; exists && v != nil { return fmt.Sprintf("%v", v) }
+	return ""
+}
+
+func (p shapeProps)Float64(keys ...string) float64 {
+	for _,key := range keys {
+		switch v := p[key].(type) {
+		case float64: return v
+		case string:
+			if f,err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil { return f }
+		}
+	}
+	return 0
+}
+
+func (p shapeProps)Bool(key string) bool {
+	switch v := p[key].(type) {
+	case bool: return v
+	case float64: return v != 0
+	case string:
+		b,_ := strconv.ParseBool(strings.TrimSpace(v))
+		return b
+	}
+	return false
+}
+
+func (p shapeProps)altitudes() (int64, int64) {
+	return int64(p.Float64("altitude_min", "floor")), int64(p.Float64("altitude_max", "ceiling"))
+}
+
+// }}}
+// {{{ restrictorsFromShape, restrictorToShape
+
+// Builds restrictors from a shape; geomType is the GeoJSON type, and paths are its points (one
+// path for Points and LineStrings, the rings for Polygons).
+func restrictorsFromShape(geomType string, paths [][]geo.Latlong, p shapeProps) ([]geo.Restrictor, error) {
+	altMin,altMax := p.altitudes()
+	excluding := p.Bool("excluding")
+	if len(paths) == 0 || len(paths[0]) == 0 {
+		return nil, fmt.Errorf("%s with no points", geomType)
+	}
+	pts := paths[0]
+
+	switch geomType {
+	case "Point":
+		if p.Float64("side_km") <= 0 {
+			return nil, fmt.Errorf("Point '%s' has no side_km", p.String("name"))
+		}
+		return []geo.Restrictor{geo.SquareBoxRestriction{
+			Debugger: new(geo.DebugLog),
+			NamedLatlong: geo.NamedLatlong{Name:p.String("name"), Latlong:pts[0]},
+			SideKM: p.Float64("side_km"),
+			AltitudeMin: altMin,
+			AltitudeMax: altMax,
+			IsExcluding: excluding,
+		}}, nil
+
+	case "LineString":
+		if len(pts) < 2 { return nil, fmt.Errorf("LineString with %d points", len(pts)) }
+		ret := []geo.Restrictor{}
+		for i:=1; i<len(pts); i++ {
+			vp := geo.VerticalPlaneRestriction{
+				Debugger: new(geo.DebugLog),
+				Start: geo.NamedLatlong{Latlong:pts[i-1]},
+				End: geo.NamedLatlong{Latlong:pts[i]},
+				AltitudeMin: altMin,
+				AltitudeMax: altMax,
+				IsExcluding: excluding,
+			}
+			if i == 1 { vp.Start.Name = p.String("start") }
+			if i == len(pts)-1 { vp.End.Name = p.String("end") }
+			ret = append(ret, vp)
+		}
+		return ret, nil
+
+	case "Polygon":
+		// Rings are closed, by repeating the first point; our polygons close themselves
+		if n := len(pts); n > 1 && pts[0].Lat == pts[n-1].Lat && pts[0].Long == pts[n-1].Long {
+			pts = pts[:n-1]
+		}
+		if len(pts) < 3 { return nil, fmt.Errorf("Polygon with %d points", len(pts)) }
+		poly := geo.NewPolygon()
+		for _,pt := range pts { poly.AddPoint(pt) }
+		return []geo.Restrictor{geo.PolygonRestriction{
+			Debugger: new(geo.DebugLog),
+			Polygon: poly,
+			AltitudeMin: altMin,
+			AltitudeMax: altMax,
+			IsExcluding: excluding,
+		}}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported geometry '%s'", geomType)
+}
+
+// The inverse of restrictorsFromShape (for a single restrictor). Polygon rings come back closed.
+func restrictorToShape(gr geo.Restrictor) (string, []geo.Latlong, shapeProps, error) {
+	p := shapeProps{}
+	setCommon := func(altMin, altMax int64, excluding bool) {
+		if altMin > 0 { p["altitude_min"] = altMin }
+		if altMax > 0 { p["altitude_max"] = altMax }
+		if excluding { p["excluding"] = true }
+	}
+
+	switch t := gr.(type) {
+	case geo.SquareBoxRestriction:
+		setCommon(t.AltitudeMin, t.AltitudeMax, t.IsExcluding)
+		p["side_km"] = t.SideKM
+		if t.Name != "" { p["name"] = t.Name }
+		return "Point", []geo.Latlong{t.Latlong}, p, nil
+
+	case geo.VerticalPlaneRestriction:
+		setCommon(t.AltitudeMin, t.AltitudeMax, t.IsExcluding)
+		if t.Start.Name != "" { p["start"] = t.Start.Name }
+		if t.End.Name != "" { p["end"] = t.End.Name }
+		return "LineString", []geo.Latlong{t.Start.Latlong, t.End.Latlong}, p, nil
+
+	case geo.PolygonRestriction:
+		setCommon(t.AltitudeMin, t.AltitudeMax, t.IsExcluding)
+		pts := t.GetPoints()
+		if len(pts) > 0 { pts = append(pts, pts[0]) }
+		return "Polygon", pts, p, nil
+	}
+
+	return "", nil, nil, fmt.Errorf("can't export restrictor %T", gr)
+}
+
+// shapeImport gathers up the restrictors from all the shapes in a file.
+type shapeImport struct {
+	R          []geo.Restrictor
+	SplitLines   int // How many LineStrings became more than one restrictor
+}
+
+func (si *shapeImport)add(geomType string, paths [][]geo.Latlong, p shapeProps) error {
+	grs,err := restrictorsFromShape(geomType, paths, p)
+	if err != nil { return err }
+	if geomType == "LineString" && len(grs) > 1 { si.SplitLines++ }
+	si.R = append(si.R, grs...)
+	return nil
+}
+
+// Sets the restrictors & logic; the logic is whatever the file said, unless a line had to be
+// split, in which case it can only be any-of.
+func (si *shapeImport)finish(grs *GeoRestrictorSet, logic string) error {
+	grs.R = si.R
+	switch strings.ToLower(strings.TrimSpace(logic)) {
+	case "any": grs.Logic = CombinationLogicAny
+	case "all": grs.Logic = CombinationLogicAll
+		if si.SplitLines > 0 {
+			return fmt.Errorf("%d LineStrings have several segments, which needs logic 'any', not 'all'",
+				si.SplitLines)
+		}
+	case "":
+		if si.SplitLines > 0 { grs.Logic = CombinationLogicAny }
+	default:
+		return fmt.Errorf("unknown logic '%s'", logic)
+	}
+	return nil
+}
+
+// Tags are written as a single comma separated string, where they can't be a list
+func splitTags(s string) []string {
+	tags := []string{}
+	for _,tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" { tags = append(tags, tag) }
+	}
+	return tags
+}
+
+// }}}
+
+// {{{ GeoJSON
+
+type geoJSONObject struct {
+	Type        string             `json:"type"`
+
+	// For FeatureCollections; the last three are our own additions
+	Features  []geoJSONObject      `json:"features,omitempty"`
+	Name        string             `json:"name,omitempty"`
+	Tags      []string             `json:"tags,omitempty"`
+	Logic       string             `json:"logic,omitempty"`
+
+	// For Features
+	Geometry   *geoJSONObject      `json:"geometry,omitempty"`
+	Properties  shapeProps         `json:"properties,omitempty"`
+
+	// For Geometries
+	Coordinates json.RawMessage    `json:"coordinates,omitempty"`
+	Geometries []geoJSONObject     `json:"geometries,omitempty"`
+}
+
+// GeoRestrictorSetFromGeoJSON reads a FeatureCollection (or a single Feature).
+func GeoRestrictorSetFromGeoJSON(r io.Reader) (GeoRestrictorSet, error) {
+	grs := GeoRestrictorSet{}
+	obj := geoJSONObject{}
+	if err := json.NewDecoder(r).Decode(&obj); err != nil {
+		return grs, fmt.Errorf("GeoJSON: %v", err)
+	}
+
+	features := obj.Features
+	switch obj.Type {
+	case "FeatureCollection":
+		grs.Name = obj.Name
+		grs.Tags = obj.Tags
+	case "Feature":
+		features = []geoJSONObject{obj}
+	default:
+		return grs, fmt.Errorf("GeoJSON: need a FeatureCollection or Feature, not '%s'", obj.Type)
+	}
+
+	si := shapeImport{}
+	for i,feature := range features {
+		if feature.Geometry == nil { continue }
+		if err := si.addGeoJSON(*feature.Geometry, feature.Properties); err != nil {
+			return grs, fmt.Errorf("GeoJSON feature %d: %v", i, err)
+		}
+	}
+
+	if err := si.finish(&grs, obj.Logic); err != nil { return grs, fmt.Errorf("GeoJSON: %v", err) }
+	return grs, nil
+}
+
+func (si *shapeImport)addGeoJSON(g geoJSONObject, p shapeProps) error {
+	add := func(geomType string, paths [][]geo.Latlong) error {
+		return si.add(geomType, paths, p)
+	}
+
+	var err error
+	switch g.Type {
+	case "Point":
+		var c []float64
+		if err = json.Unmarshal(g.Coordinates, &c); err == nil {
+			err = add("Point", [][]geo.Latlong{geoJSONPath([][]float64{c})})
+		}
+	case "LineString":
+		var c [][]float64
+		if err = json.Unmarshal(g.Coordinates, &c); err == nil {
+			err = add("LineString", [][]geo.Latlong{geoJSONPath(c)})
+		}
+	case "Polygon":
+		var c [][][]float64
+		if err = json.Unmarshal(g.Coordinates, &c); err == nil && len(c) > 0 {
+			err = add("Polygon", [][]geo.Latlong{geoJSONPath(c[0])}) // Holes are ignored
+		}
+	case "MultiLineString":
+		var c [][][]float64
+		if err = json.Unmarshal(g.Coordinates, &c); err != nil { break }
+		for _,path := range c {
+			if err = add("LineString", [][]geo.Latlong{geoJSONPath(path)}); err != nil { break }
+		}
+	case "MultiPolygon":
+		var c [][][][]float64
+		if err = json.Unmarshal(g.Coordinates, &c); err != nil { break }
+		for _,poly := range c {
+			if len(poly) == 0 { continue }
+			if err = add("Polygon", [][]geo.Latlong{geoJSONPath(poly[0])}); err != nil { break }
+		}
+	case "GeometryCollection":
+		for _,g2 := range g.Geometries {
+			if err = si.addGeoJSON(g2, p); err != nil { break }
+		}
+	default:
+		err = fmt.Errorf("unsupported geometry '%s'", g.Type)
+	}
+
+	return err
+}
+
+// GeoJSON positions are [long, lat(, altitude)]
+func geoJSONPath(c [][]float64) []geo.Latlong {
+	ret := []geo.Latlong{}
+	for _,pos := range c {
+		if len(pos) >= 2 { ret = append(ret, geo.Latlong{Lat:pos[1], Long:pos[0]}) }
+	}
+	return ret
+}
+
+// ToGeoJSON renders the set as a FeatureCollection, one Feature per restrictor.
+func (grs GeoRestrictorSet)ToGeoJSON() ([]byte, error) {
+	fc := geoJSONObject{
+		Type: "FeatureCollection",
+		Features: []geoJSONObject{},
+		Name: grs.Name,
+		Tags: grs.Tags,
+		Logic: grs.Logic.String(),
+	}
+
+	for _,gr := range grs.R {
+		geomType,pts,p,err := restrictorToShape(gr)
+		if err != nil { return nil, err }
+
+		c := [][]float64{}
+		for _,pt := range pts { c = append(c, []float64{pt.Long, pt.Lat}) }
+		var coords interface{} = c
+		switch geomType {
+		case "Point": coords = c[0]
+		case "Polygon": coords = [][][]float64{c}
+		}
+		raw,err := json.Marshal(coords)
+		if err != nil { return nil, err }
+
+		fc.Features = append(fc.Features, geoJSONObject{
+			Type: "Feature",
+			Geometry: &geoJSONObject{Type:geomType, Coordinates:raw},
+			Properties: p,
+		})
+	}
+
+	return json.MarshalIndent(fc, "", " ")
+}
+
+// }}}
+// {{{ KML
+
+type kmlPlacemark struct {
+	Name          string          `xml:"name"`
+	Data        []kmlData         `xml:"ExtendedData>Data"`
+	SimpleData  []kmlData         `xml:"ExtendedData>SchemaData>SimpleData"`
+	kmlGeometry
+}
+
+type kmlData struct {
+	Name   string   `xml:"name,attr"`
+	Value  string   `xml:"value"`
+	Text   string   `xml:",chardata"` // For SimpleData
+}
+
+// kmlGeometry is shared by placemarks and MultiGeometry
+type kmlGeometry struct {
+	Points       []kmlCoords      `xml:"Point"`
+	LineStrings  []kmlCoords      `xml:"LineString"`
+	Polygons     []kmlPolygon     `xml:"Polygon"`
+	Multi        []kmlGeometry    `xml:"MultiGeometry"`
+}
+
+type kmlCoords struct {
+	Coordinates  string   `xml:"coordinates"`
+}
+
+type kmlPolygon struct {
+	Outer   kmlCoords   `xml:"outerBoundaryIs>LinearRing"`
+}
+
+// GeoRestrictorSetFromKML reads every Placemark in the file, however deeply they are nested
+// inside Documents & Folders. The name of the first Document becomes the set's name, and its
+// ExtendedData can set the tags & logic.
+func GeoRestrictorSetFromKML(r io.Reader) (GeoRestrictorSet, error) {
+	grs := GeoRestrictorSet{}
+	si := shapeImport{}
+	logic := ""
+	dec := xml.NewDecoder(r)
+	inDocument := false
+
+	for {
+		tok,err := dec.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return grs, fmt.Errorf("KML: %v", err)
+		}
+
+		start,ok := tok.(xml.StartElement)
+		if !ok { continue }
+
+		switch start.Name.Local {
+		case "Document":
+			inDocument = true
+
+		case "name":
+			if inDocument && grs.Name == "" {
+				var name string
+				if err := dec.DecodeElement(&name, &start); err != nil { return grs, fmt.Errorf("KML: %v", err) }
+				grs.Name = strings.TrimSpace(name)
+			}
+
+		case "ExtendedData":
+			if inDocument {
+				ed := struct{ Data []kmlData `xml:"Data"` }{}
+				if err := dec.DecodeElement(&ed, &start); err != nil { return grs, fmt.Errorf("KML: %v", err) }
+				for _,d := range ed.Data {
+					switch d.Name {
+					case "tags":  grs.Tags = splitTags(d.Value)
+					case "logic": logic = d.Value
+					}
+				}
+			}
+
+		case "Folder":
+			inDocument = false // Folder names (and data) aren't the set's
+
+		case "Placemark":
+			pm := kmlPlacemark{}
+			if err := dec.DecodeElement(&pm, &start); err != nil { return grs, fmt.Errorf("KML: %v", err) }
+			p := shapeProps{}
+			for _,d := range append(pm.Data, pm.SimpleData...) {
+				p[d.Name] = strings.TrimSpace(d.Value + d.Text)
+			}
+			if _,exists := p["name"]; !exists && pm.Name != "" {
+				p["name"] = strings.TrimSpace(pm.Name)
+			}
+
+			if err := si.addKML(pm.kmlGeometry, p); err != nil {
+				return grs, fmt.Errorf("KML placemark '%s': %v", pm.Name, err)
+			}
+		}
+	}
+
+	if err := si.finish(&grs, logic); err != nil { return grs, fmt.Errorf("KML: %v", err) }
+	return grs, nil
+}
+
+func (si *shapeImport)addKML(g kmlGeometry, p shapeProps) error {
+	add := func(geomType string, coords string) error {
+		path,err := kmlPath(coords)
+		if err != nil { return err }
+		return si.add(geomType, [][]geo.Latlong{path}, p)
+	}
+
+	for _,pt := range g.Points {
+		if err := add("Point", pt.Coordinates); err != nil { return err }
+	}
+	for _,ls := range g.LineStrings {
+		if err := add("LineString", ls.Coordinates); err != nil { return err }
+	}
+	for _,poly := range g.Polygons {
+		if err := add("Polygon", poly.Outer.Coordinates); err != nil { return err }
+	}
+	for _,multi := range g.Multi {
+		if err := si.addKML(multi, p); err != nil { return err }
+	}
+
+	return nil
+}
+
+// KML coordinates are whitespace separated tuples of "long,lat[,altitude]"
+func kmlPath(coords string) ([]geo.Latlong, error) {
+	ret := []geo.Latlong{}
+	for _,tuple := range strings.Fields(coords) {
+		bits := strings.Split(tuple, ",")
+		if len(bits) < 2 { return nil, fmt.Errorf("bad coordinate '%s'", tuple) }
+		long,err1 := strconv.ParseFloat(bits[0], 64)
+		lat,err2 := strconv.ParseFloat(bits[1], 64)
+		if err1 != nil || err2 != nil { return nil, fmt.Errorf("bad coordinate '%s'", tuple) }
+		ret = append(ret, geo.Latlong{Lat:lat, Long:long})
+	}
+	return ret, nil
+}
+
+// ToKML renders the set as a KML document, one Placemark per restrictor; the properties go
+// into ExtendedData, as do the set's tags & logic.
+func (grs GeoRestrictorSet)ToKML() ([]byte, error) {
+	var buf bytes.Buffer
+	esc := func(s string) string {
+		var b bytes.Buffer
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+
+	buf.WriteString(xml.Header)
+	buf.WriteString("<kml xmlns=\"http://www.opengis.net/kml/2.2\">\n<Document>\n")
+	buf.WriteString(fmt.Sprintf(" <name>%s</name>\n", esc(grs.Name)))
+	buf.WriteString(fmt.Sprintf(" <description>%s of: tags [%s]</description>\n",
+		grs.Logic, esc(strings.Join(grs.Tags, ","))))
+	buf.WriteString(" <ExtendedData>\n")
+	buf.WriteString(fmt.Sprintf("  <Data name=\"tags\"><value>%s</value></Data>\n",
+		esc(strings.Join(grs.Tags, ","))))
+	buf.WriteString(fmt.Sprintf("  <Data name=\"logic\"><value>%s</value></Data>\n", grs.Logic))
+	buf.WriteString(" </ExtendedData>\n")
+
+	for i,gr := range grs.R {
+		geomType,pts,p,err := restrictorToShape(gr)
+		if err != nil { return nil, err }
+
+		coords := []string{}
+		for _,pt := range pts { coords = append(coords, fmt.Sprintf("%.6f,%.6f", pt.Long, pt.Lat)) }
+		coordStr := "<coordinates>" + strings.Join(coords, " ") + "</coordinates>"
+
+		buf.WriteString(fmt.Sprintf(" <Placemark>\n  <name>%s</name>\n", esc(fmt.Sprintf("[%02d] %s", i, gr))))
+		buf.WriteString("  <ExtendedData>\n")
+		for _,k := range []string{"name", "start", "end", "side_km", "altitude_min", "altitude_max",
+			"excluding"} {
+			if v,exists := p[k]; exists {
+				buf.WriteString(fmt.Sprintf("   <Data name=\"%s\"><value>%s</value></Data>\n", k,
+					esc(fmt.Sprintf("%v", v))))
+			}
+		}
+		buf.WriteString("  </ExtendedData>\n")
+
+		switch geomType {
+		case "Point":
+			buf.WriteString("  <Point>" + coordStr + "</Point>\n")
+		case "LineString":
+			buf.WriteString("  <LineString>" + coordStr + "</LineString>\n")
+		case "Polygon":
+			buf.WriteString("  <Polygon><outerBoundaryIs><LinearRing>" + coordStr +
+				"</LinearRing></outerBoundaryIs></Polygon>\n")
+		}
+		buf.WriteString(" </Placemark>\n")
+	}
+
+	buf.WriteString("</Document>\n</kml>\n")
+	return buf.Bytes(), nil
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
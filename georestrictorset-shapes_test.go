@@ -0,0 +1,118 @@
+package flightdb
+
+import(
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/skypies/geo"
+)
+
+var testGeoJSON = `{
+ "type": "FeatureCollection",
+ "name": "Bayside",
+ "logic": "any",
+ "tags": ["SFO", "ARRIVALS"],
+ "features": [
+  {"type": "Feature",
+   "properties": {"floor": 2000, "ceiling": "8000", "excluding": true},
+   "geometry": {"type": "Polygon", "coordinates": [[[-122.4,37.6], [-122.2,37.6], [-122.2,37.4], [-122.4,37.6]]]}},
+  {"type": "Feature",
+   "properties": {"altitude_max": 5000, "start": "EPICK", "end": "EDDYY"},
+   "geometry": {"type": "LineString", "coordinates": [[-122.1,37.1], [-122.2,37.2], [-122.3,37.3]]}},
+  {"type": "Feature",
+   "properties": {"name": "SFO", "side_km": 2.5},
+   "geometry": {"type": "Point", "coordinates": [-122.375,37.619]}}
+ ]
+}`
+
+func TestGeoRestrictorSetShapes(t *testing.T) {
+	grs,err := ParseGeoRestrictorSet(strings.NewReader(testGeoJSON))
+	if err != nil { t.Fatal(err) }
+	if grs.Name != "Bayside" || grs.Logic != CombinationLogicAny || len(grs.R) != 4 {
+		t.Fatalf("import looks wrong: %s", grs)
+	}
+
+	pr,ok := grs.R[0].(geo.PolygonRestriction)
+	if !ok || len(pr.GetPoints()) != 3 || pr.AltitudeMin != 2000 || pr.AltitudeMax != 8000 || !pr.IsExcluding {
+		t.Errorf("polygon looks wrong: %#v", grs.R[0])
+	}
+	vp1,ok1 := grs.R[1].(geo.VerticalPlaneRestriction)
+	vp2,ok2 := grs.R[2].(geo.VerticalPlaneRestriction)
+	if !ok1 || !ok2 || vp1.Start.Name != "EPICK" || vp2.End.Name != "EDDYY" || vp2.Start.Lat != 37.2 ||
+		vp1.AltitudeMax != 5000 {
+		t.Errorf("planes look wrong: %#v, %#v", grs.R[1], grs.R[2])
+	}
+	if sq,ok := grs.R[3].(geo.SquareBoxRestriction); !ok || sq.SideKM != 2.5 || sq.Name != "SFO" {
+		t.Errorf("box looks wrong: %#v", grs.R[3])
+	}
+
+	// Both export formats should come back as they went out
+	for _,format := range []string{"geojson", "kml"} {
+		var data []byte
+		if format == "kml" {
+			data,err = grs.ToKML()
+		} else {
+			data,err = grs.ToGeoJSON()
+		}
+		if err != nil { t.Fatalf("%s: %v", format, err) }
+
+		grs2,err := ParseGeoRestrictorSet(bytes.NewReader(data))
+		if err != nil { t.Fatalf("%s: %v\n%s", format, err, data) }
+		if grs2.Name != grs.Name || len(grs2.R) != len(grs.R) || grs2.Logic != grs.Logic ||
+			strings.Join(grs2.Tags, ",") != strings.Join(grs.Tags, ",") {
+			t.Fatalf("%s: roundtrip mismatch:\n%s\n%s", format, grs, grs2)
+		}
+		for i := range grs.R {
+			if grs.R[i].String() != grs2.R[i].String() {
+				t.Errorf("%s: [%d] changed:\n %s\n %s", format, i, grs.R[i], grs2.R[i])
+			}
+		}
+	}
+}
+
+func TestGeoRestrictorSetFromKML(t *testing.T) {
+	kml := `<?xml version="1.0" encoding="UTF-8"?>
+<kml xmlns="http://www.opengis.net/kml/2.2"><Document><name>Arrivals</name>
+ <Folder><name>Not the set name</name>
+  <Placemark><name>Gate</name>
+   <ExtendedData><Data name="altitude_min"><value>3000</value></Data></ExtendedData>
+   <MultiGeometry>
+    <LineString><coordinates>-122.1,37.1,0 -122.2,37.2,0</coordinates></LineString>
+    <Polygon><outerBoundaryIs><LinearRing><coordinates>
+     -122.4,37.6 -122.2,37.6 -122.2,37.4 -122.4,37.6
+    </coordinates></LinearRing></outerBoundaryIs></Polygon>
+   </MultiGeometry>
+  </Placemark>
+ </Folder>
+</Document></kml>`
+
+	grs,err := ParseGeoRestrictorSet(strings.NewReader(kml))
+	if err != nil { t.Fatal(err) }
+	if grs.Name != "Arrivals" || len(grs.R) != 2 {
+		t.Fatalf("import looks wrong: %s", grs)
+	}
+	if vp,ok := grs.R[0].(geo.VerticalPlaneRestriction); !ok || vp.AltitudeMin != 3000 {
+		t.Errorf("plane looks wrong: %#v", grs.R[0])
+	}
+	if pr,ok := grs.R[1].(geo.PolygonRestriction); !ok || len(pr.GetPoints()) != 3 || pr.AltitudeMin != 3000 {
+		t.Errorf("polygon looks wrong: %#v", grs.R[1])
+	}
+}
+
+func TestGeoRestrictorSetSplitLines(t *testing.T) {
+	withLogic := func(logic string) string {
+		return `{"type": "FeatureCollection", ` + logic + `"features": [{"type": "Feature",
+   "geometry": {"type": "LineString", "coordinates": [[-122.1,37.1], [-122.2,37.2], [-122.3,37.3]]}}]}`
+	}
+
+	// Crossing the line means crossing any one of its segments
+	grs,err := ParseGeoRestrictorSet(strings.NewReader(withLogic("")))
+	if err != nil { t.Fatal(err) }
+	if len(grs.R) != 2 || grs.Logic != CombinationLogicAny {
+		t.Errorf("split line should have made an any-of set: %s", grs)
+	}
+	if _,err := ParseGeoRestrictorSet(strings.NewReader(withLogic(`"logic": "all", `))); err == nil {
+		t.Errorf("split line in an all-of set should have been an error")
+	}
+}
@@ -33,10 +33,23 @@ type GeoRestrictorSet struct {
 	Tags     []string
 
 	R        []geo.Restrictor
-	
+
+	// Sharing; User is the owner. Editors & viewers are lowercased email addresses.
+	Editors  []string  // Can change the restrictors, but not the sharing, or delete it
+	Viewers  []string  // Can see it, use it, and copy it
+	Public     bool    // If set, every logged-in user is a viewer
+
 	DSKey      string
 }
 
+// The roles a user can have for a GeoRestrictorSet
+const(
+	RoleNone   = ""
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleOwner  = "owner"
+)
+
 // {{{ grs.String
 
 func (grs GeoRestrictorSet)String() string {
@@ -80,6 +93,45 @@ func (grs GeoRestrictorSet)Debug() string {
 	return str
 }
 
+// }}}
+// {{{ grs.RoleFor, CanView, CanEdit, IsOwner
+
+func (grs GeoRestrictorSet)RoleFor(user string) string {
+	user = strings.ToLower(user)
+	if user == "" { return RoleNone }
+
+	if user == strings.ToLower(grs.User) { return RoleOwner }
+	for _,editor := range grs.Editors {
+		if user == editor { return RoleEditor }
+	}
+	for _,viewer := range grs.Viewers {
+		if user == viewer { return RoleViewer }
+	}
+	if grs.Public { return RoleViewer }
+	return RoleNone
+}
+
+func (grs GeoRestrictorSet)CanView(user string) bool { return grs.RoleFor(user) != RoleNone }
+func (grs GeoRestrictorSet)IsOwner(user string) bool { return grs.RoleFor(user) == RoleOwner }
+func (grs GeoRestrictorSet)CanEdit(user string) bool {
+	role := grs.RoleFor(user)
+	return role == RoleOwner || role == RoleEditor
+}
+
+// NormalizeUsers lowercases the access lists, and drops blanks & dupes.
+func NormalizeUsers(users []string) []string {
+	ret := []string{}
+	seen := map[string]bool{}
+	for _,user := range users {
+		user = strings.ToLower(strings.TrimSpace(user))
+		if user == "" || seen[user] { continue }
+		seen[user] = true
+		ret = append(ret, user)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 // }}}
 // {{{ grs.IsNil, IsAdhoc
 
@@ -231,6 +283,11 @@ type IndexedRestrictorSetBlob struct {
 	Name           string
 	Tags         []string
 	User           string
+
+	// So that LookupRestrictorSets can find the sets shared with a user
+	Editors      []string
+	Viewers      []string
+	Public         bool
 }
 
 // {{{ grs.ToBlob
@@ -250,6 +307,9 @@ func (grs *GeoRestrictorSet)ToBlob() (*IndexedRestrictorSetBlob, error) {
 		Blob: buf.Bytes(),
 		Tags: grs.Tags,
 		User: grs.User,
+		Editors: grs.Editors,
+		Viewers: grs.Viewers,
+		Public: grs.Public,
 	}, nil
 }
 
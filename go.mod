@@ -4,8 +4,10 @@ go 1.13
 
 require (
 	cloud.google.com/go/bigquery v1.5.0
+	cloud.google.com/go/datastore v1.1.0
 	cloud.google.com/go/storage v1.6.0
 	github.com/jung-kurt/gofpdf v1.12.6
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/paulmach/go.geo v0.0.0-20180829195134-22b514266d33
 	github.com/skypies/adsb v0.1.0
 	github.com/skypies/geo v0.0.0-20180901233721-9d4f211f3066
@@ -94,7 +94,7 @@ func (o RestrictorSetIntersectOutcome)Debug() string {
 // is best suited for georestriction analysis. Those tracks are potentially mutated, and the
 // output is returned as a track with pre-computed junk.
 func (f *Flight)GetIntersectableTrack() IntersectableTrack {
-	tName, t := f.PreferredTrack([]string{"FOIA", "ADSB", "MLAT", "fr24"})
+	tName, t := f.PreferredTrack([]string{FusedTrackName, "FOIA", "ADSB", "MLAT", "fr24"})
 	if tName == "" {
 		return IntersectableTrack{}
 	}
@@ -0,0 +1,244 @@
+package flightdb
+
+// Short turnarounds, touch-and-goes and training circuits can get glued into a single Flight,
+// since each new fragment looks like a plausible continuation of the track. These routines
+// find the boundaries between the legs, and split the flight apart.
+
+import(
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type LegSplitOptions struct {
+	DwellMaxAltitude     float64       // In feet; points below this ...
+	DwellMaxGroundSpeed  float64       // ... and slower than this (knots) are on the ground
+	DwellMinDuration     time.Duration // Shorter dwells are ignored (zero allows touch-and-goes)
+	MaxGap               time.Duration // A gap in the data longer than this ends a leg
+	MinLegDuration       time.Duration // Boundaries that would make a shorter leg are ignored
+}
+
+var DefaultLegSplitOptions = LegSplitOptions{
+	DwellMaxAltitude: 1000,
+	DwellMaxGroundSpeed: 60,
+	DwellMinDuration: 0,
+	MaxGap: 8 * time.Minute,
+	MinLegDuration: 3 * time.Minute,
+}
+
+// CallsignChange records that the callsign in the data changed partway through the flight;
+// from Time onwards, the aircraft was using Callsign. (Flight.Callsign is the first one seen.)
+type CallsignChange struct {
+	Time      time.Time
+	Callsign  string
+}
+
+// Tags like ":SFO", ":SFO_S" and "MLAT" are derived from the schedule & tracks, by Analyse
+func isDerivedTag(tag string) bool { return strings.Contains(tag, ":") || tag == "MLAT" }
+
+type LegBoundary struct {
+	Time    time.Time // The first instant of the new leg
+	Reason  string
+}
+func (b LegBoundary)String() string {
+	return fmt.Sprintf("%s (%s)", b.Time.Format("15:04:05 MST"), b.Reason)
+}
+
+// {{{ f.NoteCallsignChange
+
+// NoteCallsignChange records that data with a different callsign has been added to the flight.
+func (f *Flight)NoteCallsignChange(t time.Time, callsign string) {
+	if callsign == "" || callsign == f.CallsignAt(t) { return }
+	f.CallsignChanges = append(f.CallsignChanges, CallsignChange{Time:t, Callsign:callsign})
+	sort.Slice(f.CallsignChanges, func(i,j int) bool {
+		return f.CallsignChanges[i].Time.Before(f.CallsignChanges[j].Time)
+	})
+	f.DebugLog += fmt.Sprintf("-- callsign changed to %s at %s\n", callsign, t)
+}
+
+// CallsignAt returns the callsign in use just before time t.
+func (f Flight)CallsignAt(t time.Time) string {
+	callsign := f.Callsign
+	for _,cc := range f.CallsignChanges {
+		if cc.Time.Before(t) { callsign = cc.Callsign }
+	}
+	return callsign
+}
+
+// }}}
+// {{{ f.FindLegBoundaries
+
+// FindLegBoundaries looks for places where one leg ends and another begins: a dwell at low
+// altitude & groundspeed, a long gap in the data, or a change of callsign. Boundaries that
+// would leave a leg shorter than opt.MinLegDuration are dropped.
+func (f Flight)FindLegBoundaries(opt LegSplitOptions) []LegBoundary {
+	if len(f.Tracks) == 0 { return nil }
+	s,e := f.Times()
+
+	candidates := []LegBoundary{}
+	for _,name := range f.ListTracks() {
+		candidates = append(candidates, f.Tracks[name].dwellBoundaries(opt)...)
+	}
+
+	// Gaps are looked for across all the tracks, as one may cover for another
+	all := Track{}
+	for _,t := range f.Tracks { all = append(all, (*t)...) }
+	sort.Stable(TrackByTimestampAscending(all))
+	for i:=1; i<len(all); i++ {
+		if gap := all[i].TimestampUTC.Sub(all[i-1].TimestampUTC); gap > opt.MaxGap {
+			candidates = append(candidates, LegBoundary{all[i].TimestampUTC, "gap of "+gap.String()})
+		}
+	}
+
+	for _,cc := range f.CallsignChanges {
+		candidates = append(candidates, LegBoundary{cc.Time, "callsign now "+cc.Callsign})
+	}
+
+	sort.SliceStable(candidates, func(i,j int) bool {
+		return candidates[i].Time.Before(candidates[j].Time)
+	})
+
+	boundaries := []LegBoundary{}
+	prev := s
+	for _,b := range candidates {
+		if b.Time.Sub(prev) < opt.MinLegDuration || e.Sub(b.Time) < opt.MinLegDuration {
+			continue
+		}
+		boundaries = append(boundaries, b)
+		prev = b.Time
+	}
+
+	return boundaries
+}
+
+// A dwell is a run of points that are low and slow, with airborne points either side; the
+// boundary goes in the middle of it.
+func (t Track)dwellBoundaries(opt LegSplitOptions) []LegBoundary {
+	isDwell := func(i int) bool {
+		gs := t[i].GroundSpeed
+		if gs == 0 && i > 0 {
+			// Some sources don't have groundspeed; derive it (1 knot == 1.852 KM/hour)
+			if dur := t[i].TimestampUTC.Sub(t[i-1].TimestampUTC); dur > 0 {
+				gs = (t[i].DistKM(t[i-1].Latlong) / dur.Hours()) / 1.852
+			}
+		}
+		return t[i].Altitude < opt.DwellMaxAltitude && gs < opt.DwellMaxGroundSpeed
+	}
+
+	ret := []LegBoundary{}
+	seenAirborne := false
+	for i:=0; i<len(t); i++ {
+		if !isDwell(i) {
+			seenAirborne = true
+			continue
+		}
+
+		j := i
+		for j+1 < len(t) && isDwell(j+1) { j++ }
+		if seenAirborne && j+1 < len(t) {
+			dwell := t[j].TimestampUTC.Sub(t[i].TimestampUTC)
+			if dwell >= opt.DwellMinDuration {
+				mid := t[i].TimestampUTC.Add(dwell/2)
+				ret = append(ret, LegBoundary{mid, "dwell of "+dwell.String()})
+			}
+		}
+		i = j
+	}
+
+	return ret
+}
+
+// }}}
+// {{{ f.SplitIntoLegs
+
+// SplitIntoLegs returns the flight's legs as separate flights, or nil if there was only one.
+// The first leg keeps f's datastore key and version, so persisting it overwrites f; the others
+// are new. Each leg gets the tracks for its timespan, the callsign in use at the time, the
+// tags that aren't derived from the track or schedule, and then a fresh Analyse() to work out
+// its waypoints and derived tags. f is not modified.
+func (f Flight)SplitIntoLegs(opt LegSplitOptions) []*Flight {
+	boundaries := f.FindLegBoundaries(opt)
+	if len(boundaries) == 0 { return nil }
+
+	times := []time.Time{}
+	for _,b := range boundaries { times = append(times, b.Time) }
+	times = append(times, f.lastTimeAfterEnd())
+
+	legs := []*Flight{}
+	s,_ := f.Times()
+	for i,e := range times {
+		leg := f.newLeg(s, e)
+		leg.DebugLog += fmt.Sprintf("-- SplitIntoLegs: leg %d of %d, from %s\n", i+1, len(times),
+			f.IdentityString())
+		if i > 0 {
+			leg.DebugLog += fmt.Sprintf(" - started by %s\n", boundaries[i-1])
+		}
+		if len(leg.Tracks) > 0 {
+			legs = append(legs, leg)
+		}
+		s = e
+	}
+	if len(legs) < 2 { return nil }
+
+	legs[0].ForeignKeys = f.ForeignKeys
+	legs[0].SetDatastoreKey(f.GetDatastoreKey())
+	legs[0].SetVersion(f.GetVersion())
+	legs[0].SetLastUpdate(f.GetLastUpdate())
+	legs[0].SetStoredIndex(f.GetStoredIndex())
+
+	return legs
+}
+
+// Just after the final trackpoint, so [s,e) ranges include it
+func (f Flight)lastTimeAfterEnd() time.Time {
+	_,e := f.Times()
+	return e.Add(time.Nanosecond)
+}
+
+// Builds the leg covering [s,e)
+func (f Flight)newLeg(s,e time.Time) *Flight {
+	leg := BlankFlight()
+	leg.Identity = f.Identity
+	leg.Airframe = f.Airframe
+	leg.ForeignKeys = nil
+	leg.Downsampled = f.Downsampled
+	leg.DebugLog = f.DebugLog
+
+	// The callsign in use at the end of the leg (new callsigns often show up during a dwell)
+	if callsign := f.CallsignAt(e); callsign != f.Callsign {
+		leg.Callsign = callsign
+		leg.Schedule = Schedule{}
+	}
+
+	for name,t := range f.Tracks {
+		legT := Track{}
+		for _,tp := range *t {
+			if !tp.TimestampUTC.Before(s) && tp.TimestampUTC.Before(e) {
+				legT = append(legT, tp)
+			}
+		}
+		if len(legT) > 0 {
+			leg.Tracks[name] = &legT
+		}
+	}
+
+	for _,tag := range f.TagList() {
+		if !isDerivedTag(tag) { leg.SetTag(tag) }
+	}
+	if len(leg.Tracks) > 0 {
+		leg.Analyse()
+	}
+
+	return &leg
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,75 @@
+package flightdb
+
+import(
+	"testing"
+	"time"
+
+	"github.com/skypies/geo"
+)
+
+// A circuit: 10m airborne, 5m on the ground, 10m airborne, 20m gap, 10m airborne
+func legsTestFlight() Flight {
+	s := time.Date(2017, 4, 1, 16, 0, 0, 0, time.UTC)
+	track := Track{}
+	add := func(from, to int, alt, gs float64) {
+		for i:=from; i<to; i+=10 {
+			track = append(track, Trackpoint{
+				TimestampUTC: s.Add(time.Duration(i) * time.Second),
+				Latlong: geo.Latlong{Lat: 37.6 + float64(i)/10000.0, Long: -122.4},
+				Altitude: alt,
+				GroundSpeed: gs,
+			})
+		}
+	}
+	add(0, 600, 3000, 150)
+	add(600, 900, 10, 10)
+	add(900, 1500, 3000, 150)
+	add(2700, 3300, 3000, 150)
+
+	f := BlankFlight()
+	f.IcaoId = "A12345"
+	f.Callsign = "N12345"
+	f.SetTag("FOIA")
+	f.SetTag(":SFO")
+	f.Tracks["ADSB"] = &track
+	return f
+}
+
+func TestSplitIntoLegs(t *testing.T) {
+	f := legsTestFlight()
+	f.SetDatastoreKey("somekey")
+
+	legs := f.SplitIntoLegs(DefaultLegSplitOptions)
+	if len(legs) != 3 {
+		t.Fatalf("expected 3 legs, saw %d: %v", len(legs), f.FindLegBoundaries(DefaultLegSplitOptions))
+	}
+
+	n := 0
+	for _,leg := range legs { n += len(leg.AnyTrack()) }
+	if n != len(f.AnyTrack()) {
+		t.Errorf("expected %d points across the legs, saw %d", len(f.AnyTrack()), n)
+	}
+	if legs[0].GetDatastoreKey() != "somekey" || legs[1].GetDatastoreKey() != "" {
+		t.Errorf("datastore keys not as expected")
+	}
+	if !legs[1].HasTag("FOIA") || legs[1].HasTag(":SFO") {
+		t.Errorf("tags not as expected: %v", legs[1].TagList())
+	}
+
+	// A callsign change should split the first leg again
+	f.NoteCallsignChange(f.AnyTrack()[30].TimestampUTC, "N99999")
+	legs = f.SplitIntoLegs(DefaultLegSplitOptions)
+	if len(legs) != 4 {
+		t.Fatalf("expected 4 legs, saw %d: %v", len(legs), f.FindLegBoundaries(DefaultLegSplitOptions))
+	} else if legs[0].Callsign != "N12345" || legs[1].Callsign != "N99999" {
+		t.Errorf("callsigns not as expected: %s, %s", legs[0].Callsign, legs[1].Callsign)
+	}
+
+	// A flight with just one leg shouldn't be split
+	track := (*f.Tracks["ADSB"])[:60]
+	f2 := BlankFlight()
+	f2.Tracks["ADSB"] = &track
+	if legs := f2.SplitIntoLegs(DefaultLegSplitOptions); legs != nil {
+		t.Errorf("single leg was split into %d", len(legs))
+	}
+}
@@ -0,0 +1,167 @@
+package localds
+
+// The file-backed provider is the memory provider, plus an append-only journal of every
+// mutation. On startup the journal is replayed to rebuild the in-memory state. Repeated Puts
+// of the same entity (e.g. AddTrackFragment extending a flight) grow the file, so call
+// Compact() every so often.
+
+import(
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A record is one entry in the journal file.
+type record struct {
+	Key      string                    // Key.Encode()
+	Deleted  bool
+	Data     []byte
+	Props    map[string][]interface{}
+}
+
+type FileDSProvider struct {
+	*MemoryDSProvider // embedded; handles everything except persistence
+	Filename  string
+
+	file     *os.File
+	writer   *bufio.Writer
+	enc      *gob.Encoder
+}
+
+// {{{ NewFileDSProvider
+
+// NewFileDSProvider opens (or creates) the named file, and loads its contents.
+func NewFileDSProvider(filename string) (*FileDSProvider, error) {
+	p := FileDSProvider{
+		MemoryDSProvider: NewMemoryDSProvider(),
+		Filename: filename,
+	}
+
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	if err := p.openForAppend(); err != nil {
+		return nil, err
+	}
+
+	p.MemoryDSProvider.journal = p.append
+	return &p, nil
+}
+
+// }}}
+// {{{ p.load
+
+func (p *FileDSProvider)load() error {
+	f,err := os.Open(p.Filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("localds.NewFileDSProvider: %v", err)
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	n := 0
+	for {
+		recs := []record{}
+		if err := dec.Decode(&recs); err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			// A partial write at the end of the file; everything before it is good.
+			p.Warningf(nil, "localds: %s truncated after %d batches; ignoring the tail", p.Filename, n)
+			break
+		} else if err != nil {
+			return fmt.Errorf("localds.NewFileDSProvider %s, batch %d: %v", p.Filename, n, err)
+		}
+
+		for _,rec := range recs {
+			if rec.Deleted {
+				delete(p.entities, rec.Key)
+				continue
+			}
+			k,err := DecodeKey(rec.Key)
+			if err != nil { return err }
+			p.MemoryDSProvider.store([]*entity{{Key:k, Data:rec.Data, Props:rec.Props}})
+		}
+		n++
+	}
+
+	return nil
+}
+
+// }}}
+// {{{ p.openForAppend, p.append
+
+// A gob stream carries type definitions once, at the front; so each time we open the file
+// for appending, we need a fresh stream. We do this by compacting the file on open, which
+// also throws away any superceded records.
+func (p *FileDSProvider)openForAppend() error {
+	tmpName := p.Filename + ".tmp"
+	f,err := os.Create(tmpName)
+	if err != nil { return fmt.Errorf("localds: %v", err) }
+
+	p.file = f
+	p.writer = bufio.NewWriter(f)
+	p.enc = gob.NewEncoder(p.writer)
+
+	recs := []record{}
+	for encoded,e := range p.entities {
+		recs = append(recs, record{Key:encoded, Data:e.Data, Props:e.Props})
+	}
+	if err := p.append(recs); err != nil {
+		f.Close()
+		return err
+	}
+
+	return os.Rename(tmpName, p.Filename)
+}
+
+// Called by the memory provider, with the lock held.
+func (p *FileDSProvider)append(recs []record) error {
+	if err := p.enc.Encode(recs); err != nil {
+		return fmt.Errorf("localds: journal write %s: %v", p.Filename, err)
+	}
+	if err := p.writer.Flush(); err != nil {
+		return fmt.Errorf("localds: journal flush %s: %v", p.Filename, err)
+	}
+	return nil
+}
+
+// }}}
+// {{{ p.Compact, p.Close
+
+// Compact rewrites the file, so it only contains the current version of each entity.
+func (p *FileDSProvider)Compact() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	return p.openForAppend()
+}
+
+func (p *FileDSProvider)Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.MemoryDSProvider.journal = func([]record) error {
+		return fmt.Errorf("localds: %s has been closed", p.Filename)
+	}
+	if err := p.writer.Flush(); err != nil {
+		return err
+	}
+	return p.file.Close()
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,176 @@
+package localds
+
+import(
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/skypies/util/gcp/ds"
+)
+
+// Key implements ds.Keyer for the local providers. It mirrors the shape of a datastore key: a
+// kind, either a string name or an int64 ID, and an optional parent.
+type Key struct {
+	Kind     string
+	Name     string
+	ID       int64
+	Parent  *Key
+}
+
+// keyElem is one step in the path of a key, as used in the encoded form.
+type keyElem struct {
+	K   string  `json:"k"`
+	N   string  `json:"n,omitempty"`
+	I   int64   `json:"i,omitempty"`
+}
+
+// {{{ k.Incomplete, k.Equal, k.HasAncestor
+
+func (k *Key)Incomplete() bool { return k.Name == "" && k.ID == 0 }
+
+func (k1 *Key)Equal(k2 *Key) bool {
+	for k1 != nil && k2 != nil {
+		if k1.Kind != k2.Kind || k1.Name != k2.Name || k1.ID != k2.ID { return false }
+		k1,k2 = k1.Parent,k2.Parent
+	}
+	return k1 == nil && k2 == nil
+}
+
+// HasAncestor is true if anc is k, or is one of k's parents (the datastore definition).
+func (k *Key)HasAncestor(anc *Key) bool {
+	for ; k != nil; k = k.Parent {
+		if k.Equal(anc) { return true }
+	}
+	return false
+}
+
+// }}}
+// {{{ k.String
+
+func (k *Key)String() string {
+	if k == nil { return "<nil>" }
+	str := ""
+	if k.Parent != nil { str = k.Parent.String() + "/" }
+	if k.Name != "" {
+		str += fmt.Sprintf("%s,%q", k.Kind, k.Name)
+	} else {
+		str += fmt.Sprintf("%s,%d", k.Kind, k.ID)
+	}
+	return str
+}
+
+// }}}
+// {{{ compareKeys
+
+// compareKeys gives the datastore ordering: element by element from the root; kinds sort as
+// strings, and within a kind, numeric IDs come before names.
+func compareKeys(k1, k2 *Key) int {
+	p1,p2 := k1.path(),k2.path()
+	for i:=0; i<len(p1) && i<len(p2); i++ {
+		a,b := p1[i],p2[i]
+		if a.K != b.K { return strings.Compare(a.K, b.K) }
+		if (a.N == "") != (b.N == "") {
+			if a.N == "" { return -1 }
+			return 1
+		}
+		if a.N != b.N { return strings.Compare(a.N, b.N) }
+		if a.I < b.I { return -1 } else if a.I > b.I { return 1 }
+	}
+	return len(p1) - len(p2)
+}
+
+// }}}
+// {{{ k.Encode, DecodeKey
+
+func (k *Key)path() []keyElem {
+	if k == nil { return []keyElem{} }
+	return append(k.Parent.path(), keyElem{K:k.Kind, N:k.Name, I:k.ID})
+}
+
+// Encode returns an opaque, URL-safe string; DecodeKey reverses it.
+func (k *Key)Encode() string {
+	jsonBytes,_ := json.Marshal(k.path())
+	return base64.RawURLEncoding.EncodeToString(jsonBytes)
+}
+
+func DecodeKey(encoded string) (*Key, error) {
+	jsonBytes,err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, fmt.Errorf("localds.DecodeKey '%s': %v", encoded, err)
+	}
+
+	path := []keyElem{}
+	if err := json.Unmarshal(jsonBytes, &path); err != nil {
+		return nil, fmt.Errorf("localds.DecodeKey '%s': %v", encoded, err)
+	} else if len(path) == 0 {
+		return nil, fmt.Errorf("localds.DecodeKey '%s': empty key", encoded)
+	}
+
+	var k *Key
+	for _,elem := range path {
+		k = &Key{Kind:elem.K, Name:elem.N, ID:elem.I, Parent:k}
+	}
+	return k, nil
+}
+
+// }}}
+// {{{ unpackKeyer
+
+func unpackKeyer(keyer ds.Keyer) (*Key, error) {
+	if keyer == nil { return nil, nil }
+	k,ok := keyer.(*Key)
+	if !ok {
+		return nil, fmt.Errorf("localds: keyer was %T, not *localds.Key", keyer)
+	}
+	return k, nil
+}
+
+// }}}
+// {{{ localKeys
+
+// localKeys provides the key-related parts of the ds.DatastoreProvider interface.
+type localKeys struct{}
+
+func (lk localKeys)NewIncompleteKey(ctx context.Context, kind string, root ds.Keyer) ds.Keyer {
+	parent,_ := unpackKeyer(root)
+	return &Key{Kind:kind, Parent:parent}
+}
+func (lk localKeys)NewNameKey(ctx context.Context, kind, name string, root ds.Keyer) ds.Keyer {
+	parent,_ := unpackKeyer(root)
+	return &Key{Kind:kind, Name:name, Parent:parent}
+}
+func (lk localKeys)NewIDKey(ctx context.Context, kind string, id int64, root ds.Keyer) ds.Keyer {
+	parent,_ := unpackKeyer(root)
+	return &Key{Kind:kind, ID:id, Parent:parent}
+}
+
+func (lk localKeys)DecodeKey(encoded string) (ds.Keyer, error) {
+	k,err := DecodeKey(encoded)
+	if err != nil { return nil, err }
+	return k, nil
+}
+func (lk localKeys)KeyParent(in ds.Keyer) ds.Keyer {
+	if k,_ := unpackKeyer(in); k != nil && k.Parent != nil {
+		return k.Parent
+	}
+	return nil
+}
+func (lk localKeys)KeyName(in ds.Keyer) string {
+	if k,_ := unpackKeyer(in); k != nil {
+		return k.Name
+	}
+	return ""
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,305 @@
+package localds
+
+// go test -v github.com/skypies/flightdb/localds
+
+import(
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/skypies/util/gcp/ds"
+	fdb "github.com/skypies/flightdb"
+)
+
+var ctx = context.Background()
+
+type thing struct {
+	Blob       []byte    `datastore:",noindex"`
+	Name         string
+	Slots      []time.Time
+	Tags       []string
+	Updated      time.Time
+	Ignored      string  `datastore:"-"`
+}
+
+var t0 = time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)
+func hr(n int) time.Time { return t0.Add(time.Duration(n) * time.Hour) }
+
+// {{{ populate
+
+func populate(t *testing.T, p ds.DatastoreProvider) []ds.Keyer {
+	root := p.NewNameKey(ctx, "thing", "root", nil)
+	things := []thing{
+		{Name:"a", Slots:[]time.Time{hr(1),hr(2)},       Tags:[]string{"X","Y"}, Updated:hr(10)},
+		{Name:"b", Slots:[]time.Time{hr(3)},             Tags:[]string{"X"},     Updated:hr(12)},
+		{Name:"c", Slots:[]time.Time{hr(1),hr(5)},       Tags:[]string{"Y"},     Updated:hr(11)},
+		{Name:"d", Slots:[]time.Time{hr(7),hr(8),hr(9)}, Tags:[]string{},        Updated:hr(9)},
+	}
+
+	keyers := []ds.Keyer{}
+	for i,th := range things {
+		var parent ds.Keyer
+		if i < 2 { parent = root }
+		keyer,err := p.Put(ctx, p.NewIncompleteKey(ctx, "thing", parent), &th)
+		if err != nil { t.Fatal(err) }
+		keyers = append(keyers, keyer)
+	}
+	return keyers
+}
+
+// }}}
+// {{{ names
+
+func names(t *testing.T, p ds.DatastoreProvider, q *ds.Query) string {
+	results := []thing{}
+	if _,err := p.GetAll(ctx, q, &results); err != nil {
+		t.Fatal(err)
+	}
+	str := ""
+	for _,th := range results { str += th.Name }
+	return str
+}
+
+// }}}
+
+// {{{ newSQLiteProvider
+
+func newSQLiteProvider(t *testing.T) (*SQLiteDSProvider, func()) {
+	dir,err := os.MkdirTemp("", "localds")
+	if err != nil { t.Fatal(err) }
+	p,err := NewSQLiteDSProvider(filepath.Join(dir, "test.sqlite"))
+	if err != nil { t.Fatal(err) }
+	return p, func() { p.Close(); os.RemoveAll(dir) }
+}
+
+// }}}
+
+func TestQueries(t *testing.T) {
+	testQueries(t, NewMemoryDSProvider())
+
+	p,done := newSQLiteProvider(t)
+	defer done()
+	testQueries(t, p)
+}
+
+func TestGetPutDelete(t *testing.T) {
+	testGetPutDelete(t, NewMemoryDSProvider())
+
+	p,done := newSQLiteProvider(t)
+	defer done()
+	testGetPutDelete(t, p)
+}
+
+// {{{ testQueries
+
+func testQueries(t *testing.T, p ds.DatastoreProvider) {
+	populate(t, p)
+
+	tests := []struct{
+		expected string
+		q *ds.Query
+	}{
+		{"cdab", ds.NewQuery("thing")}, // key order; a & b have a named parent, so sort last
+		{"",     ds.NewQuery("otherthing")},
+		{"ab",   ds.NewQuery("thing").Filter("Tags = ", "X")},
+		{"a",    ds.NewQuery("thing").Filter("Tags = ", "X").Filter("Tags = ", "Y")},
+		{"c",    ds.NewQuery("thing").Filter("Name =", "c")},
+		// Inequalities on one multi-valued property must be satisfied by a single value; 'c'
+		// has a slot either side of the range, but none inside it.
+		{"b",    ds.NewQuery("thing").Filter("Slots >= ", hr(3)).Filter("Slots <= ", hr(4))},
+		{"dc",   ds.NewQuery("thing").Filter("Slots > ", hr(4)).Filter("Slots < ", hr(20)).
+			Order("Updated")},
+		{"bcad", ds.NewQuery("thing").Order("-Updated")},
+		{"bc",   ds.NewQuery("thing").Order("-Updated").Limit(2)},
+		{"dcba", ds.NewQuery("thing").Order("-Slots")},
+		{"cabd", ds.NewQuery("thing").Order("Slots")}, // a,c tie; key order
+		{"",     ds.NewQuery("thing").Filter("Ignored = ", "")},
+		{"ab",   ds.NewQuery("thing").Ancestor(p.NewNameKey(ctx, "thing", "root", nil))},
+	}
+
+	for i,test := range tests {
+		if actual := names(t, p, test.q); actual != test.expected {
+			t.Errorf("[%d] expected %q, got %q; query: %s", i, test.expected, actual, test.q)
+		}
+	}
+
+	if keyers,err := p.GetAll(ctx, ds.NewQuery("thing").Filter("Tags =", "Y").KeysOnly(), nil); err != nil {
+		t.Error(err)
+	} else if len(keyers) != 2 {
+		t.Errorf("KeysOnly: expected 2 keys, got %d", len(keyers))
+	}
+
+	if _,err := p.GetAll(ctx, ds.NewQuery("thing").Filter("Tags !=", "Y"), nil); err == nil {
+		t.Errorf("Bad operator should have errored")
+	}
+}
+
+// }}}
+// {{{ testGetPutDelete
+
+func testGetPutDelete(t *testing.T, p ds.DatastoreProvider) {
+	keyers := populate(t, p)
+
+	th := thing{}
+	if err := p.Get(ctx, keyers[1], &th); err != nil {
+		t.Fatal(err)
+	} else if th.Name != "b" {
+		t.Errorf("Get: expected 'b', got %v", th)
+	}
+
+	// Check keys survive the encode/decode roundtrip, and keep their parents
+	if keyer,err := p.DecodeKey(keyers[1].Encode()); err != nil {
+		t.Fatal(err)
+	} else if keyer.Encode() != keyers[1].Encode() {
+		t.Errorf("key roundtrip: %s != %s", keyer, keyers[1])
+	} else if p.KeyName(p.KeyParent(keyer)) != "root" {
+		t.Errorf("key roundtrip lost the parent: %s", keyer)
+	}
+
+	multi := make([]thing, 2)
+	if err := p.GetMulti(ctx, keyers[2:], multi); err != nil {
+		t.Fatal(err)
+	} else if multi[0].Name != "c" || multi[1].Name != "d" {
+		t.Errorf("GetMulti: bad results: %v", multi)
+	}
+
+	// Overwrites shouldn't leave stale fields behind
+	th.Tags = nil
+	if _,err := p.Put(ctx, keyers[1], &th); err != nil { t.Fatal(err) }
+	if err := p.Get(ctx, keyers[1], &th); err != nil || len(th.Tags) != 0 {
+		t.Errorf("overwrite: err=%v, tags=%v", err, th.Tags)
+	}
+	if actual := names(t, p, ds.NewQuery("thing").Filter("Tags =", "X")); actual != "a" {
+		t.Errorf("overwrite: index not updated, got %q", actual)
+	}
+
+	if err := p.DeleteMulti(ctx, keyers[:2]); err != nil { t.Fatal(err) }
+	if err := p.Get(ctx, keyers[0], &th); err != ds.ErrNoSuchEntity {
+		t.Errorf("Get after delete: expected ErrNoSuchEntity, got %v", err)
+	}
+	if keyers,_ := p.GetAll(ctx, ds.NewQuery("thing"), nil); len(keyers) != 2 {
+		t.Errorf("expected 2 entities after delete, found %d", len(keyers))
+	}
+}
+
+// }}}
+
+func TestPutIfVersion(t *testing.T) {
+	testPutIfVersion(t, NewMemoryDSProvider())
+
+	p,done := newSQLiteProvider(t)
+	defer done()
+	testPutIfVersion(t, p)
+}
+
+// {{{ testPutIfVersion
+
+func testPutIfVersion(t *testing.T, p interface{
+	ds.DatastoreProvider
+	PutIfVersion(context.Context, ds.Keyer, interface{}, int64) (ds.Keyer, error)
+	PutMultiIfVersion(context.Context, []ds.Keyer, interface{}, []int64) ([]ds.Keyer, error)
+	PutDeleteIfVersion(context.Context, []ds.Keyer, interface{}, []int64, []ds.Keyer, []int64) ([]ds.Keyer, error)
+}) {
+	// Flights take a different path through the SQLite provider
+	for _,kind := range []string{"thing", FlightKind} {
+		keyer := p.NewIDKey(ctx, kind, 42, nil)
+		put := func(v, expected int64) error {
+			_,err := p.PutIfVersion(ctx, keyer, &fdb.IndexedFlightBlob{Version:v}, expected)
+			return err
+		}
+
+		if err := put(1, 0); err != fdb.ErrVersionConflict {
+			t.Errorf("%s: put to non-existent entity with version 0: expected conflict, got %v", kind, err)
+		}
+		if err := put(1, -1); err != nil { t.Fatalf("%s: %v", kind, err) }
+		if err := put(2, -1); err != fdb.ErrVersionConflict {
+			t.Errorf("%s: second create: expected conflict, got %v", kind, err)
+		}
+		if err := put(2, 1); err != nil { t.Fatalf("%s: %v", kind, err) }
+		if err := put(3, 1); err != fdb.ErrVersionConflict {
+			t.Errorf("%s: stale version: expected conflict, got %v", kind, err)
+		}
+
+		blob := fdb.IndexedFlightBlob{}
+		if err := p.Get(ctx, keyer, &blob); err != nil || blob.Version != 2 {
+			t.Errorf("%s: expected version 2, got %d (err=%v)", kind, blob.Version, err)
+		}
+
+		// A batch with one stale version should store nothing
+		other := p.NewIDKey(ctx, kind, 43, nil)
+		blobs := []fdb.IndexedFlightBlob{{Version:1}, {Version:3}}
+		_,err := p.PutMultiIfVersion(ctx, []ds.Keyer{other, keyer}, blobs, []int64{-1, 1})
+		if err != fdb.ErrVersionConflict {
+			t.Errorf("%s: batch with stale version: expected conflict, got %v", kind, err)
+		}
+		if err := p.Get(ctx, other, &blob); err != ds.ErrNoSuchEntity {
+			t.Errorf("%s: batch with stale version was partly stored (err=%v)", kind, err)
+		}
+		if _,err := p.PutMultiIfVersion(ctx, []ds.Keyer{other, keyer}, blobs, []int64{-1, 2}); err != nil {
+			t.Errorf("%s: batch: %v", kind, err)
+		}
+
+		// A stale version on a delete means nothing is stored, and nothing deleted
+		put4 := []*fdb.IndexedFlightBlob{{Version:4}}
+		_,err = p.PutDeleteIfVersion(ctx, []ds.Keyer{keyer}, put4, []int64{3}, []ds.Keyer{other}, []int64{0})
+		if err != fdb.ErrVersionConflict {
+			t.Errorf("%s: delete with stale version: expected conflict, got %v", kind, err)
+		}
+		if err := p.Get(ctx, other, &blob); err != nil {
+			t.Errorf("%s: delete with stale version still deleted (err=%v)", kind, err)
+		} else if err := p.Get(ctx, keyer, &blob); err != nil || blob.Version != 3 {
+			t.Errorf("%s: delete with stale version still stored: %d (err=%v)", kind, blob.Version, err)
+		}
+		if _,err := p.PutDeleteIfVersion(ctx, []ds.Keyer{keyer}, put4, []int64{3}, []ds.Keyer{other}, []int64{1}); err != nil {
+			t.Errorf("%s: put & delete: %v", kind, err)
+		} else if err := p.Get(ctx, other, &blob); err != ds.ErrNoSuchEntity {
+			t.Errorf("%s: put & delete didn't delete (err=%v)", kind, err)
+		}
+	}
+}
+
+// }}}
+
+func TestFileProvider(t *testing.T) {
+	dir,err := os.MkdirTemp("", "localds")
+	if err != nil { t.Fatal(err) }
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.fdb")
+
+	p1,err := NewFileDSProvider(filename)
+	if err != nil { t.Fatal(err) }
+	keyers := populate(t, p1)
+	if err := p1.Delete(ctx, keyers[0]); err != nil { t.Fatal(err) }
+	if err := p1.Close(); err != nil { t.Fatal(err) }
+
+	p2,err := NewFileDSProvider(filename)
+	if err != nil { t.Fatal(err) }
+	defer p2.Close()
+
+	if actual := names(t, p2, ds.NewQuery("thing").Order("-Updated")); actual != "bcd" {
+		t.Errorf("after reload, expected 'bcd', got %q", actual)
+	}
+
+	// New keys mustn't collide with the reloaded ones
+	keyer,err := p2.Put(ctx, p2.NewIncompleteKey(ctx, "thing", nil), &thing{Name:"e"})
+	if err != nil { t.Fatal(err) }
+	for _,k := range keyers {
+		if k.Encode() == keyer.Encode() { t.Errorf("new key %s collides with old", keyer) }
+	}
+
+	if err := p2.Compact(); err != nil { t.Fatal(err) }
+	if actual := names(t, p2, ds.NewQuery("thing")); actual != "cdeb" {
+		t.Errorf("after compact, expected 'cdeb', got %q", actual)
+	}
+}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,456 @@
+// Package localds provides implementations of the ds.DatastoreProvider interface that don't
+// need Google Cloud: an in-memory one (for tests), and a file-backed one (for analysis on a
+// laptop). They honour the subset of query features that flightdb uses.
+package localds
+
+/*
+
+p := localds.NewMemoryDSProvider()
+db := fgae.New(ctx, p)
+
+p,err := localds.NewFileDSProvider("/tmp/flights.fdb")
+defer p.Close()
+db := fgae.New(ctx, p)
+
+*/
+
+import(
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/skypies/util/gcp/ds"
+	fdb "github.com/skypies/flightdb"
+)
+
+var Debug = false
+
+func init() {
+	// Property values are stored as interface{}; gob needs to know about the non-basic types.
+	gob.Register(time.Time{})
+}
+
+// An entity is the stored form of whatever was Put. The object itself is gob-encoded (so that
+// callers can't alias our copy); the indexable properties are pulled out at Put time.
+type entity struct {
+	Key    *Key
+	Data   []byte
+	Props  map[string][]interface{}
+}
+
+// MemoryDSProvider implements the ds.DatastoreProvider interface entirely in RAM.
+type MemoryDSProvider struct {
+	localLogger
+	localKeys
+
+	mu          sync.RWMutex
+	entities    map[string]*entity  // keyed on Key.Encode()
+	nextID      int64
+
+	journal     func([]record) error // if set, called for all mutations, while holding the lock
+}
+
+func NewMemoryDSProvider() *MemoryDSProvider {
+	return &MemoryDSProvider{
+		entities: map[string]*entity{},
+		nextID: 1,
+	}
+}
+
+// {{{ encode/decode helpers
+
+func encodeEntity(k *Key, src reflect.Value) (*entity, error) {
+	src = reflect.Indirect(src)
+	if src.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("localds: can only store structs, not %s", src.Type())
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).EncodeValue(src); err != nil {
+		return nil, fmt.Errorf("localds: encode %s: %v", src.Type(), err)
+	}
+
+	return &entity{
+		Key: k,
+		Data: buf.Bytes(),
+		Props: extractProperties(src.Interface()),
+	}, nil
+}
+
+// decodeInto sets dst (which must be settable, and a struct or pointer to struct) to a fresh
+// copy of the entity. We never decode over the top of an existing value, as gob doesn't
+// transmit zero values, so stale fields would survive.
+func (e *entity)decodeInto(dst reflect.Value) error {
+	ty := dst.Type()
+	isPtr := ty.Kind() == reflect.Ptr
+	if isPtr { ty = ty.Elem() }
+
+	fresh := reflect.New(ty)
+	if err := gob.NewDecoder(bytes.NewReader(e.Data)).DecodeValue(fresh); err != nil {
+		return fmt.Errorf("localds: decode %s into %s: %v", e.Key, ty, err)
+	}
+
+	if isPtr {
+		dst.Set(fresh)
+	} else {
+		dst.Set(fresh.Elem())
+	}
+	return nil
+}
+
+// }}}
+
+// {{{ p.Get, p.GetMulti, p.GetAll
+
+func (p *MemoryDSProvider)Get(ctx context.Context, keyer ds.Keyer, dst interface{}) error {
+	k,err := unpackKeyer(keyer)
+	if err != nil { return err }
+
+	dstVal := reflect.ValueOf(dst)
+	if dstVal.Kind() != reflect.Ptr || dstVal.IsNil() {
+		return fmt.Errorf("localds.Get: dst must be a non-nil pointer, not %T", dst)
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	e,exists := p.entities[k.Encode()]
+	if !exists { return ds.ErrNoSuchEntity }
+
+	return e.decodeInto(dstVal.Elem())
+}
+
+// dst must be a slice of the same length as keyers.
+func (p *MemoryDSProvider)GetMulti(ctx context.Context, keyers []ds.Keyer, dst interface{}) error {
+	dstVal := reflect.ValueOf(dst)
+	if dstVal.Kind() != reflect.Slice || dstVal.Len() != len(keyers) {
+		return fmt.Errorf("localds.GetMulti: dst must be a slice of len %d, not %T", len(keyers), dst)
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var missing error
+	for i,keyer := range keyers {
+		k,err := unpackKeyer(keyer)
+		if err != nil { return err }
+
+		if e,exists := p.entities[k.Encode()]; !exists {
+			missing = ds.ErrNoSuchEntity
+		} else if err := e.decodeInto(dstVal.Index(i)); err != nil {
+			return err
+		}
+	}
+
+	return missing
+}
+
+// If dst is nil, or the query is KeysOnly, then just the keys are returned. Otherwise dst must
+// be a pointer to a slice, which has the results appended.
+func (p *MemoryDSProvider)GetAll(ctx context.Context, q *ds.Query, dst interface{}) ([]ds.Keyer, error) {
+	cq,err := compileQuery(q)
+	if err != nil {
+		return nil, fmt.Errorf("GetAll{local}: %v\nQuery: %s", err, q)
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	results := cq.run(p.entities)
+
+	keyers := []ds.Keyer{}
+	for _,e := range results {
+		keyers = append(keyers, e.Key)
+	}
+	if q.KeysOnlyVal || dst == nil {
+		return keyers, nil
+	}
+
+	dstVal := reflect.ValueOf(dst)
+	if dstVal.Kind() != reflect.Ptr || dstVal.Elem().Kind() != reflect.Slice {
+		return nil, fmt.Errorf("GetAll{local}: dst must be a pointer to a slice, not %T", dst)
+	}
+	sliceVal := dstVal.Elem()
+	for _,e := range results {
+		elem := reflect.New(sliceVal.Type().Elem()).Elem()
+		if err := e.decodeInto(elem); err != nil {
+			return nil, err
+		}
+		sliceVal.Set(reflect.Append(sliceVal, elem))
+	}
+
+	return keyers, nil
+}
+
+// }}}
+// {{{ p.Put, p.PutMulti
+
+// Must be called with the write lock held
+func (p *MemoryDSProvider)completeKey(k *Key) *Key {
+	if !k.Incomplete() { return k }
+	done := *k
+	done.ID = p.nextID
+	p.nextID++
+	return &done
+}
+
+// Must be called with the write lock held
+func (p *MemoryDSProvider)store(entities []*entity) error {
+	return p.apply(entities, nil)
+}
+
+// Stores the entities, and deletes the (encoded) keys, as a single journal entry. Must be
+// called with the write lock held.
+func (p *MemoryDSProvider)apply(entities []*entity, deleted []string) error {
+	if p.journal != nil {
+		recs := []record{}
+		for _,e := range entities {
+			recs = append(recs, record{Key:e.Key.Encode(), Data:e.Data, Props:e.Props})
+		}
+		for _,encoded := range deleted {
+			recs = append(recs, record{Key:encoded, Deleted:true})
+		}
+		if err := p.journal(recs); err != nil {
+			return err
+		}
+	}
+
+	for _,e := range entities {
+		p.entities[e.Key.Encode()] = e
+		if e.Key.Name == "" && e.Key.ID >= p.nextID {
+			p.nextID = e.Key.ID + 1
+		}
+	}
+	for _,encoded := range deleted {
+		delete(p.entities, encoded)
+	}
+	return nil
+}
+
+func (p *MemoryDSProvider)Put(ctx context.Context, keyer ds.Keyer, src interface{}) (ds.Keyer, error) {
+	k,err := unpackKeyer(keyer)
+	if err != nil { return nil, err }
+	if k == nil { return nil, fmt.Errorf("localds.Put: nil key") }
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e,err := encodeEntity(p.completeKey(k), reflect.ValueOf(src))
+	if err != nil { return nil, err }
+
+	if err := p.store([]*entity{e}); err != nil {
+		return nil, err
+	}
+
+	return e.Key, nil
+}
+
+// src must be a slice, the same length as keyers.
+func (p *MemoryDSProvider)PutMulti(ctx context.Context, keyers []ds.Keyer, src interface{}) ([]ds.Keyer, error) {
+	srcVal := reflect.ValueOf(src)
+	if srcVal.Kind() != reflect.Slice || srcVal.Len() != len(keyers) {
+		return nil, fmt.Errorf("localds.PutMulti: src must be a slice of len %d, not %T", len(keyers), src)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entities := []*entity{}
+	for i,keyer := range keyers {
+		k,err := unpackKeyer(keyer)
+		if err != nil { return nil, err }
+		if k == nil { return nil, fmt.Errorf("localds.PutMulti: nil key at [%d]", i) }
+
+		e,err := encodeEntity(p.completeKey(k), srcVal.Index(i))
+		if err != nil { return nil, err }
+		entities = append(entities, e)
+	}
+
+	if err := p.store(entities); err != nil {
+		return nil, err
+	}
+
+	out := []ds.Keyer{}
+	for _,e := range entities {
+		out = append(out, e.Key)
+	}
+	return out, nil
+}
+
+// PutIfVersion is a compare-and-swap: src is only stored if the entity's current Version
+// field matches version, else fdb.ErrVersionConflict. A negative version means the entity must
+// not exist yet. (src must be a struct with an int64 Version field.)
+func (p *MemoryDSProvider)PutIfVersion(ctx context.Context, keyer ds.Keyer, src interface{}, version int64) (ds.Keyer, error) {
+	out,err := p.PutMultiIfVersion(ctx, []ds.Keyer{keyer}, sliceOfOne(src), []int64{version})
+	if err != nil { return nil, err }
+	return out[0], nil
+}
+
+// PutMultiIfVersion is PutIfVersion for a batch; if any of the versions don't match, nothing
+// is stored.
+func (p *MemoryDSProvider)PutMultiIfVersion(ctx context.Context, keyers []ds.Keyer, src interface{}, versions []int64) ([]ds.Keyer, error) {
+	return p.PutDeleteIfVersion(ctx, keyers, src, versions, nil, nil)
+}
+
+// PutDeleteIfVersion is PutMultiIfVersion, that also deletes delKeyers, which must be at
+// delVersions; all or nothing. The deleted entities must be the same type as src's elements.
+func (p *MemoryDSProvider)PutDeleteIfVersion(ctx context.Context, keyers []ds.Keyer, src interface{}, versions []int64, delKeyers []ds.Keyer, delVersions []int64) ([]ds.Keyer, error) {
+	srcVal := reflect.ValueOf(src)
+	if srcVal.Kind() != reflect.Slice || srcVal.Len() != len(keyers) || len(versions) != len(keyers) {
+		return nil, fmt.Errorf("localds.PutDeleteIfVersion: need %d srcs & versions", len(keyers))
+	} else if len(delVersions) != len(delKeyers) {
+		return nil, fmt.Errorf("localds.PutDeleteIfVersion: need %d delete versions", len(delKeyers))
+	}
+	ty := elemStructType(srcVal)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	check := func(k *Key, version int64) error {
+		current := int64(-1)
+		if e,exists := p.entities[k.Encode()]; exists {
+			existing := reflect.New(ty).Elem()
+			if err := e.decodeInto(existing); err != nil { return err }
+			var err error
+			if current,err = versionOf(existing); err != nil { return err }
+		}
+		if current != version {
+			return fdb.ErrVersionConflict
+		}
+		return nil
+	}
+
+	entities := []*entity{}
+	for i,keyer := range keyers {
+		k,err := unpackKeyer(keyer)
+		if err != nil { return nil, err }
+		if k == nil || k.Incomplete() {
+			return nil, fmt.Errorf("localds.PutDeleteIfVersion: need a complete key at [%d]", i)
+		}
+		if err := check(k, versions[i]); err != nil { return nil, err }
+
+		e,err := encodeEntity(k, srcVal.Index(i))
+		if err != nil { return nil, err }
+		entities = append(entities, e)
+	}
+
+	deleted := []string{}
+	for i,keyer := range delKeyers {
+		k,err := unpackKeyer(keyer)
+		if err != nil { return nil, err }
+		if k == nil || k.Incomplete() {
+			return nil, fmt.Errorf("localds.PutDeleteIfVersion: need a complete key at [%d]", i)
+		}
+		if err := check(k, delVersions[i]); err != nil { return nil, err }
+		deleted = append(deleted, k.Encode())
+	}
+
+	if err := p.apply(entities, deleted); err != nil {
+		return nil, err
+	}
+
+	out := []ds.Keyer{}
+	for _,e := range entities {
+		out = append(out, e.Key)
+	}
+	return out, nil
+}
+
+// The struct type held by the slice (whose elements may be pointers, or interfaces)
+func elemStructType(sliceVal reflect.Value) reflect.Type {
+	if sliceVal.Len() > 0 { return reflect.Indirect(reflect.ValueOf(sliceVal.Index(0).Interface())).Type() }
+	ty := sliceVal.Type().Elem()
+	if ty.Kind() == reflect.Ptr { ty = ty.Elem() }
+	return ty
+}
+
+// A one element slice holding src, for the *Multi calls
+func sliceOfOne(src interface{}) interface{} {
+	v := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(src)), 1, 1)
+	v.Index(0).Set(reflect.ValueOf(src))
+	return v.Interface()
+}
+
+func versionOf(v reflect.Value) (int64, error) {
+	v = reflect.Indirect(v)
+	if v.Kind() == reflect.Struct {
+		if f := v.FieldByName("Version"); f.IsValid() && f.Kind() == reflect.Int64 {
+			return f.Int(), nil
+		}
+	}
+	return 0, fmt.Errorf("localds: %s has no int64 Version field", v.Type())
+}
+
+// }}}
+// {{{ p.Delete, p.DeleteMulti
+
+// As with datastore, deleting something that doesn't exist is not an error.
+func (p *MemoryDSProvider)Delete(ctx context.Context, keyer ds.Keyer) error {
+	return p.DeleteMulti(ctx, []ds.Keyer{keyer})
+}
+
+func (p *MemoryDSProvider)DeleteMulti(ctx context.Context, keyers []ds.Keyer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	encodedKeys := []string{}
+	for _,keyer := range keyers {
+		k,err := unpackKeyer(keyer)
+		if err != nil { return err }
+		if k == nil { continue }
+		encodedKeys = append(encodedKeys, k.Encode())
+	}
+
+	return p.apply(nil, encodedKeys)
+}
+
+// }}}
+
+// {{{ misc
+
+// Len returns how many entities are stored, of all kinds.
+func (p *MemoryDSProvider)Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.entities)
+}
+
+// localLogger provides the logging (and HTTP) parts of the ds.DatastoreProvider interface.
+type localLogger struct{}
+
+func (l localLogger)HTTPClient(ctx context.Context) *http.Client {
+	return &http.Client{}
+}
+
+func (l localLogger)Debugf(ctx context.Context, format string, args ...interface{}) {
+	if Debug {log.Printf(format, args...)}
+}
+func (l localLogger)Infof(ctx context.Context, format string,args ...interface{}) {
+	log.Printf(format, args...)
+}
+func (l localLogger)Errorf(ctx context.Context, format string,args ...interface{}) {
+	log.Printf(format, args...)
+}
+func (l localLogger)Warningf(ctx context.Context, format string,args ...interface{}) {
+	log.Printf(format, args...)
+}
+func (l localLogger)Criticalf(ctx context.Context, format string,args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,26 @@
+package localds
+
+import(
+	"path/filepath"
+
+	"github.com/skypies/util/gcp/ds"
+)
+
+// Open returns a provider for the named file; SQLite for files ending .sqlite, .sqlite3 or
+// .db, else the journal-based file provider.
+func Open(filename string) (ds.DatastoreProvider, error) {
+	switch filepath.Ext(filename) {
+	case ".sqlite", ".sqlite3", ".db":
+		return NewSQLiteDSProvider(filename)
+	default:
+		return NewFileDSProvider(filename)
+	}
+}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,306 @@
+package localds
+
+// Evaluation of ds.Query objects against stored entities. We try to follow the datastore
+// semantics that the flightdb code relies upon:
+//  * slice fields are multi-valued properties; an equality filter matches if any value matches
+//  * all the inequality filters on a property must be satisfied by the *same* value (this is
+//    what makes the Timeslots >= / <= pair in fgae.FQuery.ByTimeRange work)
+//  * when ordering by a multi-valued property, ascending uses the smallest value and
+//    descending uses the largest; entities without the property are dropped
+//  * results without an explicit order come back in key order
+
+import(
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skypies/util/gcp/ds"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// {{{ extractProperties
+
+// extractProperties walks a struct, and returns all the indexable values, keyed by property
+// name. Fields tagged `datastore:"-"` or `datastore:",noindex"` are skipped, as are []byte.
+func extractProperties(src interface{}) map[string][]interface{} {
+	props := map[string][]interface{}{}
+	v := reflect.Indirect(reflect.ValueOf(src))
+	if v.Kind() == reflect.Struct {
+		extractStructProperties(v, "", props)
+	}
+	return props
+}
+
+func extractStructProperties(v reflect.Value, prefix string, props map[string][]interface{}) {
+	t := v.Type()
+	for i:=0; i<t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous { continue } // unexported
+
+		name,opts := field.Name, ""
+		if tag := field.Tag.Get("datastore"); tag != "" {
+			bits := strings.SplitN(tag, ",", 2)
+			if bits[0] == "-" { continue }
+			if bits[0] != "" { name = bits[0] }
+			if len(bits) > 1 { opts = bits[1] }
+		}
+		if strings.Contains(opts, "noindex") { continue }
+
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct && fv.Type() != timeType {
+			if field.Anonymous {
+				extractStructProperties(fv, prefix, props)
+			} else {
+				extractStructProperties(fv, prefix+name+".", props)
+			}
+			continue
+		}
+
+		if fv.Kind() == reflect.Slice {
+			if fv.Type().Elem().Kind() == reflect.Uint8 { continue } // []byte is never indexed
+			for j:=0; j<fv.Len(); j++ {
+				if val,ok := normalizeValue(fv.Index(j)); ok {
+					props[prefix+name] = append(props[prefix+name], val)
+				}
+			}
+			continue
+		}
+
+		if val,ok := normalizeValue(fv); ok {
+			props[prefix+name] = append(props[prefix+name], val)
+		}
+	}
+}
+
+// }}}
+// {{{ normalizeValue
+
+// Collapse all the various numeric types down, so that values from entities and from query
+// filters can be compared.
+func normalizeValue(v reflect.Value) (interface{}, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Bool:
+		return v.Bool(), true
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return v.Interface().(time.Time), true
+		}
+	}
+	return nil, false
+}
+
+// }}}
+// {{{ compareValues
+
+// Returns -1, 0 or +1; ok is false if the values can't be compared.
+func compareValues(a, b interface{}) (int, bool) {
+	switch av := a.(type) {
+	case int64:
+		if bv,ok := b.(int64); ok {
+			if av < bv { return -1,true } else if av > bv { return 1,true }
+			return 0, true
+		} else if bv,ok := b.(float64); ok {
+			return compareValues(float64(av), bv)
+		}
+	case float64:
+		if bv,ok := b.(float64); ok {
+			if av < bv { return -1,true } else if av > bv { return 1,true }
+			return 0, true
+		} else if bv,ok := b.(int64); ok {
+			return compareValues(av, float64(bv))
+		}
+	case string:
+		if bv,ok := b.(string); ok { return strings.Compare(av,bv), true }
+	case bool:
+		if bv,ok := b.(bool); ok {
+			if av == bv { return 0,true } else if !av { return -1,true }
+			return 1, true
+		}
+	case time.Time:
+		if bv,ok := b.(time.Time); ok {
+			if av.Before(bv) { return -1,true } else if av.After(bv) { return 1,true }
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// }}}
+
+// {{{ filters
+
+type filter struct {
+	Field  string
+	Op     string
+	Value  interface{}
+}
+
+func (f filter)satisfiedBy(val interface{}) bool {
+	cmp,ok := compareValues(val, f.Value)
+	if !ok { return false }
+	switch f.Op {
+	case "=":  return cmp == 0
+	case "<":  return cmp <  0
+	case "<=": return cmp <= 0
+	case ">":  return cmp >  0
+	case ">=": return cmp >= 0
+	}
+	return false
+}
+
+func parseFilters(in []ds.Filter) ([]filter, error) {
+	out := []filter{}
+	for _,f := range in {
+		bits := strings.Fields(f.Field)
+		if len(bits) == 0 || len(bits) > 2 {
+			return nil, fmt.Errorf("localds: bad filter '%s'", f.Field)
+		}
+		op := "="
+		if len(bits) == 2 { op = bits[1] }
+		switch op {
+		case "=", "<", "<=", ">", ">=":
+		default:
+			return nil, fmt.Errorf("localds: unsupported filter operator in '%s'", f.Field)
+		}
+
+		val,ok := normalizeValue(reflect.ValueOf(f.Value))
+		if !ok {
+			return nil, fmt.Errorf("localds: unsupported filter value %T in '%s'", f.Value, f.Field)
+		}
+		out = append(out, filter{Field:bits[0], Op:op, Value:val})
+	}
+	return out, nil
+}
+
+// }}}
+// {{{ compiledQuery
+
+type compiledQuery struct {
+	kind         string
+	ancestor    *Key
+	equalities []filter
+	inequalities map[string][]filter // keyed on property name
+	orderField   string
+	orderDesc    bool
+	limit        int
+}
+
+func compileQuery(q *ds.Query) (*compiledQuery, error) {
+	if len(q.ProjectFields) != 0 || q.DistinctVals {
+		return nil, fmt.Errorf("localds: projection/distinct queries not supported")
+	}
+
+	cq := compiledQuery{
+		kind: q.Kind,
+		inequalities: map[string][]filter{},
+		limit: q.LimitVal,
+	}
+
+	anc,err := unpackKeyer(q.AncestorKeyer)
+	if err != nil { return nil, err }
+	cq.ancestor = anc
+
+	filters,err := parseFilters(q.Filters)
+	if err != nil { return nil, err }
+	for _,f := range filters {
+		if f.Op == "=" {
+			cq.equalities = append(cq.equalities, f)
+		} else {
+			cq.inequalities[f.Field] = append(cq.inequalities[f.Field], f)
+		}
+	}
+
+	if q.OrderStr != "" {
+		cq.orderField = strings.TrimSpace(q.OrderStr)
+		if strings.HasPrefix(cq.orderField, "-") {
+			cq.orderField, cq.orderDesc = cq.orderField[1:], true
+		}
+	}
+
+	return &cq, nil
+}
+
+func (cq *compiledQuery)matches(e *entity) bool {
+	if e.Key.Kind != cq.kind { return false }
+	if cq.ancestor != nil && !e.Key.HasAncestor(cq.ancestor) { return false }
+
+	for _,f := range cq.equalities {
+		found := false
+		for _,val := range e.Props[f.Field] {
+			if f.satisfiedBy(val) { found = true; break }
+		}
+		if !found { return false }
+	}
+
+	// A single value has to satisfy all the inequalities on its property
+	for field,filters := range cq.inequalities {
+		found := false
+		for _,val := range e.Props[field] {
+			ok := true
+			for _,f := range filters {
+				if !f.satisfiedBy(val) { ok = false; break }
+			}
+			if ok { found = true; break }
+		}
+		if !found { return false }
+	}
+
+	if cq.orderField != "" && len(e.Props[cq.orderField]) == 0 { return false }
+
+	return true
+}
+
+// orderValue picks the value of a (possibly multi-valued) property used for sorting
+func (cq *compiledQuery)orderValue(e *entity) interface{} {
+	vals := e.Props[cq.orderField]
+	best := vals[0]
+	for _,val := range vals[1:] {
+		cmp,_ := compareValues(val, best)
+		if (cq.orderDesc && cmp > 0) || (!cq.orderDesc && cmp < 0) { best = val }
+	}
+	return best
+}
+
+// run returns the matching entities, sorted and limited.
+func (cq *compiledQuery)run(all map[string]*entity) []*entity {
+	results := []*entity{}
+	for _,e := range all {
+		if cq.matches(e) { results = append(results, e) }
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if cq.orderField != "" {
+			cmp,_ := compareValues(cq.orderValue(results[i]), cq.orderValue(results[j]))
+			if cq.orderDesc { cmp = -cmp }
+			if cmp != 0 { return cmp < 0 }
+		}
+		return compareKeys(results[i].Key, results[j].Key) < 0
+	})
+
+	if cq.limit > 0 && len(results) > cq.limit {
+		results = results[:cq.limit]
+	}
+
+	return results
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,910 @@
+package localds
+
+// The SQLite provider keeps everything in a single file, and is meant for archives that are too
+// big to keep in RAM. Flights (entities of FlightKind, which must be fdb.IndexedFlightBlobs) get
+// a table of their own, with the multi-valued properties normalized out into index tables;
+// queries against them are translated into SQL. Entities of all other kinds (restrictor sets,
+// singletons, etc.) live in a generic table, and are queried using the in-memory evaluator.
+//
+// FlightIterators work unchanged; they run a keys-only query, and then fetch the flight blobs
+// a page at a time.
+
+import(
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/net/context"
+
+	"github.com/skypies/util/gcp/ds"
+	fdb "github.com/skypies/flightdb"
+)
+
+// FlightKind is the datastore kind that fgae uses for flights.
+var FlightKind = "flight"
+
+var blobType = reflect.TypeOf(fdb.IndexedFlightBlob{})
+
+// Multi-valued properties get packed into a single column via group_concat, using this.
+const kListSep = "\x1f"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS entities (
+  key            TEXT PRIMARY KEY,
+  kind           TEXT NOT NULL,
+  id             INTEGER NOT NULL,
+  data           BLOB,
+  props          BLOB
+);
+CREATE INDEX IF NOT EXISTS entities_kind ON entities(kind);
+
+CREATE TABLE IF NOT EXISTS flights (
+  key            TEXT PRIMARY KEY,
+  parent         TEXT NOT NULL,
+  id             INTEGER NOT NULL,
+  blob           BLOB,
+  blob_encoding  INTEGER NOT NULL,
+  blob_ref       TEXT NOT NULL DEFAULT '',
+  version        INTEGER NOT NULL DEFAULT 0,
+  icao24         TEXT NOT NULL,
+  ident          TEXT NOT NULL,
+  last_update    INTEGER NOT NULL,
+  equipment_type TEXT NOT NULL DEFAULT '',
+  airline_icao   TEXT NOT NULL DEFAULT '',
+  airline_iata   TEXT NOT NULL DEFAULT '',
+  origin         TEXT NOT NULL DEFAULT '',
+  destination    TEXT NOT NULL DEFAULT '',
+  registration   TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS flights_icao24 ON flights(icao24, last_update);
+CREATE INDEX IF NOT EXISTS flights_ident  ON flights(ident);
+CREATE INDEX IF NOT EXISTS flights_parent ON flights(parent);
+
+CREATE TABLE IF NOT EXISTS flight_timeslots (key TEXT NOT NULL, slot INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS flight_timeslots_slot ON flight_timeslots(slot, key);
+CREATE INDEX IF NOT EXISTS flight_timeslots_key  ON flight_timeslots(key);
+
+CREATE TABLE IF NOT EXISTS flight_tags (key TEXT NOT NULL, tag TEXT NOT NULL);
+CREATE INDEX IF NOT EXISTS flight_tags_tag ON flight_tags(tag, key);
+CREATE INDEX IF NOT EXISTS flight_tags_key ON flight_tags(key);
+
+CREATE TABLE IF NOT EXISTS flight_waypoints (key TEXT NOT NULL, waypoint TEXT NOT NULL);
+CREATE INDEX IF NOT EXISTS flight_waypoints_waypoint ON flight_waypoints(waypoint, key);
+CREATE INDEX IF NOT EXISTS flight_waypoints_key      ON flight_waypoints(key);
+
+CREATE TABLE IF NOT EXISTS flight_cells (key TEXT NOT NULL, cell TEXT NOT NULL);
+CREATE INDEX IF NOT EXISTS flight_cells_cell ON flight_cells(cell, key);
+CREATE INDEX IF NOT EXISTS flight_cells_key  ON flight_cells(key);
+
+CREATE TABLE IF NOT EXISTS flight_waypoint_times (key TEXT NOT NULL, token TEXT NOT NULL);
+CREATE INDEX IF NOT EXISTS flight_waypoint_times_token ON flight_waypoint_times(token, key);
+CREATE INDEX IF NOT EXISTS flight_waypoint_times_key   ON flight_waypoint_times(key);
+
+CREATE TABLE IF NOT EXISTS flight_cell_times (key TEXT NOT NULL, token TEXT NOT NULL);
+CREATE INDEX IF NOT EXISTS flight_cell_times_token ON flight_cell_times(token, key);
+CREATE INDEX IF NOT EXISTS flight_cell_times_key   ON flight_cell_times(key);
+`
+
+// Columns added since the first version of the schema; they get added to older files on open.
+var sqliteAddedColumns = [][]string{
+	{"flights", "blob_ref", "TEXT NOT NULL DEFAULT ''"},
+	{"flights", "version",  "INTEGER NOT NULL DEFAULT 0"},
+	{"flights", "equipment_type", "TEXT NOT NULL DEFAULT ''"},
+	{"flights", "airline_icao",   "TEXT NOT NULL DEFAULT ''"},
+	{"flights", "airline_iata",   "TEXT NOT NULL DEFAULT ''"},
+	{"flights", "origin",         "TEXT NOT NULL DEFAULT ''"},
+	{"flights", "destination",    "TEXT NOT NULL DEFAULT ''"},
+	{"flights", "registration",   "TEXT NOT NULL DEFAULT ''"},
+}
+
+// Indices on the added columns; created after the columns are.
+const sqliteAddedIndices = `
+CREATE INDEX IF NOT EXISTS flights_equipment_type ON flights(equipment_type);
+CREATE INDEX IF NOT EXISTS flights_airline_icao   ON flights(airline_icao);
+CREATE INDEX IF NOT EXISTS flights_airline_iata   ON flights(airline_iata);
+CREATE INDEX IF NOT EXISTS flights_origin         ON flights(origin);
+CREATE INDEX IF NOT EXISTS flights_destination    ON flights(destination);
+CREATE INDEX IF NOT EXISTS flights_registration   ON flights(registration);
+`
+
+// The index tables for flights, all of which have a 'key' column.
+var flightIndexTables = []string{"flight_timeslots", "flight_tags", "flight_waypoints",
+	"flight_cells", "flight_waypoint_times", "flight_cell_times"}
+
+// SQLiteDSProvider implements the ds.DatastoreProvider interface on top of a SQLite file.
+type SQLiteDSProvider struct {
+	localLogger
+	localKeys
+
+	Filename  string
+	db       *sql.DB
+
+	mu        sync.Mutex
+	nextID    int64
+}
+
+// {{{ NewSQLiteDSProvider
+
+// NewSQLiteDSProvider opens (or creates) the named database file.
+func NewSQLiteDSProvider(filename string) (*SQLiteDSProvider, error) {
+	db,err := sql.Open("sqlite3", filename + "?_busy_timeout=10000")
+	if err != nil {
+		return nil, fmt.Errorf("localds.NewSQLiteDSProvider %s: %v", filename, err)
+	}
+	// SQLite only allows one writer; funnel everything down one connection, so we never see
+	// SQLITE_BUSY. This also means we must always drain our result sets before the next query.
+	db.SetMaxOpenConns(1)
+
+	if _,err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("localds.NewSQLiteDSProvider %s: schema: %v", filename, err)
+	}
+	if err := addMissingColumns(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("localds.NewSQLiteDSProvider %s: schema: %v", filename, err)
+	}
+	if _,err := db.Exec(sqliteAddedIndices); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("localds.NewSQLiteDSProvider %s: schema: %v", filename, err)
+	}
+
+	p := SQLiteDSProvider{Filename:filename, db:db}
+
+	row := db.QueryRow(`SELECT MAX(id) FROM (SELECT MAX(id) AS id FROM entities
+                      UNION ALL SELECT MAX(id) AS id FROM flights)`)
+	var maxID sql.NullInt64
+	if err := row.Scan(&maxID); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("localds.NewSQLiteDSProvider %s: %v", filename, err)
+	}
+	p.nextID = maxID.Int64 + 1
+
+	return &p, nil
+}
+
+func addMissingColumns(db *sql.DB) error {
+	for _,added := range sqliteAddedColumns {
+		table,column,decl := added[0],added[1],added[2]
+
+		rows,err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+		if err != nil { return err }
+		exists := false
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil { rows.Close(); return err }
+			if name == column { exists = true }
+		}
+		rows.Close()
+
+		if !exists {
+			if _,err := db.Exec(`ALTER TABLE `+table+` ADD COLUMN `+column+` `+decl); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *SQLiteDSProvider)Close() error {
+	return p.db.Close()
+}
+
+// }}}
+
+// {{{ flight encode/decode helpers
+
+func toBlob(v reflect.Value) (*fdb.IndexedFlightBlob, error) {
+	v = reflect.Indirect(v)
+	if v.Type() != blobType {
+		return nil, fmt.Errorf("localds: %s entities must be %s, not %s", FlightKind, blobType, v.Type())
+	}
+	blob := v.Interface().(fdb.IndexedFlightBlob)
+	return &blob, nil
+}
+
+// setBlob stores the blob into dst, which must be an IndexedFlightBlob, or a pointer to one.
+func setBlob(dst reflect.Value, blob *fdb.IndexedFlightBlob) error {
+	switch dst.Type() {
+	case blobType:
+		dst.Set(reflect.ValueOf(*blob))
+	case reflect.PtrTo(blobType):
+		dst.Set(reflect.ValueOf(blob))
+	default:
+		return fmt.Errorf("localds: %s entities must be loaded into %s, not %s", FlightKind, blobType,
+			dst.Type())
+	}
+	return nil
+}
+
+// The columns we need to reconstitute a flight blob, with the index tables folded back in.
+const kFlightColumns = `f.key, f.blob, f.blob_encoding, f.blob_ref, f.version, f.icao24, f.ident,
+  f.last_update, f.equipment_type, f.airline_icao, f.airline_iata, f.origin, f.destination,
+  f.registration,
+  (SELECT group_concat(slot, char(31)) FROM flight_timeslots t WHERE t.key = f.key),
+  (SELECT group_concat(tag, char(31)) FROM flight_tags t WHERE t.key = f.key),
+  (SELECT group_concat(waypoint, char(31)) FROM flight_waypoints t WHERE t.key = f.key),
+  (SELECT group_concat(cell, char(31)) FROM flight_cells t WHERE t.key = f.key),
+  (SELECT group_concat(token, char(31)) FROM flight_waypoint_times t WHERE t.key = f.key),
+  (SELECT group_concat(token, char(31)) FROM flight_cell_times t WHERE t.key = f.key)`
+
+func scanFlight(rows *sql.Rows) (string, *fdb.IndexedFlightBlob, error) {
+	var key string
+	var lastUpdate int64
+	var slots, tags, waypoints, cells, wpTimes, cellTimes sql.NullString
+	blob := fdb.IndexedFlightBlob{}
+
+	err := rows.Scan(&key, &blob.Blob, &blob.BlobEncoding, &blob.BlobRef, &blob.Version, &blob.Icao24,
+		&blob.Ident, &lastUpdate, &blob.EquipmentType, &blob.AirlineICAO, &blob.AirlineIATA,
+		&blob.Origin, &blob.Destination, &blob.Registration, &slots, &tags, &waypoints, &cells,
+		&wpTimes, &cellTimes)
+	if err != nil { return "", nil, err }
+
+	blob.LastUpdate = time.Unix(0, lastUpdate).UTC()
+	for _,str := range splitList(slots) {
+		var nanos int64
+		fmt.Sscan(str, &nanos)
+		blob.Timeslots = append(blob.Timeslots, time.Unix(0, nanos).UTC())
+	}
+	blob.Tags = splitList(tags)
+	for _,wp := range splitList(waypoints) {
+		blob.Tags = append(blob.Tags, fdb.KWaypointTagPrefix + wp)
+	}
+	blob.Cells = splitList(cells)
+	blob.WaypointTimes = splitList(wpTimes)
+	blob.CellTimes = splitList(cellTimes)
+	sort.Slice(blob.Timeslots, func(i,j int) bool { return blob.Timeslots[i].Before(blob.Timeslots[j]) })
+	sort.Strings(blob.Tags)
+	sort.Strings(blob.Cells)
+	sort.Strings(blob.WaypointTimes)
+	sort.Strings(blob.CellTimes)
+
+	return key, &blob, nil
+}
+
+func splitList(s sql.NullString) []string {
+	if !s.Valid || s.String == "" { return nil }
+	return strings.Split(s.String, kListSep)
+}
+
+// }}}
+// {{{ generic encode/decode helpers
+
+func encodeProps(props map[string][]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(props)
+	return buf.Bytes(), err
+}
+
+func decodeProps(b []byte) (map[string][]interface{}, error) {
+	props := map[string][]interface{}{}
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(&props)
+	return props, err
+}
+
+// }}}
+
+// {{{ p.Get, p.GetMulti
+
+func (p *SQLiteDSProvider)Get(ctx context.Context, keyer ds.Keyer, dst interface{}) error {
+	dstVal := reflect.ValueOf(dst)
+	if dstVal.Kind() != reflect.Ptr || dstVal.IsNil() {
+		return fmt.Errorf("localds.Get: dst must be a non-nil pointer, not %T", dst)
+	}
+
+	slice := reflect.MakeSlice(reflect.SliceOf(dstVal.Type().Elem()), 1, 1)
+	if err := p.GetMulti(ctx, []ds.Keyer{keyer}, slice.Interface()); err != nil {
+		return err
+	}
+	dstVal.Elem().Set(slice.Index(0))
+	return nil
+}
+
+// dst must be a slice of the same length as keyers.
+func (p *SQLiteDSProvider)GetMulti(ctx context.Context, keyers []ds.Keyer, dst interface{}) error {
+	dstVal := reflect.ValueOf(dst)
+	if dstVal.Kind() != reflect.Slice || dstVal.Len() != len(keyers) {
+		return fmt.Errorf("localds.GetMulti: dst must be a slice of len %d, not %T", len(keyers), dst)
+	}
+
+	var missing error
+	for i,keyer := range keyers {
+		k,err := unpackKeyer(keyer)
+		if err != nil { return err }
+		if k == nil { return fmt.Errorf("localds.GetMulti: nil key at [%d]", i) }
+
+		var found bool
+		if k.Kind == FlightKind {
+			found,err = p.getFlight(k.Encode(), dstVal.Index(i))
+		} else {
+			found,err = p.getEntity(k.Encode(), dstVal.Index(i))
+		}
+		if err != nil {
+			return fmt.Errorf("localds.GetMulti %s: %v", k, err)
+		} else if !found {
+			missing = ds.ErrNoSuchEntity
+		}
+	}
+
+	return missing
+}
+
+func (p *SQLiteDSProvider)getFlight(encodedKey string, dst reflect.Value) (bool, error) {
+	rows,err := p.db.Query(`SELECT `+kFlightColumns+` FROM flights f WHERE f.key = ?`, encodedKey)
+	if err != nil { return false, err }
+	defer rows.Close()
+
+	if !rows.Next() { return false, rows.Err() }
+	_,blob,err := scanFlight(rows)
+	if err != nil { return false, err }
+
+	return true, setBlob(dst, blob)
+}
+
+func (p *SQLiteDSProvider)getEntity(encodedKey string, dst reflect.Value) (bool, error) {
+	e := entity{}
+	err := p.db.QueryRow(`SELECT data FROM entities WHERE key = ?`, encodedKey).Scan(&e.Data)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	e.Key,_ = DecodeKey(encodedKey)
+
+	return true, e.decodeInto(dst)
+}
+
+// }}}
+// {{{ p.GetAll
+
+// If dst is nil, or the query is KeysOnly, then just the keys are returned. Otherwise dst must
+// be a pointer to a slice, which has the results appended.
+func (p *SQLiteDSProvider)GetAll(ctx context.Context, q *ds.Query, dst interface{}) ([]ds.Keyer, error) {
+	cq,err := compileQuery(q)
+	if err != nil {
+		return nil, fmt.Errorf("GetAll{sqlite}: %v\nQuery: %s", err, q)
+	}
+
+	var sliceVal reflect.Value
+	keysOnly := q.KeysOnlyVal || dst == nil
+	if !keysOnly {
+		dstVal := reflect.ValueOf(dst)
+		if dstVal.Kind() != reflect.Ptr || dstVal.Elem().Kind() != reflect.Slice {
+			return nil, fmt.Errorf("GetAll{sqlite}: dst must be a pointer to a slice, not %T", dst)
+		}
+		sliceVal = dstVal.Elem()
+	}
+
+	var keyers []ds.Keyer
+	if cq.kind == FlightKind {
+		keyers,err = p.getAllFlights(cq, keysOnly, sliceVal)
+	} else {
+		keyers,err = p.getAllEntities(cq, keysOnly, sliceVal)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GetAll{sqlite}: %v\nQuery: %s", err, q)
+	}
+
+	return keyers, nil
+}
+
+func (p *SQLiteDSProvider)getAllFlights(cq *compiledQuery, keysOnly bool, sliceVal reflect.Value) ([]ds.Keyer, error) {
+	where,args,err := flightWhereClause(cq)
+	if err != nil { return nil, err }
+
+	cols := "f.key"
+	if !keysOnly { cols = kFlightColumns }
+	sqlStr := "SELECT " + cols + " FROM flights f"
+	if len(where) > 0 {
+		sqlStr += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	orderBy,err := flightOrderClause(cq)
+	if err != nil { return nil, err }
+	sqlStr += " ORDER BY " + orderBy
+
+	if cq.limit > 0 {
+		sqlStr += fmt.Sprintf(" LIMIT %d", cq.limit)
+	}
+
+	rows,err := p.db.Query(sqlStr, args...)
+	if err != nil { return nil, fmt.Errorf("%v\nSQL: %s", err, sqlStr) }
+	defer rows.Close()
+
+	keyers := []ds.Keyer{}
+	for rows.Next() {
+		var encodedKey string
+		if keysOnly {
+			if err := rows.Scan(&encodedKey); err != nil { return nil, err }
+		} else {
+			key,blob,err := scanFlight(rows)
+			if err != nil { return nil, err }
+			elem := reflect.New(sliceVal.Type().Elem()).Elem()
+			if err := setBlob(elem, blob); err != nil { return nil, err }
+			sliceVal.Set(reflect.Append(sliceVal, elem))
+			encodedKey = key
+		}
+
+		k,err := DecodeKey(encodedKey)
+		if err != nil { return nil, err }
+		keyers = append(keyers, k)
+	}
+
+	return keyers, rows.Err()
+}
+
+// Generic entities are few in number, so we just load them all up and filter in memory.
+func (p *SQLiteDSProvider)getAllEntities(cq *compiledQuery, keysOnly bool, sliceVal reflect.Value) ([]ds.Keyer, error) {
+	rows,err := p.db.Query(`SELECT key, data, props FROM entities WHERE kind = ?`, cq.kind)
+	if err != nil { return nil, err }
+	defer rows.Close()
+
+	all := map[string]*entity{}
+	for rows.Next() {
+		var encodedKey string
+		var propBytes []byte
+		e := entity{}
+		if err := rows.Scan(&encodedKey, &e.Data, &propBytes); err != nil { return nil, err }
+		if e.Key,err = DecodeKey(encodedKey); err != nil { return nil, err }
+		if e.Props,err = decodeProps(propBytes); err != nil { return nil, err }
+		all[encodedKey] = &e
+	}
+	if err := rows.Err(); err != nil { return nil, err }
+
+	keyers := []ds.Keyer{}
+	for _,e := range cq.run(all) {
+		keyers = append(keyers, e.Key)
+		if keysOnly { continue }
+		elem := reflect.New(sliceVal.Type().Elem()).Elem()
+		if err := e.decodeInto(elem); err != nil { return nil, err }
+		sliceVal.Set(reflect.Append(sliceVal, elem))
+	}
+
+	return keyers, nil
+}
+
+// }}}
+// {{{ flightWhereClause, flightOrderClause
+
+// The scalar properties of IndexedFlightBlob, and the columns that hold them.
+var flightColumns = map[string]string{
+	"Icao24": "f.icao24",
+	"Ident": "f.ident",
+	"LastUpdate": "f.last_update",
+	"BlobEncoding": "f.blob_encoding",
+	"EquipmentType": "f.equipment_type",
+	"AirlineICAO": "f.airline_icao",
+	"AirlineIATA": "f.airline_iata",
+	"Origin": "f.origin",
+	"Destination": "f.destination",
+	"Registration": "f.registration",
+}
+
+func sqlValue(v interface{}) interface{} {
+	if t,ok := v.(time.Time); ok { return t.UnixNano() }
+	return v
+}
+
+// Each equality filter on a multi-valued property is an independent EXISTS; all the
+// inequalities on Timeslots share one, so that a single timeslot has to satisfy them all.
+func flightWhereClause(cq *compiledQuery) ([]string, []interface{}, error) {
+	where := []string{}
+	args := []interface{}{}
+
+	if cq.ancestor != nil {
+		// Flights are only ever keyed as root/flight, so this is enough.
+		where = append(where, "(f.key = ? OR f.parent = ?)")
+		args = append(args, cq.ancestor.Encode(), cq.ancestor.Encode())
+	}
+
+	for _,f := range cq.equalities {
+		if col,exists := flightColumns[f.Field]; exists {
+			where = append(where, col+" = ?")
+			args = append(args, sqlValue(f.Value))
+			continue
+		}
+
+		switch f.Field {
+		case "Timeslots":
+			where = append(where,
+				"EXISTS (SELECT 1 FROM flight_timeslots t WHERE t.key = f.key AND t.slot = ?)")
+			args = append(args, sqlValue(f.Value))
+
+		case "Tags":
+			str,_ := f.Value.(string)
+			if strings.HasPrefix(str, fdb.KWaypointTagPrefix) {
+				where = append(where,
+					"EXISTS (SELECT 1 FROM flight_waypoints t WHERE t.key = f.key AND t.waypoint = ?)")
+				args = append(args, strings.TrimPrefix(str, fdb.KWaypointTagPrefix))
+			} else {
+				where = append(where,
+					"EXISTS (SELECT 1 FROM flight_tags t WHERE t.key = f.key AND t.tag = ?)")
+				args = append(args, str)
+			}
+
+		case "Cells":
+			where = append(where,
+				"EXISTS (SELECT 1 FROM flight_cells t WHERE t.key = f.key AND t.cell = ?)")
+			args = append(args, sqlValue(f.Value))
+
+		case "WaypointTimes":
+			where = append(where,
+				"EXISTS (SELECT 1 FROM flight_waypoint_times t WHERE t.key = f.key AND t.token = ?)")
+			args = append(args, sqlValue(f.Value))
+
+		case "CellTimes":
+			where = append(where,
+				"EXISTS (SELECT 1 FROM flight_cell_times t WHERE t.key = f.key AND t.token = ?)")
+			args = append(args, sqlValue(f.Value))
+
+		default:
+			return nil, nil, fmt.Errorf("can't filter %s on '%s'", FlightKind, f.Field)
+		}
+	}
+
+	for field,filters := range cq.inequalities {
+		if col,exists := flightColumns[field]; exists {
+			for _,f := range filters {
+				where = append(where, col+" "+f.Op+" ?")
+				args = append(args, sqlValue(f.Value))
+			}
+			continue
+		}
+
+		if field != "Timeslots" {
+			return nil, nil, fmt.Errorf("can't use inequalities on %s.%s", FlightKind, field)
+		}
+		conds := []string{}
+		for _,f := range filters {
+			conds = append(conds, "t.slot "+f.Op+" ?")
+			args = append(args, sqlValue(f.Value))
+		}
+		where = append(where, "EXISTS (SELECT 1 FROM flight_timeslots t WHERE t.key = f.key AND " +
+			strings.Join(conds, " AND ") + ")")
+	}
+
+	// As per datastore, entities without the property being ordered on are not returned. The
+	// only multi-valued one we allow ordering on is Timeslots.
+	if cq.orderField == "Timeslots" {
+		where = append(where, "EXISTS (SELECT 1 FROM flight_timeslots t WHERE t.key = f.key)")
+	}
+
+	return where, args, nil
+}
+
+func flightOrderClause(cq *compiledQuery) (string, error) {
+	if cq.orderField == "" {
+		return "f.key", nil
+	}
+
+	dir := "ASC"
+	if cq.orderDesc { dir = "DESC" }
+
+	if col,exists := flightColumns[cq.orderField]; exists {
+		return col+" "+dir+", f.key", nil
+	} else if cq.orderField == "Timeslots" {
+		// Ascending uses the smallest value, descending the largest
+		agg := "MIN"
+		if cq.orderDesc { agg = "MAX" }
+		return fmt.Sprintf("(SELECT %s(slot) FROM flight_timeslots t WHERE t.key = f.key) %s, f.key",
+			agg, dir), nil
+	}
+
+	return "", fmt.Errorf("can't order %s by '%s'", FlightKind, cq.orderField)
+}
+
+// }}}
+
+// {{{ p.Put, p.PutMulti
+
+func (p *SQLiteDSProvider)completeKey(k *Key) *Key {
+	if !k.Incomplete() { return k }
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	done := *k
+	done.ID = p.nextID
+	p.nextID++
+	return &done
+}
+
+func (p *SQLiteDSProvider)noteID(k *Key) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k.Name == "" && k.ID >= p.nextID {
+		p.nextID = k.ID + 1
+	}
+}
+
+func (p *SQLiteDSProvider)Put(ctx context.Context, keyer ds.Keyer, src interface{}) (ds.Keyer, error) {
+	srcVal := reflect.ValueOf(src)
+	slice := reflect.MakeSlice(reflect.SliceOf(srcVal.Type()), 0, 1)
+	slice = reflect.Append(slice, srcVal)
+
+	keyers,err := p.PutMulti(ctx, []ds.Keyer{keyer}, slice.Interface())
+	if err != nil { return nil, err }
+	return keyers[0], nil
+}
+
+// src must be a slice, the same length as keyers. All the writes happen in one transaction.
+func (p *SQLiteDSProvider)PutMulti(ctx context.Context, keyers []ds.Keyer, src interface{}) ([]ds.Keyer, error) {
+	srcVal := reflect.ValueOf(src)
+	if srcVal.Kind() != reflect.Slice || srcVal.Len() != len(keyers) {
+		return nil, fmt.Errorf("localds.PutMulti: src must be a slice of len %d, not %T", len(keyers), src)
+	}
+
+	tx,err := p.db.Begin()
+	if err != nil { return nil, fmt.Errorf("localds.PutMulti: %v", err) }
+
+	out := []ds.Keyer{}
+	for i,keyer := range keyers {
+		k,err := unpackKeyer(keyer)
+		if err != nil { tx.Rollback(); return nil, err }
+		if k == nil { tx.Rollback(); return nil, fmt.Errorf("localds.PutMulti: nil key at [%d]", i) }
+		k = p.completeKey(k)
+
+		if k.Kind == FlightKind {
+			err = putFlight(tx, k, srcVal.Index(i))
+		} else {
+			err = putEntity(tx, k, srcVal.Index(i))
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("localds.PutMulti %s: %v", k, err)
+		}
+
+		p.noteID(k)
+		out = append(out, k)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("localds.PutMulti: commit: %v", err)
+	}
+	return out, nil
+}
+
+func putFlight(tx *sql.Tx, k *Key, src reflect.Value) error {
+	blob,err := toBlob(src)
+	if err != nil { return err }
+
+	encodedKey, parent := k.Encode(), ""
+	if k.Parent != nil { parent = k.Parent.Encode() }
+
+	_,err = tx.Exec(`INSERT OR REPLACE INTO flights
+          (key, parent, id, blob, blob_encoding, blob_ref, version, icao24, ident, last_update,
+           equipment_type, airline_icao, airline_iata, origin, destination, registration)
+          VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		encodedKey, parent, k.ID, blob.Blob, blob.BlobEncoding, blob.BlobRef, blob.Version, blob.Icao24,
+		blob.Ident, blob.LastUpdate.UnixNano(), blob.EquipmentType, blob.AirlineICAO, blob.AirlineIATA,
+		blob.Origin, blob.Destination, blob.Registration)
+	if err != nil { return err }
+
+	if err := deleteFlightIndices(tx, encodedKey); err != nil { return err }
+
+	for _,t := range blob.Timeslots {
+		if _,err := tx.Exec(`INSERT INTO flight_timeslots (key, slot) VALUES (?, ?)`,
+			encodedKey, t.UnixNano()); err != nil {
+			return err
+		}
+	}
+	for _,tag := range blob.Tags {
+		if strings.HasPrefix(tag, fdb.KWaypointTagPrefix) {
+			_,err = tx.Exec(`INSERT INTO flight_waypoints (key, waypoint) VALUES (?, ?)`,
+				encodedKey, strings.TrimPrefix(tag, fdb.KWaypointTagPrefix))
+		} else {
+			_,err = tx.Exec(`INSERT INTO flight_tags (key, tag) VALUES (?, ?)`, encodedKey, tag)
+		}
+		if err != nil { return err }
+	}
+	for _,cell := range blob.Cells {
+		if _,err := tx.Exec(`INSERT INTO flight_cells (key, cell) VALUES (?, ?)`,
+			encodedKey, cell); err != nil {
+			return err
+		}
+	}
+	for _,token := range blob.WaypointTimes {
+		if _,err := tx.Exec(`INSERT INTO flight_waypoint_times (key, token) VALUES (?, ?)`,
+			encodedKey, token); err != nil {
+			return err
+		}
+	}
+	for _,token := range blob.CellTimes {
+		if _,err := tx.Exec(`INSERT INTO flight_cell_times (key, token) VALUES (?, ?)`,
+			encodedKey, token); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PutIfVersion is a compare-and-swap: src is only stored if the entity's current Version
+// field matches version, else fdb.ErrVersionConflict. A negative version means the entity must
+// not exist yet. (src must be a struct with an int64 Version field.)
+func (p *SQLiteDSProvider)PutIfVersion(ctx context.Context, keyer ds.Keyer, src interface{}, version int64) (ds.Keyer, error) {
+	out,err := p.PutMultiIfVersion(ctx, []ds.Keyer{keyer}, sliceOfOne(src), []int64{version})
+	if err != nil { return nil, err }
+	return out[0], nil
+}
+
+// PutMultiIfVersion is PutIfVersion for a batch, in a single transaction; if any of the
+// versions don't match, nothing is stored.
+func (p *SQLiteDSProvider)PutMultiIfVersion(ctx context.Context, keyers []ds.Keyer, src interface{}, versions []int64) ([]ds.Keyer, error) {
+	return p.PutDeleteIfVersion(ctx, keyers, src, versions, nil, nil)
+}
+
+// PutDeleteIfVersion is PutMultiIfVersion, that also deletes delKeyers, which must be at
+// delVersions; all in the one transaction. The deleted entities must be the same type as src's
+// elements.
+func (p *SQLiteDSProvider)PutDeleteIfVersion(ctx context.Context, keyers []ds.Keyer, src interface{}, versions []int64, delKeyers []ds.Keyer, delVersions []int64) ([]ds.Keyer, error) {
+	srcVal := reflect.ValueOf(src)
+	if srcVal.Kind() != reflect.Slice || srcVal.Len() != len(keyers) || len(versions) != len(keyers) {
+		return nil, fmt.Errorf("localds.PutDeleteIfVersion: need %d srcs & versions", len(keyers))
+	} else if len(delVersions) != len(delKeyers) {
+		return nil, fmt.Errorf("localds.PutDeleteIfVersion: need %d delete versions", len(delKeyers))
+	}
+	proto := reflect.New(elemStructType(srcVal))
+
+	tx,err := p.db.Begin()
+	if err != nil { return nil, fmt.Errorf("localds.PutDeleteIfVersion: %v", err) }
+
+	out := []*Key{}
+	for i,keyer := range keyers {
+		k,err := unpackKeyer(keyer)
+		if err != nil { tx.Rollback(); return nil, err }
+		if k == nil || k.Incomplete() {
+			tx.Rollback()
+			return nil, fmt.Errorf("localds.PutDeleteIfVersion: need a complete key at [%d]", i)
+		}
+
+		current,err := currentVersion(tx, k, srcVal.Index(i))
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("localds.PutDeleteIfVersion %s: %v", k, err)
+		} else if current != versions[i] {
+			tx.Rollback()
+			return nil, fdb.ErrVersionConflict
+		}
+
+		if k.Kind == FlightKind {
+			err = putFlight(tx, k, srcVal.Index(i))
+		} else {
+			err = putEntity(tx, k, srcVal.Index(i))
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("localds.PutDeleteIfVersion %s: %v", k, err)
+		}
+		out = append(out, k)
+	}
+
+	for i,keyer := range delKeyers {
+		k,err := unpackKeyer(keyer)
+		if err != nil { tx.Rollback(); return nil, err }
+		if k == nil || k.Incomplete() {
+			tx.Rollback()
+			return nil, fmt.Errorf("localds.PutDeleteIfVersion: need a complete key at [%d]", i)
+		}
+
+		current,err := currentVersion(tx, k, proto)
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("localds.PutDeleteIfVersion %s: %v", k, err)
+		} else if current != delVersions[i] {
+			tx.Rollback()
+			return nil, fdb.ErrVersionConflict
+		}
+
+		if err := deleteKey(tx, k); err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("localds.PutDeleteIfVersion %s: %v", k, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("localds.PutDeleteIfVersion: commit: %v", err)
+	}
+
+	keyersOut := []ds.Keyer{}
+	for _,k := range out {
+		p.noteID(k)
+		keyersOut = append(keyersOut, k)
+	}
+	return keyersOut, nil
+}
+
+// The Version of the stored entity, or -1 if there isn't one; src is what is about to replace it.
+func currentVersion(tx *sql.Tx, k *Key, src reflect.Value) (int64, error) {
+	current := int64(-1)
+	if k.Kind == FlightKind {
+		err := tx.QueryRow(`SELECT version FROM flights WHERE key = ?`, k.Encode()).Scan(&current)
+		if err == sql.ErrNoRows { err = nil }
+		return current, err
+	}
+
+	var data []byte
+	err := tx.QueryRow(`SELECT data FROM entities WHERE key = ?`, k.Encode()).Scan(&data)
+	if err == sql.ErrNoRows {
+		return current, nil
+	} else if err != nil {
+		return current, err
+	}
+	existing := reflect.New(reflect.Indirect(src).Type()).Elem()
+	if err := (&entity{Key:k, Data:data}).decodeInto(existing); err != nil {
+		return current, err
+	}
+	return versionOf(existing)
+}
+
+func putEntity(tx *sql.Tx, k *Key, src reflect.Value) error {
+	e,err := encodeEntity(k, src)
+	if err != nil { return err }
+	propBytes,err := encodeProps(e.Props)
+	if err != nil { return err }
+
+	_,err = tx.Exec(`INSERT OR REPLACE INTO entities (key, kind, id, data, props)
+          VALUES (?, ?, ?, ?, ?)`, k.Encode(), k.Kind, k.ID, e.Data, propBytes)
+	return err
+}
+
+func deleteFlightIndices(tx *sql.Tx, encodedKey string) error {
+	for _,table := range flightIndexTables {
+		if _,err := tx.Exec(`DELETE FROM `+table+` WHERE key = ?`, encodedKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// }}}
+// {{{ p.Delete, p.DeleteMulti
+
+// As with datastore, deleting something that doesn't exist is not an error.
+func (p *SQLiteDSProvider)Delete(ctx context.Context, keyer ds.Keyer) error {
+	return p.DeleteMulti(ctx, []ds.Keyer{keyer})
+}
+
+func (p *SQLiteDSProvider)DeleteMulti(ctx context.Context, keyers []ds.Keyer) error {
+	tx,err := p.db.Begin()
+	if err != nil { return fmt.Errorf("localds.DeleteMulti: %v", err) }
+
+	for _,keyer := range keyers {
+		k,err := unpackKeyer(keyer)
+		if err != nil { tx.Rollback(); return err }
+		if k == nil { continue }
+
+		if err := deleteKey(tx, k); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("localds.DeleteMulti %s: %v", k, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func deleteKey(tx *sql.Tx, k *Key) error {
+	encodedKey := k.Encode()
+	if k.Kind == FlightKind {
+		if _,err := tx.Exec(`DELETE FROM flights WHERE key = ?`, encodedKey); err != nil {
+			return err
+		}
+		return deleteFlightIndices(tx, encodedKey)
+	}
+	_,err := tx.Exec(`DELETE FROM entities WHERE key = ?`, encodedKey)
+	return err
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -27,12 +27,21 @@ type Options struct {
 	Tags             []string
 	Waypoints        []string
 
+	// Indexed flight attributes; empty means don't care
+	Equipment          string
+	Airline            string  // IATA or ICAO
+	Origin             string
+	Destination        string
+	Registration       string
+
 	NotTags          []string  // Tags that are blacklisted from results; not efficient
 	NotWaypoints     []string  // Tags that are blacklisted from results; not efficient
 
 	TimeOfDay          date.TimeOfDayRange  // If initialized, only find flights that 'match' it
+	UseWaypointTimeIndex bool  // Query waypoint times for it; misses flights not indexed by them
 	
 	GRS                fdb.GeoRestrictorSet
+	UseCellIndex       bool  // Query the cell index for the GRS; misses flights not indexed by it
 
 	// Data specification
 	CanSeeFOIA         bool    // This is locked down to a few users. Upgrade to full ACL model?
@@ -45,6 +54,8 @@ type Options struct {
 	ReferencePoint2    geo.NamedLatlong // Some reports do things in relation to a fixed point
 	RefDistanceKM      float64     // ... and maybe within {dist} of {refpoint}
 	AltitudeTolerance  float64  // Some reports care about this
+	SmoothTracks       bool     // Some reports can use Track.Smoothed, instead of PostProcess
+	Phases           []fdb.FlightPhase // Some reports only care about these phases of flight
 	time.Duration      // embedded; a time tolerance
 	
 	// Formatting / output options
@@ -72,8 +83,17 @@ func FormValueReportOptions(db fgae.FlightDB, r *http.Request) (Options, error)
 		Waypoints: []string{},
 		NotWaypoints: []string{},
 
+		Equipment: strings.ToUpper(r.FormValue("equipment")),
+		Airline: strings.ToUpper(r.FormValue("airline")),
+		Origin: strings.ToUpper(r.FormValue("origin")),
+		Destination: strings.ToUpper(r.FormValue("destination")),
+		Registration: strings.ToUpper(r.FormValue("registration")),
+
 		TextString: r.FormValue("textstring"),
 		AltitudeTolerance: widget.FormValueFloat64EatErrs(r, "altitudetolerance"),
+		SmoothTracks: widget.FormValueCheckbox(r, "smooth"),
+		UseCellIndex: widget.FormValueCheckbox(r, "cellindex"),
+		UseWaypointTimeIndex: widget.FormValueCheckbox(r, "wptimeindex"),
 		Duration: widget.FormValueDuration(r, "duration"),
 		ReferencePoint: sfo.FormValueNamedLatlong(r, "refpt"),
 		ReferencePoint2: sfo.FormValueNamedLatlong(r, "refpt2"),
@@ -88,6 +108,14 @@ func FormValueReportOptions(db fgae.FlightDB, r *http.Request) (Options, error)
 		opt.GRS = grs
 	}
 
+	for _,str := range widget.FormValueCommaSpaceSepStrings(r,"phases") {
+		if phase,err := fdb.ParseFlightPhase(str); err != nil {
+			return opt,err
+		} else {
+			opt.Phases = append(opt.Phases, phase)
+		}
+	}
+
 	if tod,err := date.FormValueTimeOfDayRange(r, "tod"); err == nil {
 		opt.TimeOfDay = tod
 	}
@@ -103,6 +131,7 @@ func FormValueReportOptions(db fgae.FlightDB, r *http.Request) (Options, error)
 	switch r.FormValue("datasource") {
 	case "ADSB": opt.TrackDataSource = "ADSB"
 	case "fr24": opt.TrackDataSource = "fr24"
+	case fdb.FusedTrackName: opt.TrackDataSource = fdb.FusedTrackName
 		// default means let the report pick
 	}
 
@@ -216,12 +245,89 @@ func (o Options)DescriptionText() string {
 	if len(o.NotTags)>0 { str += fmt.Sprintf(", not-tags=%v", o.NotTags) }
 	if len(o.Waypoints)>0 { str += fmt.Sprintf(", waypoints=%v", o.Waypoints) }
 	if len(o.NotWaypoints)>0 { str += fmt.Sprintf(", not-waypoints=%v", o.NotWaypoints) }
+	if o.Equipment != "" { str += fmt.Sprintf(", equipment=%s", o.Equipment) }
+	if o.Airline != "" { str += fmt.Sprintf(", airline=%s", o.Airline) }
+	if o.Origin != "" { str += fmt.Sprintf(", origin=%s", o.Origin) }
+	if o.Destination != "" { str += fmt.Sprintf(", destination=%s", o.Destination) }
+	if o.Registration != "" { str += fmt.Sprintf(", registration=%s", o.Registration) }
 	if !o.GRS.IsNil() { str += fmt.Sprintf(", %s", o.GRS.OnelineString()) }
+	if len(o.Phases)>0 { str += fmt.Sprintf(", phases=%v", o.Phases) }
 	// if o.TextString != "" { str += fmt.Sprintf(", str='%s'", o.TextString) }
 	
 	return str
 }
 
+// }}}
+// {{{ o.RestrictQuery
+
+// Each waypoint (or cell) time token costs a datastore query, so past this many we don't bother
+const kMaxWaypointTimeQueries = 50
+const kMaxCellTimeQueries = 50
+
+// RestrictQuery adds filters for the indexed flight attributes to the query.
+//
+// If UseWaypointTimeIndex is set, and there are waypoints and a TimeOfDay (but no geo
+// restrictions, which PreProcess would check the time of day against instead), it also uses
+// the waypoint time index to skip flights that didn't pass any of the waypoints at the right
+// time of day. If UseCellIndex is set, it uses the cell index to skip flights that can't have
+// gone near the geo restrictions. Flights written before these indexes existed will be missed;
+// the retag batch job rewrites flights, which backfills them.
+func (o Options)RestrictQuery(fq *fgae.FQuery) *fgae.FQuery {
+	if o.Equipment != ""    { fq.ByEquipment(o.Equipment) }
+	if o.Airline != ""      { fq.ByAirline(o.Airline) }
+	if o.Origin != ""       { fq.ByOrigin(o.Origin) }
+	if o.Destination != ""  { fq.ByDestination(o.Destination) }
+	if o.Registration != "" { fq.ByRegistration(o.Registration) }
+
+	if o.UseWaypointTimeIndex && o.TimeOfDay.IsInitialized() && len(o.Waypoints) > 0 &&
+		len(o.GRS.R) == 0 {
+		trs := o.TimeOfDayRanges()
+		n := 0
+		for _,tr := range trs {
+			n += len(fdb.WaypointTimeTokens("", tr.U, tr.V)) * len(o.Waypoints)
+		}
+		if len(trs) > 0 && n <= kMaxWaypointTimeQueries {
+			fq.ByAnyWaypointAt(o.Waypoints, trs)
+		}
+	}
+
+	if o.UseCellIndex {
+		groups := o.GRS.CellGroups()
+		n := 0
+		for _,group := range groups {
+			n += len(fdb.CellTimeTokens("", o.Start, o.End)) * len(group)
+		}
+		if n <= kMaxCellTimeQueries {
+			for _,group := range groups {
+				fq.ByCellsDuring(group, o.Start, o.End)
+			}
+		}
+	}
+
+	return fq
+}
+
+// TimeOfDayRanges returns the spans of time, between o.Start and o.End, that are inside
+// o.TimeOfDay.
+func (o Options)TimeOfDayRanges() []geo.TimeRange {
+	trs := []geo.TimeRange{}
+	if !o.TimeOfDay.IsInitialized() { return trs }
+
+	// Start the day before, in case the range straddles midnight
+	day := date.InPdt(o.Start).AddDate(0,0,-1)
+	for ; !day.After(o.End); day = day.AddDate(0,0,1) {
+		s := time.Date(day.Year(), day.Month(), day.Day(), o.TimeOfDay.Hour, o.TimeOfDay.Minute,
+			0, 0, day.Location())
+		e := s.Add(o.TimeOfDay.Length)
+		if s.Before(o.Start) { s = o.Start }
+		if e.After(o.End) { e = o.End }
+		if e.After(s) {
+			trs = append(trs, geo.TimeRange{U:s, V:e})
+		}
+	}
+	return trs
+}
+
 // }}}
 // {{{ o.URLValues
 
@@ -235,10 +341,15 @@ func (o Options)URLValues() url.Values {
 	if len(o.Tags) > 0 { v.Set("tags", strings.Join(o.Tags,",")) }
 	if len(o.NotTags) > 0 { v.Set("nottags", strings.Join(o.NotTags,",")) }
 	for i,wp := range o.Waypoints {
-		v.Set(fmt.Sprintf("waypoint%s", i+1), wp)
+		v.Set(fmt.Sprintf("waypoint%d", i+1), wp)
 	}
 	for i,wp := range o.NotWaypoints {
-		v.Set(fmt.Sprintf("notwaypoint%s", i+1), wp)
+		v.Set(fmt.Sprintf("notwaypoint%d", i+1), wp)
+	}
+
+	for k,val := range map[string]string{"equipment":o.Equipment, "airline":o.Airline,
+		"origin":o.Origin, "destination":o.Destination, "registration":o.Registration} {
+		if val != "" { v.Set(k, val) }
 	}
 
 	if o.GRS.IsAdhoc() && len(o.GRS.R)==1 {
@@ -251,6 +362,14 @@ func (o Options)URLValues() url.Values {
 	if o.AltitudeTolerance > 0.0 {
 		v.Set("altitudetolerance", fmt.Sprintf("%.2f", o.AltitudeTolerance))
 	}
+	if o.SmoothTracks { v.Set("smooth", "1") }
+	if o.UseCellIndex { v.Set("cellindex", "1") }
+	if o.UseWaypointTimeIndex { v.Set("wptimeindex", "1") }
+	if len(o.Phases) > 0 {
+		strs := []string{}
+		for _,p := range o.Phases { strs = append(strs, string(p)) }
+		v.Set("phases", strings.Join(strs,","))
+	}
 	if o.Duration != 0 { v.Set("duration", o.Duration.String()) }
 	if !o.ReferencePoint.IsNil() { widget.AddPrefixedValues(v, o.ReferencePoint.Values(), "refpt") }
 	if !o.ReferencePoint2.IsNil() {widget.AddPrefixedValues(v, o.ReferencePoint2.Values(), "refpt2") }
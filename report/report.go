@@ -97,6 +97,10 @@ func (r *Report)ListPreferredDataSources() []string {
 func (r *Report)PreProcess(f *fdb.Flight) (bool, []fdb.TrackIntersection) {
 	r.I["[A] PreProcessed"]++
 
+	if f.MaybeAddFusedTrack(r.ListPreferredDataSources()) {
+		r.I["[A] Fused tracks added"]++
+	}
+
 	for _,nottag := range r.NotTags {
 		if f.HasTag(nottag) {
 			r.I[fmt.Sprintf("[B] Eliminated: had not-tag '%s'", nottag)]++
@@ -0,0 +1,144 @@
+package flightdb
+
+// Old track data is mostly looked at in aggregate, so it doesn't need the full resolution of
+// the live feeds. A RetentionPolicy says how coarsely tracks should be kept, as they age.
+
+import(
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RetentionRule struct {
+	After   time.Duration // Applies to flights that ended at least this long ago ...
+	Every   time.Duration // ... which are resampled to one point per this
+}
+
+type RetentionPolicy struct {
+	Rules      []RetentionRule
+	TrackNames []string // The tracks it applies to; others are left alone
+}
+
+// After 90 days, resample ADSB/MLAT tracks to 5s; after two years, to 30s.
+var DefaultRetentionPolicy = RetentionPolicy{
+	Rules: []RetentionRule{
+		{After: 90 * 24 * time.Hour,  Every: 5 * time.Second},
+		{After: 730 * 24 * time.Hour, Every: 30 * time.Second},
+	},
+	TrackNames: []string{"ADSB", "MLAT"},
+}
+
+// A record of the most recent downsampling of a flight's tracks
+type DownsampleRecord struct {
+	Every         time.Duration
+	When          time.Time
+	PointsBefore  int
+	PointsAfter   int
+}
+
+func (r DownsampleRecord)IsZero() bool { return r.Every == 0 }
+
+func (r DownsampleRecord)String() string {
+	if r.IsZero() { return "not downsampled" }
+	return fmt.Sprintf("downsampled to %s on %s (%d -> %d points)", r.Every,
+		r.When.Format("2006/01/02"), r.PointsBefore, r.PointsAfter)
+}
+
+// {{{ ParseRetentionPolicy
+
+// ParseRetentionPolicy parses a policy of the form "90d:5s,730d:30s"; the TrackNames are taken
+// from the DefaultRetentionPolicy.
+func ParseRetentionPolicy(str string) (RetentionPolicy, error) {
+	p := RetentionPolicy{TrackNames: DefaultRetentionPolicy.TrackNames}
+	for _,ruleStr := range strings.Split(str, ",") {
+		bits := strings.Split(strings.TrimSpace(ruleStr), ":")
+		if len(bits) != 2 {
+			return p, fmt.Errorf("ParseRetentionPolicy: bad rule '%s' (want AGE:EVERY)", ruleStr)
+		}
+		after,err := parseDays(bits[0])
+		if err != nil { return p, fmt.Errorf("ParseRetentionPolicy: %v", err) }
+		every,err := time.ParseDuration(bits[1])
+		if err != nil { return p, fmt.Errorf("ParseRetentionPolicy: %v", err) }
+		p.Rules = append(p.Rules, RetentionRule{After:after, Every:every})
+	}
+	sort.Slice(p.Rules, func(i,j int) bool { return p.Rules[i].After < p.Rules[j].After })
+	return p, nil
+}
+
+// time.ParseDuration doesn't do days
+func parseDays(str string) (time.Duration, error) {
+	if strings.HasSuffix(str, "d") {
+		n,err := strconv.Atoi(strings.TrimSuffix(str, "d"))
+		return time.Duration(n) * 24 * time.Hour, err
+	}
+	return time.ParseDuration(str)
+}
+
+func (p RetentionPolicy)String() string {
+	strs := []string{}
+	for _,r := range p.Rules {
+		strs = append(strs, fmt.Sprintf("after %dd: every %s", int(r.After.Hours()/24), r.Every))
+	}
+	return fmt.Sprintf("%s %v", strings.Join(strs, "; "), p.TrackNames)
+}
+
+// }}}
+// {{{ p.EveryFor
+
+// EveryFor returns the sampling interval for data of the given age; zero means keep it all.
+func (p RetentionPolicy)EveryFor(age time.Duration) time.Duration {
+	every := time.Duration(0)
+	for _,r := range p.Rules {
+		if age >= r.After && r.Every > every {
+			every = r.Every
+		}
+	}
+	return every
+}
+
+// }}}
+// {{{ f.ApplyRetentionPolicy
+
+// ApplyRetentionPolicy resamples the flight's tracks, if the policy wants them coarser than
+// they already are, and records it in f.Downsampled. Returns true if the flight was changed.
+func (f *Flight)ApplyRetentionPolicy(p RetentionPolicy, now time.Time) bool {
+	if len(f.Tracks) == 0 { return false }
+
+	_,e := f.Times()
+	every := p.EveryFor(now.Sub(e))
+	if every == 0 || every <= f.Downsampled.Every {
+		return false
+	}
+
+	rec := DownsampleRecord{Every:every, When:now}
+	names := []string{}
+	for _,name := range p.TrackNames {
+		if !f.HasTrack(name) { continue }
+		t := f.Tracks[name]
+		newT := t.SampleEvery(every, false)
+		if len(newT) > 0 && !newT[len(newT)-1].TimestampUTC.Equal((*t)[len(*t)-1].TimestampUTC) {
+			newT = append(newT, (*t)[len(*t)-1]) // Keep the track's endpoints where they were
+		}
+		rec.PointsBefore += len(*t)
+		rec.PointsAfter += len(newT)
+		f.Tracks[name] = &newT
+		names = append(names, name)
+	}
+	if len(names) == 0 { return false }
+
+	f.Downsampled = rec
+	f.DebugLog += fmt.Sprintf("-- Retention %s: %v %s\n", now.Format("2006/01/02"), names, rec)
+	return true
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
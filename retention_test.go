@@ -0,0 +1,47 @@
+package flightdb
+
+import(
+	"testing"
+	"time"
+)
+
+func TestApplyRetentionPolicy(t *testing.T) {
+	p,err := ParseRetentionPolicy("730d:30s, 90d:5s")
+	if err != nil { t.Fatal(err) }
+	if p.EveryFor(10*24*time.Hour) != 0 || p.EveryFor(100*24*time.Hour) != 5*time.Second ||
+		p.EveryFor(1000*24*time.Hour) != 30*time.Second {
+		t.Errorf("policy looks wrong: %s", p)
+	}
+
+	// Ten minutes of 1Hz data, from 100 days ago
+	s := time.Now().Add(-100 * 24 * time.Hour)
+	track := Track{}
+	for i:=0; i<600; i++ {
+		track = append(track, Trackpoint{TimestampUTC: s.Add(time.Duration(i)*time.Second)})
+	}
+	other := append(Track{}, track...)
+	f := BlankFlight()
+	f.Tracks["ADSB"] = &track
+	f.Tracks["FOIA"] = &other
+
+	if !f.ApplyRetentionPolicy(p, time.Now()) {
+		t.Fatalf("flight was not downsampled")
+	}
+	if n := len(*f.Tracks["ADSB"]); n < 100 || n > 121 {
+		t.Errorf("expected ~120 points after 5s sampling, saw %d", n)
+	}
+	if len(*f.Tracks["FOIA"]) != 600 {
+		t.Errorf("FOIA track was modified")
+	}
+	if e := (*f.Tracks["ADSB"]).End(); !e.Equal(track.End()) {
+		t.Errorf("track end moved from %s to %s", track.End(), e)
+	}
+	if f.Downsampled.Every != 5*time.Second || f.Downsampled.PointsBefore != 600 {
+		t.Errorf("bad record: %s", f.Downsampled)
+	}
+
+	// Running it again should be a no-op
+	if f.ApplyRetentionPolicy(p, time.Now()) {
+		t.Errorf("flight was downsampled twice")
+	}
+}
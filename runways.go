@@ -0,0 +1,234 @@
+package flightdb
+
+// Runway identification. The runway database is a list of thresholds, loaded from a data file
+// (see data/runways.csv). A flight's final approach (or initial climb) is matched against each
+// runway; the points need to be low, lined up with the runway heading, close to the extended
+// centerline, and to get near the threshold. Parallel runways are told apart by which
+// centerline the points are closest to, on average.
+
+import(
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skypies/geo"
+)
+
+// The file the apps load DefaultRunways from; relative to the go module root.
+const DefaultRunwaysFile = "data/runways.csv"
+
+// If this is empty (e.g. the apps couldn't load it), Analyse doesn't look for runways.
+var DefaultRunways = RunwayDB{}
+
+const(
+	kRunwayMaxHeight        = 4000.0 // Feet above the runway; higher points aren't considered
+	kRunwayFinalKM          = 15.0   // How far out on final we look
+	kRunwayClimbKM          = 10.0   // How far past the end of the runway we look, for departures
+	kRunwayMaxHeadingDelta  = 20.0   // Degrees
+	kRunwayMinPoints        = 4
+)
+
+// The flight gets a tag for each runway it used, e.g. "RWY:SFO:28L"
+const kRunwayTagPrefix = "RWY:"
+
+type Runway struct {
+	Airport        string      // IATA code, e.g. "SFO"
+	Ident          string      // e.g. "28L"
+	Threshold      geo.Latlong
+	Heading        float64     // True heading, from this threshold towards the other end
+	ElevationFeet  float64
+	LengthFeet     float64
+}
+
+func (r Runway)String() string { return r.Airport + ":" + r.Ident }
+func (r Runway)Tag() string { return kRunwayTagPrefix + r.String() }
+
+type RunwayDB []Runway
+
+// {{{ ParseRunwayDB, LoadRunwayDB
+
+// ParseRunwayDB reads CSV lines of airport,runway,lat,long,heading,elevation_ft,length_ft;
+// lines starting with # are ignored.
+func ParseRunwayDB(r io.Reader) (RunwayDB, error) {
+	rdr := csv.NewReader(r)
+	rdr.Comment = '#'
+	rdr.FieldsPerRecord = 7
+	rdr.TrimLeadingSpace = true
+
+	db := RunwayDB{}
+	for {
+		rec,err := rdr.Read()
+		if err == io.EOF { break }
+		if err != nil { return nil, fmt.Errorf("runways: %v", err) }
+
+		vals := []float64{}
+		for _,str := range rec[2:] {
+			v,err := strconv.ParseFloat(str, 64)
+			if err != nil { return nil, fmt.Errorf("runways: %s %s: %v", rec[0], rec[1], err) }
+			vals = append(vals, v)
+		}
+
+		db = append(db, Runway{
+			Airport: strings.ToUpper(rec[0]),
+			Ident: strings.ToUpper(rec[1]),
+			Threshold: geo.Latlong{Lat: vals[0], Long: vals[1]},
+			Heading: vals[2],
+			ElevationFeet: vals[3],
+			LengthFeet: vals[4],
+		})
+	}
+	return db, nil
+}
+
+func LoadRunwayDB(filename string) (RunwayDB, error) {
+	f,err := os.Open(filename)
+	if err != nil { return nil, err }
+	defer f.Close()
+	return ParseRunwayDB(f)
+}
+
+// Lookup returns the runway, or false if it isn't in the database.
+func (db RunwayDB)Lookup(airport, ident string) (Runway, bool) {
+	for _,r := range db {
+		if r.Airport == airport && r.Ident == ident { return r, true }
+	}
+	return Runway{}, false
+}
+
+// }}}
+// {{{ db.Match
+
+// The position in the runway's frame: x is along the runway (from the threshold, towards the
+// other end), y is across it, both in KM.
+func (r Runway)localXY(pos geo.Latlong) (float64, float64) {
+	cosLat0 := math.Cos(r.Threshold.Lat * math.Pi / 180.0)
+	e := (pos.Long - r.Threshold.Long) * cosLat0 * kKMPerDegree
+	n := (pos.Lat - r.Threshold.Lat) * kKMPerDegree
+	rad := r.Heading * math.Pi / 180.0
+	return e*math.Sin(rad) + n*math.Cos(rad), e*math.Cos(rad) - n*math.Sin(rad)
+}
+
+// Match finds the runway the track (which should be just the final approach & landing, or the
+// takeoff & initial climb) used. Returns the runway, and the time at which the aircraft crossed
+// the threshold (for arrivals) or started its takeoff (as near as the data shows).
+func (db RunwayDB)Match(t Track, departure bool) (Runway, time.Time, bool) {
+	var best Runway
+	var bestTime time.Time
+	bestErr := -1.0
+
+	for _,rwy := range db {
+		lengthKM := rwy.LengthFeet / geo.KFeetPerKM
+		minX, maxX := -kRunwayFinalKM, lengthKM
+		if departure { minX, maxX = 0, lengthKM + kRunwayClimbKM }
+
+		n, sumY := 0, 0.0
+		nearestX, nearestTime := math.Inf(1), time.Time{}
+		for i,tp := range t {
+			if tp.Altitude - rwy.ElevationFeet > kRunwayMaxHeight { continue }
+			x,y := rwy.localXY(tp.Latlong)
+			if x < minX || x > maxX || math.Abs(y) > 0.3 + 0.05*math.Abs(x) { continue }
+			if math.Abs(geo.HeadingDelta(t.courseAt(i), rwy.Heading)) > kRunwayMaxHeadingDelta {
+				continue
+			}
+
+			n++
+			sumY += math.Abs(y)
+			if math.Abs(x) < nearestX { nearestX, nearestTime = math.Abs(x), tp.TimestampUTC }
+		}
+
+		// Arrivals need to get close to the threshold; departures need to be seen over the runway
+		reach := 3.0
+		if departure { reach = lengthKM + 2.0 }
+		if n < kRunwayMinPoints || nearestX > reach { continue }
+
+		if meanY := sumY / float64(n); bestErr < 0 || meanY < bestErr {
+			best, bestTime, bestErr = rwy, nearestTime, meanY
+		}
+	}
+
+	return best, bestTime, bestErr >= 0
+}
+
+// The direction the aircraft was moving in at point i; taken from the neighbouring points
+// where they're far enough apart, else the reported heading.
+func (t Track)courseAt(i int) float64 {
+	j,k := i-1, i+1
+	if j < 0 { j = 0 }
+	if k >= len(t) { k = len(t)-1 }
+	if t[j].DistKM(t[k].Latlong) < 0.05 { return t[i].Heading }
+	return t[j].BearingTowards(t[k].Latlong)
+}
+
+// }}}
+
+// {{{ f.IdentifyRunways
+
+type RunwayUse struct {
+	Runway
+	Departure  bool
+	time.Time  // When the aircraft crossed the threshold, or started its takeoff
+}
+
+func (u RunwayUse)String() string {
+	if u.Departure { return fmt.Sprintf("%s departure", u.Runway) }
+	return fmt.Sprintf("%s arrival", u.Runway)
+}
+
+// IdentifyRunways works out which runways the flight arrived on and departed from, using the
+// phases of flight (see AnalysePhases), and tags the flight with them. If the db is empty, it
+// does nothing; in particular, it leaves the runway tags the flight already has alone.
+func (f *Flight)IdentifyRunways(db RunwayDB) []RunwayUse {
+	uses := []RunwayUse{}
+	if len(db) == 0 { return uses }
+
+	for tag,_ := range f.Tags {
+		if strings.HasPrefix(tag, kRunwayTagPrefix) { f.DropTag(tag) }
+	}
+	if len(f.Phases) == 0 { return uses }
+	_,t := f.PreferredTrack(kPhaseTracks)
+
+	// Departure: the takeoff, and the climb that follows it
+	for i,seg := range f.Phases {
+		if seg.Phase != PhaseTakeoff { continue }
+		s,e := seg.Start, seg.End
+		if i+1 < len(f.Phases) && f.Phases[i+1].Phase == PhaseClimb { e = f.Phases[i+1].End }
+		if rwy,tm,ok := db.Match(Track(t.ClipTo(s,e)), true); ok {
+			uses = append(uses, RunwayUse{Runway:rwy, Departure:true, Time:tm})
+		}
+		break
+	}
+
+	// Arrival: the final approach & landing
+	for i:=len(f.Phases)-1; i>=0; i-- {
+		if p := f.Phases[i].Phase; p != PhaseApproach && p != PhaseLanding { continue }
+		s,e := f.Phases[i].Start, f.Phases[i].End
+		for i > 0 && (f.Phases[i-1].Phase == PhaseApproach || f.Phases[i-1].Phase == PhaseLanding) {
+			i--
+			s = f.Phases[i].Start
+		}
+		if rwy,tm,ok := db.Match(Track(t.ClipTo(s,e)), false); ok {
+			uses = append(uses, RunwayUse{Runway:rwy, Departure:false, Time:tm})
+		}
+		break
+	}
+
+	for _,u := range uses {
+		if !f.HasTag(u.Tag()) { f.SetTag(u.Tag()) }
+	}
+	return uses
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,92 @@
+package flightdb
+
+import(
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skypies/geo"
+)
+
+// A 1Hz track, with each leg being {secs, groundspeed, feet/min}; the aircraft starts at pos,
+// and keeps on the heading.
+func runwaysTestTrack(s time.Time, pos geo.Latlong, alt, heading float64, legs [][3]float64) Track {
+	track := Track{}
+	for _,leg := range legs {
+		for i:=0; i<int(leg[0]); i++ {
+			track = append(track, Trackpoint{
+				DataSource: "ADSB",
+				TimestampUTC: s.Add(time.Duration(len(track))*time.Second),
+				Latlong: pos,
+				Altitude: math.Max(0, math.Round(alt/25)*25),
+				GroundSpeed: leg[1],
+				Heading: heading,
+			})
+			pos = pos.MoveKM(heading, geo.NM2KM(leg[1]) / 3600.0)
+			alt += leg[2] / 60.0
+		}
+	}
+	return track
+}
+
+func TestIdentifyRunways(t *testing.T) {
+	db,err := LoadRunwayDB(DefaultRunwaysFile)
+	if err != nil { t.Fatal(err) }
+	if _,exists := db.Lookup("SFO", "28L"); !exists || len(db) < 10 {
+		t.Fatalf("runway db not as expected (%d runways)", len(db))
+	}
+	if _,err := ParseRunwayDB(strings.NewReader("SFO,28L,37.6,-122.3,297.9,13\n")); err == nil {
+		t.Errorf("short line was accepted")
+	}
+
+	s := time.Date(2017, 4, 1, 16, 0, 0, 0, time.UTC)
+	rwy28L,_ := db.Lookup("SFO", "28L")
+	rwy1R,_ := db.Lookup("SFO", "1R")
+
+	// A 3 degree final onto 28L, from 25KM out, a little off the centerline; then rollout & taxi
+	start := rwy28L.Threshold.MoveKM(rwy28L.Heading + 180, 25).MoveKM(rwy28L.Heading + 90, 0.03)
+	arrival := runwaysTestTrack(s, start, 4300, rwy28L.Heading, [][3]float64{
+		{347, 140, -740},  // final
+		{40, 80, 0},       // rollout
+		{120, 15, 0},      // taxi
+	})
+
+	// Departure from 1R: hold, roll, climb out
+	departure := runwaysTestTrack(s, rwy1R.Threshold, 10, rwy1R.Heading, [][3]float64{
+		{60, 5, 0},
+		{35, 100, 0},
+		{180, 180, 2500},
+	})
+
+	saved := DefaultRunways
+	DefaultRunways = db
+	defer func() { DefaultRunways = saved }()
+
+	for _,test := range []struct{
+		Track
+		Expected string
+		Departure bool
+	}{
+		{arrival, "RWY:SFO:28L", false},
+		{departure, "RWY:SFO:1R", true},
+	} {
+		f := BlankFlight()
+		track := test.Track
+		f.Tracks["ADSB"] = &track
+		f.Analyse()
+
+		if !f.HasTag(test.Expected) {
+			t.Errorf("expected %s, got tags %v (phases %v)", test.Expected, f.TagList(), f.Phases)
+		}
+		uses := f.IdentifyRunways(db)
+		if len(uses) != 1 || uses[0].Departure != test.Departure || uses[0].Tag() != test.Expected {
+			t.Errorf("runway uses: %v", uses)
+		}
+
+		// Without a runway db, nothing is found, but the tags are left alone
+		if uses := f.IdentifyRunways(nil); len(uses) != 0 || !f.HasTag(test.Expected) {
+			t.Errorf("with no runways: uses %v, tags %v", uses, f.TagList())
+		}
+	}
+}
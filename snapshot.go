@@ -33,15 +33,29 @@ func (fs *FlightSnapshot)LocalizeTo(refpt geo.Latlong, elevation float64) {
 }
 
 // Returns nil if flight not known at that time.
-// Does not interpolate; returns the 'most recent' trackpoint to the specified time
+// Does not interpolate; returns the 'most recent' trackpoint to the specified time.
+// Uses the fused track, if the flight has had one added.
 func (f *Flight)TakeSnapshotAt(t time.Time) *FlightSnapshot {
+	return f.TakeSnapshotAtWith(t, InterpolateNone)
+}
+
+// TakeSnapshotAtWith interpolates the position at the specified time, using the mode; PrevPos
+// and NextPos are the real trackpoints either side.
+func (f *Flight)TakeSnapshotAtWith(t time.Time, mode InterpolationMode) *FlightSnapshot {
 
-	for _,trackKey := range []string{"FOIA", "ADSB", "MLAT"} {
+	for _,trackKey := range []string{FusedTrackName, "FOIA", "ADSB", "MLAT"} {
 		if !f.HasTrack(trackKey) { continue }
 		track := *f.Tracks[trackKey]
 		index := track.IndexAtTime(t)
 		if index < 0 { continue }
 
+		if mode != InterpolateNone {
+			tp,_ := track.InterpolateAt(t, mode)
+			fs := FlightSnapshot{Flight: *f, Trackpoint: tp, PrevPos: track[index]}
+			if index <len(track)-1 { fs.NextPos = track[index+1] }
+			return &fs
+		}
+
 		fs := FlightSnapshot{Flight: *f, Trackpoint: track[index]}
 		if index > 0           { fs.PrevPos = track[index-1] }
 		if index <len(track)-1 { fs.NextPos = track[index+1] }
@@ -0,0 +1,224 @@
+package flightdb
+
+// Track fusion. A flight can have tracks from several sources, which overlap, stack, or have
+// gaps. The fused track walks through time; wherever the best available source has data, its
+// timestamps are used, and any lower-priority source that also has data at that moment gets
+// folded in, weighted by how good its DataSystem is. Where the better sources have gaps, the
+// lower-priority ones fill them in. Each point records which tracks it came from.
+//
+// The fused track is derived, and never stored; call f.AddFusedTrack() (or MaybeAddFusedTrack,
+// with a trackspec) and then use f.Tracks[FusedTrackName] like any other track.
+
+import(
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skypies/geo"
+)
+
+const FusedTrackName = "FUSED"
+
+// The tracks that can be fused, highest priority first
+var FusionSources = []string{"ADSB", "MLAT", "FA:TA", "FOIA", "FA:TZ", "fr24"}
+
+// A source doesn't cover a moment if its points either side are further apart than this
+var MaxFusionGap = time.Minute
+
+// How much worse (in KM per second from the nearest real point) an interpolated position gets
+const kFusionDriftKMPerSec = 0.01
+
+// {{{ ds.FusionSigmaKM
+
+// FusionSigmaKM is roughly how accurate a position from the data system is.
+func (ds DataSystem)FusionSigmaKM() float64 {
+	switch ds {
+	case DSADSB:           return 0.03
+	case DSMLAT:           return 0.15
+	case DSCorrectedRadar: return 0.2
+	case DSRadar:          return 0.5
+	default:               return 0.3
+	}
+}
+
+// }}}
+// {{{ f.AddFusedTrack, f.MaybeAddFusedTrack
+
+// AddFusedTrack (re)builds the fused track, and adds it to the flight; returns false if there
+// was nothing to fuse.
+func (f *Flight)AddFusedTrack() bool {
+	t := f.FusedTrack()
+	if len(t) == 0 { return false }
+	f.Tracks[FusedTrackName] = &t
+	return true
+}
+
+// MaybeAddFusedTrack adds the fused track if the trackspec asks for it, and it isn't there yet.
+func (f *Flight)MaybeAddFusedTrack(trackspec []string) bool {
+	for _,name := range trackspec {
+		if name == FusedTrackName {
+			return f.HasTrack(FusedTrackName) || f.AddFusedTrack()
+		}
+	}
+	return false
+}
+
+// withoutDerivedTracks returns a shallow copy of the flight that doesn't have any tracks
+// which shouldn't be stored.
+func (f *Flight)withoutDerivedTracks() *Flight {
+	if !f.HasTrack(FusedTrackName) { return f }
+	g := *f
+	g.Tracks = map[string]*Track{}
+	for name,t := range f.Tracks {
+		if name != FusedTrackName { g.Tracks[name] = t }
+	}
+	return &g
+}
+
+// }}}
+
+// {{{ fusionSource
+
+type fusionSource struct {
+	Name      string
+	Track
+	SigmaKM   float64
+}
+
+// at estimates the source's position at the time, interpolating between the points either side.
+// Also returns the variance of the estimate (in KM^2), and the nearest real point.
+func (src fusionSource)at(tm time.Time) (Trackpoint, float64, Trackpoint, bool) {
+	t := src.Track
+	i := sort.Search(len(t), func(i int) bool { return !t[i].TimestampUTC.Before(tm) })
+	if i == len(t) {
+		return Trackpoint{}, 0, Trackpoint{}, false
+	} else if t[i].TimestampUTC.Equal(tm) {
+		return t[i], src.SigmaKM * src.SigmaKM, t[i], true
+	} else if i == 0 || t[i].TimestampUTC.Sub(t[i-1].TimestampUTC) > MaxFusionGap {
+		return Trackpoint{}, 0, Trackpoint{}, false
+	}
+
+	pre,post := t[i-1], t[i]
+	ratio := tm.Sub(pre.TimestampUTC).Seconds() / post.TimestampUTC.Sub(pre.TimestampUTC).Seconds()
+	tp := pre
+	tp.TimestampUTC = tm
+	tp.Latlong = geo.Latlong{
+		Lat: pre.Lat + ratio * (post.Lat - pre.Lat),
+		Long: pre.Long + ratio * (post.Long - pre.Long),
+	}
+	tp.Altitude = pre.Altitude + ratio * (post.Altitude - pre.Altitude)
+
+	nearest,nearestDist := pre, tm.Sub(pre.TimestampUTC)
+	if post.TimestampUTC.Sub(tm) < nearestDist {
+		nearest,nearestDist = post, post.TimestampUTC.Sub(tm)
+	}
+	drift := nearestDist.Seconds() * kFusionDriftKMPerSec
+
+	return tp, src.SigmaKM*src.SigmaKM + drift*drift, nearest, true
+}
+
+func (f Flight)fusionSources() []fusionSource {
+	sources := []fusionSource{}
+	for _,name := range FusionSources {
+		if !f.HasTrack(name) || len(*f.Tracks[name]) == 0 { continue }
+		t := append(Track{}, *f.Tracks[name]...)
+		sort.Sort(TrackByTimestampAscending(t))
+		sources = append(sources, fusionSource{
+			Name: name,
+			Track: t,
+			SigmaKM: t[0].GetDataSystem().FusionSigmaKM(),
+		})
+	}
+	return sources
+}
+
+// }}}
+// {{{ f.FusedTrack
+
+// FusedTrack builds the fused track from whichever source tracks the flight has. Each point's
+// DataSource is that of its best contributor, and Provenance lists the contributing tracks.
+func (f Flight)FusedTrack() Track {
+	sources := f.fusionSources()
+	if len(sources) == 0 { return Track{} }
+
+	// The timestamps of each source, wherever no better source has data
+	times := []time.Time{}
+	nFilled := 0
+	for i,src := range sources {
+		for _,tp := range src.Track {
+			covered := false
+			for _,better := range sources[:i] {
+				if _,_,_,ok := better.at(tp.TimestampUTC); ok { covered = true; break }
+			}
+			if !covered {
+				times = append(times, tp.TimestampUTC)
+				if i > 0 { nFilled++ }
+			}
+		}
+	}
+	sort.Slice(times, func(i,j int) bool { return times[i].Before(times[j]) })
+
+	fused := Track{}
+	for i,tm := range times {
+		if i > 0 && tm.Equal(times[i-1]) { continue }
+
+		var best Trackpoint
+		bestVar := -1.0
+		sumW, lat, long := 0.0, 0.0, 0.0
+		altW, alt := 0.0, 0.0
+		names := []string{}
+		corrected := []Trackpoint{}
+
+		for _,src := range sources {
+			tp,variance,nearest,ok := src.at(tm)
+			if !ok { continue }
+			w := 1.0 / variance
+			sumW += w
+			lat += w * tp.Lat
+			long += w * tp.Long
+			names = append(names, src.Name)
+			if bestVar < 0 || variance < bestVar { best,bestVar = nearest,variance }
+
+			// Corrected radar altitudes aren't pressure altitudes, so don't mix them in
+			if tp.GetDataSystem() == DSCorrectedRadar {
+				corrected = append(corrected, tp)
+			} else {
+				altW += w
+				alt += w * tp.Altitude
+			}
+		}
+		if bestVar < 0 { continue } // Can't happen
+
+		if altW == 0 {
+			altW,alt = 1.0, corrected[0].Altitude
+		}
+
+		out := best
+		out.TimestampUTC = tm
+		out.Latlong = geo.Latlong{Lat: lat/sumW, Long: long/sumW}
+		out.Altitude = alt/altW
+		out.Provenance = strings.Join(names, "+")
+		out.Notes = ""
+		fused = append(fused, out)
+	}
+
+	if len(fused) > 0 {
+		names := []string{}
+		for _,src := range sources { names = append(names, src.Name) }
+		fused[0].Notes = fmt.Sprintf("(fused from %s; %d points filled from lower priority tracks)",
+			strings.Join(names, ","), nFilled)
+	}
+
+	return fused
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,169 @@
+package flightdb
+
+// Interpolation modes, for when we need to guess where the aircraft was inbetween two points.
+//
+// Linear interpolation of lat/long (what tp.InterpolateTo does) is fine for points that are a
+// few seconds apart, but cuts the corner in turns, and drifts off the great circle across the
+// long gaps we get in FA & fr24 data over the ocean. Great circle interpolation follows the
+// shortest path; Hermite interpolation also uses the heading & groundspeed at each end, to fit
+// a cubic that leaves and arrives in the right direction, and so follows turns.
+
+import(
+	"math"
+	"time"
+
+	"github.com/skypies/geo"
+)
+
+type InterpolationMode int
+const(
+	InterpolateNone        InterpolationMode = iota // Don't interpolate; use the most recent point
+	InterpolateLinear                               // Straight line in lat/long
+	InterpolateGreatCircle                          // Shortest path over the earth's surface
+	InterpolateHermite                              // Cubic, matching heading & speed at each end
+)
+
+func (mode InterpolationMode)String() string {
+	switch mode {
+	case InterpolateNone:        return "none"
+	case InterpolateLinear:      return "linear"
+	case InterpolateGreatCircle: return "greatcircle"
+	case InterpolateHermite:     return "hermite"
+	default:                     return "?"
+	}
+}
+
+// Hermite interpolation over gaps longer than this is mostly guesswork, so we fall back to
+// great circle.
+var MaxHermiteGap = 5 * time.Minute
+
+// {{{ tp.InterpolateToWith
+
+// InterpolateToWith is like InterpolateTo, but lets you choose how the position is interpolated.
+// InterpolateNone stays at the from point. Hermite falls back to great circle if either point
+// lacks a groundspeed, if the gap is too long, or if the speeds don't match the distance flown.
+func (from Trackpoint)InterpolateToWith(to Trackpoint, ratio float64, mode InterpolationMode) InterpolatedTrackpoint {
+	itp := from.InterpolateTo(to, ratio)
+
+	switch mode {
+	case InterpolateNone:
+		itp.Trackpoint = from
+	case InterpolateGreatCircle:
+		itp.Latlong, itp.Heading = from.greatCircleTo(to, ratio)
+	case InterpolateHermite:
+		if !from.hermiteTo(to, ratio, &itp.Trackpoint) {
+			itp.Latlong, itp.Heading = from.greatCircleTo(to, ratio)
+		}
+	}
+
+	return itp
+}
+
+// Returns the position, and the heading along the great circle at that position.
+func (from Trackpoint)greatCircleTo(to Trackpoint, ratio float64) (pos geo.Latlong, heading float64) {
+	distKM := from.DistKM(to.Latlong)
+	if distKM == 0 { return from.Latlong, from.Heading }
+
+	pos = from.MoveKM(from.BearingTowards(to.Latlong), ratio * distKM)
+	if ratio < 1.0 {
+		heading = pos.BearingTowards(to.Latlong)
+	} else {
+		heading = math.Mod(to.Latlong.BearingTowards(from.Latlong) + 180.0, 360.0)
+	}
+	return
+}
+
+// hermiteTo fills in the position & heading, returning false if it isn't appropriate.
+func (from Trackpoint)hermiteTo(to Trackpoint, ratio float64, out *Trackpoint) bool {
+	dt := to.TimestampUTC.Sub(from.TimestampUTC)
+	if dt <= 0 || dt > MaxHermiteGap || from.GroundSpeed <= 0 || to.GroundSpeed <= 0 {
+		return false
+	}
+
+	// If the reported speeds are way off what it would take to cover the distance, the cubic
+	// will go looping off somewhere silly
+	secs := dt.Seconds()
+	chordKPS := from.DistKM(to.Latlong) / secs
+	speedKPS := geo.NM2KM((from.GroundSpeed + to.GroundSpeed) / 2) / 3600.0
+	if chordKPS > 2*speedKPS || chordKPS < speedKPS/2 { return false }
+
+	// Work in a flat plane, in KM, centered on the from point
+	cosLat0 := math.Cos(from.Lat * math.Pi / 180.0)
+	e1 := (to.Long - from.Long) * cosLat0 * kKMPerDegree
+	n1 := (to.Lat - from.Lat) * kKMPerDegree
+	velocity := func(tp Trackpoint) (float64, float64) {
+		kps := geo.NM2KM(tp.GroundSpeed) / 3600.0
+		rad := tp.Heading * math.Pi / 180.0
+		return kps * math.Sin(rad) * secs, kps * math.Cos(rad) * secs // Scaled to the interval
+	}
+	ve0,vn0 := velocity(from)
+	ve1,vn1 := velocity(to)
+
+	// The basis functions (the from point is the origin, so h00 drops out), and their derivatives
+	s := ratio
+	s2,s3 := s*s, s*s*s
+	h10, h01, h11 := s3 - 2*s2 + s, -2*s3 + 3*s2, s3 - s2
+	d10, d01, d11 := 3*s2 - 4*s + 1, -6*s2 + 6*s, 3*s2 - 2*s
+
+	e := h10*ve0 + h01*e1 + h11*ve1
+	n := h10*vn0 + h01*n1 + h11*vn1
+	out.Latlong = geo.Latlong{Lat: from.Lat + n/kKMPerDegree, Long: from.Long + e/(cosLat0*kKMPerDegree)}
+
+	de := d10*ve0 + d01*e1 + d11*ve1
+	dn := d10*vn0 + d01*n1 + d11*vn1
+	if de != 0 || dn != 0 {
+		out.Heading = math.Mod(math.Atan2(de, dn) * 180.0 / math.Pi + 360.0, 360.0)
+	}
+
+	return true
+}
+
+// }}}
+// {{{ t.InterpolateAt
+
+// InterpolateAt returns where the track puts the aircraft at the time, interpolating between
+// the points either side using the mode. Returns false if the time is outside the track.
+func (t Track)InterpolateAt(tm time.Time, mode InterpolationMode) (Trackpoint, bool) {
+	if len(t) == 0 { return Trackpoint{}, false }
+	if tm.Equal(t.End()) { return t[len(t)-1], true }
+
+	i := t.IndexAtTime(tm)
+	if i < 0 { return Trackpoint{}, false }
+	if mode == InterpolateNone || t[i].TimestampUTC.Equal(tm) { return t[i], true }
+
+	return interpolateBetween(t[i], t[i+1], tm, mode), true
+}
+
+// interpolateBetween returns a copy of the pre point (so it keeps the datasource etc), moved to
+// wherever the mode puts it at the time.
+func interpolateBetween(pre, post Trackpoint, tm time.Time, mode InterpolationMode) Trackpoint {
+	ratio := 0.0
+	if dur := post.TimestampUTC.Sub(pre.TimestampUTC); dur > 0 {
+		ratio = float64(tm.Sub(pre.TimestampUTC)) / float64(dur)
+	}
+	itp := pre.InterpolateToWith(post, ratio, mode)
+
+	tp := pre
+	tp.TimestampUTC = tm
+	tp.Latlong = itp.Latlong
+	tp.Altitude = itp.Altitude
+	tp.Heading = itp.Heading
+	tp.GroundSpeed = itp.GroundSpeed
+	tp.VerticalRate = itp.VerticalRate
+	tp.DistanceTravelledKM = itp.DistanceTravelledKM
+	tp.GroundAccelerationKPS = itp.GroundAccelerationKPS
+	tp.VerticalSpeedFPM = itp.VerticalSpeedFPM
+	tp.VerticalAccelerationFPMPS = itp.VerticalAccelerationFPMPS
+	tp.Notes = "(" + mode.String() + " interpolation)"
+	return tp
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -0,0 +1,264 @@
+package flightdb
+
+// Phase of flight. A track gets split into contiguous segments, each labelled as one of
+// ground, takeoff, climb, cruise, level-off, descent, approach or landing.
+//
+// The vertical rate is measured over a window of track (the reported vertical rates are too
+// patchy across the different data sources to rely on), and there is hysteresis on both it and
+// the groundspeed, so a bumpy climb doesn't come out as a string of climbs and level-offs. We
+// don't know airport elevations, so heights for takeoff & landing are relative to where the
+// track was on the ground; if it never was, we assume a sea-level airport.
+
+import(
+	"fmt"
+	"strings"
+	"time"
+)
+
+type FlightPhase string
+const(
+	PhaseGround   FlightPhase = "ground"
+	PhaseTakeoff  FlightPhase = "takeoff"
+	PhaseClimb    FlightPhase = "climb"
+	PhaseCruise   FlightPhase = "cruise"
+	PhaseLevelOff FlightPhase = "leveloff"
+	PhaseDescent  FlightPhase = "descent"
+	PhaseApproach FlightPhase = "approach"
+	PhaseLanding  FlightPhase = "landing"
+)
+
+var AllFlightPhases = []FlightPhase{PhaseGround, PhaseTakeoff, PhaseClimb, PhaseCruise,
+	PhaseLevelOff, PhaseDescent, PhaseApproach, PhaseLanding}
+
+// The flight gets one of these tags for each phase it has, e.g. "PHASE:LANDING"
+const kPhaseTagPrefix = "PHASE:"
+func (p FlightPhase)Tag() string { return kPhaseTagPrefix + strings.ToUpper(string(p)) }
+
+// ParseFlightPhase is case-insensitive, and accepts "level-off" as well as "leveloff".
+func ParseFlightPhase(s string) (FlightPhase, error) {
+	s = strings.Replace(strings.ToLower(strings.TrimSpace(s)), "-", "", -1)
+	for _,p := range AllFlightPhases {
+		if s == string(p) { return p, nil }
+	}
+	return "", fmt.Errorf("unknown phase of flight '%s'", s)
+}
+
+type PhaseOptions struct {
+	GroundMaxSpeed     float64       // Knots; slower than this, the aircraft is on the ground ...
+	AirborneMinSpeed   float64       // ... until it gets faster than this
+	VerticalEnterFPM   float64       // A climb or descent starts when the vertical rate exceeds this ...
+	VerticalExitFPM    float64       // ... and ends when it drops back under this
+	VerticalWindow     time.Duration // The vertical rate is measured across this much track
+	MinSegment         time.Duration // Shorter airborne segments are absorbed into a neighbour
+	TakeoffHeight      float64       // Feet above the departure; takeoff becomes climb here
+	ApproachHeight     float64       // Feet above the arrival; descent becomes approach here ...
+	LandingHeight      float64       // ... and approach becomes landing here
+	CruiseBand         float64       // Level flight within this many feet of the top is cruise
+}
+
+var DefaultPhaseOptions = PhaseOptions{
+	GroundMaxSpeed: 50,
+	AirborneMinSpeed: 70,
+	VerticalEnterFPM: 500,
+	VerticalExitFPM: 200,
+	VerticalWindow: time.Minute,
+	MinSegment: time.Minute,
+	TakeoffHeight: 1000,
+	ApproachHeight: 3000,
+	LandingHeight: 200,
+	CruiseBand: 2000,
+}
+
+type PhaseSegment struct {
+	Phase       FlightPhase
+	Start, End  time.Time // The first & last trackpoints in the segment
+}
+
+func (s PhaseSegment)Duration() time.Duration { return s.End.Sub(s.Start) }
+func (s PhaseSegment)String() string {
+	return fmt.Sprintf("%s[%s-%s]", s.Phase, s.Start.Format("15:04:05"), s.End.Format("15:04:05"))
+}
+
+// {{{ t.Phases
+
+func (t Track)Phases() []PhaseSegment { return t.PhasesWith(DefaultPhaseOptions) }
+
+// PhasesWith splits the track into phases of flight; the track should be in time order.
+func (t Track)PhasesWith(opt PhaseOptions) []PhaseSegment {
+	n := len(t)
+	if n == 0 { return nil }
+
+	labels := t.phaseLabels(opt)
+
+	segs := []PhaseSegment{}
+	for i,iStart := 1,0; i<=n; i++ {
+		if i == n || labels[i] != labels[iStart] {
+			segs = append(segs, PhaseSegment{labels[iStart], t[iStart].TimestampUTC, t[i-1].TimestampUTC})
+			iStart = i
+		}
+	}
+	return segs
+}
+
+// phaseLabels returns a phase for each trackpoint.
+func (t Track)phaseLabels(opt PhaseOptions) []FlightPhase {
+	n := len(t)
+	raw := make([]FlightPhase, n) // Just ground, climb, cruise (meaning level) & descent
+
+	// Groundspeed & vertical rate, across a window centered on each point
+	for i,j0,j1 := 0,0,0; i<n; i++ {
+		tm := t[i].TimestampUTC
+		for j0 < i && tm.Sub(t[j0].TimestampUTC) > opt.VerticalWindow/2 { j0++ }
+		for j1 < n-1 && t[j1+1].TimestampUTC.Sub(tm) <= opt.VerticalWindow/2 { j1++ }
+
+		vs, gs := 0.0, t[i].GroundSpeed
+		if dur := t[j1].TimestampUTC.Sub(t[j0].TimestampUTC); dur > 0 {
+			vs = (t[j1].Altitude - t[j0].Altitude) / dur.Minutes()
+			if gs <= 0 {
+				gs = t[j0].DistNM(t[j1].Latlong) / dur.Hours()
+			}
+		}
+
+		prev := PhaseCruise
+		if i > 0 { prev = raw[i-1] }
+		raw[i] = opt.nextRawPhase(prev, gs, vs)
+	}
+
+	// Absorb short airborne runs into whatever came before (or after, if that was the ground).
+	// Ground runs are left alone; the groundspeed hysteresis has already dealt with them.
+	runs := [][2]int{}
+	for i,iStart := 1,0; i<=n; i++ {
+		if i == n || raw[i] != raw[iStart] {
+			runs = append(runs, [2]int{iStart, i})
+			iStart = i
+		}
+	}
+	for _,run := range runs {
+		if raw[run[0]] == PhaseGround { continue }
+		end := t[n-1].TimestampUTC
+		if run[1] < n { end = t[run[1]].TimestampUTC }
+		if end.Sub(t[run[0]].TimestampUTC) >= opt.MinSegment { continue }
+
+		fill := PhaseGround
+		if run[0] > 0 { fill = raw[run[0]-1] }
+		if fill == PhaseGround && run[1] < n { fill = raw[run[1]] }
+		if fill == PhaseGround { continue }
+		for i:=run[0]; i<run[1]; i++ { raw[i] = fill }
+	}
+
+	// Now work out where takeoff, approach & landing are
+	originAlt, destAlt, maxAlt := 0.0, 0.0, t[0].Altitude
+	if raw[0] == PhaseGround {
+		i := 0
+		for i < n-1 && raw[i+1] == PhaseGround { i++ }
+		originAlt = t[i].Altitude
+	}
+	if raw[n-1] == PhaseGround {
+		i := n-1
+		for i > 0 && raw[i-1] == PhaseGround { i-- }
+		destAlt = t[i].Altitude
+	}
+	iFirstAboveTakeoff, iLastAboveApproach, iLastAboveLanding := n, -1, -1
+	for i,tp := range t {
+		if tp.Altitude > maxAlt { maxAlt = tp.Altitude }
+		if raw[i] == PhaseGround { continue }
+		if iFirstAboveTakeoff == n && tp.Altitude >= originAlt + opt.TakeoffHeight {
+			iFirstAboveTakeoff = i
+		}
+		if tp.Altitude >= destAlt + opt.ApproachHeight { iLastAboveApproach = i }
+		if tp.Altitude >= destAlt + opt.LandingHeight { iLastAboveLanding = i }
+	}
+
+	labels := make([]FlightPhase, n)
+	for i,tp := range t {
+		switch {
+		case raw[i] == PhaseGround:
+			labels[i] = PhaseGround
+		case i < iFirstAboveTakeoff && iFirstAboveTakeoff < n:
+			labels[i] = PhaseTakeoff
+		case i > iLastAboveLanding && iLastAboveLanding >= 0:
+			labels[i] = PhaseLanding
+		case i > iLastAboveApproach && iLastAboveApproach >= 0:
+			labels[i] = PhaseApproach
+		case raw[i] == PhaseCruise && tp.Altitude < maxAlt - opt.CruiseBand:
+			labels[i] = PhaseLevelOff
+		default:
+			labels[i] = raw[i]
+		}
+	}
+
+	return labels
+}
+
+// The hysteresis; prev is the raw phase of the previous point.
+func (opt PhaseOptions)nextRawPhase(prev FlightPhase, gs, vs float64) FlightPhase {
+	if prev == PhaseGround {
+		if gs <= opt.AirborneMinSpeed { return PhaseGround }
+	} else if gs < opt.GroundMaxSpeed {
+		return PhaseGround
+	}
+
+	switch {
+	case prev == PhaseClimb && vs > opt.VerticalExitFPM:    return PhaseClimb
+	case prev == PhaseDescent && vs < -opt.VerticalExitFPM: return PhaseDescent
+	case vs > opt.VerticalEnterFPM:                         return PhaseClimb
+	case vs < -opt.VerticalEnterFPM:                        return PhaseDescent
+	default:                                                return PhaseCruise
+	}
+}
+
+// }}}
+
+// {{{ f.AnalysePhases
+
+// The tracks we work out phases from, in order of preference
+var kPhaseTracks = []string{FusedTrackName, "FOIA", "ADSB", "MLAT", "fr24"}
+
+// AnalysePhases works out the phases of flight from the flight's best track, storing them in
+// f.Phases, and tagging the flight with each of them. Returns the name of the track it used.
+func (f *Flight)AnalysePhases() string {
+	for tag,_ := range f.Tags {
+		if strings.HasPrefix(tag, kPhaseTagPrefix) { f.DropTag(tag) }
+	}
+
+	name,t := f.PreferredTrack(kPhaseTracks)
+	f.Phases = t.Phases()
+
+	for _,seg := range f.Phases {
+		if !f.HasTag(seg.Phase.Tag()) { f.SetTag(seg.Phase.Tag()) }
+	}
+	return name
+}
+
+// }}}
+// {{{ f.PhaseAt, f.PhasesBetween
+
+// PhaseAt returns the phase of flight at the time, or "" if it's outside all the segments.
+func (f Flight)PhaseAt(t time.Time) FlightPhase {
+	for _,seg := range f.Phases {
+		if !t.Before(seg.Start) && !t.After(seg.End) { return seg.Phase }
+	}
+	return ""
+}
+
+// PhasesBetween returns the segments that overlap the time range, clipped to it.
+func (f Flight)PhasesBetween(s,e time.Time) []PhaseSegment {
+	ret := []PhaseSegment{}
+	for _,seg := range f.Phases {
+		if seg.End.Before(s) || seg.Start.After(e) { continue }
+		if seg.Start.Before(s) { seg.Start = s }
+		if seg.End.After(e) { seg.End = e }
+		ret = append(ret, seg)
+	}
+	return ret
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
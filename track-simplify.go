@@ -0,0 +1,138 @@
+package flightdb
+
+// Track simplification, for when we're rendering or exporting far more points than are needed
+// to show the shape of the flight (e.g. 100KM of straight & level flight at 1Hz).
+//
+// This is Douglas-Peucker, but using the synchronized euclidean distance: a dropped point is
+// compared against where the simplified track would put the aircraft *at that point's time*,
+// rather than against the nearest bit of line. So the simplified track, when interpolated, is
+// never further away than the tolerance in space, altitude or time.
+
+import(
+	"math"
+	"time"
+)
+
+type SimplifyTolerance struct {
+	HorizontalKM  float64 // Max horizontal error; zero means horizontal error is ignored
+	VerticalFeet  float64 // Max vertical error; zero means vertical error is ignored
+}
+
+func (tol SimplifyTolerance)IsZero() bool { return tol.HorizontalKM <= 0 && tol.VerticalFeet <= 0 }
+
+// SimplifyToleranceForLevel maps a simple level (e.g. from a URL) to a tolerance; 0 means no
+// simplification, and each level after that doubles the tolerance, starting at 50m & 50ft.
+func SimplifyToleranceForLevel(level int) SimplifyTolerance {
+	if level <= 0 { return SimplifyTolerance{} }
+	if level > 10 { level = 10 }
+	scale := math.Pow(2, float64(level-1))
+	return SimplifyTolerance{HorizontalKM: 0.05 * scale, VerticalFeet: 50 * scale}
+}
+
+// {{{ t.Simplify
+
+// Simplify returns a copy of the track with as few points as possible, such that none of the
+// dropped points is further away than the tolerance. The first and last points are always kept,
+// as are the points listed in keep, and any points that a report has annotated or highlighted.
+func (t Track)Simplify(tol SimplifyTolerance, keep ...int) Track {
+	n := len(t)
+	if n <= 2 || tol.IsZero() { return append(Track{}, t...) }
+
+	kept := make([]bool, n)
+	kept[0], kept[n-1] = true, true
+	for _,i := range keep {
+		if i >= 0 && i < n { kept[i] = true }
+	}
+	for i,tp := range t {
+		if tp.AnalysisAnnotation != "" || tp.AnalysisDisplay == AnalysisDisplayHighlight {
+			kept[i] = true
+		}
+	}
+
+	// Each run between points we must keep is simplified separately
+	segments := [][2]int{}
+	for i,iLast := 1,0; i<n; i++ {
+		if kept[i] {
+			segments = append(segments, [2]int{iLast, i})
+			iLast = i
+		}
+	}
+
+	for len(segments) > 0 {
+		i,j := segments[len(segments)-1][0], segments[len(segments)-1][1]
+		segments = segments[:len(segments)-1]
+
+		worst,kWorst := 1.0, -1
+		for k:=i+1; k<j; k++ {
+			if e := t.simplifyError(i,j,k,tol); e > worst {
+				worst,kWorst = e,k
+			}
+		}
+		if kWorst >= 0 {
+			kept[kWorst] = true
+			segments = append(segments, [2]int{i,kWorst}, [2]int{kWorst,j})
+		}
+	}
+
+	out := Track{}
+	for i := range t {
+		if kept[i] { out = append(out, t[i]) }
+	}
+	return out
+}
+
+// How far point k is from where the line i->j puts the aircraft at k's time, as a multiple of
+// the tolerance (so anything over 1.0 is out of bounds).
+func (t Track)simplifyError(i,j,k int, tol SimplifyTolerance) float64 {
+	ratio := 0.5
+	if dur := t[j].TimestampUTC.Sub(t[i].TimestampUTC); dur > 0 {
+		ratio = float64(t[k].TimestampUTC.Sub(t[i].TimestampUTC)) / float64(dur)
+	}
+
+	err := 0.0
+	if tol.HorizontalKM > 0 {
+		pos := t[i].Latlong.InterpolateTo(t[j].Latlong, ratio)
+		err = t[k].DistKM(pos) / tol.HorizontalKM
+	}
+	if tol.VerticalFeet > 0 {
+		alt := interpolateFloat64(t[i].Altitude, t[j].Altitude, ratio)
+		err = math.Max(err, math.Abs(t[k].Altitude - alt) / tol.VerticalFeet)
+	}
+	return err
+}
+
+// }}}
+// {{{ f.SimplifyTrack
+
+// SimplifyTrack simplifies a track from this flight, also keeping the points at which it
+// matched waypoints, and where it starts & ends any of the intersections. The intersections may
+// be from a different track, so we keep the points either side of each of those times; then the
+// simplified track still crosses where the original did.
+func (f Flight)SimplifyTrack(t Track, tol SimplifyTolerance, tis ...TrackIntersection) Track {
+	times := []time.Time{}
+	for _,tm := range f.Waypoints { times = append(times, tm) }
+	for _,ti := range tis {
+		times = append(times, ti.Start.TimestampUTC)
+		if !ti.IsPointIntersection() { times = append(times, ti.End.TimestampUTC) }
+	}
+
+	keep := []int{}
+	for _,tm := range times {
+		if i := t.IndexAtTime(tm); i >= 0 {
+			keep = append(keep, i)
+			if t[i].TimestampUTC.Before(tm) { keep = append(keep, i+1) }
+		}
+	}
+
+	return t.Simplify(tol, keep...)
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
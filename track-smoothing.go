@@ -0,0 +1,351 @@
+package flightdb
+
+// Statistical smoothing of tracks. Each axis (east, north, altitude) gets a constant-acceleration
+// Kalman filter, followed by a Rauch-Tung-Striebel smoother pass, so every point is estimated
+// from the data both before and after it. Points whose innovation (the difference between what
+// was reported and what the filter predicted) is too unlikely are rejected as outliers; they
+// keep their slot in the track, but carry the smoother's estimate instead of the bogus data.
+//
+// Unlike PostProcess, the derived fields (vertical speed, acceleration, angle of inclination)
+// come from the smoothed velocity & acceleration estimates, rather than by differencing raw
+// points, so they don't need the track to be thinned out with SampleEvery first.
+
+import(
+	"fmt"
+	"math"
+
+	"github.com/skypies/geo"
+)
+
+const kKMPerDegree = 6371.0 * math.Pi / 180.0 // Only used for our local projection
+
+// If a run of this many points is rejected, accept the next one anyway; we've probably lost
+// track of a real maneuver, not found a run of bogus data.
+const kMaxGatedRun = 5
+
+type SmoothingParams struct {
+	PositionSigmaKM    float64 // Measurement noise, horizontal
+	AltitudeSigmaFeet  float64 // Measurement noise, vertical
+	HorizontalJerk     float64 // Process noise; roughly, how hard the aircraft can jerk, in KM/s^3
+	VerticalJerk       float64 // ... and vertically, in feet/s^3
+	GateSigmas         float64 // Reject points whose innovation is more than this many sigmas out
+}
+
+type SmoothedTrackpoint struct {
+	Trackpoint  // Smoothed position & altitude; the derived fields are populated from the filter
+
+	PositionOutlier        bool    // The reported position was rejected
+	AltitudeOutlier        bool    // The reported altitude was rejected
+
+	// One-sigma uncertainties of the smoothed values
+	PositionSigmaKM        float64
+	AltitudeSigmaFeet      float64
+	GroundSpeedSigmaKnots  float64
+	VerticalSpeedSigmaFPM  float64
+}
+
+type SmoothedTrack []SmoothedTrackpoint
+
+// {{{ t.DefaultSmoothingParams
+
+// Guesses measurement noise from the track's data source.
+func (t Track)DefaultSmoothingParams() SmoothingParams {
+	p := SmoothingParams{
+		PositionSigmaKM: 0.03,
+		AltitudeSigmaFeet: 40,
+		HorizontalJerk: 0.0003,
+		VerticalJerk: 0.5,
+		GateSigmas: 4.0,
+	}
+
+	if len(t) == 0 {
+		return p
+	} else if t.DataSourceIsFAA() || t[0].DataSource == "FA:TZ" {
+		p.PositionSigmaKM, p.AltitudeSigmaFeet = 0.2, 100 // Radar, and Mode C altitudes
+	} else if t[0].DataSource == "MLAT" {
+		p.PositionSigmaKM = 0.15
+	}
+
+	return p
+}
+
+// }}}
+// {{{ t.Smoothed, t.SmoothedWith
+
+func (t Track)Smoothed() SmoothedTrack { return t.SmoothedWith(t.DefaultSmoothingParams()) }
+
+// SmoothedWith returns a smoothed copy of the track, with one point per input point. The input
+// needs to be in time order; it is left untouched.
+func (t Track)SmoothedWith(p SmoothingParams) SmoothedTrack {
+	n := len(t)
+	out := make(SmoothedTrack, n)
+	if n == 0 { return out }
+
+	// Project onto a flat plane, in KM, centered on the first point
+	origin := t[0].Latlong
+	cosLat0 := math.Cos(origin.Lat * math.Pi / 180.0)
+	project := func(pos geo.Latlong) (float64, float64) {
+		return (pos.Long-origin.Long) * cosLat0 * kKMPerDegree, (pos.Lat-origin.Lat) * kKMPerDegree
+	}
+	unproject := func(e, n float64) geo.Latlong {
+		return geo.Latlong{Lat: origin.Lat + n/kKMPerDegree, Long: origin.Long + e/(cosLat0*kKMPerDegree)}
+	}
+
+	// Initial uncertainty of velocity & acceleration: anything an airliner might do
+	axes := [3]*kalmanAxis{
+		newKalmanAxis(n, p.HorizontalJerk, p.PositionSigmaKM, 0.3, 0.005),
+		newKalmanAxis(n, p.HorizontalJerk, p.PositionSigmaKM, 0.3, 0.005),
+		newKalmanAxis(n, p.VerticalJerk, p.AltitudeSigmaFeet, 100, 10),
+	}
+
+	gate2 := p.GateSigmas * p.GateSigmas
+	nPosRejected, nAltRejected := 0, 0
+	posRun, altRun := 0, 0
+	for i,tp := range t {
+		e,north := project(tp.Latlong)
+		z := [3]float64{e, north, tp.Altitude}
+
+		if i == 0 {
+			for j,ax := range axes { ax.init(z[j]) }
+			continue
+		}
+
+		dt := tp.TimestampUTC.Sub(t[i-1].TimestampUTC).Seconds()
+		if dt < 0 { dt = 0 }
+		for _,ax := range axes { ax.predict(i, dt) }
+
+		// Gate the horizontal axes together, so a point is either in or out
+		if d2 := axes[0].nis(i, z[0]) + axes[1].nis(i, z[1]); d2 > gate2 && posRun < kMaxGatedRun {
+			out[i].PositionOutlier = true
+			nPosRejected++
+			posRun++
+		} else {
+			axes[0].update(i, z[0])
+			axes[1].update(i, z[1])
+			posRun = 0
+		}
+
+		if d2 := axes[2].nis(i, z[2]); d2 > gate2 && altRun < kMaxGatedRun {
+			out[i].AltitudeOutlier = true
+			nAltRejected++
+			altRun++
+		} else {
+			axes[2].update(i, z[2])
+			altRun = 0
+		}
+	}
+
+	for _,ax := range axes { ax.smooth() }
+
+	// Now turn the states back into trackpoints
+	for i := range t {
+		xe,xn,xa := axes[0].xs[i], axes[1].xs[i], axes[2].xs[i]
+		pe,pn,pa := axes[0].ps[i], axes[1].ps[i], axes[2].ps[i]
+
+		tp := t[i]
+		tp.Latlong = unproject(xe[0], xn[0])
+		tp.Altitude = xa[0]
+
+		// Undo the projection's stretching of east-west distances at this latitude
+		stretch := math.Cos(tp.Lat * math.Pi / 180.0) / cosLat0
+		ve,vn,ae,an := xe[1]*stretch, xn[1], xe[2]*stretch, xn[2]
+
+		speedKPS := math.Hypot(ve, vn)
+		if t.DataSourceIsFAA() {
+			tp.GroundSpeed = speedKPS * 3600.0 / 1.852 // No groundspeed data in FAA tracks
+			tp.Heading = math.Mod(math.Atan2(ve, vn) * 180.0/math.Pi + 360.0, 360.0)
+		}
+		if speedKPS > 0 {
+			tp.GroundAccelerationKPS = ((ve*ae + vn*an) / speedKPS) * 3600.0 / 1.852
+		}
+		tp.VerticalSpeedFPM = xa[1] * 60.0
+		tp.VerticalAccelerationFPMPS = xa[2] * 60.0
+		tp.AngleOfInclination = math.Atan2(xa[1]/geo.KFeetPerKM, speedKPS) * 180.0/math.Pi
+
+		if i > 0 {
+			tp.DistanceTravelledKM = out[i-1].DistanceTravelledKM + tp.DistKM(out[i-1].Latlong)
+		} else {
+			tp.DistanceTravelledKM = 0
+		}
+
+		out[i].Trackpoint = tp
+		out[i].PositionSigmaKM = math.Sqrt(pe[0][0] + pn[0][0])
+		out[i].AltitudeSigmaFeet = math.Sqrt(pa[0][0])
+		out[i].GroundSpeedSigmaKnots = math.Sqrt(pe[1][1] + pn[1][1]) * 3600.0 / 1.852
+		out[i].VerticalSpeedSigmaFPM = math.Sqrt(pa[1][1]) * 60.0
+	}
+
+	out[0].Notes += fmt.Sprintf("(smoothed; rejected %d positions, %d altitudes)",
+		nPosRejected, nAltRejected)
+
+	return out
+}
+
+// }}}
+// {{{ st.AsTrack
+
+// AsTrack returns the smoothed points as a plain track, with the same indices as the original
+// (outliers carry the smoothed estimate). Don't call PostProcess on it, or the derived fields
+// will be recomputed from the positions.
+func (st SmoothedTrack)AsTrack() Track {
+	t := make(Track, len(st))
+	for i := range st { t[i] = st[i].Trackpoint }
+	return t
+}
+
+// }}}
+
+// {{{ kalmanAxis
+
+// A constant-acceleration Kalman filter along one axis; state is [position, velocity, accel].
+type kalmanAxis struct {
+	q        float64  // Spectral density of the process noise (white jerk)
+	r        float64  // Variance of measurement noise
+	p0       mat3     // Initial covariance
+
+	xp,xf,xs []vec3   // Predicted, filtered, smoothed states, per point
+	pp,pf,ps []mat3   // ... and their covariances
+	f        []mat3   // Transition from the previous point
+}
+
+func newKalmanAxis(n int, jerk, sigma, sigmaV, sigmaA float64) *kalmanAxis {
+	ax := kalmanAxis{
+		q: jerk*jerk,
+		r: sigma*sigma,
+		xp: make([]vec3, n), xf: make([]vec3, n), xs: make([]vec3, n),
+		pp: make([]mat3, n), pf: make([]mat3, n), ps: make([]mat3, n),
+		f: make([]mat3, n),
+	}
+	ax.p0 = mat3{{ax.r,0,0}, {0,sigmaV*sigmaV,0}, {0,0,sigmaA*sigmaA}}
+	return &ax
+}
+
+func (ax *kalmanAxis)init(z float64) {
+	ax.xp[0], ax.xf[0] = vec3{z,0,0}, vec3{z,0,0}
+	ax.pp[0], ax.pf[0] = ax.p0, ax.p0
+	ax.f[0] = identity3()
+}
+
+// Predicts the state at point i, dt seconds after i-1. Until update is called, the filtered
+// state is just the prediction.
+func (ax *kalmanAxis)predict(i int, dt float64) {
+	f := mat3{{1, dt, dt*dt/2}, {0, 1, dt}, {0, 0, 1}}
+	d2,d3,d4,d5 := dt*dt, dt*dt*dt, dt*dt*dt*dt, dt*dt*dt*dt*dt
+	q := mat3{{d5/20, d4/8, d3/6}, {d4/8, d3/3, d2/2}, {d3/6, d2/2, dt}}.scale(ax.q)
+
+	ax.f[i] = f
+	ax.xp[i] = f.mulv(ax.xf[i-1])
+	ax.pp[i] = f.mul(ax.pf[i-1]).mul(f.transpose()).add(q)
+	ax.xf[i], ax.pf[i] = ax.xp[i], ax.pp[i]
+}
+
+// The normalized innovation squared, for a measurement at point i
+func (ax *kalmanAxis)nis(i int, z float64) float64 {
+	innov := z - ax.xp[i][0]
+	return innov * innov / (ax.pp[i][0][0] + ax.r)
+}
+
+func (ax *kalmanAxis)update(i int, z float64) {
+	p := ax.pp[i]
+	s := p[0][0] + ax.r
+	innov := z - ax.xp[i][0]
+
+	k := vec3{p[0][0]/s, p[1][0]/s, p[2][0]/s}
+	for r:=0; r<3; r++ {
+		ax.xf[i][r] = ax.xp[i][r] + k[r]*innov
+		for c:=0; c<3; c++ {
+			ax.pf[i][r][c] = p[r][c] - k[r]*p[0][c]
+		}
+	}
+}
+
+// The Rauch-Tung-Striebel backward pass
+func (ax *kalmanAxis)smooth() {
+	n := len(ax.xf)
+	ax.xs[n-1], ax.ps[n-1] = ax.xf[n-1], ax.pf[n-1]
+	for i:=n-2; i>=0; i-- {
+		inv,ok := ax.pp[i+1].inverse()
+		if !ok {
+			ax.xs[i], ax.ps[i] = ax.xf[i], ax.pf[i]
+			continue
+		}
+		c := ax.pf[i].mul(ax.f[i+1].transpose()).mul(inv)
+		ax.xs[i] = ax.xf[i].add(c.mulv(ax.xs[i+1].sub(ax.xp[i+1])))
+		ax.ps[i] = ax.pf[i].add(c.mul(ax.ps[i+1].sub(ax.pp[i+1])).mul(c.transpose()))
+	}
+}
+
+// }}}
+// {{{ mat3, vec3
+
+type vec3 [3]float64
+type mat3 [3][3]float64
+
+func identity3() mat3 { return mat3{{1,0,0}, {0,1,0}, {0,0,1}} }
+
+func (a vec3)add(b vec3) vec3 { return vec3{a[0]+b[0], a[1]+b[1], a[2]+b[2]} }
+func (a vec3)sub(b vec3) vec3 { return vec3{a[0]-b[0], a[1]-b[1], a[2]-b[2]} }
+
+func (a mat3)mul(b mat3) mat3 {
+	ret := mat3{}
+	for r:=0; r<3; r++ {
+		for c:=0; c<3; c++ {
+			ret[r][c] = a[r][0]*b[0][c] + a[r][1]*b[1][c] + a[r][2]*b[2][c]
+		}
+	}
+	return ret
+}
+
+func (a mat3)mulv(v vec3) vec3 {
+	ret := vec3{}
+	for r:=0; r<3; r++ { ret[r] = a[r][0]*v[0] + a[r][1]*v[1] + a[r][2]*v[2] }
+	return ret
+}
+
+func (a mat3)add(b mat3) mat3 {
+	for r:=0; r<3; r++ { for c:=0; c<3; c++ { a[r][c] += b[r][c] } }
+	return a
+}
+
+func (a mat3)sub(b mat3) mat3 {
+	for r:=0; r<3; r++ { for c:=0; c<3; c++ { a[r][c] -= b[r][c] } }
+	return a
+}
+
+func (a mat3)scale(s float64) mat3 {
+	for r:=0; r<3; r++ { for c:=0; c<3; c++ { a[r][c] *= s } }
+	return a
+}
+
+func (a mat3)transpose() mat3 {
+	for r:=0; r<3; r++ { for c:=r+1; c<3; c++ { a[r][c],a[c][r] = a[c][r],a[r][c] } }
+	return a
+}
+
+func (a mat3)inverse() (mat3, bool) {
+	det := a[0][0]*(a[1][1]*a[2][2]-a[1][2]*a[2][1]) -
+		a[0][1]*(a[1][0]*a[2][2]-a[1][2]*a[2][0]) +
+		a[0][2]*(a[1][0]*a[2][1]-a[1][1]*a[2][0])
+	if det == 0 || math.IsNaN(det) { return mat3{}, false }
+
+	ret := mat3{}
+	for r:=0; r<3; r++ {
+		for c:=0; c<3; c++ {
+			// Cofactor of the transpose
+			r1,r2 := (c+1)%3, (c+2)%3
+			c1,c2 := (r+1)%3, (r+2)%3
+			ret[r][c] = (a[r1][c1]*a[r2][c2] - a[r1][c2]*a[r2][c1]) / det
+		}
+	}
+	return ret, true
+}
+
+// }}}
+
+// {{{ -------------------------={ E N D }=----------------------------------
+
+// Local variables:
+// folded-file: t
+// end:
+
+// }}}
@@ -191,7 +191,7 @@ func (t Track)DataSourceIsFAA () bool {
 // Derive a bunch of data fields from the raw data.
 // NOTE - the vertical data gets too jerky with ADSB, because altitude change appears more like
 // an occasional step function when the datapoints are too close. You should use t.SampleEvery()
-// to space things out a bit before using those fields.
+// to space things out a bit before using those fields, or use t.Smoothed() instead.
 func (t Track)PostProcess() {
 	// Skip the first point
 	for i:=1; i<len(t); i++ {
@@ -599,9 +599,15 @@ func (t Track)ClipTo(s,e time.Time) []Trackpoint {
 // {{{ t.SampleEvery
 
 // Returns a track that has (more or less) one point per time.Duration.
-// If interpolate is true, then we interpolate through gaps that are too long.
+// If interpolate is true, then we interpolate (linearly) through gaps that are too long.
 // The returned track contains copies of the trackpoints
 func (t Track)SampleEvery(d time.Duration, interpolate bool) Track {
+	if interpolate { return t.SampleEveryWith(d, InterpolateLinear) }
+	return t.SampleEveryWith(d, InterpolateNone)
+}
+
+// SampleEveryWith is like SampleEvery, but fills in gaps that are too long using the mode.
+func (t Track)SampleEveryWith(d time.Duration, mode InterpolationMode) Track {
 	if len(t) == 0 { return []Trackpoint{} }
 
 	new := []Trackpoint{t[0]}
@@ -612,8 +618,11 @@ func (t Track)SampleEvery(d time.Duration, interpolate bool) Track {
 		tDelta := t[i].TimestampUTC.Sub(t[iLast].TimestampUTC)
 
 		if tDelta > d {
-			if interpolate && tDelta > 2*d {
-				// IMPLEMENT ME
+			if mode != InterpolateNone && tDelta > 2*d {
+				// The gap is between i-1 and i (anything before i-1 was within d of iLast)
+				for tm := t[iLast].TimestampUTC.Add(d); t[i].TimestampUTC.Sub(tm) >= d; tm = tm.Add(d) {
+					new = append(new, interpolateBetween(t[i-1], t[i], tm, mode))
+				}
 			}
 			new = append(new, t[i])
 			iLast = i
@@ -634,9 +643,16 @@ func (t Track)SampleEvery(d time.Duration, interpolate bool) Track {
 // {{{ t.SampleEveryDist
 
 // Returns a track that has (more or less) one point per distance unit (as flown along the path).
-// If interpolate is true, then we interpolate through gaps that are too long; else they remain.
-// The returned track contains copies of the trackpoints.
+// If interpolate is true, then we interpolate (linearly) through gaps that are too long; else
+// they remain. The returned track contains copies of the trackpoints.
 func (t Track)SampleEveryDist(distKM float64, interpolate bool) Track {
+	if interpolate { return t.SampleEveryDistWith(distKM, InterpolateLinear) }
+	return t.SampleEveryDistWith(distKM, InterpolateNone)
+}
+
+// SampleEveryDistWith is like SampleEveryDist, but fills in gaps that are too long using the
+// mode. Interpolated points are evenly spaced in time across the gap.
+func (t Track)SampleEveryDistWith(distKM float64, mode InterpolationMode) Track {
 	if len(t) == 0 { return []Trackpoint{} }
 
 	new := []Trackpoint{t[0]}
@@ -647,8 +663,14 @@ func (t Track)SampleEveryDist(distKM float64, interpolate bool) Track {
 		distDelta := t[i].DistKM(t[iLast].Latlong)
 
 		if distDelta > distKM {
-			if interpolate && distDelta > 2*distKM {
-				// IMPLEMENT ME
+			if mode != InterpolateNone && distDelta > 2*distKM {
+				pre,post := t[i-1], t[i]
+				n := int(pre.DistKM(post.Latlong) / distKM)
+				dur := post.TimestampUTC.Sub(pre.TimestampUTC)
+				for j:=1; j<n; j++ {
+					tm := pre.TimestampUTC.Add(dur * time.Duration(j) / time.Duration(n))
+					new = append(new, interpolateBetween(pre, post, tm, mode))
+				}
 			}
 			new = append(new, t[i])
 			iLast = i
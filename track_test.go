@@ -5,9 +5,12 @@ package flightdb
 import (
 	"encoding/json"
 	"fmt"
-	//"math"
+	"math"
+	"math/rand"
 	"testing"
-	//"time"
+	"time"
+
+	"github.com/skypies/geo"
 )
 
 var(
@@ -175,3 +178,311 @@ func TestWindowedAverageAt(t *testing.T) {
 	}
 }
 */
+
+func TestSmoothed(t *testing.T) {
+	// Ten minutes of 1Hz ADSB, heading east at 250 knots and climbing at 1500 feet/min, with
+	// some noise, altitudes in 25ft steps, and two bogus points
+	rng := rand.New(rand.NewSource(1))
+	s := time.Date(2017, 3, 31, 18, 0, 0, 0, time.UTC)
+	speedKPS := 250 * 1.852 / 3600.0
+	track := Track{}
+	for i:=0; i<600; i++ {
+		distKM := speedKPS * float64(i) + rng.NormFloat64()*0.03
+		track = append(track, Trackpoint{
+			DataSource: "ADSB",
+			TimestampUTC: s.Add(time.Duration(i)*time.Second),
+			Latlong: geo.Latlong{Lat: 37.0 + rng.NormFloat64()*0.0003, Long: -122.5 + distKM/88.8},
+			Altitude: math.Round((5000 + 25*float64(i) + rng.NormFloat64()*10) / 25) * 25,
+		})
+	}
+	track[200].Lat += 0.05
+	track[400].Altitude += 3000
+
+	st := track.Smoothed()
+	if len(st) != len(track) {
+		t.Fatalf("smoothed track has %d points, not %d", len(st), len(track))
+	}
+	if !st[200].PositionOutlier || !st[400].AltitudeOutlier {
+		t.Errorf("outliers not rejected: %v, %v", st[200].PositionOutlier, st[400].AltitudeOutlier)
+	}
+
+	nOutliers := 0
+	for i,stp := range st {
+		if stp.PositionOutlier || stp.AltitudeOutlier { nOutliers++ }
+		if i < 30 || i > 570 { continue } // Let the filter settle at the edges
+		if math.Abs(stp.VerticalSpeedFPM - 1500) > 150 || math.Abs(stp.AngleOfInclination - 3.39) > 0.4 {
+			t.Errorf("[%d] vertical speed %.0f, angle %.2f", i, stp.VerticalSpeedFPM, stp.AngleOfInclination)
+		}
+		if math.Abs(stp.Altitude - (5000 + 25*float64(i))) > 3*stp.AltitudeSigmaFeet + 10 {
+			t.Errorf("[%d] altitude %.0f +/- %.0f", i, stp.Altitude, stp.AltitudeSigmaFeet)
+		}
+		if math.Abs(stp.GroundAccelerationKPS) > 1.0 {
+			t.Errorf("[%d] acceleration %.2f", i, stp.GroundAccelerationKPS)
+		}
+	}
+	if nOutliers > 6 {
+		t.Errorf("too many outliers: %d", nOutliers)
+	}
+
+	if dist := st.AsTrack()[599].DistanceTravelledKM; math.Abs(dist - speedKPS*599) > 1.0 {
+		t.Errorf("distance travelled %.2fKM, expected %.2fKM", dist, speedKPS*599)
+	}
+}
+
+func TestFusedTrack(t *testing.T) {
+	// ADSB for the first & last 30s, with a gap; MLAT every 5s throughout, 100m further north
+	s := time.Date(2017, 3, 31, 18, 0, 0, 0, time.UTC)
+	adsbT, mlatT := Track{}, Track{}
+	for i:=0; i<=150; i++ {
+		tp := Trackpoint{
+			TimestampUTC: s.Add(time.Duration(i)*time.Second),
+			Latlong: geo.Latlong{Lat: 37.0, Long: -122.5 + float64(i)*0.001},
+			Altitude: 10000,
+		}
+		if i <= 30 || i >= 120 {
+			tp.DataSource = "ADSB"
+			adsbT = append(adsbT, tp)
+		}
+		if i % 5 == 0 {
+			tp.DataSource, tp.Lat = "MLAT", tp.Lat + 0.0009
+			mlatT = append(mlatT, tp)
+		}
+	}
+	f := BlankFlight()
+	f.Tracks["ADSB"] = &adsbT
+	f.Tracks["MLAT"] = &mlatT
+
+	if !f.MaybeAddFusedTrack([]string{"FOIA", FusedTrackName}) {
+		t.Fatalf("fused track not added")
+	}
+	fused := *f.Tracks[FusedTrackName]
+	if n := len(adsbT) + 17; len(fused) != n { // MLAT fills the gap with 35s,40s,...,115s
+		t.Errorf("fused track has %d points, expected %d", len(fused), n)
+	}
+
+	for _,tp := range fused {
+		secs := int(tp.TimestampUTC.Sub(s).Seconds())
+		if secs > 30 && secs < 120 {
+			if tp.Provenance != "MLAT" || tp.Lat != 37.0009 {
+				t.Errorf("[%3ds] gap not filled from MLAT: %s %s", secs, tp.Provenance, tp.Latlong)
+			}
+		} else if secs < 25 || secs > 125 {
+			// Points near the gap get less MLAT weight, but ADSB should dominate either way
+			if tp.Provenance != "ADSB+MLAT" || tp.DataSource != "ADSB" || math.Abs(tp.Lat - 37.0) > 0.0001 {
+				t.Errorf("[%3ds] not fused: %s %s %s", secs, tp.Provenance, tp.DataSource, tp.Latlong)
+			}
+		}
+	}
+
+	// The fused track is derived, so shouldn't be stored
+	blob,err := f.ToBlob()
+	if err != nil { t.Fatal(err) }
+	f2,err := blob.ToFlight("")
+	if err != nil { t.Fatal(err) }
+	if f2.HasTrack(FusedTrackName) || !f.HasTrack(FusedTrackName) || !f2.HasTrack("MLAT") {
+		t.Errorf("fused track was persisted (or lost): %v, %v", f2.ListTracks(), f.ListTracks())
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	// Twenty minutes at 1Hz: straight & level, then a climbing turn, then straight & level
+	s := time.Date(2017, 3, 31, 18, 0, 0, 0, time.UTC)
+	pos := geo.Latlong{Lat: 37.0, Long: -122.5}
+	heading, alt := 90.0, 10000.0
+	track := Track{}
+	for i:=0; i<1200; i++ {
+		if i >= 500 && i < 560 { heading += 1.5; alt += 20 }
+		track = append(track, Trackpoint{
+			TimestampUTC: s.Add(time.Duration(i)*time.Second),
+			Latlong: pos,
+			Altitude: alt,
+		})
+		pos = pos.MoveKM(heading, 0.13)
+	}
+	track[800].AnalysisAnnotation = "* something interesting"
+
+	tol := SimplifyToleranceForLevel(1)
+	simple := track.Simplify(tol, 300)
+	if len(simple) < 4 || len(simple) > 60 {
+		t.Errorf("simplified to %d points", len(simple))
+	}
+
+	has := map[time.Time]bool{}
+	for _,tp := range simple { has[tp.TimestampUTC] = true }
+	for _,i := range []int{0, 300, 800, 1199} {
+		if !has[track[i].TimestampUTC] { t.Errorf("point %d was dropped", i) }
+	}
+
+	// An intersection found on another track falls between our points; both sides are kept
+	f := Flight{}
+	tm := track[900].TimestampUTC.Add(400*time.Millisecond)
+	ti := TrackIntersection{Start:Trackpoint{TimestampUTC:tm}}
+	has = map[time.Time]bool{}
+	for _,tp := range f.SimplifyTrack(track, tol, ti) { has[tp.TimestampUTC] = true }
+	if !has[track[900].TimestampUTC] || !has[track[901].TimestampUTC] {
+		t.Errorf("points either side of the intersection were dropped")
+	}
+
+	// Every original point should be within tolerance of the simplified track, at the same time
+	for i,tp := range track[:len(track)-1] {
+		j := simple.IndexAtTime(tp.TimestampUTC)
+		if j < 0 { t.Fatalf("[%d] not covered by simplified track", i) }
+		ratio := float64(tp.TimestampUTC.Sub(simple[j].TimestampUTC)) /
+			float64(simple[j+1].TimestampUTC.Sub(simple[j].TimestampUTC))
+		itp := simple[j].InterpolateTo(simple[j+1], ratio)
+		if d := tp.DistKM(itp.Latlong); d > tol.HorizontalKM {
+			t.Errorf("[%d] %.3fKM out", i, d)
+		}
+		if d := math.Abs(tp.Altitude - itp.Altitude); d > tol.VerticalFeet {
+			t.Errorf("[%d] %.0fft out", i, d)
+		}
+	}
+}
+
+func TestInterpolationModes(t *testing.T) {
+	maxErrKM := func(truth, sparse Track, mode InterpolationMode) float64 {
+		worst := 0.0
+		for _,tp := range truth {
+			itp,ok := sparse.InterpolateAt(tp.TimestampUTC, mode)
+			if !ok { continue }
+			worst = math.Max(worst, tp.DistKM(itp.Latlong))
+		}
+		return worst
+	}
+	every := func(in Track, n int) Track {
+		out := Track{}
+		for i:=0; i<len(in); i+=n { out = append(out, in[i]) }
+		return out
+	}
+
+	// Real ADSB, with every other point held out; it's straight, so all modes should do fine
+	real := loadTrack(tN)
+	for _,mode := range []InterpolationMode{InterpolateLinear, InterpolateGreatCircle, InterpolateHermite} {
+		if e := maxErrKM(real, every(real,2), mode); e > 0.1 {
+			t.Errorf("real track, %s: held-out points %.3fKM out", mode, e)
+		}
+	}
+
+	// A standard rate turn at 250 knots, reported every 20s (e.g. FA); 1Hz ground truth
+	s := time.Date(2017, 3, 31, 18, 0, 0, 0, time.UTC)
+	pos := geo.Latlong{Lat: 37.0, Long: -122.5}
+	heading, kmPerSec := 0.0, geo.NM2KM(250) / 3600.0
+	turn := Track{}
+	for i:=0; i<=240; i++ {
+		turn = append(turn, Trackpoint{
+			DataSource: "FA:TA",
+			TimestampUTC: s.Add(time.Duration(i)*time.Second),
+			Latlong: pos,
+			Altitude: 8000,
+			GroundSpeed: 250,
+			Heading: heading,
+		})
+		pos = pos.MoveKM(heading + 1.5, kmPerSec)
+		heading = math.Mod(heading + 3.0, 360)
+	}
+	sparse := every(turn, 20)
+	linear, hermite := maxErrKM(turn, sparse, InterpolateLinear), maxErrKM(turn, sparse, InterpolateHermite)
+	if linear < 0.2 || hermite > 0.05 {
+		t.Errorf("turn: linear %.3fKM out, hermite %.3fKM out", linear, hermite)
+	}
+
+	// Resampling should put the new points on the turn, too
+	resampled := sparse.SampleEveryWith(5*time.Second, InterpolateHermite)
+	if len(resampled) != 49 {
+		t.Errorf("resampled turn has %d points, expected 49", len(resampled))
+	}
+	for _,tp := range resampled {
+		i := int(tp.TimestampUTC.Sub(s).Seconds())
+		if d := tp.DistKM(turn[i].Latlong); d > 0.05 {
+			t.Errorf("resampled turn [%ds] %.3fKM out", i, d)
+		}
+	}
+
+	// Four hours across the pacific, with only the endpoints reported (e.g. fr24)
+	pos = geo.Latlong{Lat: 37.6, Long: -122.4}
+	ocean := Track{}
+	for i:=0; i<=240; i++ {
+		ocean = append(ocean, Trackpoint{
+			DataSource: "fr24",
+			TimestampUTC: s.Add(time.Duration(i)*time.Minute),
+			Latlong: pos,
+			Altitude: 37000,
+			GroundSpeed: 450,
+		})
+		if i < 240 { pos = pos.MoveKM(pos.BearingTowards(geo.Latlong{Lat:21.3, Long:-157.9}), 13.9) }
+	}
+	sparse = Track{ocean[0], ocean[240]}
+	linear = maxErrKM(ocean, sparse, InterpolateLinear)
+	gc := maxErrKM(ocean, sparse, InterpolateGreatCircle)
+	if linear < 20 || gc > 2 || maxErrKM(ocean, sparse, InterpolateHermite) != gc {
+		t.Errorf("ocean: linear %.1fKM out, great circle %.1fKM out", linear, gc)
+	}
+
+	f := BlankFlight()
+	f.Tracks["FOIA"] = &sparse
+	tm := s.Add(90*time.Minute)
+	if fs := f.TakeSnapshotAtWith(tm, InterpolateGreatCircle); fs == nil {
+		t.Errorf("no snapshot")
+	} else if d := fs.DistKM(ocean[90].Latlong); d > 2 || !fs.PrevPos.TimestampUTC.Equal(s) {
+		t.Errorf("snapshot %.1fKM out, prev=%s", d, fs.PrevPos)
+	}
+	if fs := f.TakeSnapshotAt(tm); fs == nil || !fs.Latlong.Equal(ocean[0].Latlong) {
+		t.Errorf("uninterpolated snapshot moved: %v", fs)
+	}
+}
+
+func TestPhases(t *testing.T) {
+	// A whole flight at 1Hz, from taxi out to taxi in; each leg is {secs, groundspeed, feet/min}
+	legs := [][3]float64{
+		{180, 15, 0},        // taxi
+		{40, 150, 0},        // takeoff roll
+		{270, 200, 2000},    // climb to 9000ft
+		{180, 250, 0},       // level off
+		{780, 300, 2000},    // climb to 35000ft
+		{1200, 450, 0},      // cruise
+		{930, 300, -2000},   // descend to 4000ft
+		{120, 220, 0},       // level off
+		{300, 160, -800},    // down to 0ft
+		{40, 80, 0},         // rollout
+		{180, 15, 0},        // taxi
+	}
+	s := time.Date(2017, 3, 31, 18, 0, 0, 0, time.UTC)
+	pos, alt := geo.Latlong{Lat: 37.6, Long: -122.4}, 0.0
+	track := Track{}
+	for _,leg := range legs {
+		for i:=0; i<int(leg[0]); i++ {
+			track = append(track, Trackpoint{
+				DataSource: "ADSB",
+				TimestampUTC: s.Add(time.Duration(len(track))*time.Second),
+				Latlong: pos,
+				Altitude: math.Max(0, math.Round(alt/25)*25),
+				GroundSpeed: leg[1],
+			})
+			pos = pos.MoveKM(90, geo.NM2KM(leg[1]) / 3600.0)
+			alt += leg[2] / 60.0
+		}
+	}
+
+	expected := []FlightPhase{PhaseGround, PhaseTakeoff, PhaseClimb, PhaseLevelOff, PhaseClimb,
+		PhaseCruise, PhaseDescent, PhaseLevelOff, PhaseDescent, PhaseApproach, PhaseLanding,
+		PhaseGround}
+	segs := track.Phases()
+	actual := []FlightPhase{}
+	for _,seg := range segs { actual = append(actual, seg.Phase) }
+	if fmt.Sprintf("%v", actual) != fmt.Sprintf("%v", expected) {
+		t.Fatalf("phases:-\n got %v\nwant %v", segs, expected)
+	}
+
+	f := BlankFlight()
+	f.Tracks["ADSB"] = &track
+	f.Analyse()
+	if !f.HasTag(PhaseLanding.Tag()) || !f.HasTag(PhaseCruise.Tag()) || len(f.Phases) != len(segs) {
+		t.Errorf("flight not tagged with phases: %v", f.TagList())
+	}
+	if p := f.PhaseAt(s.Add(2000*time.Second)); p != PhaseCruise {
+		t.Errorf("phase at 2000s was %s", p)
+	}
+	if between := f.PhasesBetween(s.Add(2500*time.Second), s.Add(3000*time.Second)); len(between) != 2 {
+		t.Errorf("phases between: %v", between)
+	}
+}
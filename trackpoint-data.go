@@ -64,6 +64,7 @@ func (tp Trackpoint)GetDataSystem() DataSystem {
 //	}
 	switch tp.DataSource {
 	case "ADSB":  return DSADSB
+	case "MLAT":  return DSMLAT
 	case "fr24":  return DSUnknown
 	case "FA:TZ": return DSRadar
 	case "FA:TA": return DSADSB
@@ -78,6 +79,7 @@ func (tp Trackpoint)GetDataProvider() DataProvider {
 //	}
 	switch tp.DataSource {
 	case "ADSB":  return DPSkypi
+	case "MLAT":  return DPSkypi
 	case "fr24":  return DPFR24
 	case "FA:TZ": return DPFA
 	case "FA:TA": return DPFA
@@ -40,6 +40,9 @@ type Trackpoint struct {
 	VerticalSpeedFPM          float64 `datastore:"-" json:"-"` // Feet per minute (~== VerticalRate)
 	VerticalAccelerationFPMPS float64 `datastore:"-" json:"-"` // In (feet per minute) per second
 	AngleOfInclination        float64 `datastore:"-" json:"-"` // In degrees. +ve means climbing
+
+	// Only in fused tracks; the tracks this point was built from, e.g. "ADSB+MLAT"
+	Provenance                string  `datastore:"-" json:"-"`
 	
 	// Populated just in first trackpoint, to hold transient notes for the whole track.
 	Notes                     string  `datastore:"-" json:"-"`
@@ -107,6 +110,12 @@ func (tp Trackpoint)ToJSString() string {
 // {{{ tp.LongSource
 
 func (tp Trackpoint)LongSource() string {
+	if tp.Provenance != "" {
+		src := tp
+		src.Provenance = ""
+		return fmt.Sprintf("Fused from %s; mostly %s", tp.Provenance, src.LongSource())
+	}
+
 	switch tp.DataSource {
 	case "":      return "(none specified)"
 	case "FA:TZ": return "FlightAware, Radar (TZ)"
@@ -20,6 +20,7 @@ import(
 
 // ?idspec=F12123@144001232[,...]
 // &json=1
+// &simplify=2      (drop points that don't change the shape; see fdb.SimplifyToleranceForLevel)
 
 func VectorHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 	ctx := db.Ctx()
@@ -62,6 +63,7 @@ func OutputFlightAsVectorJSON(db fgae.FlightDB, w http.ResponseWriter, r *http.R
 	if len(trackspecs) == 0 {
 		trackspecs = []string{"FOIA", "ADSB", "MLAT", "FA", "fr24"}
 	}
+	f.MaybeAddFusedTrack(trackspecs) // &trackspec=FUSED
 	trackName,_ := f.PreferredTrack(trackspecs)
 
 	colorscheme := FormValueColorScheme(r)
@@ -76,17 +78,23 @@ func OutputFlightAsVectorJSON(db fgae.FlightDB, w http.ResponseWriter, r *http.R
 		}
 	}
 
-	// If we have CGI args for a report, process the flight, to get display hints.
+	// If we have CGI args for a report, process the flight, to get display hints; and hang on to
+	// where it crossed the report's restrictions, so simplifying doesn't lose them.
 	opt,_ := GetUIOptions(ctx)
+	tis := []fdb.TrackIntersection{}
 	if opt.Report != nil {
-		if _,err := opt.Report.Process(f); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		if ok,intersections := opt.Report.PreProcess(f); ok {
+			tis = intersections
+			if _,err := opt.Report.Func(opt.Report, f, tis); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 		}
 	}
 	
 	w.Header().Set("Content-Type", "application/json")
-	lines := FlightToMapLines(f, trackName, colorscheme, complaintTimes)
+	tol := fdb.SimplifyToleranceForLevel(int(widget.FormValueInt64(r, "simplify")))
+	lines := FlightToMapLines(f, trackName, colorscheme, complaintTimes, tol, tis...)
 	jsonBytes,err := json.Marshal(lines)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -144,7 +152,7 @@ func MapLineFormat(f *fdb.Flight, t fdb.Track, trackName string, l geo.LatlongLi
 // }}}
 // {{{ FlightToMapLines
 
-func FlightToMapLines(f *fdb.Flight, trackName string, colorscheme ColorScheme, times []time.Time) []MapLine{
+func FlightToMapLines(f *fdb.Flight, trackName string, colorscheme ColorScheme, times []time.Time, tol fdb.SimplifyTolerance, tis ...fdb.TrackIntersection) []MapLine{
 	lines   := []MapLine{}
 
 	if trackName == "" { trackName = "fr24"}
@@ -166,16 +174,21 @@ func FlightToMapLines(f *fdb.Flight, trackName string, colorscheme ColorScheme,
 	for _,index := range toRemove {
 		track = append(track[:index], track[index+1:]...)
 	}
-	
+
+	// A simplified track has only the points that matter, so draw a line between each of them
+	if !tol.IsZero() {
+		track = f.SimplifyTrack(track, tol, tis...)
+		sampleRate = 0
+	}
+
 	flightLines := track.AsLinesSampledEvery(sampleRate)
 
 	complaintCounts := make([]int, len(flightLines))
 	if colorscheme.Strategy == ByComplaints {
 		// Walk through lines; for each, bucket up the complaints that occur during it
 		j := 0
-		t := f.Tracks[trackName]
 		for i,l := range flightLines {
-			s, e := (*t)[l.I].TimestampUTC, (*t)[l.J].TimestampUTC
+			s, e := track[l.I].TimestampUTC, track[l.J].TimestampUTC
 			for j < len(times) {
 				if times[j].After(s) && !times[j].After(e) {
 					// This complaint timestamp hits this flightline
@@ -293,7 +306,7 @@ func ProcedureHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request)
 	db.Infof(fmt.Sprintf(" * tags=%v, s=%s, e=%s", tags, s, e))
 
 	tStart := time.Now()
-	cfs,err,str := db.FetchCondensedFlights(s,e,tags)
+	set,err,str := db.FetchCondensedFlightSet(s,e,tags)
 	if err != nil {
 		db.Infof(fmt.Sprintf(" * Err = %v", err.Error()))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -302,6 +315,18 @@ func ProcedureHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request)
 
 	db.Infof(fmt.Sprintf(" * elapsed = %s", time.Since(tStart).String()))
 
+	// Clients can tell if the data has changed since they last fetched it. Live data has no
+	// meaningful generation, so no etag.
+	w.Header().Set("X-Fdb-Generation", set.Generation)
+	if !set.Live {
+		etag := fmt.Sprintf(`"%s"`, set.Generation)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag && r.FormValue("text") == "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
 	if r.FormValue("text") != "" {
 		str += "(elapsed: "+time.Since(tStart).String()+")\n"	
 		w.Header().Set("Content-Type", "text/plain")
@@ -309,7 +334,7 @@ func ProcedureHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	WriteEncodedData(w,r,cfs)
+	WriteEncodedData(w,r,set.Flights)
 }
 
 // }}}
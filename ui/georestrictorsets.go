@@ -2,6 +2,7 @@ package ui
 
 import(
 	"fmt"
+	"io"
 	"net/http"
 	"sort"
 	"strings"
@@ -16,6 +17,8 @@ import(
 
 var uriStem = "/fdb/restrictors"
 
+const kMaxShapesUploadBytes = 4 * 1024 * 1024
+
 // {{{ RListHandler
 
 func RListHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
@@ -70,6 +73,7 @@ func RGrsEditHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 
 	grs := fdb.GeoRestrictorSet{User:opt.UserEmail}
 	maybeLoadGRSDSKey(db, r, &grs)	// If we have a key, load it up to populate the grs
+	if !checkGRSAccess(w, grs, opt.UserEmail, fdb.RoleViewer) { return }
 
 	// If no form data, display the grs in an edit form
 	if r.FormValue("name") == "" {
@@ -85,6 +89,8 @@ func RGrsEditHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !checkGRSAccess(w, grs, opt.UserEmail, fdb.RoleEditor) { return }
+
 	// Parse out the grs from the form
 	grs.Name = strings.ToLower(r.FormValue("name"))
 	switch r.FormValue("combinationlogic") {
@@ -94,7 +100,14 @@ func RGrsEditHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 	grs.Tags = widget.FormValueCommaSpaceSepStrings(r,"tags")
 	sort.Strings(grs.Tags)
 	for i,tag := range grs.Tags { grs.Tags[i] = strings.ToUpper(tag) }
-	
+
+	// Only the owner gets to change who else can see it
+	if grs.IsOwner(opt.UserEmail) {
+		grs.Editors = fdb.NormalizeUsers(widget.FormValueCommaSpaceSepStrings(r,"editors"))
+		grs.Viewers = fdb.NormalizeUsers(widget.FormValueCommaSpaceSepStrings(r,"viewers"))
+		grs.Public = (r.FormValue("public") != "")
+	}
+
 	if err := db.PersistRestrictorSet(grs); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -110,12 +123,20 @@ func RGrsEditHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 
 // RGrsDeleteHandler - (key) delete it, chain to ./list
 func RGrsDeleteHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
+	opt,_ := GetUIOptions(db.Ctx())
 	key := r.FormValue("grs_dskey")
 	if key == "" {
 		http.Error(w, "/grs/delete - no grs_dskey", http.StatusBadRequest)
 		return
 	}
 
+	if grs,err := db.LoadRestrictorSet(key); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !checkGRSAccess(w, grs, opt.UserEmail, fdb.RoleOwner) {
+		return
+	}
+
 	if err := db.DeleteRestrictorSet(key); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -137,6 +158,8 @@ func RGrsViewHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("RGrViewHandler, err: %v", err), http.StatusBadRequest)
 		return
 	}
+	opt,_ := GetUIOptions(ctx)
+	if !checkGRSAccess(w, grs, opt.UserEmail, fdb.RoleViewer) { return }
 	
 	editUrl := fmt.Sprintf("%s/grs/edit?grs_dskey=%s", uriStem, grs.DSKey)
 	legend := fmt.Sprintf("[<a target=\"_blank\" href=\"%s\">edit</a>]\n\n%s", editUrl, grs.String())
@@ -201,6 +224,86 @@ func RGrsViewHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 
 // }}}
 
+// {{{ RGrsCopyHandler
+
+// RGrsCopyHandler   - (key) copy into the user's own sets, chain to ./grs/edit of the copy
+func RGrsCopyHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
+	opt,_ := GetUIOptions(db.Ctx())
+
+	grs,err := db.CopyRestrictorSet(r.FormValue("grs_dskey"), opt.UserEmail)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("RGrsCopyHandler, err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w,r, uriStem+"/grs/edit?grs_dskey="+grs.DSKey, http.StatusFound)
+}
+
+// }}}
+
+// {{{ RGrsExportHandler
+
+// RGrsExportHandler - (key [,format=kml]) download the set as GeoJSON (or KML)
+func RGrsExportHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
+	opt,_ := GetUIOptions(db.Ctx())
+	grs,err := db.LoadRestrictorSet(r.FormValue("grs_dskey"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("RGrsExportHandler, err: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !checkGRSAccess(w, grs, opt.UserEmail, fdb.RoleViewer) { return }
+
+	var data []byte
+	contentType,ext := "application/geo+json", "geojson"
+	if r.FormValue("format") == "kml" {
+		contentType,ext = "application/vnd.google-earth.kml+xml", "kml"
+		data,err = grs.ToKML()
+	} else {
+		data,err = grs.ToGeoJSON()
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("RGrsExportHandler, err: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	filename := strings.Map(func(r rune) rune {
+		if r == '"' || r == '/' || r == '\\' || r < ' ' { return '_' }
+		return r
+	}, grs.Name)
+	if filename == "" { filename = "restrictors" }
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", filename, ext))
+	w.Write(data)
+}
+
+// }}}
+// {{{ RGrsImportHandler
+
+// RGrsImportHandler - (file [,key]) upload GeoJSON or KML; append to the set, or make a new one,
+// and chain to ./grs/edit
+func RGrsImportHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
+	opt,_ := GetUIOptions(db.Ctx())
+
+	file,_,err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("RGrsImportHandler, no file: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	grs,err := db.ImportRestrictorSet(io.LimitReader(file, kMaxShapesUploadBytes),
+		r.FormValue("grs_dskey"), opt.UserEmail)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("RGrsImportHandler, err: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w,r, uriStem+"/grs/edit?grs_dskey="+grs.DSKey, http.StatusFound)
+}
+
+// }}}
+
 // {{{ RGrNewHandler
 
 func RGrNewHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
@@ -213,6 +316,7 @@ func RGrNewHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("RGrNewHandler, err: %v", err), http.StatusBadRequest)
 		return
 	}
+	if !checkGRSAccess(w, grs, opt.UserEmail, fdb.RoleEditor) { return }
 	
 	params := map[string]interface{}{
 		"URIStem": uriStem,
@@ -243,6 +347,7 @@ func RGrEditHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("RGrNewHandler, err: %v", err), http.StatusBadRequest)
 		return
 	}
+	if !checkGRSAccess(w, grs, opt.UserEmail, fdb.RoleEditor) { return }
 
 	grIndex := int(widget.FormValueInt64(r, "gr_index"))
 	if grIndex > len(grs.R) {
@@ -300,11 +405,13 @@ func RGrEditHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 
 // RGrDeleteHandler  - (key,index)
 func RGrDeleteHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
+	opt,_ := GetUIOptions(db.Ctx())
 	grs,err := formValueDSKey(db, r)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("RGrNewHandler, err: %v", err), http.StatusBadRequest)
 		return
 	}
+	if !checkGRSAccess(w, grs, opt.UserEmail, fdb.RoleEditor) { return }
 
 	grIndex := int(widget.FormValueInt64(r, "gr_index"))
 	if grIndex >= len(grs.R) {
@@ -355,6 +462,24 @@ func maybeLoadGRSDSKey(db fgae.FlightDB, r *http.Request, grs *fdb.GeoRestrictor
 	}
 }
 
+// }}}
+// {{{ checkGRSAccess
+
+// Writes out an error, and returns false, if the user doesn't have at least the role.
+func checkGRSAccess(w http.ResponseWriter, grs fdb.GeoRestrictorSet, user string, role string) bool {
+	ok := false
+	switch role {
+	case fdb.RoleViewer: ok = grs.CanView(user)
+	case fdb.RoleEditor: ok = grs.CanEdit(user)
+	case fdb.RoleOwner:  ok = grs.IsOwner(user)
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("restrictor set '%s' needs %s access; %s has '%s'", grs.Name, role,
+			user, grs.RoleFor(user)), http.StatusForbidden)
+	}
+	return ok
+}
+
 // }}}
 // {{{ formValueDSKey
 
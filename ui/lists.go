@@ -2,46 +2,51 @@ package ui
 
 import(
 	"net/http"
+	"net/url"
 
 	hw "github.com/skypies/util/handlerware"
 	"github.com/skypies/util/widget"
 
-	fdb "github.com/skypies/flightdb"
 	"github.com/skypies/flightdb/fgae"
 )
 
+// How many flights go on a page of the list
+const kListPageSize = 200
+
 // icaoid=A12345 - lookup recent flights on that airframe
+// cursor=...    - the next page, as linked from the previous one
 func ListHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 	ctx := db.Ctx()
 	templates := hw.GetTemplates(ctx)
 
 	tags := widget.FormValueCommaSepStrings(r, "tags")
-	flights := []*fdb.Flight{}
 
-	query := fgae.QueryForRecent(tags, 200)
+	// No limit on the query, so that the pages can use the datastore's own cursors
+	query := fgae.QueryForRecent(tags, 0)
 	if r.FormValue("icaoid") != "" {
-		query = fgae.QueryForRecentIcaoId(r.FormValue("icaoid"), 200)
+		query = fgae.QueryForRecentIcaoId(r.FormValue("icaoid"), 0)
 	}
-	
-	it := db.NewIterator(query)
-	for it.Iterate(ctx) {
-		f := it.Flight()
-		if it.Err() != nil {
-			http.Error(w, it.Err().Error(), http.StatusInternalServerError)
-			return
-		}
-		f.PruneTrackContents() // Save on RAM
-		flights = append(flights, f)
-	}
-	if it.Err() != nil {
-		http.Error(w, it.Err().Error(), http.StatusInternalServerError)
+	query.StartAt(r.FormValue("cursor"))
+
+	flights,cursor,err := db.LookupPage(query, kListPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	for _,f := range flights {
+		f.PruneTrackContents() // Save on RAM
+	}
 	
 	var params = map[string]interface{}{
 		"Tags": tags,
 		"Flights": flights,
 	}
+	if cursor != "" {
+		v := url.Values{}
+		for k,vals := range r.Form { v[k] = vals }
+		v.Set("cursor", cursor)
+		params["NextPageUrl"] = r.URL.Path + "?" + v.Encode()
+	}
 	if err := templates.ExecuteTemplate(w, "fdb-recentlist", params); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
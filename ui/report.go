@@ -5,6 +5,8 @@ import(
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 	
@@ -34,6 +36,10 @@ func maybeButtonPOST(idspecs []string, title string, url string) string {
 		idspecs)
 }
 
+// By default, a report stops after this many flights (and offers a link to carry on from
+// there), so that long date ranges don't run into the request deadline. pagesize=N overrides.
+const kReportPageSize = 5000
+
 func ReportHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 	ctx := db.Ctx()
 	opt,_ := GetUIOptions(ctx)
@@ -87,12 +93,20 @@ func ReportHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 	idspecsRejectByRestrict := []string{}
 	idspecsRejectByReport := []string{}
 
+	pageSize := kReportPageSize
+	if n,err := strconv.Atoi(r.FormValue("pagesize")); err == nil && n > 0 {
+		pageSize = n
+	}
+
 	query := fgae.QueryForTimeRangeWaypoint(rep.Tags, rep.Options.Waypoints, rep.Start,rep.End)
-	it := db.NewIterator(query)
+	rep.Options.RestrictQuery(query)
+	query.StartAt(r.FormValue("cursor"))
+	it := db.NewIterator(query).Prefetch(fgae.DefaultPrefetchWorkers)
+	defer it.Close()
 	n := 0
 	tStart := time.Now()
 	tBottomOfLoop := tStart
-	for it.Iterate(ctx) {
+	for n < pageSize && it.Iterate(ctx) {
 		rep.Stats.RecordValue("flightfetch", (time.Since(tBottomOfLoop).Nanoseconds()/1000))
 
 		f := it.Flight()
@@ -123,6 +137,15 @@ func ReportHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 	}
 
 	rep.FinishSummary()
+
+	// If we stopped short, the results only cover part of the time range; link to the rest
+	nextPageUrl := ""
+	if cursor := it.Cursor(); cursor != "" {
+		v := url.Values{}
+		for k,vals := range r.Form { v[k] = vals }
+		v.Set("cursor", cursor)
+		nextPageUrl = "/report?" + v.Encode()
+	}
 	
 	if r.FormValue("debug") != "" {
 		str := ""
@@ -176,6 +199,7 @@ func ReportHandler(db fgae.FlightDB, w http.ResponseWriter, r *http.Request) {
 		"Title": "Reports (DB v2)",
 		"UIOptions": opt,
 		"VisualizationFormTag": template.HTML(vizFormTag),
+		"NextPageUrl": nextPageUrl,
 	}
 	if err := templates.ExecuteTemplate(w, "report-results", params); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -32,6 +32,7 @@ import(
 //  &anchor_within_dist=8  (how close, in KM, a flight must be to the anchor to be included)
 //  &showaccelerations=1
 //  &showangleofinclination=1
+//  &smooth=1           (use a smoothed track, rather than differencing the sampled points)
 
 //  &arriving=KSJC
 //  &departing=KSFO
@@ -210,8 +211,13 @@ func flightToAltitudeTrack(opt UIOptions, r *http.Request, metars *metar.Archive
 
 	sampleRate := widget.FormValueDuration(r, "sample")
 	if sampleRate == 0 { sampleRate = 15 * time.Second }
-	track = track.SampleEvery(sampleRate, false)
-	track.PostProcess()
+	if widget.FormValueCheckbox(r, "smooth") {
+		// Smooth at full resolution; the sampled points keep their derived fields
+		track = track.Smoothed().AsTrack().SampleEvery(sampleRate, false)
+	} else {
+		track = track.SampleEvery(sampleRate, false)
+		track.PostProcess()
+	}
 	
 	if trackKeyName == "FOIA" {
 		track.AdjustAltitudes(nil) // FOIA track altitudes are already pressure-corrected
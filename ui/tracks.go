@@ -236,7 +236,10 @@ func OutputTrackpointsOnAMap(db fgae.FlightDB, w http.ResponseWriter, r *http.Re
 	} else if len(flights) == 1 {
 		f := flights[0]
 		// Pick most recent instance, and colorize all visible tracks.
-		for _,trackType := range []string{"ADSB", "MLAT", "fr24", "FA:TA", "FA:TZ", "FOIA"} {
+		if r.FormValue("track") == fdb.FusedTrackName {
+			f.AddFusedTrack()
+		}
+		for _,trackType := range []string{"ADSB", "MLAT", "fr24", "FA:TA", "FA:TZ", "FOIA", fdb.FusedTrackName} {
 			if len(r.FormValue("track")) > 1 && r.FormValue("track") != trackType { continue }
 			if _,exists := f.Tracks[trackType]; !exists { continue }
 
@@ -271,6 +274,7 @@ func OutputTrackpointsOnAMap(db fgae.FlightDB, w http.ResponseWriter, r *http.Re
 			for name,color := range map[string]string{
 				"ADSB":"#888811","MLAT":"#8888ff",
 				"fr24":"#11aa11","FA:TA":"#1111aa","FA:TZ":"#1111aa","FOIA":"#664433",
+				fdb.FusedTrackName:"#aa1111",
 			} {
 				if len(r.FormValue("boxes")) > 1 && r.FormValue("boxes") != name { continue }
 				if t,exists := f.Tracks[name]; exists==true {
@@ -305,6 +309,7 @@ func OutputTrackpointsOnAMap(db fgae.FlightDB, w http.ResponseWriter, r *http.Re
 // ?idspec==XX,YY,...
 //  &colorby=procedure   (what we tagged them as - not implemented ?)
 //  &nofurniture=1       (to suppress furniture)
+//  &simplify=2          (simplify the tracks; see fdb.SimplifyToleranceForLevel)
 
 func OutputMapLinesOnAStreamingMap(ctx context.Context, w http.ResponseWriter, r *http.Request, vectorURLPath string) {
 	opt,_ := GetUIOptions(ctx)
@@ -332,6 +337,7 @@ func OutputMapLinesOnAStreamingMap(ctx context.Context, w http.ResponseWriter, r
 		"IdSpecs": IdSpecsToJSVar(opt.IdSpecStrings),
 		"VectorURLPath": vectorURLPath,  // retire this when DBv1/v2ui.go and friends are gone
 		"TrackSpec": trackspec,
+		"Simplify": widget.FormValueInt64(r, "simplify"),
 		"ColorScheme": opt.ColorScheme,
 		"Report": opt.Report,  // So that any rendering hints can be determined
 		